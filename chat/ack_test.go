@@ -0,0 +1,65 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAcks(t *testing.T) {
+	tests := []struct {
+		name     string
+		down     bool
+		wantType string
+	}{
+		{"stored", false, messageTypeAck},
+		{"store failing", true, messageTypeNack},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &flakyStore{MemoryStore: NewMemoryStore()}
+			s, _ := newTestServer(t, WithStore(store))
+			ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+			bob := dialTestServer(t, s, "room=general&username=bob", "chat.v2")
+			waitClients(t, s, 2)
+			waitReplayed(t, s)
+
+			store.setDown(tt.down)
+			before := time.Now().UnixMilli()
+			if err := ann.WriteJSON(ChatMessage{Text: "hi", ClientID: "c1"}); err != nil {
+				t.Fatal(err)
+			}
+
+			var raw json.RawMessage
+			readFrameInto(t, ann, tt.wantType, &raw)
+			if tt.down {
+				var f nackFrame
+				if err := json.Unmarshal(raw, &f); err != nil {
+					t.Fatal(err)
+				}
+				if f.ClientID != "c1" || f.Code != "not_stored" {
+					t.Errorf("nack %+v, want not_stored for c1", f)
+				}
+			} else {
+				var f ackFrame
+				if err := json.Unmarshal(raw, &f); err != nil {
+					t.Fatal(err)
+				}
+				if f.ClientID != "c1" || f.ID == "" || f.Timestamp < before {
+					t.Errorf("ack %+v, want the ID and time assigned to c1", f)
+				}
+				stored, err := store.MemoryStore.Get(context.Background(), f.ID)
+				if err != nil || stored.Text != "hi" {
+					t.Errorf("acked message %q stored as %+v, %v", f.ID, stored, err)
+				}
+			}
+
+			// the room gets the message either way; only its sender is
+			// told whether it was stored
+			if msg := readFrameOf(t, bob, messageTypeChat, nil); msg.Text != "hi" {
+				t.Errorf("room got %q, want the message", msg.Text)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// bearerToken extracts the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token
+}
+
+// isAdmin reports whether r carries the admin token. It is always false when
+// no admin token is configured.
+func (s *Server) isAdmin(r *http.Request) bool {
+	token := s.settings().adminToken
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(token)) == 1
+}
+
+// adminOnly rejects requests that don't carry the admin token.
+func (s *Server) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminIfConfigured protects next with the admin token only when one is set,
+// for endpoints that are public on unconfigured servers.
+func (s *Server) adminIfConfigured(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.settings().adminToken != "" {
+			s.adminOnly(next)(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
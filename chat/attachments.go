@@ -0,0 +1,131 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// Attachment describes a file shared in a message. The file itself is
+// uploaded elsewhere, the message only refers to it.
+type Attachment struct {
+	URL      string `json:"url"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+	Filename string `json:"filename,omitempty"`
+}
+
+const (
+	// defaultAttachmentTypes are the media types attachments may have,
+	// unless ATTACHMENT_TYPES says otherwise.
+	defaultAttachmentTypes = "image/png,image/jpeg,image/gif,image/webp,application/pdf"
+
+	// defaultAttachmentMaxSize is the largest attachment, in bytes, unless
+	// ATTACHMENT_MAX_SIZE says otherwise.
+	defaultAttachmentMaxSize = 10 << 20
+
+	maxAttachmentURLLen  = 2048
+	maxAttachmentNameLen = 255
+)
+
+var errInvalidAttachment = errors.New("invalid attachment")
+
+// parseAttachmentTypes parses the comma-separated media types of
+// ATTACHMENT_TYPES. A type may end in /* to allow all of its subtypes.
+func parseAttachmentTypes(v string) ([]string, error) {
+	if v == "" {
+		v = defaultAttachmentTypes
+	}
+
+	var types []string
+	for _, t := range splitList(v) {
+		t = strings.ToLower(t)
+		major, minor, ok := strings.Cut(t, "/")
+		if !ok || major == "" || major == "*" || minor == "" {
+			return nil, fmt.Errorf("ATTACHMENT_TYPES: %q is not a media type", t)
+		}
+		if minor != "*" {
+			if _, _, err := mime.ParseMediaType(t); err != nil {
+				return nil, fmt.Errorf("ATTACHMENT_TYPES: %q is not a media type", t)
+			}
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// attachmentTypeAllowed reports whether types allow the media type t,
+// parameters left out.
+func attachmentTypeAllowed(types []string, t string) bool {
+	major, _, _ := strings.Cut(t, "/")
+	for _, allowed := range types {
+		if allowed == t || allowed == major+"/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAttachment validates a, normalizing its media type and filename. The
+// URL must be https, the type one of ATTACHMENT_TYPES, and the size at most
+// ATTACHMENT_MAX_SIZE. The errors wrap errInvalidAttachment and say what is
+// wrong, for the sender.
+func (s *Server) checkAttachment(a *Attachment) error {
+	if len(a.URL) > maxAttachmentURLLen {
+		return fmt.Errorf("%w: the URL is longer than %d bytes", errInvalidAttachment, maxAttachmentURLLen)
+	}
+	u, err := url.Parse(a.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil {
+		return fmt.Errorf("%w: the URL must be an https URL", errInvalidAttachment)
+	}
+	a.URL = u.String()
+
+	mediaType, _, err := mime.ParseMediaType(a.MimeType)
+	if err != nil {
+		return fmt.Errorf("%w: %q is not a media type", errInvalidAttachment, a.MimeType)
+	}
+	if !attachmentTypeAllowed(s.attachmentTypes, mediaType) {
+		return fmt.Errorf("%w: files of type %s are not allowed", errInvalidAttachment, mediaType)
+	}
+	a.MimeType = mediaType
+
+	if a.Size <= 0 {
+		return fmt.Errorf("%w: the size must be positive", errInvalidAttachment)
+	}
+	if a.Size > s.attachmentMaxSize {
+		return fmt.Errorf("%w: files may be at most %d bytes", errInvalidAttachment, s.attachmentMaxSize)
+	}
+
+	// only the name is kept, the path of the sender's machine isn't shared
+	name := path.Base(strings.ReplaceAll(a.Filename, `\`, "/"))
+	if name == "." || name == "/" {
+		name = ""
+	}
+	if len(name) > maxAttachmentNameLen || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%w: invalid filename", errInvalidAttachment)
+	}
+	a.Filename = name
+	return nil
+}
+
+// plainText is the text of msg for the transports that only carry text,
+// with the link to its attachment if any.
+func (msg ChatMessage) plainText() string {
+	a := msg.Attachment
+	if a == nil {
+		return msg.Text
+	}
+
+	link := a.URL
+	if a.Filename != "" {
+		link = a.Filename + " " + a.URL
+	}
+	if msg.Text == "" {
+		return "[" + link + "]"
+	}
+	return msg.Text + " [" + link + "]"
+}
@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseAttachmentTypes(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    []string
+		wantErr bool
+	}{
+		{"", strings.Split(defaultAttachmentTypes, ","), false},
+		{"image/*, Application/PDF", []string{"image/*", "application/pdf"}, false},
+		{"image", nil, true},
+		{"*/*", nil, true},
+		{"image/", nil, true},
+		{"image/png;;", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAttachmentTypes(tt.v)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("parseAttachmentTypes(%q) = %q, %v, want %q, an error %v", tt.v, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckAttachment(t *testing.T) {
+	t.Setenv("ATTACHMENT_TYPES", "image/*,application/pdf")
+	t.Setenv("ATTACHMENT_MAX_SIZE", "1000")
+	s, _ := newTestServer(t)
+
+	valid := Attachment{URL: "https://files.example.com/cat.png", MimeType: "image/png", Size: 1000, Filename: "cat.png"}
+	tests := []struct {
+		name    string
+		edit    func(*Attachment)
+		want    Attachment // after normalization, when valid
+		wantErr bool
+	}{
+		{"valid", func(*Attachment) {}, valid, false},
+		{"any image", func(a *Attachment) { a.MimeType = "image/avif" }, Attachment{URL: valid.URL, MimeType: "image/avif", Size: 1000, Filename: "cat.png"}, false},
+		{"pdf", func(a *Attachment) { a.MimeType = "application/pdf" }, Attachment{URL: valid.URL, MimeType: "application/pdf", Size: 1000, Filename: "cat.png"}, false},
+		{"type normalized", func(a *Attachment) { a.MimeType = "Image/PNG; q=1" }, valid, false},
+		{"path left out", func(a *Attachment) { a.Filename = `C:\Users\ann\cat.png` }, valid, false},
+		{"no filename", func(a *Attachment) { a.Filename = "" }, Attachment{URL: valid.URL, MimeType: "image/png", Size: 1000}, false},
+		{"disallowed type", func(a *Attachment) { a.MimeType = "application/zip" }, Attachment{}, true},
+		{"html", func(a *Attachment) { a.MimeType = "text/html" }, Attachment{}, true},
+		{"not a type", func(a *Attachment) { a.MimeType = "png" }, Attachment{}, true},
+		{"oversized", func(a *Attachment) { a.Size = 1001 }, Attachment{}, true},
+		{"no size", func(a *Attachment) { a.Size = 0 }, Attachment{}, true},
+		{"http", func(a *Attachment) { a.URL = "http://files.example.com/cat.png" }, Attachment{}, true},
+		{"credentials", func(a *Attachment) { a.URL = "https://ann:pw@files.example.com/cat.png" }, Attachment{}, true},
+		{"long URL", func(a *Attachment) { a.URL = "https://files.example.com/" + strings.Repeat("a", maxAttachmentURLLen) }, Attachment{}, true},
+		{"control in filename", func(a *Attachment) { a.Filename = "cat\n.png" }, Attachment{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := valid
+			tt.edit(&a)
+			err := s.checkAttachment(&a)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkAttachment error = %v, want an error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, errInvalidAttachment) {
+					t.Errorf("error %v doesn't wrap errInvalidAttachment", err)
+				}
+				return
+			}
+			if a != tt.want {
+				t.Errorf("checkAttachment left %+v, want %+v", a, tt.want)
+			}
+		})
+	}
+}
+
+// TestAttachmentMessages checks that a valid attachment is broadcast and
+// stored with its message, and an invalid one refused.
+func TestAttachmentMessages(t *testing.T) {
+	t.Setenv("ATTACHMENT_MAX_SIZE", "1000")
+	s, _ := newTestServer(t)
+	ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	waitClients(t, s, 1)
+
+	big := &Attachment{URL: "https://files.example.com/big.png", MimeType: "image/png", Size: 1001}
+	if err := ann.WriteJSON(ChatMessage{Text: "too big", Attachment: big}); err != nil {
+		t.Fatal(err)
+	}
+	var f errorFrame
+	readFrameInto(t, ann, messageTypeError, &f)
+	if f.Code != "invalid_attachment" {
+		t.Errorf("error %q, want invalid_attachment", f.Code)
+	}
+
+	cat := &Attachment{URL: "https://files.example.com/cat.png", MimeType: "image/png", Size: 1000, Filename: "cat.png"}
+	if err := ann.WriteJSON(ChatMessage{Text: "look", Attachment: cat}); err != nil {
+		t.Fatal(err)
+	}
+	msg := readFrameOf(t, ann, messageTypeChat, nil)
+	if msg.Text != "look" || msg.Attachment == nil || *msg.Attachment != *cat {
+		t.Errorf("broadcast %q with %+v, want the attachment", msg.Text, msg.Attachment)
+	}
+
+	stored, err := s.store.Get(context.Background(), msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Attachment == nil || *stored.Attachment != *cat {
+		t.Errorf("stored %+v, want the attachment", stored.Attachment)
+	}
+}
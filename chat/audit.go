@@ -0,0 +1,172 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Actions recorded in the audit log, besides the sanctions being applied
+// ("mute", "ban") and lifted ("unmute", "unban").
+const (
+	auditJoin   = "join"
+	auditLeave  = "leave"
+	auditKick   = "kick"
+	auditDelete = "delete"
+	auditMOTD   = "motd"
+
+	// auditMonitor records an admin watching the monitor feed.
+	auditMonitor = "monitor"
+)
+
+// Actors of the audit entries not made by a user.
+const (
+	auditActorAdmin  = "admin"
+	auditActorServer = "server"
+)
+
+const (
+	// auditQueue is how many entries wait to be written before new ones are
+	// dropped.
+	auditQueue = 1024
+
+	// defaultAuditMaxLen approximately caps the audit stream unless
+	// AUDIT_MAXLEN says otherwise.
+	defaultAuditMaxLen = 100000
+
+	defaultAuditLimit = 50
+	maxAuditLimit     = 500
+)
+
+// audit is the Redis stream moderation and connection events are kept in.
+func (ks keyspace) audit() string {
+	return ks.key("audit_log")
+}
+
+// AuditEntry is a moderation or connection event.
+type AuditEntry struct {
+	ID     string    `json:"id"`
+	Action string    `json:"action"`
+	Actor  string    `json:"actor,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Room   string    `json:"room,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// audit queues e for the audit log. The write happens in the background and
+// the entry is dropped when the queue is full, so that auditing never holds
+// up what it records; it is safe to call from the hub.
+func (s *Server) audit(e AuditEntry) {
+	e.Time = time.Now().UTC()
+
+	select {
+	case s.auditLog <- e:
+	default:
+		s.logger.Warn("audit queue full, dropping entry", "action", e.Action, "target", e.Target)
+	}
+}
+
+// runAudit writes the queued audit entries to the stream.
+func (s *Server) runAudit() {
+	for e := range s.auditLog {
+		values := map[string]interface{}{
+			"action": e.Action,
+			"actor":  e.Actor,
+			"target": e.Target,
+			"room":   e.Room,
+			"ip":     e.IP,
+			"reason": e.Reason,
+			"ts":     e.Time.Format(time.RFC3339Nano),
+		}
+		args := &redis.XAddArgs{
+			Stream: s.keys.audit(),
+			MaxLen: s.auditMaxLen,
+			Approx: true,
+			Values: values,
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := s.rdb.XAdd(ctx, args).Err(); err != nil {
+			s.logger.Warn("writing audit entry", "action", e.Action, "err", err)
+		}
+		cancel()
+	}
+}
+
+// parseAuditEntry turns a stream message back into an entry.
+func parseAuditEntry(m redis.XMessage) AuditEntry {
+	field := func(k string) string {
+		v, _ := m.Values[k].(string)
+		return v
+	}
+
+	e := AuditEntry{
+		ID:     m.ID,
+		Action: field("action"),
+		Actor:  field("actor"),
+		Target: field("target"),
+		Room:   field("room"),
+		IP:     field("ip"),
+		Reason: field("reason"),
+	}
+	e.Time, _ = time.Parse(time.RFC3339Nano, field("ts"))
+	return e
+}
+
+type auditResponse struct {
+	Entries []AuditEntry `json:"entries"`
+
+	// NextBefore is the before parameter fetching the older entries, empty
+	// when there are none.
+	NextBefore string `json:"next_before,omitempty"`
+}
+
+// streamID matches the IDs of Redis stream entries.
+var streamID = regexp.MustCompile(`^[0-9]+(-[0-9]+)?$`)
+
+// handleAudit returns the audit log newest first, limit entries at a time,
+// starting below the entry ID given as before.
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	limit := defaultAuditLimit
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxAuditLimit)
+	}
+
+	end := "+"
+	if v := params.Get("before"); v != "" {
+		if !streamID.MatchString(v) {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return
+		}
+		end = "(" + v
+	}
+
+	msgs, err := s.rdb.XRevRangeN(r.Context(), s.keys.audit(), end, "-", int64(limit)).Result()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	resp := auditResponse{Entries: make([]AuditEntry, len(msgs))}
+	for i, m := range msgs {
+		resp.Entries[i] = parseAuditEntry(m)
+	}
+	if len(msgs) == limit {
+		resp.NextBefore = msgs[len(msgs)-1].ID
+	}
+
+	writeJSONResponse(w, http.StatusOK, resp)
+}
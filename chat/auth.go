@@ -0,0 +1,131 @@
+package chat
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// roleAdmin is the role exempting a connection from slow mode and read-only
+// rooms, like the admin token does.
+const roleAdmin = "admin"
+
+// Authenticator identifies the user behind a WebSocket request before it is
+// upgraded. An error turns the request away; an empty username connects
+// anonymously.
+type Authenticator interface {
+	Authenticate(r *http.Request) (username string, roles []string, err error)
+}
+
+// NoAuth takes the username the client asks for, unverified.
+type NoAuth struct{}
+
+func (NoAuth) Authenticate(r *http.Request) (string, []string, error) {
+	return r.URL.Query().Get("username"), nil, nil
+}
+
+// verifiesUsers reports whether the Authenticator checks who connects,
+// rather than taking the username asked for. Direct messages are only
+// private to their sender and recipient when it does.
+func (s *Server) verifiesUsers() bool {
+	_, open := s.auth.(NoAuth)
+	return !open
+}
+
+var errInvalidJWT = errors.New("invalid token")
+
+// JWTAuth accepts HS256 JSON Web Tokens signed with its secret, given as a
+// bearer token or, since browsers can't set headers on WebSockets, as the
+// access_token parameter. The subject is the username, and a roles claim
+// lists the roles.
+type JWTAuth struct {
+	secret []byte
+}
+
+func NewJWTAuth(secret string) *JWTAuth {
+	return &JWTAuth{secret: []byte(secret)}
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Roles     []string `json:"roles"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+}
+
+func (ja *JWTAuth) Authenticate(r *http.Request) (string, []string, error) {
+	token := bearerToken(r)
+	if token == "" {
+		token = r.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		return "", nil, errors.New("missing token")
+	}
+
+	claims, err := ja.verify(token)
+	if err != nil {
+		return "", nil, err
+	}
+	return claims.Subject, claims.Roles, nil
+}
+
+// verify checks the signature and validity period of token and returns its
+// claims.
+func (ja *JWTAuth) verify(token string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, errInvalidJWT
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return jwtClaims{}, errInvalidJWT
+	}
+
+	mac := hmac.New(sha256.New, ja.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return jwtClaims{}, errInvalidJWT
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return jwtClaims{}, errInvalidJWT
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return jwtClaims{}, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return jwtClaims{}, errors.New("token not valid yet")
+	}
+	if claims.Subject == "" {
+		return jwtClaims{}, errors.New("token has no subject")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package chat
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// signJWT makes a token for claims, signed with secret using alg.
+func signJWT(t *testing.T, secret, alg string, claims interface{}) string {
+	t.Helper()
+
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	unsigned := encode(map[string]string{"alg": alg, "typ": "JWT"}) + "." + encode(claims)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuth(t *testing.T) {
+	now := time.Now().Unix()
+	valid := signJWT(t, "secret", "HS256", jwtClaims{Subject: "ann", Roles: []string{roleAdmin}, ExpiresAt: now + 60})
+
+	tests := []struct {
+		name      string
+		bearer    string
+		param     string
+		wantUser  string
+		wantAdmin bool
+	}{
+		{"bearer", valid, "", "ann", true},
+		{"parameter", "", valid, "ann", true},
+		{"no roles", signJWT(t, "secret", "HS256", jwtClaims{Subject: "bob"}), "", "bob", false},
+		{"missing", "", "", "", false},
+		{"malformed", "not.a-token", "", "", false},
+		{"wrong secret", signJWT(t, "other", "HS256", jwtClaims{Subject: "ann"}), "", "", false},
+		{"unsigned", signJWT(t, "secret", "none", jwtClaims{Subject: "ann"}), "", "", false},
+		{"expired", signJWT(t, "secret", "HS256", jwtClaims{Subject: "ann", ExpiresAt: now - 1}), "", "", false},
+		{"not valid yet", signJWT(t, "secret", "HS256", jwtClaims{Subject: "ann", NotBefore: now + 60}), "", "", false},
+		{"no subject", signJWT(t, "secret", "HS256", jwtClaims{ExpiresAt: now + 60}), "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/websocket?access_token="+tt.param, nil)
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+
+			user, roles, err := NewJWTAuth("secret").Authenticate(r)
+			if (err == nil) != (tt.wantUser != "") {
+				t.Fatalf("Authenticate error %v, want a user %v", err, tt.wantUser != "")
+			}
+			if user != tt.wantUser || hasRole(roles, roleAdmin) != tt.wantAdmin {
+				t.Errorf("Authenticate = %q %v, want %q, admin %v", user, roles, tt.wantUser, tt.wantAdmin)
+			}
+		})
+	}
+}
+
+// keyAuth is an Authenticator taking API keys in the key parameter.
+type keyAuth map[string]struct {
+	user  string
+	roles []string
+}
+
+func (ka keyAuth) Authenticate(r *http.Request) (string, []string, error) {
+	id, ok := ka[r.URL.Query().Get("key")]
+	if !ok {
+		return "", nil, errors.New("unknown key")
+	}
+	return id.user, id.roles, nil
+}
+
+// TestAuthenticator checks that the server connects the user an
+// Authenticator names, with its roles, and turns away the requests it
+// rejects.
+func TestAuthenticator(t *testing.T) {
+	auth := keyAuth{
+		"k1":    {"ann", nil},
+		"k2":    {"", nil},
+		"admin": {"root", []string{roleAdmin}},
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		wantUser string
+		wantPost bool // whether it may post in a read-only room
+	}{
+		{"accepted", "key=k1&username=mallory", http.StatusSwitchingProtocols, "ann", false},
+		{"anonymous", "key=k2", http.StatusSwitchingProtocols, "", false},
+		{"admin role", "key=admin", http.StatusSwitchingProtocols, "root", true},
+		{"unknown key", "key=k3&username=ann", http.StatusUnauthorized, "", false},
+		{"no key", "username=ann", http.StatusUnauthorized, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			t.Setenv("REDIS_URL", "redis://"+mr.Addr())
+			cfg := loadTestConfig(t)
+			cfg.Authenticator = auth
+			s := startTestServer(t, cfg)
+			opts := defaultRoomOptions()
+			opts.ReadOnly = true
+			if _, err := s.createRoom(context.Background(), "general", opts, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantCode != http.StatusSwitchingProtocols {
+				if _, code := tryDial(t, s, "room=general&"+tt.query); code != tt.wantCode {
+					t.Errorf("status %d, want %d", code, tt.wantCode)
+				}
+				return
+			}
+			ws := dialTestServer(t, s, "room=general&"+tt.query, "chat.v2")
+			waitClients(t, s, 1)
+
+			username := make(chan string, 1)
+			s.ops <- func(h *hub) {
+				for c := range h.clients {
+					username <- c.username
+				}
+			}
+			if user := <-username; user != tt.wantUser {
+				t.Errorf("connected as %q, want %q", user, tt.wantUser)
+			}
+
+			if err := ws.WriteJSON(ChatMessage{Text: "hi"}); err != nil {
+				t.Fatal(err)
+			}
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				var msg ChatMessage
+				if err := ws.ReadJSON(&msg); err != nil {
+					t.Fatal(err)
+				}
+				if msg.Type == messageTypeError || msg.Text == "hi" {
+					if posted := msg.Type != messageTypeError; posted != tt.wantPost {
+						t.Errorf("posted in a read-only room %v, want %v", posted, tt.wantPost)
+					}
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+//go:build autocert
+
+package chat
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serveAutocert runs srv on ln over TLS with certificates obtained from Let's
+// Encrypt, answering the HTTP-01 challenge on :80 and redirecting everything
+// else there to HTTPS.
+func serveAutocert(srv *http.Server, ln net.Listener, domains []string, cacheDir string) error {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+	}
+
+	go func() {
+		err := http.ListenAndServe(":80", m.HTTPHandler(http.HandlerFunc(redirectHTTPS)))
+		log.Fatal(err)
+	}()
+
+	srv.TLSConfig = &tls.Config{GetCertificate: m.GetCertificate}
+	return srv.ServeTLS(ln, "", "")
+}
@@ -0,0 +1,15 @@
+//go:build !autocert
+
+package chat
+
+import (
+	"errors"
+	"net"
+	"net/http"
+)
+
+// serveAutocert is only available in binaries built with the autocert tag,
+// which pulls in golang.org/x/crypto.
+func serveAutocert(srv *http.Server, ln net.Listener, domains []string, cacheDir string) error {
+	return errors.New("AUTOCERT_DOMAINS requires a binary built with -tags autocert")
+}
@@ -0,0 +1,200 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the slow consumer thresholds.
+const (
+	defaultSlowQueue = 100
+	defaultSlowWrite = 500 * time.Millisecond
+
+	// slowestClients is how many clients the stats list as slowest.
+	slowestClients = 5
+)
+
+// backpressure holds the thresholds past which a client is told it is a
+// slow consumer, and the counters shared by every client.
+type backpressure struct {
+	// warnQueue is a number of frames queued for a client, warnWrite a
+	// smoothed write duration; 0 disables either check.
+	warnQueue int
+	warnWrite time.Duration
+
+	deadlineMisses atomic.Int64
+}
+
+// write sends v to c, recording how long that took. It runs on the writer
+// goroutine; the history replay writes directly and isn't counted.
+func (c *Client) write(v interface{}) error {
+	start := time.Now()
+	err := c.writeFrame(v)
+	d := time.Since(start)
+
+	// a moving average, so that a single slow write doesn't count
+	if avg := time.Duration(c.writeLatency.Load()); avg == 0 {
+		c.writeLatency.Store(int64(d))
+	} else {
+		c.writeLatency.Store(int64(avg + (d-avg)/5))
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		c.deadlineMisses.Add(1)
+		if c.bp != nil {
+			c.bp.deadlineMisses.Add(1)
+		}
+	}
+	return err
+}
+
+// slow reports whether c is past either warn threshold, or, with half set,
+// past half of them.
+func (c *Client) slow(half bool) bool {
+	if c.bp == nil {
+		return false
+	}
+
+	queue, write := c.bp.warnQueue, c.bp.warnWrite
+	if half {
+		queue, write = queue/2, write/2
+	}
+	return (queue > 0 && c.queueDepth() >= queue) ||
+		(write > 0 && time.Duration(c.writeLatency.Load()) >= write)
+}
+
+// checkBackpressure warns c once it becomes a slow consumer, so that it can
+// shed load, and rearms the warning once it has caught up. It runs on the
+// hub.
+func (c *Client) checkBackpressure() {
+	switch {
+	case !c.slowWarned && c.slow(false):
+		c.slowWarned = true
+		c.logger.Warn("slow consumer", "queued", c.queueDepth(), "write_latency", time.Duration(c.writeLatency.Load()))
+		if c.version >= protocolV2 {
+			f := systemFrame{Type: messageTypeSystem, Code: "slow_consumer", Text: "You are receiving messages slower than they are sent."}
+			if err := c.deliver("", f); err != nil && unsafeError(err) {
+				c.logger.Warn("sending slow consumer notice", "err", err)
+			}
+		}
+
+	case c.slowWarned && !c.slow(true):
+		c.slowWarned = false
+	}
+}
+
+// SlowClient describes one of the slowest clients in the stats.
+type SlowClient struct {
+	Username            string  `json:"username,omitempty"`
+	IP                  string  `json:"ip"`
+	Room                string  `json:"room"`
+	QueueDepth          int     `json:"queue_depth"`
+	WriteLatencyMs      float64 `json:"write_latency_ms"`
+	WriteDeadlineMisses int64   `json:"write_deadline_misses"`
+}
+
+// backpressureSample is the backpressure of every client.
+type backpressureSample struct {
+	clients []SlowClient
+}
+
+// sampleBackpressure collects the backpressure of every client on the hub.
+func (s *Server) sampleBackpressure() backpressureSample {
+	reply := make(chan backpressureSample, 1)
+
+	s.ops <- func(h *hub) {
+		var sample backpressureSample
+		defer func() { reply <- sample }()
+
+		for c := range h.clients {
+			sample.clients = append(sample.clients, SlowClient{
+				Username:            c.claimed,
+				IP:                  c.ip,
+				Room:                c.room,
+				QueueDepth:          c.queueDepth(),
+				WriteLatencyMs:      float64(c.writeLatency.Load()) / float64(time.Millisecond),
+				WriteDeadlineMisses: c.deadlineMisses.Load(),
+			})
+		}
+	}
+
+	return <-reply
+}
+
+// slowest returns the n clients with the deepest queues, then the slowest
+// writes.
+func (bs backpressureSample) slowest(n int) []SlowClient {
+	clients := append([]SlowClient(nil), bs.clients...)
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].QueueDepth != clients[j].QueueDepth {
+			return clients[i].QueueDepth > clients[j].QueueDepth
+		}
+		return clients[i].WriteLatencyMs > clients[j].WriteLatencyMs
+	})
+	return clients[:min(n, len(clients))]
+}
+
+// quantiles returns the given quantiles of the values picked from every
+// client.
+func (bs backpressureSample) quantiles(pick func(SlowClient) float64, qs []float64) []float64 {
+	values := make([]float64, len(bs.clients))
+	for i, c := range bs.clients {
+		values[i] = pick(c)
+	}
+	sort.Float64s(values)
+
+	out := make([]float64, len(qs))
+	if len(values) == 0 {
+		return out
+	}
+	for i, q := range qs {
+		out[i] = values[int(q*float64(len(values)-1))]
+	}
+	return out
+}
+
+var metricQuantiles = []float64{0.5, 0.9, 0.99}
+
+// handleMetrics exposes the backpressure of the clients in the Prometheus
+// text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	sample := s.sampleBackpressure()
+
+	var b strings.Builder
+	summary := func(name, help string, pick func(SlowClient) float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s summary\n", name, help, name)
+		var sum float64
+		for _, c := range sample.clients {
+			sum += pick(c)
+		}
+		for i, v := range sample.quantiles(pick, metricQuantiles) {
+			fmt.Fprintf(&b, "%s{quantile=\"%g\"} %g\n", name, metricQuantiles[i], v)
+		}
+		fmt.Fprintf(&b, "%s_sum %g\n%s_count %d\n", name, sum, name, len(sample.clients))
+	}
+
+	summary("chat_client_queue_depth", "Frames queued per connected client.", func(c SlowClient) float64 {
+		return float64(c.QueueDepth)
+	})
+	summary("chat_client_write_seconds", "Smoothed write duration per connected client.", func(c SlowClient) float64 {
+		return c.WriteLatencyMs / 1000
+	})
+
+	fmt.Fprintf(&b, "# HELP chat_clients Connected clients.\n")
+	fmt.Fprintf(&b, "# TYPE chat_clients gauge\n")
+	fmt.Fprintf(&b, "chat_clients %d\n", s.ClientCount())
+
+	fmt.Fprintf(&b, "# HELP chat_write_deadline_misses_total Writes to clients that hit the write deadline.\n")
+	fmt.Fprintf(&b, "# TYPE chat_write_deadline_misses_total counter\n")
+	fmt.Fprintf(&b, "chat_write_deadline_misses_total %d\n", s.backpressure.deadlineMisses.Load())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, b.String())
+}
@@ -0,0 +1,162 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Bot takes part in the chat from inside the server. It sees every chat
+// message stored by this instance, except those of bots, and answers through
+// reply, under its name. OnMessage is called from a single goroutine shared
+// by every bot, so it should not block for long.
+type Bot interface {
+	Name() string
+	OnMessage(ctx context.Context, msg ChatMessage, reply func(ChatMessage))
+}
+
+const (
+	// botQueue is how many messages wait for the bots before new ones are
+	// dropped.
+	botQueue = 256
+
+	// botTimeout bounds the handling of one message by a bot.
+	botTimeout = 10 * time.Second
+)
+
+// builtinBots are the bots BOTS can enable, by name.
+var builtinBots = map[string]func() Bot{
+	"help": func() Bot { return new(helpBot) },
+	"echo": func() Bot { return echoBot{} },
+}
+
+// parseBots checks the comma-separated names of built-in bots in BOTS.
+func parseBots(v string) ([]string, error) {
+	names := splitList(v)
+	for _, name := range names {
+		if builtinBots[name] == nil {
+			return nil, fmt.Errorf("BOTS: unknown bot %q", name)
+		}
+	}
+	return names, nil
+}
+
+// botDispatcher hands the stored messages to the bots. A nil *botDispatcher
+// has no bots.
+type botDispatcher struct {
+	s     *Server
+	bots  []Bot
+	queue chan ChatMessage
+}
+
+// newBotDispatcher returns the dispatcher of the bots registered with
+// WithBot and of the built-in ones named in cfg, nil when there are none.
+func newBotDispatcher(s *Server, cfg Config) *botDispatcher {
+	bots := s.bots
+	for _, name := range cfg.Bots {
+		bots = append(bots, builtinBots[name]())
+	}
+	if len(bots) == 0 {
+		return nil
+	}
+
+	names := make([]string, len(bots))
+	for i, b := range bots {
+		names[i] = b.Name()
+	}
+	sort.Strings(names)
+	for _, b := range bots {
+		if hb, ok := b.(*helpBot); ok {
+			hb.bots = names
+		}
+	}
+
+	return &botDispatcher{s: s, bots: bots, queue: make(chan ChatMessage, botQueue)}
+}
+
+// forward queues msg for the bots, unless a bot sent it: bots answering each
+// other could go on forever. It runs on the hub and never blocks.
+func (bd *botDispatcher) forward(msg ChatMessage) {
+	if bd == nil || msg.Bot {
+		return
+	}
+
+	select {
+	case bd.queue <- msg:
+	default:
+		bd.s.logger.Warn("bot queue full, dropping message", "room", msg.Room, "id", msg.ID)
+	}
+}
+
+func (bd *botDispatcher) run() {
+	for msg := range bd.queue {
+		for _, b := range bd.bots {
+			bd.call(b, msg)
+		}
+	}
+}
+
+// call hands msg to b. A panicking bot is logged and skipped, rather than
+// taking the server down.
+func (bd *botDispatcher) call(b Bot, msg ChatMessage) {
+	defer func() {
+		if v := recover(); v != nil {
+			bd.s.logger.Error("bot panicked", "bot", b.Name(), "panic", v, "stack", string(debug.Stack()))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(bd.s.lifetime, botTimeout)
+	defer cancel()
+
+	b.OnMessage(ctx, msg, func(reply ChatMessage) {
+		bd.reply(ctx, b, msg.Room, reply)
+	})
+}
+
+// reply sends the text of reply, and the message it answers, to room as b.
+func (bd *botDispatcher) reply(ctx context.Context, b Bot, room string, reply ChatMessage) {
+	s := bd.s
+	if strings.TrimSpace(reply.Text) == "" {
+		return
+	}
+
+	msg := ChatMessage{Username: b.Name(), Text: reply.Text, ReplyTo: reply.ReplyTo, Bot: true}
+	if err := s.resolveReply(ctx, room, &msg); err != nil {
+		s.logger.Warn("bot replied to an unknown message", "bot", b.Name(), "reply_to", msg.ReplyTo, "err", err)
+		msg.ReplyTo = ""
+	}
+	s.sendMessage(ctx, nil, room, msg)
+}
+
+// helpBot answers !help with the bots of the server.
+type helpBot struct {
+	bots []string
+}
+
+func (*helpBot) Name() string { return "help" }
+
+func (hb *helpBot) OnMessage(ctx context.Context, msg ChatMessage, reply func(ChatMessage)) {
+	if strings.TrimSpace(msg.Text) != "!help" {
+		return
+	}
+	reply(ChatMessage{
+		Text:    "Bots here: " + strings.Join(hb.bots, ", ") + ". Send /help for the commands.",
+		ReplyTo: msg.ID,
+	})
+}
+
+// echoBot answers !echo with the text that follows it.
+type echoBot struct{}
+
+func (echoBot) Name() string { return "echo" }
+
+func (echoBot) OnMessage(ctx context.Context, msg ChatMessage, reply func(ChatMessage)) {
+	text, ok := strings.CutPrefix(msg.Text, "!echo ")
+	if !ok {
+		return
+	}
+	reply(ChatMessage{Text: text, ReplyTo: msg.ID})
+}
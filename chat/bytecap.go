@@ -0,0 +1,112 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// byteTrimmer is implemented by the stores that keep count of the bytes each
+// room stores, which a byte cap needs to be cheap enough to check on every
+// write.
+type byteTrimmer interface {
+	// TrimBytes drops the oldest messages of room until it stores at most
+	// maxBytes, as counted by messageSize. The latest message is always
+	// kept, however large.
+	TrimBytes(ctx context.Context, room string, maxBytes int64) error
+}
+
+// messageSize is the size of msg as counted against a byte cap: the bytes of
+// its texts and attachment. It leaves out the overhead of the store, which
+// is about the same for every message.
+func messageSize(msg *ChatMessage) int64 {
+	n := len(msg.Username) + len(msg.Text) + len(msg.DisplayName) + len(msg.AvatarURL) + len(msg.ReplyTo)
+	if msg.Attachment != nil {
+		data, _ := json.Marshal(msg.Attachment)
+		n += len(data)
+	}
+	return int64(n)
+}
+
+// roomBytes is the Redis counter of the bytes stored for room, the sum of
+// the sizes of the messages in its index. Messages stored before sizes were
+// recorded count as empty.
+func (ks keyspace) roomBytes(room string) string {
+	return ks.key("room_bytes:" + room)
+}
+
+// addToIndex adds a message to the index of a room, counting its size
+// unless it was there already, so that writing a message again, as the
+// migration may, doesn't count it twice.
+var addToIndex = redis.NewScript(`
+if redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2]) == 1 then
+	redis.call("INCRBY", KEYS[2], ARGV[3])
+end
+return 0
+`)
+
+// removeFromIndex deletes the messages ARGV from the index of their room,
+// subtracting the sizes of those that were in it. Messages removed by a
+// concurrent trim are thus only subtracted once. KEYS[3] on pair the hash of
+// each message with the list of its replies, which goes with it.
+var removeFromIndex = redis.NewScript(`
+local freed = 0
+for i, id in ipairs(ARGV) do
+	local hash = KEYS[2 * i + 1]
+	if redis.call("ZREM", KEYS[1], id) == 1 then
+		freed = freed + (tonumber(redis.call("HGET", hash, "size")) or 0)
+	end
+	redis.call("DEL", hash, KEYS[2 * i + 2])
+end
+if freed > 0 then
+	redis.call("DECRBY", KEYS[2], freed)
+end
+return freed
+`)
+
+func (rs *RedisStore) TrimBytes(ctx context.Context, room string, maxBytes int64) error {
+	index := rs.keys.roomIndex(room)
+
+	for {
+		total, err := rs.rdb.Get(ctx, rs.keys.roomBytes(room)).Int64()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil || total <= maxBytes {
+			return err
+		}
+
+		n, err := rs.rdb.ZCard(ctx, index).Result()
+		if err != nil || n <= 1 {
+			return err
+		}
+		ids, err := rs.rdb.ZRange(ctx, index, 0, min(pruneBatch, n-1)-1).Result()
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		cmds, err := rs.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, id := range ids {
+				pipe.HGet(ctx, rs.keys.message(id), "size")
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		// oldest first, until enough is freed
+		var drop []string
+		for i, cmd := range cmds {
+			size, _ := cmd.(*redis.StringCmd).Int64()
+			drop = append(drop, ids[i])
+			if total -= size; total <= maxBytes {
+				break
+			}
+		}
+		if err := rs.remove(ctx, room, drop); err != nil {
+			return err
+		}
+	}
+}
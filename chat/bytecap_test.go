@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestTrimBytes(t *testing.T) {
+	// each message is 100 bytes: "ann" and a text of 97
+	tests := []struct {
+		name     string
+		add      int
+		maxBytes int64
+		want     int
+	}{
+		{"under the cap", 5, 1000, 5},
+		{"at the cap", 5, 500, 5},
+		{"over the cap", 5, 250, 2},
+		{"latest kept", 5, 50, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			mr := miniredis.RunT(t)
+			store := NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test:")
+
+			var added []string
+			for i := 0; i < tt.add; i++ {
+				added = append(added, string(rune('a'+i))+strings.Repeat("x", 96))
+			}
+			appendTexts(t, store, "general", added...)
+
+			if err := store.TrimBytes(ctx, "general", tt.maxBytes); err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.Recent(ctx, "general", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := added[tt.add-tt.want:]; strings.Join(texts(got), ",") != strings.Join(want, ",") {
+				t.Errorf("kept %d messages, want the latest %d", len(got), tt.want)
+			}
+			if total, err := mr.Get(store.keys.roomBytes("general")); err != nil || total != strconv.Itoa(100*tt.want) {
+				t.Errorf("counted %s bytes, %v, want %d", total, err, 100*tt.want)
+			}
+		})
+	}
+}
+
+// TestRoomBytesCounted checks that the byte counter follows the messages
+// removed by other means than the byte cap.
+func TestRoomBytesCounted(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	store := NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test:")
+
+	msgs := appendTexts(t, store, "general", strings.Repeat("x", 97), strings.Repeat("y", 97), strings.Repeat("z", 97), "hi")
+	if err := store.Trim(ctx, "general", 3); err != nil {
+		t.Fatal(err)
+	}
+	if total, _ := mr.Get(store.keys.roomBytes("general")); total != "205" {
+		t.Errorf("counted %s bytes after trimming, want 205", total)
+	}
+
+	if err := store.remove(ctx, "general", []string{msgs[1].ID, msgs[1].ID}); err != nil {
+		t.Fatal(err)
+	}
+	if total, _ := mr.Get(store.keys.roomBytes("general")); total != "105" {
+		t.Errorf("counted %s bytes after removing, want 105", total)
+	}
+}
+
+// TestHistoryMaxBytes checks that rooms are trimmed to their byte cap as
+// messages are posted, with a room's own cap overriding HISTORY_MAX_BYTES.
+func TestHistoryMaxBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		room     string
+		roomCap  int64
+		wantKept int
+	}{
+		{"default cap", "general", 0, 2},
+		{"room cap", "tiny", 300, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HISTORY_MAX_BYTES", "1100")
+			s, _ := newTestServer(t)
+			ctx := context.Background()
+			if tt.roomCap > 0 {
+				if _, err := s.createRoom(ctx, tt.room, RoomOptions{Replay: true, MaxBytes: tt.roomCap}, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ann := dialTestServer(t, s, "room="+tt.room+"&username=ann", "chat.v2")
+			waitClients(t, s, 1)
+
+			var posted []string
+			for _, c := range "abcd" {
+				text := string(c) + strings.Repeat("x", 499)
+				if err := ann.WriteJSON(ChatMessage{Text: text}); err != nil {
+					t.Fatal(err)
+				}
+				readFrameOf(t, ann, messageTypeChat, func(m ChatMessage) bool { return m.Text == text })
+				posted = append(posted, text)
+			}
+
+			got, err := s.store.Recent(ctx, tt.room, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := posted[len(posted)-tt.wantKept:]; strings.Join(texts(got), ",") != strings.Join(want, ",") {
+				t.Errorf("kept %d messages, want the latest %d", len(got), tt.wantKept)
+			}
+		})
+	}
+}
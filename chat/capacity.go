@@ -0,0 +1,71 @@
+package chat
+
+import (
+	"sort"
+
+	"github.com/gorilla/websocket"
+)
+
+// seat decides whether c gets a seat in its room, given the room options,
+// which have the final say once the room is full: c is either turned away
+// or, in rooms with a lobby, kept read-only until a seat frees up. Observers
+// and admins don't need a seat. It reports false when c was turned away. It
+// runs on the hub.
+func (s *Server) seat(h *hub, c *Client, opts RoomOptions) bool {
+	if c.observer {
+		return true
+	}
+	if opts.Capacity <= 0 || c.admin || h.occupancy[c.room] < opts.Capacity {
+		h.occupancy[c.room]++
+		c.seated = true
+		return true
+	}
+
+	if !opts.Lobby {
+		closeClient(c, websocket.CloseTryAgainLater, "room is full")
+		return false
+	}
+
+	c.waiting.Store(true)
+	f := systemFrame{Type: messageTypeSystem, Code: "lobby", Text: "The room is full. You can read along and will be let in once someone leaves."}
+	if err := c.deliver("", f.forVersion(c.version)); err != nil && unsafeError(err) {
+		c.logger.Warn("sending lobby notice", "err", err)
+	}
+	return true
+}
+
+// unseat frees the seat of c, if it had one, letting in whoever waited the
+// longest in the lobby. It runs on the hub.
+func unseat(h *hub, c *Client) {
+	if !c.seated {
+		return
+	}
+	c.seated = false
+	h.occupancy[c.room]--
+	if h.occupancy[c.room] <= 0 {
+		delete(h.occupancy, c.room)
+	}
+
+	var lobby []*Client
+	for other := range h.clients {
+		if other.room == c.room && other.waiting.Load() {
+			lobby = append(lobby, other)
+		}
+	}
+	if len(lobby) == 0 {
+		return
+	}
+	sort.Slice(lobby, func(i, j int) bool {
+		return lobby[i].connectedAt.Before(lobby[j].connectedAt)
+	})
+
+	next := lobby[0]
+	next.waiting.Store(false)
+	next.seated = true
+	h.occupancy[next.room]++
+
+	f := systemFrame{Type: messageTypeSystem, Code: "admitted", Text: "A seat freed up, you can now post."}
+	if err := next.deliver("", f.forVersion(next.version)); err != nil && unsafeError(err) {
+		next.logger.Warn("sending admission notice", "err", err)
+	}
+}
@@ -0,0 +1,88 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRoomCapacity(t *testing.T) {
+	tests := []struct {
+		name  string
+		lobby bool
+	}{
+		{"reject", false},
+		{"lobby", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			opts := defaultRoomOptions()
+			opts.Capacity = 1
+			opts.Lobby = tt.lobby
+			if _, err := s.createRoom(context.Background(), "general", opts, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+			waitClients(t, s, 1)
+			bob := dialTestServer(t, s, "room=general&username=bob", "chat.v2")
+
+			if !tt.lobby {
+				bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+				for {
+					_, _, err := bob.ReadMessage()
+					if err == nil {
+						continue
+					}
+					var ce *websocket.CloseError
+					if !errors.As(err, &ce) || ce.Code != websocket.CloseTryAgainLater || ce.Text != "room is full" {
+						t.Errorf("got %v, want a close frame with %d", err, websocket.CloseTryAgainLater)
+					}
+					break
+				}
+				waitClients(t, s, 1)
+
+				// a seat frees up
+				ann.Close()
+				waitClients(t, s, 0)
+				bob = dialTestServer(t, s, "room=general&username=bob", "chat.v2")
+				waitClients(t, s, 1)
+			} else {
+				var f systemFrame
+				readFrameInto(t, bob, messageTypeSystem, &f)
+				if f.Code != "lobby" {
+					t.Fatalf("notice %q, want lobby", f.Code)
+				}
+				if err := bob.WriteJSON(ChatMessage{Text: "let me in"}); err != nil {
+					t.Fatal(err)
+				}
+				var e errorFrame
+				readFrameInto(t, bob, messageTypeError, &e)
+				if e.Code != "room_full" {
+					t.Errorf("error %q, want room_full", e.Code)
+				}
+
+				// the lobby reads along
+				if err := ann.WriteJSON(ChatMessage{Text: "full house"}); err != nil {
+					t.Fatal(err)
+				}
+				readFrameOf(t, bob, messageTypeChat, func(m ChatMessage) bool { return m.Text == "full house" })
+
+				ann.Close()
+				readFrameInto(t, bob, messageTypeSystem, &f)
+				if f.Code != "admitted" {
+					t.Fatalf("notice %q, want admitted", f.Code)
+				}
+			}
+
+			if err := bob.WriteJSON(ChatMessage{Text: "seated"}); err != nil {
+				t.Fatal(err)
+			}
+			readFrameOf(t, bob, messageTypeChat, func(m ChatMessage) bool { return m.Text == "seated" })
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package chat
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrorClass tells how an error on a connection should be treated.
+type ErrorClass int
+
+const (
+	// ErrorExpected is a normal end of a connection, such as a browser
+	// closing its tab, and is not worth more than a debug line.
+	ErrorExpected ErrorClass = iota
+
+	// ErrorProtocol is a client misbehaving: malformed frames or a close
+	// with an error code.
+	ErrorProtocol
+
+	// ErrorServer is anything else, a genuine failure on our side.
+	ErrorServer
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorExpected:
+		return "expected"
+	case ErrorProtocol:
+		return "protocol"
+	}
+	return "server"
+}
+
+// errMalformedFrame wraps the error decoding a frame a client sent.
+var errMalformedFrame = errors.New("malformed frame")
+
+// errFrameTooLarge is returned for frames over the size limit.
+var errFrameTooLarge = errors.New("frame too large")
+
+// expectedCloseCodes are the close codes of connections ending normally.
+// 1006 is reported when the peer vanished without a close frame, which is
+// what closing a laptop lid looks like.
+var expectedCloseCodes = []int{
+	websocket.CloseNormalClosure,
+	websocket.CloseGoingAway,
+	websocket.CloseNoStatusReceived,
+	websocket.CloseAbnormalClosure,
+}
+
+// ClassifyError sorts an error reading from or writing to a connection into
+// an ErrorClass.
+func ClassifyError(err error) ErrorClass {
+	var closeErr *websocket.CloseError
+	switch {
+	case err == nil:
+		return ErrorExpected
+
+	case errors.As(err, &closeErr):
+		if websocket.IsCloseError(err, expectedCloseCodes...) {
+			return ErrorExpected
+		}
+		return ErrorProtocol
+
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, net.ErrClosed),
+		errors.Is(err, websocket.ErrCloseSent),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE):
+		return ErrorExpected
+
+	case errors.Is(err, errMalformedFrame),
+		errors.Is(err, errFrameTooLarge):
+		return ErrorProtocol
+	}
+
+	return ErrorServer
+}
+
+// unsafeError reports whether err is worth logging, rather than a client
+// going away while a message is sent to it.
+func unsafeError(err error) bool {
+	return ClassifyError(err) != ErrorExpected
+}
+
+// closeTimeout bounds the write of a close frame when writes aren't bounded
+// otherwise.
+const closeTimeout = time.Second
+
+// controlDeadline returns the deadline of a control frame written with the
+// write timeout d. Unlike other frames, control frames can't go without one,
+// and a zero deadline would have passed already.
+func controlDeadline(d time.Duration) time.Time {
+	if d <= 0 {
+		d = closeTimeout
+	}
+	return time.Now().Add(d)
+}
+
+// closeClient sends c a close frame with code and reason and closes it.
+// Control frames may be written concurrently with other writes, so it is
+// safe to call off the hub.
+func closeClient(c *Client, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	err := c.ws.WriteControl(websocket.CloseMessage, msg, controlDeadline(c.writeTimeout))
+	if err != nil && unsafeError(err) {
+		c.logger.Warn("sending close frame", "err", err)
+	}
+	c.ws.Close()
+}
+
+// disconnect closes c with code and reason once the frames already sent to
+// it went out, and unregisters it.
+func (s *Server) disconnect(c *Client, code int, reason string) {
+	s.ops <- func(h *hub) {
+		if !removeClient(h, c, code, reason) {
+			return
+		}
+		s.audit(AuditEntry{Action: auditKick, Actor: auditActorServer, Target: c.claimed, Room: c.room, IP: c.ip, Reason: reason})
+	}
+}
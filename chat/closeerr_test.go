@@ -0,0 +1,227 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+)
+
+func TestClassifyError(t *testing.T) {
+	closeErr := func(code int) error {
+		return &websocket.CloseError{Code: code, Text: "bye"}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"nil", nil, ErrorExpected},
+		{"normal closure", closeErr(websocket.CloseNormalClosure), ErrorExpected},
+		{"going away", closeErr(websocket.CloseGoingAway), ErrorExpected},
+		{"no status", closeErr(websocket.CloseNoStatusReceived), ErrorExpected},
+		{"abnormal closure", closeErr(websocket.CloseAbnormalClosure), ErrorExpected},
+		{"protocol error", closeErr(websocket.CloseProtocolError), ErrorProtocol},
+		{"unsupported data", closeErr(websocket.CloseUnsupportedData), ErrorProtocol},
+		{"invalid payload", closeErr(websocket.CloseInvalidFramePayloadData), ErrorProtocol},
+		{"policy violation", closeErr(websocket.ClosePolicyViolation), ErrorProtocol},
+		{"message too big", closeErr(websocket.CloseMessageTooBig), ErrorProtocol},
+		{"internal error", closeErr(websocket.CloseInternalServerErr), ErrorProtocol},
+		{"EOF", io.EOF, ErrorExpected},
+		{"unexpected EOF", io.ErrUnexpectedEOF, ErrorExpected},
+		{"closed connection", &net.OpError{Op: "read", Net: "tcp", Err: net.ErrClosed}, ErrorExpected},
+		{"close sent", websocket.ErrCloseSent, ErrorExpected},
+		{"connection reset", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, ErrorExpected},
+		{"broken pipe", &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, ErrorExpected},
+		{"malformed frame", fmt.Errorf("%w: unexpected end of JSON input", errMalformedFrame), ErrorProtocol},
+		{"frame too large", errFrameTooLarge, ErrorProtocol},
+		{"timeout", os.ErrDeadlineExceeded, ErrorServer},
+		{"other", errors.New("redis: connection pool timeout"), ErrorServer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Errorf("ClassifyError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+			if got, want := unsafeError(tt.err), tt.want != ErrorExpected; got != want {
+				t.Errorf("unsafeError(%v) = %v, want %v", tt.err, got, want)
+			}
+		})
+	}
+}
+
+// TestCloseHandshake checks that the server answers a client's close frame
+// with one of its own.
+func TestCloseHandshake(t *testing.T) {
+	tests := []struct {
+		name         string
+		sent         []byte
+		writeTimeout string
+		want         int
+	}{
+		{"normal", websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), "", websocket.CloseNormalClosure},
+		{"going away", websocket.FormatCloseMessage(websocket.CloseGoingAway, "tab closed"), "", websocket.CloseGoingAway},
+		{"no status", nil, "", websocket.CloseNormalClosure},
+		{"no write timeout", websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), "0", websocket.CloseGoingAway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.writeTimeout != "" {
+				t.Setenv("WRITE_TIMEOUT", tt.writeTimeout)
+			}
+			s, _ := newTestServer(t)
+			ws := dialTestServer(t, s, "room=general&username=ann")
+			waitClients(t, s, 1)
+
+			if err := ws.WriteControl(websocket.CloseMessage, tt.sent, time.Now().Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				_, _, err := ws.ReadMessage()
+				if err == nil {
+					continue
+				}
+				var ce *websocket.CloseError
+				if !errors.As(err, &ce) || ce.Code != tt.want {
+					t.Errorf("got %v, want a close frame with %d", err, tt.want)
+				}
+				break
+			}
+			waitClients(t, s, 0)
+		})
+	}
+}
+
+// TestServerCloseCodes checks that the clients the server drops learn why
+// from the close frame.
+func TestServerCloseCodes(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T)
+		act        func(t *testing.T, s *Server, mr *miniredis.Miniredis, ws *websocket.Conn)
+		wantCode   int
+		wantReason string
+	}{
+		{
+			"banned",
+			nil,
+			func(t *testing.T, s *Server, mr *miniredis.Miniredis, ws *websocket.Conn) {
+				mr.Set(s.keys.sanction(sanctionBan, "ann"), "1")
+				if err := ws.WriteJSON(ChatMessage{Text: "hi"}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			websocket.ClosePolicyViolation, "banned",
+		},
+		{
+			"banned without a write timeout",
+			func(t *testing.T) { t.Setenv("WRITE_TIMEOUT", "0") },
+			func(t *testing.T, s *Server, mr *miniredis.Miniredis, ws *websocket.Conn) {
+				mr.Set(s.keys.sanction(sanctionBan, "ann"), "1")
+				if err := ws.WriteJSON(ChatMessage{Text: "hi"}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			websocket.ClosePolicyViolation, "banned",
+		},
+		{
+			"flooding",
+			func(t *testing.T) {
+				t.Setenv("RATE_LIMIT", "0.01")
+				t.Setenv("RATE_BURST", "1")
+			},
+			func(t *testing.T, s *Server, mr *miniredis.Miniredis, ws *websocket.Conn) {
+				for i := 0; i <= rateAbuseThreshold; i++ {
+					if err := ws.WriteJSON(ChatMessage{Text: strconv.Itoa(i)}); err != nil {
+						return
+					}
+				}
+			},
+			websocket.CloseTryAgainLater, "sending too fast",
+		},
+		{
+			"shutdown",
+			nil,
+			func(t *testing.T, s *Server, mr *miniredis.Miniredis, ws *websocket.Conn) {
+				go s.Shutdown()
+			},
+			websocket.CloseServiceRestart, "server restarting",
+		},
+		{
+			"oversized frame",
+			func(t *testing.T) { t.Setenv("MAX_FRAME_SIZE", "64") },
+			func(t *testing.T, s *Server, mr *miniredis.Miniredis, ws *websocket.Conn) {
+				if err := ws.WriteJSON(ChatMessage{Text: strings.Repeat("a", 64)}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			websocket.ClosePolicyViolation, "frame larger than 64 bytes",
+		},
+		{
+			"oversized binary frame",
+			func(t *testing.T) { t.Setenv("MAX_FRAME_SIZE", "64") },
+			func(t *testing.T, s *Server, mr *miniredis.Miniredis, ws *websocket.Conn) {
+				if err := ws.WriteMessage(websocket.BinaryMessage, make([]byte, 1024)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			websocket.ClosePolicyViolation, "frame larger than 64 bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup(t)
+			}
+			s, mr := newTestServer(t)
+			ws := dialTestServer(t, s, "room=general&username=ann")
+			waitClients(t, s, 1)
+
+			tt.act(t, s, mr, ws)
+
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				_, _, err := ws.ReadMessage()
+				if err == nil {
+					continue
+				}
+				var ce *websocket.CloseError
+				if !errors.As(err, &ce) || ce.Code != tt.wantCode || ce.Text != tt.wantReason {
+					t.Errorf("got %v, want a close frame with %d %q", err, tt.wantCode, tt.wantReason)
+				}
+				break
+			}
+		})
+	}
+}
+
+// TestFrameAtLimit checks that a frame of exactly the maximum size is
+// accepted.
+func TestFrameAtLimit(t *testing.T) {
+	t.Setenv("MAX_FRAME_SIZE", "64")
+	s, _ := newTestServer(t)
+	ws := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	waitClients(t, s, 1)
+
+	frame := `{"text":"` + strings.Repeat("a", 53) + `"}`
+	if len(frame) != 64 {
+		t.Fatalf("frame of %d bytes", len(frame))
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readFrameOf(t, ws, messageTypeChat, nil); len(msg.Text) != 53 {
+		t.Errorf("got %q, want the message", msg.Text)
+	}
+}
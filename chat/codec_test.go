@@ -0,0 +1,191 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLookupCodecs(t *testing.T) {
+	tests := []struct {
+		names string
+		want  []string
+		err   bool
+	}{
+		{"", []string{"json", "msgpack"}, false},
+		{"json", []string{"json"}, false},
+		{"msgpack", []string{"json", "msgpack"}, false},
+		{" msgpack , json ", []string{"json", "msgpack"}, false},
+		{"cbor", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := lookupCodecs(tt.names)
+		if (err != nil) != tt.err {
+			t.Errorf("lookupCodecs(%q) error = %v, want error %v", tt.names, err, tt.err)
+			continue
+		}
+		var names []string
+		for _, c := range got {
+			names = append(names, c.Name())
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("lookupCodecs(%q) = %v, want %v", tt.names, names, tt.want)
+		}
+	}
+}
+
+func TestMsgpackMarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want []byte
+	}{
+		{"fixmap", map[string]int{"a": 1}, []byte{0x81, 0xa1, 'a', 0x01}},
+		{"negative", -1, []byte{0xff}},
+		{"int16", 300, []byte{0xd1, 0x01, 0x2c}},
+		{"bool and nil", []interface{}{true, nil}, []byte{0x92, 0xc3, 0xc0}},
+		{"sorted keys", map[string]string{"b": "", "a": ""}, []byte{0x82, 0xa1, 'a', 0xa0, 0xa1, 'b', 0xa0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := msgpackCodec{}.Marshal(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal(%v) = % x, want % x", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMsgpackUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, errMsgpackShort},
+		{"short string", []byte{0xa3, 'a'}, errMsgpackShort},
+		{"oversized array", []byte{0xdd, 0xff, 0xff, 0xff, 0xff}, errMsgpackShort},
+		{"too deep", append(bytes.Repeat([]byte{0x91}, maxMsgpackDepth+1), 0xc0), errMsgpackDepth},
+		{"trailing data", []byte{0xc0, 0xc0}, nil},
+		{"unsupported type", []byte{0xc1}, nil},
+		{"non-string key", []byte{0x81, 0x01, 0x01}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v interface{}
+			err := msgpackCodec{}.Unmarshal(tt.data, &v)
+			if err == nil {
+				t.Fatalf("Unmarshal(% x) succeeded", tt.data)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("Unmarshal(% x) error = %v, want %v", tt.data, err, tt.want)
+			}
+		})
+	}
+}
+
+// TestMsgpackConnection checks that a client negotiating MessagePack sends
+// and receives binary frames.
+func TestMsgpackConnection(t *testing.T) {
+	s, _ := newTestServer(t)
+	ws := dialTestServer(t, s, "room=general", "chat.v2.msgpack")
+	if got := ws.Subprotocol(); got != "chat.v2.msgpack" {
+		t.Fatalf("negotiated %q, want chat.v2.msgpack", got)
+	}
+
+	codec := msgpackCodec{}
+	data, err := codec.Marshal(ChatMessage{Username: "ann", Text: "packed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.Fatal(err)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		typ, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != websocket.BinaryMessage {
+			t.Fatalf("got a frame of type %d, want binary", typ)
+		}
+		var msg ChatMessage
+		if err := codec.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == messageTypeChat {
+			if msg.Text != "packed" || msg.Username != "ann" {
+				t.Errorf("got %+v, want ann's packed message", msg)
+			}
+			return
+		}
+	}
+}
+
+// countingCodec is the JSON codec, counting the frames it encodes.
+type countingCodec struct {
+	jsonCodec
+	n *atomic.Int64
+}
+
+func (cc countingCodec) Marshal(v interface{}) ([]byte, error) {
+	cc.n.Add(1)
+	return cc.jsonCodec.Marshal(v)
+}
+
+// TestBroadcastEncodedOnce checks that a message broadcast to several
+// clients is encoded once per codec and protocol version.
+func TestBroadcastEncodedOnce(t *testing.T) {
+	var n atomic.Int64
+	codec := countingCodec{n: &n}
+
+	var conns []*fakeConn
+	var clients []*Client
+	for _, version := range []int{protocolV1, protocolV2, protocolV2, protocolV2} {
+		fc := newFakeConn(false)
+		c := newFakeClient(fc, 0)
+		c.codec = codec
+		c.version = version
+		c.send = make(chan pendingFrame, 1)
+		conns = append(conns, fc)
+		clients = append(clients, c)
+	}
+
+	frames := make(frameCache)
+	msg := ChatMessage{Type: messageTypeChat, ID: "1", Username: "ann", Text: "hi", Seq: 1}
+	for _, c := range clients {
+		if err := c.deliverMessage(msg, frames); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range clients {
+		if !c.writeQueued(<-c.send) {
+			t.Fatal("write failed")
+		}
+	}
+
+	if got := n.Load(); got != 2 {
+		t.Errorf("encoded %d times, want 2, once per version", got)
+	}
+	for i, fc := range conns {
+		var got ChatMessage
+		if err := json.Unmarshal(fc.frames[0], &got); err != nil {
+			t.Fatal(err)
+		}
+		want := msg.forVersion(clients[i].version)
+		if got.Text != want.Text || got.Seq != want.Seq || got.Type != want.Type {
+			t.Errorf("client %d got %+v, want %+v", i, got, want)
+		}
+	}
+}
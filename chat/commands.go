@@ -0,0 +1,119 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// commandReply is what a command answers: a notice to its sender, or, with
+// toRoom set, a message broadcast to the room in place of the command.
+type commandReply struct {
+	text   string
+	toRoom bool
+}
+
+// commandFunc runs a command sent by c, args being the text after its name.
+type commandFunc func(ctx context.Context, s *Server, c *Client, msg ChatMessage, args string) (commandReply, error)
+
+type command struct {
+	usage string
+	help  string
+	run   commandFunc
+}
+
+// commands maps the name of every slash command to its handler.
+var commands = make(map[string]command)
+
+// registerCommand makes /name run fn. usage and help are what /help lists.
+func registerCommand(name, usage, help string, fn commandFunc) {
+	if _, ok := commands[name]; ok {
+		panic("command registered twice: " + name)
+	}
+	commands[name] = command{usage: usage, help: help, run: fn}
+}
+
+func init() {
+	registerCommand("help", "/help", "list the commands", runHelp)
+	registerCommand("me", "/me <action>", "say what you are doing", runMe)
+	registerCommand("users", "/users", "list who is in the room", runUsers)
+}
+
+func runHelp(ctx context.Context, s *Server, c *Client, msg ChatMessage, args string) (commandReply, error) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("Commands:")
+	for _, name := range names {
+		fmt.Fprintf(&b, "\n%s - %s", commands[name].usage, commands[name].help)
+	}
+	b.WriteString("\nStart a message with // to send it with a single /.")
+	return commandReply{text: b.String()}, nil
+}
+
+func runMe(ctx context.Context, s *Server, c *Client, msg ChatMessage, args string) (commandReply, error) {
+	if args == "" {
+		return commandReply{text: "usage: /me <action>"}, nil
+	}
+
+	name := msg.Username
+	if name == "" {
+		name = "someone"
+	}
+	return commandReply{text: "* " + name + " " + args, toRoom: true}, nil
+}
+
+func runUsers(ctx context.Context, s *Server, c *Client, msg ChatMessage, args string) (commandReply, error) {
+	roster := s.roster(c.room)
+
+	names := make([]string, len(roster.Members))
+	for i, m := range roster.Members {
+		names[i] = m.Username
+	}
+
+	text := "Online: " + strings.Join(names, ", ")
+	if len(names) == 0 {
+		text = "Online: nobody with a username"
+	}
+	if roster.Anonymous > 0 {
+		text += fmt.Sprintf(" (and %d anonymous)", roster.Anonymous)
+	}
+	return commandReply{text: text}, nil
+}
+
+// runCommand interprets msg, whose text starts with a slash, as a command
+// from c. It reports whether msg, with the text the command gave it, should
+// still be broadcast; a leading // just escapes the slash.
+func (s *Server) runCommand(ctx context.Context, c *Client, msg *ChatMessage) bool {
+	if strings.HasPrefix(msg.Text, "//") {
+		msg.Text = msg.Text[1:]
+		return true
+	}
+
+	name, args, _ := strings.Cut(msg.Text[1:], " ")
+	cmd, ok := commands[strings.ToLower(name)]
+	if !ok {
+		s.sendError(c, "unknown_command", fmt.Sprintf("unknown command /%s, try /help", name))
+		return false
+	}
+
+	reply, err := cmd.run(ctx, s, c, *msg, strings.TrimSpace(args))
+	if err != nil {
+		c.logger.Error("running command", "command", name, "err", err)
+		s.sendError(c, "command_failed", "the command failed")
+		return false
+	}
+	if reply.toRoom {
+		msg.Text = reply.text
+		return true
+	}
+
+	f := systemFrame{Type: messageTypeSystem, Code: "command", Text: reply.text}
+	s.sendFrame(c, f.forVersion(c.version))
+	return false
+}
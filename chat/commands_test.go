@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommands(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		wantError string // code of the error frame sent back
+		wantReply string // part of the notice sent back
+		wantRoom  string // message broadcast in place of the command
+	}{
+		{"help", "/help", "", "/users - list who is in the room", ""},
+		{"users", "/users", "", "Online: ann, bob", ""},
+		{"case insensitive", "/USERS", "", "Online: ann, bob", ""},
+		{"me", "/me waves", "", "", "* ann waves"},
+		{"me without action", "/me", "", "usage: /me <action>", ""},
+		{"escaped", "//shrug", "", "", "/shrug"},
+		{"unknown", "/dance now", "unknown_command", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+			bob := dialTestServer(t, s, "room=general&username=bob", "chat.v2")
+			waitClients(t, s, 2)
+
+			if err := ann.WriteJSON(ChatMessage{Text: tt.text}); err != nil {
+				t.Fatal(err)
+			}
+
+			switch {
+			case tt.wantError != "":
+				var f errorFrame
+				readFrameInto(t, ann, messageTypeError, &f)
+				if f.Code != tt.wantError {
+					t.Errorf("error %q, want %q", f.Code, tt.wantError)
+				}
+			case tt.wantReply != "":
+				var f systemFrame
+				readFrameInto(t, ann, messageTypeSystem, &f)
+				if f.Code != "command" || !strings.Contains(f.Text, tt.wantReply) {
+					t.Errorf("notice %q %q, want a command reply containing %q", f.Code, f.Text, tt.wantReply)
+				}
+			default:
+				if msg := readFrameOf(t, bob, messageTypeChat, nil); msg.Text != tt.wantRoom {
+					t.Errorf("room got %q, want %q", msg.Text, tt.wantRoom)
+				}
+			}
+		})
+	}
+}
+
+// TestConnectionPanicRecovered checks that a panic while running a
+// command only ends that connection.
+func TestConnectionPanicRecovered(t *testing.T) {
+	registerCommand("boom", "/boom", "panic", func(context.Context, *Server, *Client, ChatMessage, string) (commandReply, error) {
+		panic("boom")
+	})
+	t.Cleanup(func() { delete(commands, "boom") })
+
+	s, _ := newTestServer(t)
+	bad := dialTestServer(t, s, "room=general&username=ann")
+	good := dialTestServer(t, s, "room=general&username=bob")
+	waitClients(t, s, 2)
+
+	if err := bad.WriteJSON(ChatMessage{Username: "ann", Text: "/boom"}); err != nil {
+		t.Fatal(err)
+	}
+	bad.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg ChatMessage
+		if err := bad.ReadJSON(&msg); err != nil {
+			break
+		}
+	}
+	waitClients(t, s, 1)
+
+	if err := good.WriteJSON(ChatMessage{Username: "bob", Text: "still up"}); err != nil {
+		t.Fatal(err)
+	}
+	good.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg ChatMessage
+		if err := good.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Username == "bob" {
+			break
+		}
+	}
+}
@@ -0,0 +1,583 @@
+package chat
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Config is the configuration of the server, read from the environment once
+// at startup. A few settings can also be given as flags, which take
+// precedence.
+type Config struct {
+	// Port is the port the HTTP server listens on. IRCPort and GRPCPort
+	// are those of the IRC listener and the gRPC API, which are off when
+	// empty.
+	Port     string
+	IRCPort  string
+	GRPCPort string
+
+	// ListenAddr overrides Port with a TCP address, or with a Unix socket
+	// as unix:/path, created with SocketMode permissions. A socket passed
+	// by systemd socket activation takes precedence over both.
+	ListenAddr string
+	SocketMode fs.FileMode
+
+	// RedisURL locates the Redis instance holding the server's state, all
+	// of whose keys start with RedisKeyPrefix. It defaults to a local
+	// instance with the redis backend, and is optional with the others:
+	// without it, history and rooms live in the store alone, and the
+	// features keeping their state in Redis, such as moderation, invites,
+	// read markers and scheduled messages, report errors instead.
+	RedisURL       string
+	RedisKeyPrefix string
+
+	// HistoryBackend is where history is kept: "redis", "memory",
+	// "sqlite", in the database at SQLitePath, or "postgres", in the one
+	// at DatabaseURL.
+	HistoryBackend string
+	SQLitePath     string
+	DatabaseURL    string
+
+	// HistoryCap is the number of messages kept by rooms created without a
+	// cap of their own, 0 meaning unlimited.
+	HistoryCap int64
+
+	// HistoryMaxBytes caps the bytes of the messages each room keeps, in
+	// the rooms without a byte cap of their own, 0 meaning unlimited.
+	HistoryMaxBytes int64
+
+	// MigrateOnStart moves legacy history to the current layout at startup.
+	MigrateOnStart bool
+
+	// WriteBehind broadcasts messages before they are stored, in batches
+	// of up to WriteBehindBatch at least every WriteBehindInterval. The
+	// messages still buffered are lost if the process crashes.
+	WriteBehind         bool
+	WriteBehindBatch    int
+	WriteBehindInterval time.Duration
+
+	// DryRun broadcasts messages without storing them or replaying any
+	// history, to measure the fan-out alone.
+	DryRun bool
+
+	// MOTD is the message of the day clients are greeted with, unless an
+	// admin replaced it with /motd.
+	MOTD string
+
+	// LogPayloads adds the text of the messages received and broadcast to
+	// their debug log lines, which otherwise only carry metadata.
+	LogPayloads bool
+
+	AdminToken string
+	APIKey     string
+
+	// APIToken authenticates the calls to the gRPC API.
+	APIToken string
+
+	// Authenticator identifies WebSocket and IRC clients: JWTs signed with
+	// JWT_SECRET when set, given by IRC clients with PASS, and the username
+	// they ask for otherwise.
+	Authenticator Authenticator
+
+	// Codecs and ProtocolVersions are what clients may negotiate.
+	Codecs           []Codec
+	ProtocolVersions []int
+
+	// StrictProtocol refuses frames of unknown types or with unknown keys,
+	// which are otherwise ignored.
+	StrictProtocol bool
+
+	WriteTimeout     time.Duration
+	MaxFrameSize     int64
+	DrainGracePeriod time.Duration
+	IdleTimeout      time.Duration
+
+	// ResumeSecret signs the resume tokens, which are valid for ResumeTTL.
+	ResumeSecret string
+	ResumeTTL    time.Duration
+
+	RoomsStrict    bool
+	RoomConfigTTL  time.Duration
+	DuplicateUsers string
+	AvatarHosts    []string
+
+	// UsernameNFKC folds lookalike characters out of usernames, in
+	// binaries built with the nfkc tag.
+	UsernameNFKC bool
+
+	// MaxUsernameLen caps the length of usernames, in characters, and
+	// nobody may use ReservedUsernames, which are lowercase.
+	MaxUsernameLen    int
+	ReservedUsernames map[string]bool
+
+	// BannedWords are the words messages may not contain, lowercase, read
+	// from BannedWordsFile.
+	BannedWordsFile string
+	BannedWords     map[string]bool
+
+	// SearchScanBudget is the most messages a search scans, unless
+	// RediSearch indexes them.
+	SearchScanBudget int64
+	RediSearch       bool
+
+	TrustedProxies []netip.Prefix
+	MaxConnsPerIP  int
+	RateLimit      float64
+	RateBurst      int
+
+	// MaxSubscriptions caps the rooms a connection subscribes to beyond
+	// the one it connected to.
+	MaxSubscriptions int
+
+	// HandshakeLimit caps the requests, WebSocket handshakes included,
+	// each address makes per HandshakeWindow. 0 disables the limit.
+	HandshakeLimit  int
+	HandshakeWindow time.Duration
+
+	// AttachmentTypes are the media types of the files messages may
+	// attach, of up to AttachmentMaxSize bytes.
+	AttachmentTypes   []string
+	AttachmentMaxSize int64
+
+	// FloodThreshold rate-limit or validation violations by a user within
+	// FloodWindow mute them for FloodMute, multiplied by FloodMuteFactor
+	// for each auto-mute of theirs in the last day, up to FloodMuteMax. 0
+	// disables auto-mutes.
+	FloodThreshold  int
+	FloodWindow     time.Duration
+	FloodMute       time.Duration
+	FloodMuteFactor float64
+	FloodMuteMax    time.Duration
+
+	// A text its sender already sent within DuplicateWindow, among their
+	// last DuplicateHistory messages, is rejected, unless it is shorter
+	// than DuplicateMinLength. 0 disables the check.
+	DuplicateWindow    time.Duration
+	DuplicateHistory   int
+	DuplicateMinLength int
+
+	// SlowQueue and SlowWrite are the queued frames and smoothed write
+	// duration past which a client is warned it is a slow consumer.
+	// SendQueue is the queued frames past which it is disconnected.
+	SlowQueue int
+	SlowWrite time.Duration
+	SendQueue int
+
+	CORS corsConfig
+
+	// WSOrigins are the origins WebSocket connections may come from, "*"
+	// allowing any. Any is allowed when it is empty, as are requests not
+	// sending an Origin header.
+	WSOrigins []string
+
+	// PubSubRelay relays messages to the other instances over Redis
+	// Pub/Sub, or Postgres LISTEN/NOTIFY with the postgres backend. They
+	// are signed with RelaySecret when it is set, in which case unsigned
+	// messages are dropped.
+	PubSubRelay bool
+	RelaySecret string
+
+	// TelegramToken enables the Telegram bridge, relaying the chats of
+	// TelegramRooms to the rooms they map to.
+	TelegramToken string
+	TelegramRooms map[int64]string
+
+	// Bots are the names of the built-in bots to run: help and echo.
+	Bots []string
+
+	// VAPIDPublicKey and VAPIDPrivateKey enable Web Push notifications
+	// for mentions; VAPIDSubject is the contact push services see.
+	VAPIDPublicKey  string
+	VAPIDPrivateKey string
+	VAPIDSubject    string
+	PushHourlyLimit int
+
+	// EventsStream is empty when the events stream is disabled.
+	EventsStream string
+	EventsMaxLen int
+	AuditMaxLen  int
+
+	// RetentionMaxAge is how long messages are kept in the rooms without a
+	// max age of their own, and RetentionInterval how often the expired
+	// ones are pruned. Retention, rooms' max ages included, is off unless
+	// either is set; the interval is a minute when only the max age is.
+	RetentionMaxAge   time.Duration
+	RetentionInterval time.Duration
+
+	TLSCertFile      string
+	TLSKeyFile       string
+	AutocertDomains  []string
+	AutocertCacheDir string
+
+	// StaticDir is served at the root, falling back to its index.html
+	// for unknown paths when SPAFallback is set. TemplateReload parses
+	// index.html again on every request; it is set along with the
+	// directory by PUBLIC_DIR, for development.
+	StaticDir      string
+	SPAFallback    bool
+	StaticGzip     bool
+	TemplateReload bool
+
+	// BasePath is the path the app is mounted under, such as /chat, empty
+	// when it is served from the root.
+	BasePath string
+
+	DebugEndpoints bool
+}
+
+// defaultMaxFrameSize is the largest frame clients may send unless
+// MAX_FRAME_SIZE says otherwise, 0 lifting the limit.
+const defaultMaxFrameSize = 64 << 10
+
+// defaultRedisURL is the Redis instance of the redis backend when REDIS_URL
+// is not set.
+const defaultRedisURL = "redis://localhost:6379"
+
+// envOr returns the environment variable name, or def when it is unset.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			items = append(items, v)
+		}
+	}
+	return items
+}
+
+// LoadConfig reads the configuration from the environment and then from the
+// command-line flags in args. Every problem found is reported at once.
+func LoadConfig(args []string) (Config, error) {
+	var p envParser
+
+	cfg := Config{
+		Port:           envOr("PORT", "8080"),
+		IRCPort:        os.Getenv("IRC_PORT"),
+		GRPCPort:       os.Getenv("GRPC_PORT"),
+		ListenAddr:     os.Getenv("LISTEN_ADDR"),
+		RedisURL:       os.Getenv("REDIS_URL"),
+		RedisKeyPrefix: os.Getenv("REDIS_KEY_PREFIX"),
+
+		HistoryBackend: envOr("HISTORY_BACKEND", "redis"),
+		SQLitePath:     envOr("SQLITE_PATH", "chat.db"),
+		DatabaseURL:    os.Getenv("DATABASE_URL"),
+		HistoryCap:     int64(p.int("HISTORY_CAP", 0)),
+		MigrateOnStart: os.Getenv("MIGRATE_ON_START") != "0",
+		DryRun:         os.Getenv("DRY_RUN") == "1",
+		LogPayloads:    os.Getenv("LOG_PAYLOADS") == "1",
+		MOTD:           os.Getenv("MOTD"),
+
+		WriteBehind:         os.Getenv("WRITE_BEHIND") == "1",
+		WriteBehindBatch:    p.int("WRITE_BEHIND_BATCH", 100),
+		WriteBehindInterval: p.duration("WRITE_BEHIND_INTERVAL", 50*time.Millisecond),
+
+		AdminToken: os.Getenv("ADMIN_TOKEN"),
+		APIKey:     os.Getenv("API_KEY"),
+		APIToken:   os.Getenv("API_TOKEN"),
+
+		WriteTimeout:     p.duration("WRITE_TIMEOUT", 10*time.Second),
+		MaxFrameSize:     int64(p.int("MAX_FRAME_SIZE", defaultMaxFrameSize)),
+		StrictProtocol:   os.Getenv("STRICT_PROTOCOL") == "1",
+		ResumeSecret:     os.Getenv("RESUME_SECRET"),
+		ResumeTTL:        p.duration("RESUME_TOKEN_TTL", defaultResumeTTL),
+		DrainGracePeriod: p.duration("DRAIN_GRACE_PERIOD", 30*time.Second),
+		IdleTimeout:      p.duration("IDLE_TIMEOUT", 0),
+
+		RoomsStrict:   os.Getenv("ROOMS_STRICT") == "1",
+		UsernameNFKC:  os.Getenv("USERNAME_NFKC") == "1",
+		RoomConfigTTL: p.duration("ROOM_CONFIG_TTL", defaultRoomConfigTTL),
+		AvatarHosts:   avatarHosts(),
+
+		SearchScanBudget: int64(p.int("SEARCH_SCAN_BUDGET", defaultSearchScanBudget)),
+		RediSearch:       os.Getenv("REDISEARCH") == "1",
+
+		MaxConnsPerIP: p.int("MAX_CONNS_PER_IP", 0),
+		RateLimit:     p.float("RATE_LIMIT", 0),
+		RateBurst:     p.int("RATE_BURST", 5),
+
+		MaxSubscriptions: p.int("MAX_SUBSCRIPTIONS", defaultMaxSubscriptions),
+
+		HandshakeLimit:  p.int("HANDSHAKE_LIMIT", 0),
+		HandshakeWindow: p.duration("HANDSHAKE_WINDOW", time.Minute),
+
+		HistoryMaxBytes: int64(p.int("HISTORY_MAX_BYTES", 0)),
+
+		MaxUsernameLen:    p.int("USERNAME_MAX_LENGTH", defaultMaxUsernameLen),
+		ReservedUsernames: reservedUsernames(),
+		BannedWordsFile:   os.Getenv("BANNED_WORDS_FILE"),
+
+		AttachmentMaxSize: int64(p.int("ATTACHMENT_MAX_SIZE", defaultAttachmentMaxSize)),
+
+		FloodThreshold:  p.int("FLOOD_THRESHOLD", 0),
+		FloodWindow:     p.duration("FLOOD_WINDOW", 5*time.Minute),
+		FloodMute:       p.duration("FLOOD_MUTE", time.Minute),
+		FloodMuteFactor: p.float("FLOOD_MUTE_FACTOR", 2),
+		FloodMuteMax:    p.duration("FLOOD_MUTE_MAX", 24*time.Hour),
+
+		DuplicateWindow:    p.duration("DUPLICATE_WINDOW", 0),
+		DuplicateHistory:   p.int("DUPLICATE_HISTORY", 5),
+		DuplicateMinLength: p.int("DUPLICATE_MIN_LENGTH", 5),
+
+		SlowQueue: p.int("SLOW_CONSUMER_QUEUE", defaultSlowQueue),
+		SlowWrite: p.duration("SLOW_CONSUMER_WRITE", defaultSlowWrite),
+		SendQueue: p.int("SEND_QUEUE", defaultSendQueue),
+
+		CORS:      loadCORSConfig(),
+		WSOrigins: splitList(os.Getenv("WS_ALLOWED_ORIGINS")),
+
+		VAPIDPublicKey:  os.Getenv("VAPID_PUBLIC_KEY"),
+		VAPIDPrivateKey: os.Getenv("VAPID_PRIVATE_KEY"),
+		VAPIDSubject:    envOr("VAPID_SUBJECT", "mailto:webmaster@localhost"),
+		PushHourlyLimit: p.int("PUSH_HOURLY_LIMIT", defaultPushHourlyLimit),
+
+		EventsMaxLen: p.int("EVENTS_MAXLEN", 0),
+		AuditMaxLen:  p.int("AUDIT_MAXLEN", defaultAuditMaxLen),
+
+		RetentionMaxAge:   p.duration("RETENTION_MAX_AGE", 0),
+		RetentionInterval: p.duration("RETENTION_INTERVAL", 0),
+
+		TLSCertFile:      os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:       os.Getenv("TLS_KEY_FILE"),
+		AutocertDomains:  splitList(os.Getenv("AUTOCERT_DOMAINS")),
+		AutocertCacheDir: envOr("AUTOCERT_CACHE_DIR", "autocert-cache"),
+
+		StaticDir:      envOr("STATIC_DIR", "./public"),
+		TemplateReload: os.Getenv("PUBLIC_DIR") != "",
+		SPAFallback:    os.Getenv("SPA_FALLBACK") == "1",
+		StaticGzip:     os.Getenv("STATIC_GZIP") == "1",
+		DebugEndpoints: os.Getenv("DEBUG_ENDPOINTS") == "1",
+	}
+
+	var err error
+	if cfg.Codecs, err = lookupCodecs(os.Getenv("WS_CODECS")); err != nil {
+		p.fail(fmt.Errorf("WS_CODECS: %w", err))
+	}
+	if cfg.ProtocolVersions, err = lookupVersions(os.Getenv("WS_PROTOCOL_VERSIONS")); err != nil {
+		p.fail(fmt.Errorf("WS_PROTOCOL_VERSIONS: %w", err))
+	}
+	if cfg.BasePath, err = parseBasePath(os.Getenv("BASE_PATH")); err != nil {
+		p.fail(err)
+	}
+	if cfg.AttachmentTypes, err = parseAttachmentTypes(os.Getenv("ATTACHMENT_TYPES")); err != nil {
+		p.fail(err)
+	}
+	if cfg.TrustedProxies, err = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES")); err != nil {
+		p.fail(err)
+	}
+	if cfg.DuplicateUsers, err = parseDuplicatePolicy(os.Getenv("DUPLICATE_USERS")); err != nil {
+		p.fail(err)
+	}
+	if cfg.SocketMode, err = parseSocketMode(os.Getenv("SOCKET_MODE")); err != nil {
+		p.fail(err)
+	}
+	if cfg.BannedWords, err = loadWordlist(cfg.BannedWordsFile); err != nil {
+		p.fail(fmt.Errorf("BANNED_WORDS_FILE: %w", err))
+	}
+	cfg.Authenticator = NoAuth{}
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		cfg.Authenticator = NewJWTAuth(secret)
+	}
+	cfg.PubSubRelay = os.Getenv("PUBSUB_RELAY") == "1"
+	cfg.RelaySecret = os.Getenv("RELAY_SIGNING_SECRET")
+	cfg.TelegramToken = os.Getenv("TELEGRAM_BOT_TOKEN")
+	if cfg.TelegramRooms, err = parseTelegramRooms(os.Getenv("TELEGRAM_ROOMS")); err != nil {
+		p.fail(err)
+	}
+	if cfg.Bots, err = parseBots(os.Getenv("BOTS")); err != nil {
+		p.fail(err)
+	}
+	if dir := os.Getenv("PUBLIC_DIR"); dir != "" {
+		cfg.StaticDir = dir
+	}
+	if os.Getenv("EVENTS_ENABLED") == "1" {
+		cfg.EventsStream = envOr("EVENTS_STREAM", defaultEventsStream)
+	}
+	if cfg.RetentionInterval == 0 && cfg.RetentionMaxAge > 0 {
+		cfg.RetentionInterval = time.Minute
+	}
+
+	fs := flag.NewFlagSet("chatserver", flag.ContinueOnError)
+	fs.StringVar(&cfg.Port, "port", cfg.Port, "port to listen on (PORT)")
+	fs.StringVar(&cfg.RedisURL, "redis-url", cfg.RedisURL, "URL of the Redis instance (REDIS_URL)")
+	fs.StringVar(&cfg.HistoryBackend, "history-backend", cfg.HistoryBackend, `"redis", "memory", "sqlite" or "postgres" (HISTORY_BACKEND)`)
+	fs.Int64Var(&cfg.HistoryCap, "history-cap", cfg.HistoryCap, "messages kept per room, 0 for unlimited (HISTORY_CAP)")
+	fs.StringVar(&cfg.StaticDir, "static-dir", cfg.StaticDir, "directory of the static files (STATIC_DIR)")
+	fs.StringVar(&cfg.TLSCertFile, "tls-cert", cfg.TLSCertFile, "TLS certificate file (TLS_CERT_FILE)")
+	fs.StringVar(&cfg.TLSKeyFile, "tls-key", cfg.TLSKeyFile, "TLS key file (TLS_KEY_FILE)")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if cfg.RedisURL == "" && cfg.HistoryBackend == "redis" {
+		cfg.RedisURL = defaultRedisURL
+	}
+
+	p.fail(cfg.Validate())
+	return cfg, errors.Join(p.errs...)
+}
+
+// Validate checks the settings that can be wrong independently of how they
+// were parsed, reporting all the problems together.
+func (cfg Config) Validate() error {
+	var errs []error
+
+	if n, err := strconv.Atoi(cfg.Port); err != nil || n < 1 || n > 65535 {
+		errs = append(errs, fmt.Errorf("PORT: invalid port %q", cfg.Port))
+	}
+	if n, err := strconv.Atoi(cfg.IRCPort); cfg.IRCPort != "" && (err != nil || n < 1 || n > 65535) {
+		errs = append(errs, fmt.Errorf("IRC_PORT: invalid port %q", cfg.IRCPort))
+	}
+	if n, err := strconv.Atoi(cfg.GRPCPort); cfg.GRPCPort != "" && (err != nil || n < 1 || n > 65535) {
+		errs = append(errs, fmt.Errorf("GRPC_PORT: invalid port %q", cfg.GRPCPort))
+	}
+	if cfg.GRPCPort != "" && cfg.APIToken == "" {
+		errs = append(errs, errors.New("GRPC_PORT requires API_TOKEN"))
+	}
+	if (cfg.VAPIDPublicKey == "") != (cfg.VAPIDPrivateKey == "") {
+		errs = append(errs, errors.New("VAPID_PUBLIC_KEY and VAPID_PRIVATE_KEY must be set together"))
+	} else if cfg.VAPIDPrivateKey != "" {
+		if _, err := parseVAPIDKeys(cfg.VAPIDPublicKey, cfg.VAPIDPrivateKey); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if !strings.HasPrefix(cfg.VAPIDSubject, "mailto:") && !strings.HasPrefix(cfg.VAPIDSubject, "https://") {
+		errs = append(errs, fmt.Errorf("VAPID_SUBJECT: %q is neither a mailto: nor an https: URL", cfg.VAPIDSubject))
+	}
+	if cfg.PushHourlyLimit < 0 {
+		errs = append(errs, errors.New("PUSH_HOURLY_LIMIT must not be negative"))
+	}
+	if cfg.RedisURL != "" {
+		if _, err := redis.ParseURL(cfg.RedisURL); err != nil {
+			errs = append(errs, fmt.Errorf("REDIS_URL: %w", err))
+		}
+	} else {
+		// the settings whose features keep their state in Redis
+		if cfg.HistoryBackend == "redis" {
+			errs = append(errs, errors.New("HISTORY_BACKEND=redis requires REDIS_URL"))
+		}
+		if cfg.PubSubRelay && cfg.HistoryBackend != "postgres" {
+			errs = append(errs, errors.New("PUBSUB_RELAY=1 requires REDIS_URL unless HISTORY_BACKEND=postgres"))
+		}
+		if cfg.RediSearch {
+			errs = append(errs, errors.New("REDISEARCH=1 requires REDIS_URL"))
+		}
+		if cfg.EventsStream != "" {
+			errs = append(errs, errors.New("EVENTS_ENABLED=1 requires REDIS_URL"))
+		}
+		if cfg.TelegramToken != "" {
+			errs = append(errs, errors.New("TELEGRAM_BOT_TOKEN requires REDIS_URL"))
+		}
+		if cfg.VAPIDPrivateKey != "" {
+			errs = append(errs, errors.New("VAPID_PRIVATE_KEY requires REDIS_URL"))
+		}
+		if cfg.FloodThreshold > 0 {
+			errs = append(errs, errors.New("FLOOD_THRESHOLD requires REDIS_URL"))
+		}
+	}
+	switch cfg.HistoryBackend {
+	case "redis", "memory", "sqlite":
+	case "postgres":
+		if cfg.DatabaseURL == "" {
+			errs = append(errs, errors.New("HISTORY_BACKEND=postgres requires DATABASE_URL"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("HISTORY_BACKEND: unknown backend %q", cfg.HistoryBackend))
+	}
+	if cfg.HistoryCap < 0 {
+		errs = append(errs, errors.New("HISTORY_CAP: must not be negative"))
+	}
+	if cfg.MaxUsernameLen < 1 {
+		errs = append(errs, errors.New("USERNAME_MAX_LENGTH: must be positive"))
+	}
+	if cfg.HistoryMaxBytes < 0 {
+		errs = append(errs, errors.New("HISTORY_MAX_BYTES: must not be negative"))
+	}
+	if cfg.HistoryMaxBytes > 0 && cfg.HistoryBackend != "redis" {
+		errs = append(errs, errors.New("HISTORY_MAX_BYTES requires HISTORY_BACKEND=redis"))
+	}
+	if cfg.WriteBehind {
+		if cfg.HistoryBackend != "redis" {
+			errs = append(errs, errors.New("WRITE_BEHIND=1 requires HISTORY_BACKEND=redis"))
+		}
+		if cfg.WriteBehindBatch < 1 {
+			errs = append(errs, errors.New("WRITE_BEHIND_BATCH: must be positive"))
+		}
+		if cfg.WriteBehindInterval <= 0 {
+			errs = append(errs, errors.New("WRITE_BEHIND_INTERVAL: must be positive"))
+		}
+	}
+	if cfg.SearchScanBudget <= 0 {
+		errs = append(errs, errors.New("SEARCH_SCAN_BUDGET: must be positive"))
+	}
+	if cfg.ResumeTTL <= 0 {
+		errs = append(errs, errors.New("RESUME_TOKEN_TTL: must be positive"))
+	}
+	if cfg.MaxFrameSize < 0 {
+		errs = append(errs, errors.New("MAX_FRAME_SIZE: must not be negative"))
+	}
+	if cfg.RetentionInterval < 0 {
+		errs = append(errs, errors.New("RETENTION_INTERVAL: must not be negative"))
+	}
+	if cfg.UsernameNFKC && !nfkcAvailable {
+		errs = append(errs, errors.New("USERNAME_NFKC=1 requires a binary built with -tags nfkc"))
+	}
+	if cfg.DuplicateWindow > 0 && cfg.DuplicateHistory <= 0 {
+		errs = append(errs, errors.New("DUPLICATE_HISTORY: must be positive"))
+	}
+	if cfg.AttachmentMaxSize <= 0 {
+		errs = append(errs, errors.New("ATTACHMENT_MAX_SIZE: must be positive"))
+	}
+	if cfg.SendQueue <= 0 {
+		errs = append(errs, errors.New("SEND_QUEUE: must be positive"))
+	}
+	if cfg.HandshakeLimit > 0 && cfg.HandshakeWindow <= 0 {
+		errs = append(errs, errors.New("HANDSHAKE_WINDOW: must be positive"))
+	}
+	if cfg.FloodThreshold > 0 {
+		if cfg.FloodWindow <= 0 || cfg.FloodMute <= 0 || cfg.FloodMuteMax <= 0 {
+			errs = append(errs, errors.New("FLOOD_WINDOW, FLOOD_MUTE and FLOOD_MUTE_MAX: must be positive"))
+		}
+		if cfg.FloodMuteFactor < 1 {
+			errs = append(errs, errors.New("FLOOD_MUTE_FACTOR: must be at least 1"))
+		}
+	}
+
+	for _, o := range cfg.WSOrigins {
+		if u, err := url.Parse(o); o != "*" && (err != nil || u.Scheme == "" || u.Host == "" || u.Path != "") {
+			errs = append(errs, fmt.Errorf("WS_ALLOWED_ORIGINS: %q is not an origin", o))
+		}
+	}
+
+	if fi, err := os.Stat(cfg.StaticDir); err != nil || !fi.IsDir() {
+		errs = append(errs, fmt.Errorf("STATIC_DIR: %q is not a directory", cfg.StaticDir))
+	}
+
+	if cfg.ListenAddr == "unix:" {
+		errs = append(errs, errors.New("LISTEN_ADDR: unix: needs a socket path"))
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		errs = append(errs, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+	if len(cfg.AutocertDomains) > 0 && cfg.TLSCertFile != "" {
+		errs = append(errs, errors.New("AUTOCERT_DOMAINS can't be combined with TLS_CERT_FILE"))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestValidateRedisURL checks which settings need Redis.
+func TestValidateRedisURL(t *testing.T) {
+	t.Setenv("REDIS_URL", "")
+	t.Setenv("HISTORY_BACKEND", "memory")
+	base := loadTestConfig(t)
+
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   string
+	}{
+		{"memory backend", func(*Config) {}, ""},
+		{"sqlite backend", func(cfg *Config) { cfg.HistoryBackend = "sqlite" }, ""},
+		{"postgres relay", func(cfg *Config) {
+			cfg.HistoryBackend, cfg.DatabaseURL, cfg.PubSubRelay = "postgres", "postgres://localhost/chat", true
+		}, ""},
+		{"redis backend", func(cfg *Config) { cfg.HistoryBackend = "redis" }, "HISTORY_BACKEND=redis requires REDIS_URL"},
+		{"redis relay", func(cfg *Config) { cfg.PubSubRelay = true }, "PUBSUB_RELAY=1 requires REDIS_URL"},
+		{"redisearch", func(cfg *Config) { cfg.RediSearch = true }, "REDISEARCH=1 requires REDIS_URL"},
+		{"flood guard", func(cfg *Config) { cfg.FloodThreshold = 3 }, "FLOOD_THRESHOLD requires REDIS_URL"},
+		{"invalid url", func(cfg *Config) { cfg.RedisURL = "http://example.com" }, "REDIS_URL:"},
+		{"valid url", func(cfg *Config) { cfg.RedisURL = "redis://localhost:6379" }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			tt.change(&cfg)
+
+			err := cfg.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestLoadConfigRedisURL checks that only the redis backend defaults to a
+// local Redis instance.
+func TestLoadConfigRedisURL(t *testing.T) {
+	tests := []struct {
+		backend string
+		want    string
+	}{
+		{"redis", defaultRedisURL},
+		{"memory", ""},
+		{"sqlite", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.backend, func(t *testing.T) {
+			t.Setenv("REDIS_URL", "")
+			t.Setenv("HISTORY_BACKEND", tt.backend)
+			if cfg := loadTestConfig(t); cfg.RedisURL != tt.want {
+				t.Errorf("RedisURL = %q, want %q", cfg.RedisURL, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package chat
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// corsConfig is the cross-origin policy of the HTTP API. The WebSocket
+// endpoint has its own origin check, checkOrigin.
+type corsConfig struct {
+	// origins are the allowed origins, "*" allowing any. CORS is off when
+	// it is empty.
+	origins []string
+	methods string
+	headers string
+}
+
+// loadCORSConfig reads CORS_ALLOWED_ORIGINS, CORS_ALLOWED_METHODS and
+// CORS_ALLOWED_HEADERS, all comma-separated.
+func loadCORSConfig() corsConfig {
+	cfg := corsConfig{
+		methods: "GET, POST, DELETE",
+		headers: "Authorization, Content-Type, X-API-Key",
+	}
+
+	for _, o := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			cfg.origins = append(cfg.origins, o)
+		}
+	}
+	if v := os.Getenv("CORS_ALLOWED_METHODS"); v != "" {
+		cfg.methods = v
+	}
+	if v := os.Getenv("CORS_ALLOWED_HEADERS"); v != "" {
+		cfg.headers = v
+	}
+
+	return cfg
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for origin, or
+// "" when it isn't allowed.
+func (cfg corsConfig) allowedOrigin(origin string) string {
+	for _, o := range cfg.origins {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// cors adds CORS headers to the responses of next and answers preflight
+// requests, leaving the WebSocket endpoint alone.
+func (s *Server) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		cfg := s.settings().cors
+		if len(cfg.origins) == 0 || origin == "" || r.URL.Path == "/websocket" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowed := cfg.allowedOrigin(origin)
+		if allowed != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed != "" {
+				w.Header().Set("Access-Control-Allow-Methods", cfg.methods)
+				w.Header().Set("Access-Control-Allow-Headers", cfg.headers)
+				w.Header().Set("Access-Control-Max-Age", "600")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkOrigin is the origin check of the WebSocket upgrader. It allows the
+// origins in WS_ALLOWED_ORIGINS, and any when there are none. Requests not
+// sending an Origin header don't come from a browser, and are allowed.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	origins := s.settings().wsOrigins
+	if origin == "" || len(origins) == 0 {
+		return true
+	}
+	for _, o := range origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package chat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name      string
+		origins   string
+		method    string
+		path      string
+		origin    string
+		preflight bool
+
+		wantCode    int
+		wantOrigin  string
+		wantMethods string
+	}{
+		{"off", "", http.MethodGet, "/api/rooms", "https://app.example", false, http.StatusOK, "", ""},
+		{"no origin", "https://app.example", http.MethodGet, "/api/rooms", "", false, http.StatusOK, "", ""},
+		{"allowed", "https://app.example", http.MethodGet, "/api/rooms", "https://APP.example", false, http.StatusOK, "https://APP.example", ""},
+		{"any", "*", http.MethodGet, "/api/rooms", "https://app.example", false, http.StatusOK, "*", ""},
+		{"disallowed", "https://app.example", http.MethodGet, "/api/rooms", "https://evil.example", false, http.StatusOK, "", ""},
+		{"preflight", "https://app.example, https://other.example", http.MethodOptions, "/send", "https://other.example", true, http.StatusNoContent, "https://other.example", "GET, POST, DELETE"},
+		{"disallowed preflight", "https://app.example", http.MethodOptions, "/send", "https://evil.example", true, http.StatusNoContent, "", ""},
+		{"websocket", "*", http.MethodGet, "/websocket", "https://app.example", false, http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CORS_ALLOWED_ORIGINS", tt.origins)
+			s, _ := newTestServer(t)
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /api/rooms", s.handleListRooms)
+			mux.HandleFunc("POST /send", s.handleSend)
+			mux.HandleFunc("/websocket", s.HandleConnetions)
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			rec := httptest.NewRecorder()
+			s.cors(mux).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Errorf("status %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin %q, want %q", got, tt.wantOrigin)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Methods"); got != tt.wantMethods {
+				t.Errorf("Access-Control-Allow-Methods %q, want %q", got, tt.wantMethods)
+			}
+		})
+	}
+}
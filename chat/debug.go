@@ -0,0 +1,82 @@
+package chat
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// mountDebug adds the pprof handlers and a hub snapshot under /debug/, all
+// of them requiring the admin token.
+func (s *Server) mountDebug(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", s.adminOnly(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", s.adminOnly(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", s.adminOnly(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", s.adminOnly(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", s.adminOnly(pprof.Trace))
+	mux.HandleFunc("GET /debug/hub", s.adminOnly(s.handleDebugHub))
+}
+
+// HubSnapshot is the state of the hub as dumped by /debug/hub.
+type HubSnapshot struct {
+	Clients int            `json:"clients"`
+	Rooms   map[string]int `json:"rooms"`
+	Users   int            `json:"users"`
+
+	// Monitors are the connections to the monitor feed, which Clients
+	// leaves out.
+	Monitors int `json:"monitors"`
+
+	// Replaying counts the clients still being sent their history, whose
+	// live frames are queued meanwhile, PendingFrames in total.
+	Replaying     int `json:"replaying"`
+	PendingFrames int `json:"pending_frames"`
+
+	// OpsQueue and AuditQueue are the lengths of the hub's op channel and
+	// the audit log queue.
+	OpsQueue   int `json:"ops_queue"`
+	AuditQueue int `json:"audit_queue"`
+
+	OldestConnectionSeconds float64 `json:"oldest_connection_seconds"`
+}
+
+// hubSnapshot collects a HubSnapshot on the hub.
+func (s *Server) hubSnapshot() HubSnapshot {
+	reply := make(chan HubSnapshot, 1)
+
+	s.ops <- func(h *hub) {
+		var snap HubSnapshot
+		defer func() { reply <- snap }()
+
+		snap = HubSnapshot{
+			Clients:  len(h.clients),
+			Rooms:    make(map[string]int),
+			Users:    len(h.users),
+			Monitors: len(h.monitors),
+			OpsQueue: len(s.ops),
+		}
+
+		var oldest time.Time
+		for c := range h.clients {
+			snap.Rooms[c.room]++
+			if c.pending != nil {
+				snap.Replaying++
+				snap.PendingFrames += len(c.pending)
+			}
+			if oldest.IsZero() || c.connectedAt.Before(oldest) {
+				oldest = c.connectedAt
+			}
+		}
+		if !oldest.IsZero() {
+			snap.OldestConnectionSeconds = time.Since(oldest).Seconds()
+		}
+	}
+
+	snap := <-reply
+	snap.AuditQueue = len(s.auditLog)
+	return snap
+}
+
+func (s *Server) handleDebugHub(w http.ResponseWriter, r *http.Request) {
+	writeJSONResponse(w, http.StatusOK, s.hubSnapshot())
+}
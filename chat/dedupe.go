@@ -0,0 +1,80 @@
+package chat
+
+import (
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// Policies for a connection claiming a username that is already online.
+const (
+	// duplicateAllow lets any number of connections share a username.
+	duplicateAllow = "allow"
+
+	// duplicateReject turns the new connection away.
+	duplicateReject = "reject"
+
+	// duplicateReplace closes the older connection, last writer wins.
+	duplicateReplace = "replace"
+)
+
+func parseDuplicatePolicy(v string) (string, error) {
+	switch v {
+	case "":
+		return duplicateAllow, nil
+	case duplicateAllow, duplicateReject, duplicateReplace:
+		return v, nil
+	}
+	return "", fmt.Errorf("DUPLICATE_USERS: unknown policy %q", v)
+}
+
+// claimUsername registers the username c connected with, applying the
+// duplicate policy. It reports false when c must be turned away. It runs on
+// the hub.
+func (s *Server) claimUsername(h *hub, c *Client) bool {
+	// subscriptions go by the claim of their connection
+	if c.claimed == "" || c.parent != nil {
+		return true
+	}
+
+	old, ok := h.users[c.claimed]
+	if ok {
+		c.recent = old.recent
+	}
+	// the channels of an IRC session share its claim
+	if ok && c.session != nil && old.session == c.session {
+		return true
+	}
+	if ok && s.duplicateUsers != duplicateAllow {
+		if s.duplicateUsers == duplicateReject {
+			closeClient(c, websocket.ClosePolicyViolation, "username already connected")
+			return false
+		}
+
+		removeClient(h, old, websocket.ClosePolicyViolation, "connected from another session")
+		s.audit(AuditEntry{Action: auditKick, Actor: auditActorServer, Target: old.claimed, Room: old.room, IP: old.ip, Reason: "replaced"})
+	}
+
+	h.users[c.claimed] = c
+	return true
+}
+
+// releaseUsername forgets the claim of c, unless a newer connection took it
+// over, or hands it to another channel of its IRC session. It runs on the
+// hub.
+func releaseUsername(h *hub, c *Client) {
+	if c.claimed == "" || h.users[c.claimed] != c {
+		return
+	}
+	delete(h.users, c.claimed)
+
+	if c.session == nil {
+		return
+	}
+	for other := range h.clients {
+		if other != c && other.session == c.session {
+			h.users[c.claimed] = other
+			return
+		}
+	}
+}
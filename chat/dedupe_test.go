@@ -0,0 +1,79 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseDuplicatePolicy(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{"", duplicateAllow, false},
+		{"allow", duplicateAllow, false},
+		{"reject", duplicateReject, false},
+		{"replace", duplicateReplace, false},
+		{"Reject", "", true},
+		{"kick", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseDuplicatePolicy(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseDuplicatePolicy(%q) = %q, %v, want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// closedWith reads from ws until it is closed and returns the close code, or
+// 0 when ws stays open.
+func closedWith(t *testing.T, ws *websocket.Conn) int {
+	t.Helper()
+
+	ws.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			if ce, ok := err.(*websocket.CloseError); ok {
+				return ce.Code
+			}
+			return 0
+		}
+	}
+}
+
+func TestDuplicateUsers(t *testing.T) {
+	tests := []struct {
+		policy           string
+		oldCode, newCode int
+		wantClients      int
+	}{
+		{duplicateAllow, 0, 0, 2},
+		{duplicateReject, 0, websocket.ClosePolicyViolation, 1},
+		{duplicateReplace, websocket.ClosePolicyViolation, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			t.Setenv("DUPLICATE_USERS", tt.policy)
+			s, _ := newTestServer(t)
+			old := dialTestServer(t, s, "room=general&username=ann")
+			waitClients(t, s, 1)
+			fresh := dialTestServer(t, s, "room=general&username=ann")
+
+			if got := closedWith(t, fresh); got != tt.newCode {
+				t.Errorf("new connection closed with %d, want %d", got, tt.newCode)
+			}
+			if got := closedWith(t, old); got != tt.oldCode {
+				t.Errorf("old connection closed with %d, want %d", got, tt.oldCode)
+			}
+			waitClients(t, s, tt.wantClients)
+
+			done := make(chan *Client)
+			s.ops <- func(h *hub) { done <- h.users["ann"] }
+			if c := <-done; c == nil {
+				t.Error("ann no longer online")
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package chat
+
+import "time"
+
+// deliveryWindow is the most messages kept for a client until it acks them.
+// Older ones are dropped, so a client falling further behind only gets them
+// through the history replay.
+const deliveryWindow = 256
+
+// messageTypeDelivery hands a client opting into acks the ID to reconnect
+// with, so that it gets resent what it didn't ack.
+const messageTypeDelivery = "delivery"
+
+type deliveryFrame struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Window int    `json:"window"`
+}
+
+// deliveryLog keeps the chat messages sent to a client opting into acks
+// that it hasn't acked yet, in the order of their room seq. When the client
+// goes away with messages unacked, the log is parked on the hub until the
+// resume TTL is over, for the client to reconnect to with ?acks=<id>. Logs
+// are kept in memory, so only a reconnection to the same instance gets the
+// resend. They are owned by the hub.
+type deliveryLog struct {
+	id       string
+	username string
+	room     string
+
+	unacked []ChatMessage
+
+	// parkedAt is when the client of a parked log went away.
+	parkedAt time.Time
+}
+
+// attachDelivery gives c the log parked under id, resending what it holds,
+// or a new one when there is no such log for c's username and room. It
+// runs on the hub.
+func attachDelivery(h *hub, c *Client, id string) {
+	d := h.deliveries[id]
+	if d != nil && d.username == c.claimed && d.room == c.room {
+		delete(h.deliveries, id)
+		c.logger.Info("resending unacked messages", "count", len(d.unacked))
+		for _, m := range d.unacked {
+			c.deliver(m.ID, m)
+		}
+	} else {
+		d = &deliveryLog{id: newToken(), username: c.claimed, room: c.room}
+	}
+	c.delivery = d
+
+	c.deliver("", deliveryFrame{Type: messageTypeDelivery, ID: d.id, Window: deliveryWindow})
+}
+
+// parkDelivery keeps the log of c, which went away, if it holds unacked
+// messages. It runs on the hub.
+func parkDelivery(h *hub, c *Client) {
+	d := c.delivery
+	if d == nil || len(d.unacked) == 0 {
+		return
+	}
+	d.parkedAt = time.Now()
+	h.deliveries[d.id] = d
+}
+
+// expireDeliveries drops the logs parked for longer than the resume TTL.
+// It runs on the hub.
+func (s *Server) expireDeliveries(h *hub) {
+	for id, d := range h.deliveries {
+		if time.Since(d.parkedAt) > s.resumeTTL {
+			delete(h.deliveries, id)
+		}
+	}
+}
+
+// deliverMessage sends the chat message msg to c, keeping it until acked
+// when c acks what it receives. The clients msg is broadcast to share its
+// encodings through frames. It runs on the hub.
+func (c *Client) deliverMessage(msg ChatMessage, frames frameCache) error {
+	m := msg.forVersion(c.version)
+	if d := c.delivery; d != nil {
+		if len(d.unacked) == deliveryWindow {
+			c.logger.Debug("delivery window full, dropping oldest unacked message", "seq", d.unacked[0].Seq)
+			d.unacked = append(d.unacked[:0], d.unacked[1:]...)
+		}
+		d.unacked = append(d.unacked, m)
+	}
+	return c.deliver(msg.ID, frames.frame(c, m))
+}
+
+// handleAck forgets the messages c acked, every one up to seq.
+func (s *Server) handleAck(c *Client, seq int64) {
+	s.ops <- func(h *hub) {
+		d := c.delivery
+		if d == nil {
+			return
+		}
+		n := 0
+		for n < len(d.unacked) && d.unacked[n].Seq <= seq {
+			n++
+		}
+		d.unacked = append(d.unacked[:0], d.unacked[n:]...)
+	}
+}
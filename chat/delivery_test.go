@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeliveryWindow(t *testing.T) {
+	c := newFakeClient(newFakeConn(false), 0)
+	c.send = make(chan pendingFrame, deliveryWindow+1)
+	c.stop = make(chan struct{})
+	c.delivery = &deliveryLog{id: "d1"}
+
+	for seq := int64(1); seq <= deliveryWindow+1; seq++ {
+		if err := c.deliverMessage(ChatMessage{Type: messageTypeChat, Seq: seq}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unacked := c.delivery.unacked
+	if len(unacked) != deliveryWindow || unacked[0].Seq != 2 {
+		t.Errorf("%d unacked from seq %d, want %d from seq 2", len(unacked), unacked[0].Seq, deliveryWindow)
+	}
+}
+
+// TestDeliveryResend checks that the messages a client didn't ack are sent
+// again when it reconnects with its delivery ID, and only those.
+func TestDeliveryResend(t *testing.T) {
+	tests := []struct {
+		name       string
+		acked      int // messages acked of the three sent
+		wantResent []string
+	}{
+		{"dropped", 1, []string{"two", "three"}},
+		{"none acked", 0, []string{"one", "two", "three"}},
+		{"all acked", 3, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			// without the history replay, only the resend brings messages back
+			opts := s.newRoomOptions()
+			opts.Replay = false
+			if _, err := s.createRoom(context.Background(), "general", opts, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+			bob := dialTestServer(t, s, "room=general&username=bob&acks=new", "chat.v2")
+			var d deliveryFrame
+			readFrameInto(t, bob, messageTypeDelivery, &d)
+			if d.ID == "" || d.Window != deliveryWindow {
+				t.Fatalf("delivery frame %+v", d)
+			}
+			waitClients(t, s, 2)
+
+			var got []ChatMessage
+			for _, text := range []string{"one", "two", "three"} {
+				if err := ann.WriteJSON(ChatMessage{Text: text}); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, readFrameOf(t, bob, messageTypeChat, nil))
+			}
+			if tt.acked > 0 {
+				if err := bob.WriteJSON(ChatMessage{Type: messageTypeAck, Seq: got[tt.acked-1].Seq}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			bob.Close()
+			waitClients(t, s, 1)
+
+			bob = dialTestServer(t, s, "room=general&username=bob&acks="+d.ID, "chat.v2")
+			var resent []string
+			bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				var msg ChatMessage
+				if err := bob.ReadJSON(&msg); err != nil {
+					t.Fatal(err)
+				}
+				if msg.Type == messageTypeChat {
+					resent = append(resent, msg.Text)
+				}
+				if msg.Type == messageTypeDelivery {
+					// a log with nothing left to resend isn't kept
+					if resumed := msg.ID == d.ID; resumed != (tt.wantResent != nil) {
+						t.Errorf("resumed the delivery log %v, want %v", resumed, tt.wantResent != nil)
+					}
+					break
+				}
+			}
+			if strings.Join(resent, ",") != strings.Join(tt.wantResent, ",") {
+				t.Errorf("resent %q, want %q", resent, tt.wantResent)
+			}
+		})
+	}
+}
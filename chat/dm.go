@@ -0,0 +1,153 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"slices"
+)
+
+// The statuses of a direct message, in the order it goes through them: sent
+// once stored, delivered once written to a connection of its recipient, and
+// read once the recipient's read marker passes it.
+const (
+	dmSent      = "sent"
+	dmDelivered = "delivered"
+	dmRead      = "read"
+)
+
+var dmStatuses = []string{dmSent, dmDelivered, dmRead}
+
+// statusesBefore returns the statuses a direct message moves on to status
+// from. Statuses only move forward, so that every instance and connection
+// may report what it saw, in any order.
+func statusesBefore(status string) []string {
+	i := slices.Index(dmStatuses, status)
+	if i < 0 {
+		return nil
+	}
+	return dmStatuses[:i]
+}
+
+// dmReadWindow is how many messages before the one a read frame references
+// are looked at for direct messages to mark read.
+const dmReadWindow = 100
+
+// messageTypeStatus tells the sender of a direct message how far it got.
+const messageTypeStatus = "status"
+
+type statusFrame struct {
+	Type      string `json:"type"`
+	Room      string `json:"room"`
+	MessageID string `json:"message_id"`
+	To        string `json:"to"`
+	Status    string `json:"status"`
+}
+
+// visibleTo reports whether user may see m: everyone sees the messages of a
+// room, but only its sender and recipient see a direct message.
+func (m ChatMessage) visibleTo(user string) bool {
+	return m.To == "" || user != "" && (user == m.Username || user == m.To)
+}
+
+// visibleMessages drops from msgs the direct messages user may not see.
+func visibleMessages(msgs []ChatMessage, user string) []ChatMessage {
+	return slices.DeleteFunc(msgs, func(msg ChatMessage) bool {
+		return !msg.visibleTo(user)
+	})
+}
+
+// requester is the user behind r, whose direct messages it may read, or ""
+// when it can't tell. Without an Authenticator verifying users, it never can.
+func (s *Server) requester(r *http.Request) string {
+	if !s.verifiesUsers() {
+		return ""
+	}
+	user, _, err := s.auth.Authenticate(r)
+	if err != nil {
+		return ""
+	}
+	if user, err = s.normalizeUsername(user); err != nil {
+		return ""
+	}
+	return user
+}
+
+// advanceStatus moves direct message msg on to status and, if it wasn't
+// there already, tells the connections of its sender, on every instance.
+// It blocks on the store and the hub, so it doesn't run on the hub.
+func (s *Server) advanceStatus(msg ChatMessage, status string) {
+	ctx, cancel := context.WithTimeout(s.lifetime, storeTimeout)
+	defer cancel()
+
+	moved, err := s.store.SetStatus(ctx, msg.ID, status)
+	if err != nil {
+		s.logger.Error("updating message status", "id", msg.ID, "status", status, "err", err)
+		return
+	}
+	if !moved {
+		return
+	}
+
+	update := ChatMessage{Type: messageTypeStatus, Room: msg.Room, Username: msg.Username, To: msg.To, MessageID: msg.ID, Status: status}
+	s.ops <- func(h *hub) {
+		broadcastStatus(h, update)
+	}
+	s.relay(update)
+}
+
+// broadcastStatus tells the connections of the sender of a direct message
+// its new status, which update carries. Subscriptions share the connection
+// of their parent, which is told once. It runs on the hub.
+func broadcastStatus(h *hub, update ChatMessage) {
+	f := statusFrame{Type: messageTypeStatus, Room: update.Room, MessageID: update.MessageID, To: update.To, Status: update.Status}
+
+	var failed []*Client
+	for c := range h.clients {
+		if c.claimed != update.Username || c.parent != nil || c.version < protocolV2 {
+			continue
+		}
+		if err := c.deliver("", f); err != nil && unsafeError(err) {
+			c.logger.Warn("sending message status", "err", err)
+			failed = append(failed, c)
+		}
+	}
+	for _, c := range failed {
+		removeClient(h, c, 0, "")
+	}
+}
+
+// markDirectRead marks read the direct messages to user in room up to
+// message id, which user just read. Those up to prev, the read marker
+// before, were marked already, and only the last dmReadWindow messages are
+// looked at.
+func (s *Server) markDirectRead(ctx context.Context, room, user, prev, id string) error {
+	rank, err := s.store.Rank(ctx, room, id)
+	if err == errMessageNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	start := max(rank-dmReadWindow+1, 0)
+	if prev != "" {
+		if prevRank, err := s.store.Rank(ctx, room, prev); err == nil {
+			start = max(start, prevRank+1)
+		}
+	}
+	if start > rank {
+		return nil
+	}
+
+	msgs, err := s.store.Range(ctx, room, start, rank)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if msg.To == user && msg.Status != dmRead {
+			msg.Room = room
+			s.advanceStatus(msg, dmRead)
+		}
+	}
+	return nil
+}
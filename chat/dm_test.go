@@ -0,0 +1,303 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// vouchingAuth takes the username the client asks for, like NoAuth, but as
+// an Authenticator verifying it would, so that direct messages are allowed.
+type vouchingAuth struct{}
+
+func (vouchingAuth) Authenticate(r *http.Request) (string, []string, error) {
+	return r.URL.Query().Get("username"), nil, nil
+}
+
+// newDMTestServer starts a test server whose users count as verified.
+func newDMTestServer(t *testing.T) (*Server, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", "redis://"+mr.Addr())
+	cfg := loadTestConfig(t)
+	cfg.Authenticator = vouchingAuth{}
+	return startTestServer(t, cfg), mr
+}
+
+func TestStoreSetStatus(t *testing.T) {
+	for name, open := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := open()
+
+			dm := ChatMessage{Username: "ann", Text: "psst", To: "bob", Status: dmSent}
+			if err := store.Append(ctx, "general", &dm); err != nil {
+				t.Fatal(err)
+			}
+			public := ChatMessage{Username: "ann", Text: "hi"}
+			if err := store.Append(ctx, "general", &public); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, tt := range []struct {
+				id, status string
+				moved      bool
+				want       string
+			}{
+				{dm.ID, dmDelivered, true, dmDelivered},
+				{dm.ID, dmDelivered, false, dmDelivered},
+				{dm.ID, dmSent, false, dmDelivered},
+				{dm.ID, dmRead, true, dmRead},
+				{dm.ID, dmDelivered, false, dmRead},
+				{dm.ID, "lost", false, dmRead},
+				{public.ID, dmDelivered, false, ""},
+				{"999", dmDelivered, false, ""},
+			} {
+				moved, err := store.SetStatus(ctx, tt.id, tt.status)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if moved != tt.moved {
+					t.Errorf("SetStatus(%s, %s) = %v, want %v", tt.id, tt.status, moved, tt.moved)
+				}
+				if tt.id == "999" {
+					continue
+				}
+
+				msg, err := store.Get(ctx, tt.id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				msgs, err := store.Recent(ctx, "general", 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, m := range msgs {
+					if m.ID == tt.id && m.Status != msg.Status {
+						t.Errorf("history has status %q for %s, Get has %q", m.Status, tt.id, msg.Status)
+					}
+				}
+				if msg.Status != tt.want {
+					t.Errorf("after SetStatus(%s, %s), status is %q, want %q", tt.id, tt.status, msg.Status, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageVisibleTo(t *testing.T) {
+	dm := ChatMessage{Username: "ann", To: "bob"}
+	tests := []struct {
+		msg  ChatMessage
+		user string
+		want bool
+	}{
+		{ChatMessage{Username: "ann"}, "", true},
+		{ChatMessage{Username: "ann"}, "carol", true},
+		{dm, "ann", true},
+		{dm, "bob", true},
+		{dm, "carol", false},
+		{dm, "", false},
+	}
+	for _, tt := range tests {
+		if got := tt.msg.visibleTo(tt.user); got != tt.want {
+			t.Errorf("message from %s to %q visibleTo(%q) = %v, want %v", tt.msg.Username, tt.msg.To, tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestDirectMessageStatus(t *testing.T) {
+	s, _ := newDMTestServer(t)
+	ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	bob := dialTestServer(t, s, "room=general&username=bob", "chat.v2")
+	carol := dialTestServer(t, s, "room=general&username=carol", "chat.v2")
+	waitClients(t, s, 3)
+
+	if err := ann.WriteJSON(ChatMessage{Text: "psst", To: " bob "}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ann.WriteJSON(ChatMessage{Text: "hello all"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readFrameOf(t, bob, messageTypeChat, nil)
+	if got.Text != "psst" || got.To != "bob" || got.Status != dmSent {
+		t.Fatalf("bob got %+v, want the direct message, sent", got)
+	}
+	id := got.ID
+	if got := readFrameOf(t, carol, messageTypeChat, nil); got.Text != "hello all" {
+		t.Fatalf("carol got %q first, want only the room message", got.Text)
+	}
+
+	for _, want := range []string{dmDelivered, dmRead} {
+		if want == dmRead {
+			if err := bob.WriteJSON(ChatMessage{Type: messageTypeRead, MessageID: id}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f := readFrameOf(t, ann, messageTypeStatus, func(m ChatMessage) bool { return m.Status == want })
+		if f.MessageID != id || f.To != "bob" || f.Room != "general" {
+			t.Errorf("status frame %+v, want message %s to bob in general", f, id)
+		}
+	}
+
+	for _, tt := range []struct {
+		user string
+		want []string
+	}{
+		{"ann", []string{"psst", "hello all"}},
+		{"bob", []string{"psst", "hello all"}},
+		{"carol", []string{"hello all"}},
+		{"", []string{"hello all"}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/rooms/general/messages?username="+tt.user, nil)
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+
+		var resp historyResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		var texts []string
+		for _, msg := range resp.Messages {
+			texts = append(texts, msg.Text)
+			if msg.To != "" && msg.Status != dmRead {
+				t.Errorf("history of %q has status %q, want %q", tt.user, msg.Status, dmRead)
+			}
+		}
+		if len(texts) != len(tt.want) || len(texts) > 0 && texts[0] != tt.want[0] {
+			t.Errorf("history of %q = %q, want %q", tt.user, texts, tt.want)
+		}
+	}
+}
+
+// TestDirectMessageInbox checks that a direct message to a user who isn't
+// connected is delivered once they connect and catch up.
+func TestDirectMessageInbox(t *testing.T) {
+	s, _ := newDMTestServer(t)
+	ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	waitClients(t, s, 1)
+
+	if err := ann.WriteJSON(ChatMessage{Text: "later", To: "dave"}); err != nil {
+		t.Fatal(err)
+	}
+	ack := readFrameOf(t, ann, messageTypeAck, nil)
+
+	msg, err := s.store.Get(context.Background(), ack.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Status != dmSent {
+		t.Fatalf("stored with status %q, want %q", msg.Status, dmSent)
+	}
+
+	dave := dialTestServer(t, s, "room=general&username=dave", "chat.v2")
+	if got := readFrameOf(t, dave, messageTypeChat, nil); got.ID != ack.ID {
+		t.Fatalf("dave caught up on %s, want %s", got.ID, ack.ID)
+	}
+	readFrameOf(t, ann, messageTypeStatus, func(m ChatMessage) bool {
+		return m.MessageID == ack.ID && m.Status == dmDelivered
+	})
+}
+
+func TestDirectMessageRejected(t *testing.T) {
+	s, _ := newDMTestServer(t)
+	tests := []struct {
+		name, query string
+		msg         ChatMessage
+		code        string
+	}{
+		{"anonymous", "room=general", ChatMessage{Username: "ann", Text: "psst", To: "bob"}, "anonymous"},
+		{"to self", "room=general&username=ann", ChatMessage{Text: "psst", To: "ann"}, "invalid_recipient"},
+		{"invalid recipient", "room=general&username=ann", ChatMessage{Text: "psst", To: "bo\u200bb"}, "invalid_recipient"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := dialTestServer(t, s, tt.query, "chat.v2")
+			if err := ws.WriteJSON(tt.msg); err != nil {
+				t.Fatal(err)
+			}
+
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				var f errorFrame
+				if err := ws.ReadJSON(&f); err != nil {
+					t.Fatal(err)
+				}
+				if f.Type == messageTypeChat {
+					t.Fatal("the direct message was sent")
+				}
+				if f.Type == messageTypeError {
+					if f.Code != tt.code {
+						t.Errorf("error %q, want %q", f.Code, tt.code)
+					}
+					return
+				}
+			}
+		})
+	}
+}
+
+// TestDirectMessagesWithoutAuth checks that without an Authenticator
+// verifying users, who could then claim the recipient's name, direct
+// messages are refused, and those stored before are shown to nobody.
+func TestDirectMessagesWithoutAuth(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	if err := ann.WriteJSON(ChatMessage{Text: "psst", To: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	ann.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var f errorFrame
+		if err := ann.ReadJSON(&f); err != nil {
+			t.Fatal(err)
+		}
+		if f.Type == messageTypeChat {
+			t.Fatal("the direct message was sent")
+		}
+		if f.Type == messageTypeError {
+			if f.Code != "unsupported" {
+				t.Errorf("error %q, want %q", f.Code, "unsupported")
+			}
+			break
+		}
+	}
+
+	ctx := context.Background()
+	dm := ChatMessage{Username: "ann", Text: "psst", To: "bob", Status: dmSent, Timestamp: time.Now().UnixMilli()}
+	if err := s.store.Append(ctx, "general", &dm); err != nil {
+		t.Fatal(err)
+	}
+	public := ChatMessage{Username: "ann", Text: "hello all", Timestamp: time.Now().UnixMilli()}
+	if err := s.store.Append(ctx, "general", &public); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		"/api/rooms/general/messages?username=bob",
+		"/api/messages/" + dm.ID + "?username=bob",
+		"/api/messages/" + dm.ID + "/replies?username=bob",
+		"/api/search?room=general&q=psst&username=bob",
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		if body := rec.Body.String(); strings.Contains(body, "psst") {
+			t.Errorf("%s shows the direct message: %d %s", path, rec.Code, body)
+		}
+	}
+
+	bob := dialTestServer(t, s, "room=general&username=bob", "chat.v2")
+	if got := readFrameOf(t, bob, messageTypeChat, nil); got.Text != "hello all" {
+		t.Errorf("bob was replayed %q first, want only the room message", got.Text)
+	}
+}
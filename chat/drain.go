@@ -0,0 +1,165 @@
+package chat
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const messageTypeSystem = "system"
+
+// systemFrame is a server notice sent to clients, such as a reconnect advice.
+type systemFrame struct {
+	Type string `json:"type"`
+	Code string `json:"code"`
+	Text string `json:"text"`
+}
+
+// forVersion renders the notice as a chat message from "system" for clients
+// that don't know about frame types.
+func (f systemFrame) forVersion(version int) interface{} {
+	if version < protocolV2 {
+		return ChatMessage{Username: "system", Text: f.Text}
+	}
+	return f
+}
+
+// broadcastSystem sends a system notice to every client in room, or to every
+// client when room is empty. It must run inside a hub op.
+func broadcastSystem(h *hub, room, code, text string) {
+	f := systemFrame{Type: messageTypeSystem, Code: code, Text: text}
+
+	var failed []*Client
+	for c := range h.clients {
+		if room != "" && c.room != room {
+			continue
+		}
+
+		err := c.deliver("", f.forVersion(c.version))
+		if err != nil && unsafeError(err) {
+			c.logger.Warn("sending system notice", "err", err)
+			failed = append(failed, c)
+		}
+	}
+	for _, c := range failed {
+		removeClient(h, c, 0, "")
+	}
+}
+
+// drain takes the server out of rotation: new connections are refused,
+// connected clients are told to reconnect elsewhere and, once the grace
+// period is over, closed with code. Messages keep flowing normally meanwhile.
+// It reports false when undrain cancelled it before the clients were closed.
+// The server stays out of rotation until undrain is called.
+func (s *Server) drain(code int, reason string) bool {
+	s.drainMu.Lock()
+	if s.drainCancel == nil {
+		s.drainCancel = make(chan struct{})
+		s.draining.Store(true)
+
+		s.logger.Info("draining", "grace_period", s.drainGracePeriod)
+		s.ops <- func(h *hub) {
+			broadcastSystem(h, "", "reconnect", "This server is going away, please reconnect.")
+		}
+	}
+	cancel := s.drainCancel
+	s.drainMu.Unlock()
+
+	select {
+	case <-time.After(s.drainGracePeriod):
+	case <-cancel:
+		return false
+	}
+
+	done := make(chan struct{})
+	s.ops <- func(h *hub) {
+		defer close(done)
+
+		clients := make([]*Client, 0, len(h.clients))
+		for c := range h.clients {
+			clients = append(clients, c)
+		}
+		for _, c := range clients {
+			removeClient(h, c, code, reason)
+		}
+	}
+	<-done
+
+	s.logger.Info("drained")
+	return true
+}
+
+// undrain puts the server back into rotation, cancelling a drain still in
+// its grace period. It reports false when the server is shutting down.
+func (s *Server) undrain() bool {
+	if s.shuttingDown.Load() {
+		return false
+	}
+
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+
+	if s.drainCancel != nil {
+		close(s.drainCancel)
+		s.drainCancel = nil
+		s.draining.Store(false)
+		s.logger.Info("accepting connections again")
+	}
+	return true
+}
+
+// Shutdown drains the server for good and cancels the work still bound to
+// it, then closes Drained so that the process can exit. Calling it again just waits.
+func (s *Server) Shutdown() {
+	if !s.shuttingDown.CompareAndSwap(false, true) {
+		<-s.drained
+		return
+	}
+
+	s.drain(websocket.CloseServiceRestart, "server restarting")
+	s.writeBehind.close()
+	s.telegram.close()
+	s.stop()
+	close(s.drained)
+}
+
+// ToggleDrain drains the server, or puts it back into rotation when it is
+// draining already.
+func (s *Server) ToggleDrain() {
+	if s.draining.Load() {
+		s.undrain()
+	} else {
+		go s.drain(websocket.CloseTryAgainLater, "try again later")
+	}
+}
+
+// Drained is closed once a shutdown completed.
+func (s *Server) Drained() <-chan struct{} {
+	return s.drained
+}
+
+// handleDrain puts the server in drain mode, in which it keeps serving the
+// API but hands its WebSocket clients over to other instances.
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	go s.drain(websocket.CloseTryAgainLater, "try again later")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleUndrain leaves drain mode.
+func (s *Server) handleUndrain(w http.ResponseWriter, r *http.Request) {
+	if !s.undrain() {
+		http.Error(w, "server is shutting down", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleReady reports whether the instance should receive traffic.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
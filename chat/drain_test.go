@@ -0,0 +1,132 @@
+package chat
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+)
+
+// tryDial connects to s like dialTestServer, returning the status of a
+// refused handshake rather than failing.
+func tryDial(t *testing.T, s *Server, query string) (*websocket.Conn, int) {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleConnetions))
+	t.Cleanup(ts.Close)
+
+	ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket?"+query, nil)
+	if err != nil {
+		if resp == nil {
+			t.Fatal(err)
+		}
+		return nil, resp.StatusCode
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws, http.StatusSwitchingProtocols
+}
+
+// adminRequest serves an admin request for method and path on s.
+func adminRequest(s *Server, method, path string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/admin/drain", s.adminOnly(s.handleDrain))
+	mux.HandleFunc("DELETE /api/admin/drain", s.adminOnly(s.handleUndrain))
+
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+// newDrainTestServer starts a server draining for grace.
+func newDrainTestServer(t *testing.T, grace time.Duration) *Server {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", "redis://"+mr.Addr())
+	t.Setenv("ADMIN_TOKEN", "secret")
+	cfg := loadTestConfig(t)
+	cfg.DrainGracePeriod = grace
+	return startTestServer(t, cfg)
+}
+
+func TestDrain(t *testing.T) {
+	s := newDrainTestServer(t, 300*time.Millisecond)
+	ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	waitClients(t, s, 1)
+
+	if rec := adminRequest(s, http.MethodPost, "/api/admin/drain"); rec.Code != http.StatusAccepted {
+		t.Fatalf("drain: status %d", rec.Code)
+	}
+	var f systemFrame
+	readFrameInto(t, ann, messageTypeSystem, &f)
+	if f.Code != "reconnect" {
+		t.Errorf("notice %q, want reconnect", f.Code)
+	}
+
+	// new connections go elsewhere, existing ones carry on
+	if _, code := tryDial(t, s, "room=general&username=bob"); code != http.StatusServiceUnavailable {
+		t.Errorf("upgrade while draining: status %d, want 503", code)
+	}
+	rec := httptest.NewRecorder()
+	s.handleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz while draining: status %d, want 503", rec.Code)
+	}
+	if err := ann.WriteJSON(ChatMessage{Username: "ann", Text: "still here"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readFrameOf(t, ann, messageTypeChat, nil); msg.Text != "still here" {
+		t.Errorf("got %q while draining, want the message", msg.Text)
+	}
+
+	// once the grace period is over, clients are told to try again later
+	ann.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := ann.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var ce *websocket.CloseError
+		if !errors.As(err, &ce) || ce.Code != websocket.CloseTryAgainLater {
+			t.Errorf("got %v, want a close frame with %d", err, websocket.CloseTryAgainLater)
+		}
+		break
+	}
+
+	if rec := adminRequest(s, http.MethodDelete, "/api/admin/drain"); rec.Code != http.StatusNoContent {
+		t.Fatalf("undrain: status %d", rec.Code)
+	}
+	if _, code := tryDial(t, s, "room=general&username=bob"); code != http.StatusSwitchingProtocols {
+		t.Errorf("upgrade after undraining: status %d, want 101", code)
+	}
+}
+
+// TestUndrainCancelsDrain checks that leaving drain mode within the grace
+// period keeps the clients connected.
+func TestUndrainCancelsDrain(t *testing.T) {
+	s := newDrainTestServer(t, 100*time.Millisecond)
+	dialTestServer(t, s, "room=general&username=ann")
+	waitClients(t, s, 1)
+
+	drained := make(chan bool)
+	go func() { drained <- s.drain(websocket.CloseTryAgainLater, "try again later") }()
+	for !s.draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if !s.undrain() {
+		t.Fatal("undrain refused")
+	}
+	if <-drained {
+		t.Error("drain completed despite undrain")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	waitClients(t, s, 1)
+}
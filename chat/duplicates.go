@@ -0,0 +1,73 @@
+package chat
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// duplicateThrottle rejects a message whose text its sender already sent
+// within the window, among their last keep messages. Texts shorter than
+// minLength, such as "ok" or "+1", may be repeated at will.
+type duplicateThrottle struct {
+	window    time.Duration
+	keep      int
+	minLength int
+}
+
+func newDuplicateThrottle(cfg Config) *duplicateThrottle {
+	if cfg.DuplicateWindow <= 0 {
+		return nil
+	}
+	return &duplicateThrottle{window: cfg.DuplicateWindow, keep: cfg.DuplicateHistory, minLength: cfg.DuplicateMinLength}
+}
+
+// recentTexts are hashes of the last texts a user sent. The connections
+// sharing a claimed username share them, hence the lock.
+type recentTexts struct {
+	mu      sync.Mutex
+	entries []recentText
+}
+
+type recentText struct {
+	sum uint64
+	at  time.Time
+}
+
+// normalizeText collapses every run of whitespace in text to a space.
+func normalizeText(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// allow reports whether text may be sent now by the user rt belongs to, and
+// remembers it if so.
+func (dt *duplicateThrottle) allow(rt *recentTexts, text string, now time.Time) bool {
+	if dt == nil {
+		return true
+	}
+	text = normalizeText(text)
+	if utf8.RuneCountInString(text) < dt.minLength {
+		return true
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(text))
+	sum := h.Sum64()
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for _, e := range rt.entries {
+		if e.sum == sum && now.Sub(e.at) < dt.window {
+			return false
+		}
+	}
+
+	rt.entries = append(rt.entries, recentText{sum: sum, at: now})
+	if len(rt.entries) > dt.keep {
+		rt.entries = rt.entries[len(rt.entries)-dt.keep:]
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package chat
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// durationEnv parses the duration in the environment variable name, returning
+// def when it is unset.
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s: must not be negative", name)
+	}
+	return d, nil
+}
+
+// intEnv parses the integer in the environment variable name, returning def
+// when it is unset.
+func intEnv(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%s: must not be negative", name)
+	}
+	return n, nil
+}
+
+// floatEnv parses the number in the environment variable name, returning def
+// when it is unset.
+func floatEnv(name string, def float64) (float64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if f < 0 {
+		return 0, fmt.Errorf("%s: must not be negative", name)
+	}
+	return f, nil
+}
+
+// envParser reads several variables, collecting their errors so that they
+// can be reported together.
+type envParser struct {
+	errs []error
+}
+
+func (p *envParser) fail(err error) {
+	if err != nil {
+		p.errs = append(p.errs, err)
+	}
+}
+
+func (p *envParser) duration(name string, def time.Duration) time.Duration {
+	d, err := durationEnv(name, def)
+	p.fail(err)
+	return d
+}
+
+func (p *envParser) int(name string, def int) int {
+	n, err := intEnv(name, def)
+	p.fail(err)
+	return n
+}
+
+func (p *envParser) float(name string, def float64) float64 {
+	f, err := floatEnv(name, def)
+	p.fail(err)
+	return f
+}
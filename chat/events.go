@@ -0,0 +1,47 @@
+package chat
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Connection-lifecycle events published to the events stream.
+const (
+	eventConnect    = "connect"
+	eventMessage    = "message"
+	eventDisconnect = "disconnect"
+)
+
+// defaultEventsStream is the stream key used when EVENTS_STREAM is unset.
+const defaultEventsStream = "chat_events"
+
+// emitEvent appends an event to the events stream, if enabled. The stream is
+// an audit log for other services, so failing to write it is logged rather
+// than interrupting the chat.
+func (s *Server) emitEvent(ctx context.Context, event, room, username string) {
+	if s.eventsStream == "" {
+		return
+	}
+
+	values := map[string]interface{}{
+		"event":    event,
+		"room":     room,
+		"username": username,
+		"ts":       time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if id := connIDFrom(ctx); id != "" {
+		values["conn"] = id
+	}
+
+	args := &redis.XAddArgs{Stream: s.keys.key(s.eventsStream), Values: values}
+	if s.eventsMaxLen > 0 {
+		args.MaxLen = s.eventsMaxLen
+		args.Approx = true
+	}
+
+	if err := s.rdb.XAdd(ctx, args).Err(); err != nil {
+		s.logger.WarnContext(ctx, "emitting event", "event", event, "room", room, "err", err)
+	}
+}
@@ -0,0 +1,125 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEmitEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled string
+		stream  string
+		want    []string
+	}{
+		{"disabled", "", "", nil},
+		{"default stream", "1", "", []string{eventConnect, eventMessage, eventDisconnect}},
+		{"custom stream", "1", "lifecycle", []string{eventConnect, eventMessage, eventDisconnect}},
+	}
+	// a connection is only named once it posts
+	usernames := map[string]string{eventConnect: "", eventMessage: "ann", eventDisconnect: "ann"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("EVENTS_ENABLED", tt.enabled)
+			t.Setenv("EVENTS_STREAM", tt.stream)
+			s, mr := newTestServer(t)
+
+			ws := dialTestServer(t, s, "room=general")
+			if err := ws.WriteJSON(ChatMessage{Username: "ann", Text: "hi"}); err != nil {
+				t.Fatal(err)
+			}
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if err := ws.ReadJSON(new(ChatMessage)); err != nil {
+				t.Fatal(err)
+			}
+			ws.Close()
+			waitClients(t, s, 0)
+
+			stream := tt.stream
+			if stream == "" {
+				stream = defaultEventsStream
+			}
+			if tt.want == nil {
+				if mr.Exists(s.keys.key(stream)) {
+					t.Error("events written while disabled")
+				}
+				return
+			}
+
+			ctx := context.Background()
+			var got []string
+			for deadline := time.Now().Add(5 * time.Second); len(got) < len(tt.want) && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				entries, err := s.rdb.XRange(ctx, s.keys.key(stream), "-", "+").Result()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = got[:0]
+				var conn string
+				for _, e := range entries {
+					event, _ := e.Values["event"].(string)
+					got = append(got, event)
+					if e.Values["room"] != "general" || e.Values["username"] != usernames[event] || e.Values["ts"] == "" {
+						t.Fatalf("event %v lacks its room, username or time", e.Values)
+					}
+					id, _ := e.Values["conn"].(string)
+					if id == "" || conn != "" && id != conn {
+						t.Fatalf("event %v does not carry the connection ID %q", e.Values, conn)
+					}
+					conn = id
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("events %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("events %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+// TestConnectEventNamesUser checks that connect events carry the username
+// a client connected with.
+func TestConnectEventNamesUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		connect func(t *testing.T, s *Server)
+	}{
+		{"websocket", func(t *testing.T, s *Server) {
+			dialTestServer(t, s, "room=general&username=ann")
+		}},
+		{"irc", func(t *testing.T, s *Server) {
+			ic := dialIRC(t, s)
+			ic.send(t, "NICK ann", "USER ann 0 * :Ann", "JOIN #general")
+			ic.expect(t, " 366 ")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("EVENTS_ENABLED", "1")
+			s, _ := newTestServer(t)
+			tt.connect(t, s)
+
+			ctx := context.Background()
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+				entries, err := s.rdb.XRange(ctx, s.keys.key(defaultEventsStream), "-", "+").Result()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(entries) > 0 {
+					if e := entries[0].Values; e["event"] != eventConnect || e["username"] != "ann" {
+						t.Errorf("first event %v, want ann connecting", e)
+					}
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("no connect event")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package chat
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// maxExpiry is the longest a self-destructing message may be kept for.
+const maxExpiry = 30 * 24 * time.Hour
+
+// messageTypeExpired tells the clients of a room that a message expired
+// and should no longer be shown.
+const messageTypeExpired = "expired"
+
+type expiredFrame struct {
+	Type      string `json:"type"`
+	Room      string `json:"room"`
+	MessageID string `json:"message_id"`
+}
+
+// expiring is the Redis sorted set of the messages due to expire, as
+// "room:id" members scored by their expiry in Unix milliseconds.
+func (ks keyspace) expiring() string {
+	return ks.key("expiring")
+}
+
+// expired reports whether msg carries an expiry that passed by now.
+func (m ChatMessage) expired(now time.Time) bool {
+	return m.ExpiresAt != 0 && m.ExpiresAt <= now.UnixMilli()
+}
+
+// scheduleExpiry has the sweeper remove msg, stored in room, once it
+// expires.
+func (s *Server) scheduleExpiry(ctx context.Context, room string, msg *ChatMessage) error {
+	return s.rdb.ZAdd(ctx, s.keys.expiring(), redis.Z{
+		Score:  float64(msg.ExpiresAt),
+		Member: room + ":" + msg.ID,
+	}).Err()
+}
+
+// runExpiry removes the expired messages. Every instance runs it; claimDue
+// keeps them from expiring a message twice.
+func (s *Server) runExpiry() {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.expireDue(context.Background())
+	}
+}
+
+// expireDue removes the messages that expired from the history and tells
+// the rooms, here and on the other instances.
+func (s *Server) expireDue(ctx context.Context) {
+	for {
+		members, err := claimDue.Run(ctx, s.rdb, []string{s.keys.expiring()},
+			time.Now().UnixMilli(), scheduleBatch).StringSlice()
+		if err != nil {
+			s.logger.Error("claiming expired messages", "err", err)
+			return
+		}
+
+		for _, member := range members {
+			room, id, _ := strings.Cut(member, ":")
+			if err := s.store.Remove(ctx, room, id); err != nil {
+				// replay skips it anyway, only the storage lingers
+				s.logger.Error("removing expired message", "room", room, "id", id, "err", err)
+			}
+
+			s.ops <- func(h *hub) {
+				broadcastExpired(h, room, id)
+			}
+			s.relay(ChatMessage{Type: messageTypeExpired, Room: room, MessageID: id})
+		}
+
+		if len(members) < scheduleBatch {
+			return
+		}
+	}
+}
+
+// broadcastExpired tells the clients in room that message id expired.
+// Version 1 clients have no way to unshow a message and are left out.
+func broadcastExpired(h *hub, room, id string) {
+	f := expiredFrame{Type: messageTypeExpired, Room: room, MessageID: id}
+
+	var failed []*Client
+	for c := range h.clients {
+		if c.room != room || c.version < protocolV2 {
+			continue
+		}
+		if err := c.deliver("", f); err != nil && unsafeError(err) {
+			c.logger.Warn("sending expiry", "err", err)
+			failed = append(failed, c)
+		}
+	}
+	for _, c := range failed {
+		removeClient(h, c, 0, "")
+	}
+}
@@ -0,0 +1,179 @@
+package chat
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// exportChunk is the number of messages read from the store at a time.
+const exportChunk = 500
+
+// exportWriter writes the rows of an export as they are read.
+type exportWriter interface {
+	write(msg ChatMessage) error
+	close() error
+}
+
+// csvExport writes one row per message under a header row.
+type csvExport struct {
+	w *csv.Writer
+}
+
+func newCSVExport(w io.Writer) (*csvExport, error) {
+	e := &csvExport{w: csv.NewWriter(w)}
+	return e, e.w.Write([]string{"id", "time", "username", "text", "reply_to"})
+}
+
+func (e *csvExport) write(msg ChatMessage) error {
+	var ts string
+	if msg.Timestamp != 0 {
+		ts = time.UnixMilli(msg.Timestamp).UTC().Format(time.RFC3339Nano)
+	}
+	return e.w.Write([]string{msg.ID, ts, msg.Username, msg.Text, msg.ReplyTo})
+}
+
+func (e *csvExport) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonExport writes the messages as a single JSON array, one element at a
+// time.
+type jsonExport struct {
+	w     io.Writer
+	first bool
+}
+
+func newJSONExport(w io.Writer) (*jsonExport, error) {
+	_, err := io.WriteString(w, "[")
+	return &jsonExport{w: w, first: true}, err
+}
+
+func (e *jsonExport) write(msg ChatMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if !e.first {
+		data = append([]byte(","), data...)
+	}
+	e.first = false
+
+	_, err = e.w.Write(append(data, '\n'))
+	return err
+}
+
+func (e *jsonExport) close() error {
+	_, err := io.WriteString(e.w, "]\n")
+	return err
+}
+
+// parseTimeParam parses an RFC 3339 query parameter, the zero time meaning
+// unbounded.
+func parseTimeParam(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// handleExport streams the history of a room as a CSV or JSON download,
+// optionally limited to messages received in [from, to). Messages are read
+// from the store in chunks rather than all at once.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+
+	room := q.Get("room")
+	if room == "" {
+		room = defaultRoom
+	}
+	if !validRoomName(room) {
+		http.Error(w, "invalid room name", http.StatusBadRequest)
+		return
+	}
+
+	format := q.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	var contentType string
+	switch format {
+	case "json":
+		contentType = "application/json"
+	case "csv":
+		contentType = "text/csv; charset=utf-8"
+	default:
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
+
+	from, err := parseTimeParam(q.Get("from"))
+	if err != nil {
+		http.Error(w, "invalid from", http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParam(q.Get("to"))
+	if err != nil {
+		http.Error(w, "invalid to", http.StatusBadRequest)
+		return
+	}
+
+	// read the first chunk before committing to a 200, so that a store
+	// failure can still be reported
+	chunk, err := s.store.Range(ctx, room, 0, exportChunk-1)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+room+`.`+format+`"`)
+
+	user := s.requester(r)
+	var e exportWriter
+	if format == "csv" {
+		e, err = newCSVExport(w)
+	} else {
+		e, err = newJSONExport(w)
+	}
+
+	for offset := int64(0); err == nil && len(chunk) > 0; {
+		for _, msg := range chunk {
+			if !msg.visibleTo(user) {
+				continue
+			}
+			t := time.UnixMilli(msg.Timestamp)
+			if !from.IsZero() && t.Before(from) {
+				continue
+			}
+			// messages are stored in the order they were received
+			if !to.IsZero() && !t.Before(to) {
+				chunk = nil
+				break
+			}
+
+			msg.Room = room
+			if err = e.write(msg); err != nil {
+				break
+			}
+		}
+		if err != nil || len(chunk) < exportChunk {
+			break
+		}
+
+		offset += exportChunk
+		chunk, err = s.store.Range(ctx, room, offset, offset+exportChunk-1)
+	}
+
+	if err == nil {
+		err = e.close()
+	}
+	if err != nil {
+		// the response is already under way, so the download is cut short
+		s.logger.Warn("exporting history", "room", room, "err", err)
+	}
+}
@@ -0,0 +1,52 @@
+package chat
+
+import "fmt"
+
+// messageFilter picks the chat messages a connection receives, chosen with
+// the filter parameter on connect. System events, acks and the like are
+// always delivered.
+type messageFilter int
+
+const (
+	// filterAll delivers every message, the default.
+	filterAll messageFilter = iota
+
+	// filterMentions only delivers the messages mentioning the user, and
+	// their own.
+	filterMentions
+)
+
+// parseMessageFilter parses the filter parameter.
+func parseMessageFilter(v string) (messageFilter, error) {
+	switch v {
+	case "", "all":
+		return filterAll, nil
+	case "mentions":
+		return filterMentions, nil
+	}
+	return 0, fmt.Errorf("unknown filter %q, expected all or mentions", v)
+}
+
+// wants reports whether msg passes the filter of c, and is not a direct
+// message to someone else.
+func (c *Client) wants(msg ChatMessage) bool {
+	if !msg.visibleTo(c.verified) {
+		return false
+	}
+	switch c.filter {
+	case filterMentions:
+		if c.username == "" {
+			return false
+		}
+		if msg.Username == c.username {
+			return true
+		}
+		for _, user := range mentions(msg.Text) {
+			if user == c.username {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
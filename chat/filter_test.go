@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseMessageFilter(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    messageFilter
+		wantErr bool
+	}{
+		{"", filterAll, false},
+		{"all", filterAll, false},
+		{"mentions", filterMentions, false},
+		{"Mentions", 0, true},
+		{"everything", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseMessageFilter(tt.v)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseMessageFilter(%q) = %v, %v, want %v, an error %v", tt.v, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestClientWants(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   string
+		filter messageFilter
+		msg    ChatMessage
+		want   bool
+	}{
+		{"default", "bob", filterAll, ChatMessage{Username: "ann", Text: "hello all"}, true},
+		{"default, direct to someone else", "bob", filterAll, ChatMessage{Username: "ann", Text: "psst", To: "carol"}, false},
+		{"default, direct to them", "bob", filterAll, ChatMessage{Username: "ann", Text: "psst", To: "bob"}, true},
+		{"mention", "bob", filterMentions, ChatMessage{Username: "ann", Text: "hi @bob"}, true},
+		{"no mention", "bob", filterMentions, ChatMessage{Username: "ann", Text: "hello all"}, false},
+		{"longer name", "bob", filterMentions, ChatMessage{Username: "ann", Text: "hi @bobby"}, false},
+		{"own message", "bob", filterMentions, ChatMessage{Username: "bob", Text: "hello all"}, true},
+		{"anonymous", "", filterMentions, ChatMessage{Username: "ann", Text: "hi @bob"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{username: tt.user, claimed: tt.user, verified: tt.user, filter: tt.filter}
+			if got := c.wants(tt.msg); got != tt.want {
+				t.Errorf("wants = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// a name nobody vouched for doesn't make the client the recipient
+	c := &Client{username: "bob", claimed: "bob"}
+	if c.wants(ChatMessage{Username: "ann", Text: "psst", To: "bob"}) {
+		t.Error("an unverified client wants direct messages to its name")
+	}
+}
+
+func TestMessageFilter(t *testing.T) {
+	s, _ := newTestServer(t)
+	if _, code := tryDial(t, s, "room=general&username=bob&filter=some"); code != http.StatusBadRequest {
+		t.Errorf("unknown filter: status %d, want 400", code)
+	}
+
+	ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	bob := dialTestServer(t, s, "room=general&username=bob&filter=mentions", "chat.v2")
+	carol := dialTestServer(t, s, "room=general&username=carol&filter=all", "chat.v2")
+	waitClients(t, s, 3)
+
+	for _, text := range []string{"hello all", "hi @bob", "bye @carol"} {
+		if err := ann.WriteJSON(ChatMessage{Text: text}); err != nil {
+			t.Fatal(err)
+		}
+		readFrameOf(t, ann, messageTypeChat, func(m ChatMessage) bool { return m.Text == text })
+	}
+	if err := bob.WriteJSON(ChatMessage{Text: "done"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		ws   *websocket.Conn
+		want []string
+	}{
+		{"bob", bob, []string{"hi @bob", "done"}},
+		{"carol", carol, []string{"hello all", "hi @bob", "bye @carol", "done"}},
+	} {
+		var got []string
+		for len(got) == 0 || got[len(got)-1] != "done" {
+			got = append(got, readFrameOf(t, tt.ws, messageTypeChat, nil).Text)
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package chat
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// floodMemory is how long a user's auto-mutes keep counting towards the
+// length of the next one.
+const floodMemory = 24 * time.Hour
+
+// messageTypeMuted tells a client it was muted automatically.
+const messageTypeMuted = "muted"
+
+type mutedFrame struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+
+	// ExpiresIn is in seconds and ExpiresAt in Unix milliseconds.
+	ExpiresIn int64 `json:"expires_in"`
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// violations is the Redis sorted set of the recent violations of username,
+// scored by their time in Unix milliseconds.
+func (ks keyspace) violations(username string) string {
+	return ks.key("violations:" + username)
+}
+
+// floodLevel is the Redis counter of the auto-mutes of username within
+// floodMemory.
+func (ks keyspace) floodLevel(username string) string {
+	return ks.key("flood_level:" + username)
+}
+
+// floodGuard mutes the users who keep breaking the rate limits or sending
+// invalid frames. Violations are counted per username in Redis, so that
+// reconnecting doesn't reset them. Every auto-mute lasts factor times longer
+// than the previous one, up to max.
+type floodGuard struct {
+	threshold int
+	window    time.Duration
+	mute      time.Duration
+	factor    float64
+	max       time.Duration
+}
+
+func newFloodGuard(cfg Config) *floodGuard {
+	if cfg.FloodThreshold <= 0 {
+		return nil
+	}
+	return &floodGuard{
+		threshold: cfg.FloodThreshold,
+		window:    cfg.FloodWindow,
+		mute:      cfg.FloodMute,
+		factor:    cfg.FloodMuteFactor,
+		max:       cfg.FloodMuteMax,
+	}
+}
+
+// muteFor is the length of the level-th auto-mute, counting from 1.
+func (fg *floodGuard) muteFor(level int64) time.Duration {
+	d := float64(fg.mute) * math.Pow(fg.factor, float64(level-1))
+	if d >= float64(fg.max) {
+		return fg.max
+	}
+	return time.Duration(d)
+}
+
+// violation records that c broke a rule, for the monitors, muting its user
+// once it did so threshold times within the window. Anonymous connections,
+// and users who are muted already, aren't tracked.
+func (s *Server) violation(ctx context.Context, c *Client, code string) {
+	s.monitorViolation(c, code)
+
+	fg := s.flood
+	username := c.claimed
+	if username == "" {
+		username = c.username
+	}
+	if fg == nil || username == "" {
+		return
+	}
+
+	if _, muted, err := s.sanctionRemaining(ctx, sanctionMute, username); err != nil || muted {
+		if err != nil {
+			c.logger.Error("checking mute", "err", err)
+		}
+		return
+	}
+
+	now := time.Now()
+	key := s.keys.violations(username)
+	var count *redis.IntCmd
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.Add(-fg.window).UnixMilli(), 10))
+		pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.UnixMilli()), Member: strconv.FormatInt(now.UnixNano(), 10) + ":" + code})
+		count = pipe.ZCard(ctx, key)
+		pipe.PExpire(ctx, key, fg.window)
+		return nil
+	})
+	if err != nil {
+		c.logger.Error("recording violation", "err", err)
+		return
+	}
+	if count.Val() < int64(fg.threshold) {
+		return
+	}
+
+	level, err := s.rdb.Incr(ctx, s.keys.floodLevel(username)).Result()
+	if err != nil {
+		c.logger.Error("escalating mute", "err", err)
+		return
+	}
+	d := fg.muteFor(level)
+
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Expire(ctx, s.keys.floodLevel(username), floodMemory)
+		pipe.Set(ctx, s.keys.sanction(sanctionMute, username), now.Unix(), d)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		c.logger.Error("muting flooding user", "err", err)
+		return
+	}
+
+	c.logger.Warn("muted flooding user", "violations", count.Val(), "duration", d)
+	s.audit(AuditEntry{
+		Action: string(sanctionMute),
+		Actor:  auditActorServer,
+		Target: username,
+		Room:   c.room,
+		IP:     c.ip,
+		Reason: strconv.FormatInt(count.Val(), 10) + " violations, last " + code,
+	})
+
+	if c.version >= protocolV2 {
+		s.sendFrame(c, mutedFrame{
+			Type:      messageTypeMuted,
+			Message:   "you were muted for flooding",
+			ExpiresIn: int64((d + time.Second - 1) / time.Second),
+			ExpiresAt: now.Add(d).UnixMilli(),
+		})
+	}
+}
@@ -0,0 +1,250 @@
+//go:build grpc
+
+package chat
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	chatpb "heroku_chat_sample/proto"
+)
+
+// grpcQueue is how many messages wait to be streamed to a subscriber before
+// it is dropped as too slow.
+const grpcQueue = 256
+
+// grpcChat implements the Chat service of proto/chat.proto.
+type grpcChat struct {
+	chatpb.UnimplementedChatServer
+
+	s     *Server
+	token string
+}
+
+// startGRPC serves the gRPC API on GRPC_PORT, when set. The returned func
+// stops it gracefully.
+func startGRPC(s *Server, cfg Config) (func(), error) {
+	if cfg.GRPCPort == "" {
+		return func() {}, nil
+	}
+
+	ln, err := net.Listen("tcp", ":"+cfg.GRPCPort)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := grpc.NewServer()
+	chatpb.RegisterChatServer(srv, &grpcChat{s: s, token: cfg.APIToken})
+
+	s.logger.Info("gRPC server starting at localhost:" + cfg.GRPCPort)
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			s.logger.Error("serving gRPC", "err", err)
+		}
+	}()
+	return srv.GracefulStop, nil
+}
+
+// authorize checks the bearer token in the metadata of ctx.
+func (gc *grpcChat) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		token, _ := strings.CutPrefix(v, "Bearer ")
+		if gc.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(gc.token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "a valid API token is required")
+}
+
+// room checks that room is valid and exists.
+func (gc *grpcChat) room(ctx context.Context, room string) (RoomOptions, error) {
+	if room == "" {
+		room = defaultRoom
+	}
+	if !validRoomName(room) {
+		return RoomOptions{}, status.Error(codes.InvalidArgument, "invalid room name")
+	}
+
+	ok, err := gc.s.ensureRoom(ctx, room)
+	if err != nil {
+		return RoomOptions{}, status.Error(codes.Internal, "loading room")
+	}
+	if !ok {
+		return RoomOptions{}, status.Error(codes.NotFound, "room does not exist")
+	}
+	opts, err := gc.s.roomOptions(ctx, room)
+	if err != nil {
+		return RoomOptions{}, status.Error(codes.Internal, "loading room")
+	}
+	return opts, nil
+}
+
+// Send posts msg like the HTTP send endpoint, answering once it is stored.
+func (gc *grpcChat) Send(ctx context.Context, msg *chatpb.ChatMessage) (*chatpb.Ack, error) {
+	if err := gc.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(msg.GetUsername()) == "" || strings.TrimSpace(msg.GetText()) == "" {
+		return nil, status.Error(codes.InvalidArgument, "username and text are required")
+	}
+	if hasBannedWord(gc.s.settings().bannedWords, msg.GetText()) {
+		return nil, status.Error(codes.InvalidArgument, "the message contains a banned word")
+	}
+	room := msg.GetRoom()
+	if room == "" {
+		room = defaultRoom
+	}
+	if _, err := gc.room(ctx, room); err != nil {
+		return nil, err
+	}
+
+	sent := ChatMessage{Username: msg.GetUsername(), Text: msg.GetText(), ReplyTo: msg.GetReplyTo()}
+	if err := gc.s.resolveReply(ctx, room, &sent); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	stored, err := gc.s.postMessage(ctx, room, sent)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, "the message was delivered but could not be stored")
+	}
+	gc.s.emitEvent(ctx, eventMessage, room, msg.GetUsername())
+	return &chatpb.Ack{Id: stored.ID, Ts: stored.Timestamp}, nil
+}
+
+// Subscribe streams the messages of a room. The subscriber joins the hub as
+// an observer, so it gets exactly the chat messages WebSocket clients get.
+func (gc *grpcChat) Subscribe(req *chatpb.SubscribeRequest, stream chatpb.Chat_SubscribeServer) error {
+	ctx := stream.Context()
+	if err := gc.authorize(ctx); err != nil {
+		return err
+	}
+	room := req.GetRoom()
+	if room == "" {
+		room = defaultRoom
+	}
+	opts, err := gc.room(ctx, room)
+	if err != nil {
+		return err
+	}
+
+	s := gc.s
+	conn := &grpcConn{out: make(chan *chatpb.ChatMessage, grpcQueue), done: make(chan struct{})}
+	if p, ok := peer.FromContext(ctx); ok {
+		conn.addr = p.Addr
+	}
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	c := &Client{
+		ws:           conn,
+		version:      protocolV2,
+		codec:        jsonCodec{},
+		room:         room,
+		ip:           ip,
+		observer:     true,
+		noReplay:     true,
+		writeTimeout: s.writeTimeout,
+		connectedAt:  time.Now(),
+		bp:           s.backpressure,
+		logger:       s.logger.With("conn", newConnID(), "ip", ip, "room", room, "transport", "grpc"),
+		recent:       new(recentTexts),
+	}
+	c.touch()
+
+	if !s.addClient(c, opts) {
+		return status.Error(codes.Unavailable, "subscription refused")
+	}
+	defer s.delClient(c)
+	s.replayHistory(ctx, c)
+
+	for {
+		select {
+		case msg := <-conn.out:
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+			c.touch()
+		case <-conn.done:
+			return status.Error(codes.Unavailable, conn.reason)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// grpcConn is the connection of a gRPC subscriber. The hub's writes are
+// queued and streamed by the subscription, so that flow control can't hold
+// up the hub.
+type grpcConn struct {
+	addr net.Addr
+	out  chan *chatpb.ChatMessage
+
+	// done is closed by Close, once, with the reason of the close frame.
+	// The writer of the client and the subscription may both close it.
+	done   chan struct{}
+	closed sync.Once
+	reason string
+}
+
+var errGRPCSlow = errors.New("grpc subscriber too slow")
+
+// WriteMessage queues the chat messages among the frames the hub sends, which
+// it encodes as JSON.
+func (gc *grpcConn) WriteMessage(_ int, data []byte) error {
+	var msg ChatMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != messageTypeChat {
+		return nil
+	}
+
+	select {
+	case gc.out <- &chatpb.ChatMessage{
+		Id:       msg.ID,
+		Room:     msg.Room,
+		Username: msg.Username,
+		Text:     msg.Text,
+		ReplyTo:  msg.ReplyTo,
+		Ts:       msg.Timestamp,
+	}:
+		return nil
+	default:
+		return errGRPCSlow
+	}
+}
+
+func (gc *grpcConn) WriteControl(messageType int, data []byte, _ time.Time) error {
+	if len(data) > 2 {
+		gc.reason = string(data[2:])
+	}
+	return nil
+}
+
+func (gc *grpcConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (gc *grpcConn) NextReader() (int, io.Reader, error) {
+	return 0, nil, errors.New("grpc: subscribers don't send frames")
+}
+
+func (gc *grpcConn) RemoteAddr() net.Addr {
+	if gc.addr == nil {
+		return &net.TCPAddr{}
+	}
+	return gc.addr
+}
+
+func (gc *grpcConn) Close() error {
+	gc.closed.Do(func() { close(gc.done) })
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !grpc
+
+package chat
+
+import "errors"
+
+// startGRPC is only available in binaries built with the grpc tag, which
+// pulls in gRPC.
+func startGRPC(s *Server, cfg Config) (func(), error) {
+	if cfg.GRPCPort != "" {
+		return nil, errors.New("GRPC_PORT requires a binary built with -tags grpc")
+	}
+	return func() {}, nil
+}
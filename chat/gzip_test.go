@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.8", true},
+		{"GZIP", true},
+		{"gzip;q=0", false},
+		{"br", false},
+		{"x-gzip", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptsGzip(r); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"text/css", true},
+		{"application/javascript", true},
+		{"Application/JSON", true},
+		{"image/svg+xml", true},
+		{"image/png", false},
+		{"application/zip", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := compressible(tt.contentType); got != tt.want {
+			t.Errorf("compressible(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestStaticGzip(t *testing.T) {
+	script := strings.Repeat("console.log('hello');\n", 100)
+	image := []byte("\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 100))
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		path     string
+		encoding string
+		rangeHdr string
+		wantGzip bool
+		want     []byte
+	}{
+		{"script", true, "/app.js", "gzip", "", true, []byte(script)},
+		{"not accepted", true, "/app.js", "", "", false, []byte(script)},
+		{"refused", true, "/app.js", "gzip;q=0", "", false, []byte(script)},
+		{"compressed already", true, "/logo.png", "gzip", "", false, image},
+		{"range", true, "/app.js", "gzip", "bytes=0-6", false, []byte("console")},
+		{"disabled", false, "/app.js", "gzip", "", false, []byte(script)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range map[string][]byte{"app.js": []byte(script), "logo.png": image} {
+				if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			static := http.FileServer(http.Dir(dir))
+			if tt.enabled {
+				static = gzipFiles(static)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.encoding != "" {
+				req.Header.Set("Accept-Encoding", tt.encoding)
+			}
+			if tt.rangeHdr != "" {
+				req.Header.Set("Range", tt.rangeHdr)
+			}
+			rec := httptest.NewRecorder()
+			static.ServeHTTP(rec, req)
+
+			body := rec.Body.Bytes()
+			if got := rec.Header().Get("Content-Encoding") == "gzip"; got != tt.wantGzip {
+				t.Fatalf("gzipped %v, want %v", got, tt.wantGzip)
+			}
+			if tt.wantGzip {
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+				if rec.Header().Get("Content-Length") != "" {
+					t.Error("Content-Length of the uncompressed file kept")
+				}
+			}
+			if !bytes.Equal(body, tt.want) {
+				t.Errorf("body %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
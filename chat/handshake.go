@@ -0,0 +1,47 @@
+package chat
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// newHandshakeLimiter returns the limiter allowing limit requests from each
+// address per window, in a burst or spread out. It is nil, allowing
+// everything, when limit is 0.
+func newHandshakeLimiter(limit int, window time.Duration) *rateLimiter {
+	if limit <= 0 || window <= 0 {
+		return nil
+	}
+	return newRateLimiter(float64(limit)/window.Seconds(), limit)
+}
+
+// limitRequests turns away, before anything else is done for them, the
+// requests of the addresses over HANDSHAKE_LIMIT, so that opening WebSocket
+// handshakes or API calls in a loop costs the server little. The static
+// files, which a page load fetches many of at once, and the readiness probe
+// aren't counted.
+func (s *Server) limitRequests(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		live := s.settings()
+		if live.handshakes == nil {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		if _, pattern := mux.Handler(r); pattern == "/" || pattern == "GET /readyz" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		if ip := s.clientIP(r); !live.handshakes.allow(ip) {
+			s.logger.InfoContext(r.Context(), "too many requests", "ip", ip, "path", r.URL.Path)
+			// the time a request takes to be allowed again
+			wait := math.Ceil(live.handshakeWindow.Seconds() / float64(live.handshakeLimit))
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait)))
+			http.Error(w, "too many requests from this address", http.StatusTooManyRequests)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
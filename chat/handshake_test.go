@@ -0,0 +1,69 @@
+package chat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestLimitRequests checks that the requests of an address over
+// HANDSHAKE_LIMIT are turned away with a 429 saying when to retry, and that
+// other addresses, static files and the readiness probe aren't held back.
+func TestLimitRequests(t *testing.T) {
+	t.Setenv("HANDSHAKE_LIMIT", "2")
+	t.Setenv("HANDSHAKE_WINDOW", "1m")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.1")
+	s, _ := newTestServer(t)
+
+	get := func(path, remoteAddr, xff string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = remoteAddr
+		if xff != "" {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, r)
+		return rec
+	}
+
+	for i := range 2 {
+		if rec := get("/api/rooms", "203.0.113.7:4000", ""); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: got %d, want %d", i, rec.Code, http.StatusOK)
+		}
+	}
+	rec := get("/api/rooms", "203.0.113.7:4000", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("over the limit: got %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	// two requests a minute are allowed, one every 30s
+	if got := rec.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want %q", got, "30")
+	}
+	if rec := get("/websocket", "203.0.113.7:4000", ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("handshake over the limit: got %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		xff        string
+		want       int
+	}{
+		{"other address", "/api/rooms", "198.51.100.1:4000", "", http.StatusOK},
+		// the static directory of the tests is empty
+		{"static files", "/app.js", "203.0.113.7:4000", "", http.StatusNotFound},
+		{"readiness probe", "/readyz", "203.0.113.7:4000", "", http.StatusOK},
+		{"behind the proxy", "/api/rooms", "10.0.0.1:4000", "198.51.100.2", http.StatusOK},
+		{"limited behind the proxy", "/api/rooms", "10.0.0.1:4000", "203.0.113.7", http.StatusTooManyRequests},
+		{"spoofed behind the proxy", "/api/rooms", "10.0.0.1:4000", "198.51.100.3, 203.0.113.7", http.StatusTooManyRequests},
+		{"forwarded by an untrusted peer", "/api/rooms", "203.0.113.7:4000", "198.51.100.4", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := get(tt.path, tt.remoteAddr, tt.xff); rec.Code != tt.want {
+				t.Errorf("got %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
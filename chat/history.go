@@ -0,0 +1,197 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// clearHistory wipes the history of room and tells its clients to empty
+// their view. It runs on the hub, so that no message is stored halfway
+// through.
+func (s *Server) clearHistory(ctx context.Context, room string) (int64, error) {
+	type result struct {
+		n   int64
+		err error
+	}
+	reply := make(chan result, 1)
+
+	s.ops <- func(h *hub) {
+		r := result{err: errHubOp}
+		defer func() { reply <- r }()
+
+		r.n, r.err = s.store.Clear(ctx, room)
+		if r.err != nil {
+			return
+		}
+		broadcastSystem(h, room, "history_cleared", "The history of this room was cleared.")
+	}
+
+	r := <-reply
+	return r.n, r.err
+}
+
+type clearHistoryResponse struct {
+	Deleted int64 `json:"deleted"`
+}
+
+// handleClearHistory deletes every message of a room.
+func (s *Server) handleClearHistory(w http.ResponseWriter, r *http.Request) {
+	room := r.PathValue("name")
+	if !validRoomName(room) {
+		http.NotFound(w, r)
+		return
+	}
+
+	n, err := s.clearHistory(r.Context(), room)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	s.logger.InfoContext(r.Context(), "cleared history", "room", room, "count", n)
+	s.audit(AuditEntry{Action: auditDelete, Actor: auditActorAdmin, Room: room, IP: s.clientIP(r), Reason: strconv.FormatInt(n, 10) + " messages"})
+	writeJSONResponse(w, http.StatusOK, clearHistoryResponse{Deleted: n})
+}
+
+// handleGetMessage returns a stored message by ID, for deep links and reply
+// previews. Messages are stored by ID, so this is a single lookup whatever
+// the size of the history. The optional room parameter must match the room
+// of the message.
+func (s *Server) handleGetMessage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	msg, err := s.store.Get(ctx, r.PathValue("id"))
+	if err == errMessageNotFound || err == errMessageGone {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if room := r.URL.Query().Get("room"); room != "" && room != msg.Room {
+		http.NotFound(w, r)
+		return
+	}
+	// the sweeper may not have removed it yet
+	if msg.expired(time.Now()) || !msg.visibleTo(s.requester(r)) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// messages of private rooms are only visible to members over the socket
+	opts, err := s.roomOptions(ctx, msg.Room)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if opts.Private {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSONResponse(w, http.StatusOK, msg)
+}
+
+const (
+	// defaultHistoryPage and maxHistoryPage are the default and largest
+	// number of messages in a page of history.
+	defaultHistoryPage = 50
+	maxHistoryPage     = 500
+)
+
+type historyResponse struct {
+	Messages []ChatMessage `json:"messages"`
+
+	// NextBefore is the before parameter fetching the older messages,
+	// empty when there are none.
+	NextBefore string `json:"next_before,omitempty"`
+}
+
+// historyPage returns up to limit messages of room, oldest first, that came
+// before message before, or the latest ones when before is empty. The cursor
+// is an ID, resolved to a position on every call, so that trims between two
+// pages don't shift them. A trim racing with the lookup can only shift the
+// range towards newer messages, which are cut at the cursor. A cursor that
+// was trimmed away ends the history, as everything older went with it.
+func (s *Server) historyPage(ctx context.Context, room, before string, limit int64) ([]ChatMessage, error) {
+	if before == "" {
+		return s.store.Recent(ctx, room, limit)
+	}
+
+	rank, err := s.store.Rank(ctx, room, before)
+	if err == errMessageNotFound || err == nil && rank == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := s.store.Range(ctx, room, max(rank-limit, 0), rank-1)
+	if err != nil {
+		return nil, err
+	}
+	for i, msg := range msgs {
+		if msg.ID == before {
+			return msgs[:i], nil
+		}
+	}
+	return msgs, nil
+}
+
+// handleListMessages pages through the history of a room, newest page first:
+// limit messages at a time, oldest first within a page, that came before the
+// message ID given as before.
+func (s *Server) handleListMessages(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	room := r.PathValue("name")
+	if !validRoomName(room) {
+		http.NotFound(w, r)
+		return
+	}
+	params := r.URL.Query()
+
+	limit := int64(defaultHistoryPage)
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxHistoryPage)
+	}
+
+	// the history of private rooms is only visible to members over the
+	// socket
+	opts, err := s.roomOptions(ctx, room)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if opts.Private {
+		http.NotFound(w, r)
+		return
+	}
+
+	msgs, err := s.historyPage(ctx, room, params.Get("before"), limit)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	resp := historyResponse{Messages: make([]ChatMessage, 0, len(msgs))}
+	if int64(len(msgs)) == limit {
+		resp.NextBefore = msgs[0].ID
+	}
+	now, user := time.Now(), s.requester(r)
+	for _, msg := range msgs {
+		// the sweeper may not have removed them yet
+		if !msg.expired(now) && msg.visibleTo(user) {
+			resp.Messages = append(resp.Messages, msg)
+		}
+	}
+
+	writeJSONResponse(w, http.StatusOK, resp)
+}
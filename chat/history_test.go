@@ -0,0 +1,205 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClearHistory(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	s, mr := newTestServer(t)
+	ctx := context.Background()
+	ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	waitClients(t, s, 1)
+
+	appendTexts(t, s.store, "general", "one", "two")
+	appendTexts(t, s.store, "random", "elsewhere")
+	if !mr.Exists(s.keys.roomIndex("general")) {
+		t.Fatal("history key missing before clearing")
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "nope", http.StatusUnauthorized},
+		{"admin", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/api/rooms/general/messages", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			req.SetPathValue("name", "general")
+			rec := httptest.NewRecorder()
+			s.adminOnly(s.handleClearHistory)(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d", rec.Code, tt.want)
+			}
+
+			msgs, err := s.store.Recent(ctx, "general", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != http.StatusOK {
+				if len(msgs) != 2 {
+					t.Errorf("history %q after a refused clear, want it intact", texts(msgs))
+				}
+				return
+			}
+
+			var resp clearHistoryResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Deleted != 2 {
+				t.Errorf("deleted %d, want 2", resp.Deleted)
+			}
+			if len(msgs) != 0 {
+				t.Errorf("history %q left after clearing", texts(msgs))
+			}
+			if mr.Exists(s.keys.roomIndex("general")) {
+				t.Error("history key still there")
+			}
+		})
+	}
+
+	var f systemFrame
+	readFrameInto(t, ann, messageTypeSystem, &f)
+	if f.Code != "history_cleared" {
+		t.Errorf("system notice %q, want history_cleared", f.Code)
+	}
+
+	if msgs, err := s.store.Recent(ctx, "random", 0); err != nil || len(msgs) != 1 {
+		t.Errorf("random has %q, %v, want its message", texts(msgs), err)
+	}
+}
+
+func TestGetMessage(t *testing.T) {
+	s, _ := newTestServer(t)
+	ctx := context.Background()
+
+	opts := s.newRoomOptions()
+	opts.Private = true
+	if _, err := s.createRoom(ctx, "secret", opts, ""); err != nil {
+		t.Fatal(err)
+	}
+	hi := appendTexts(t, s.store, "general", "hi")[0]
+	hush := appendTexts(t, s.store, "secret", "hush")[0]
+	gone := ChatMessage{Username: "ann", Text: "gone", Timestamp: time.Now().UnixMilli(), ExpiresAt: time.Now().Add(-time.Minute).UnixMilli()}
+	if err := s.store.Append(ctx, "general", &gone); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+	}{
+		{"found", "/messages/" + hi.ID, http.StatusOK},
+		{"api route", "/api/messages/" + hi.ID, http.StatusOK},
+		{"in room", "/messages/" + hi.ID + "?room=general", http.StatusOK},
+		{"in another room", "/messages/" + hi.ID + "?room=random", http.StatusNotFound},
+		{"unknown", "/messages/999999", http.StatusNotFound},
+		{"private room", "/messages/" + hush.ID, http.StatusNotFound},
+		{"expired", "/messages/" + gone.ID, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var msg ChatMessage
+			if err := json.NewDecoder(rec.Body).Decode(&msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.ID != hi.ID || msg.Text != "hi" || msg.Room != "general" {
+				t.Errorf("got %+v, want message %s", msg, hi.ID)
+			}
+		})
+	}
+}
+
+// TestListMessagesPaging pages back through a history that grows and is
+// trimmed between pages, checking that no message is skipped or repeated.
+func TestListMessagesPaging(t *testing.T) {
+	names := func(from, to int) []string {
+		var s []string
+		for i := from; i <= to; i++ {
+			s = append(s, "m"+strconv.Itoa(i))
+		}
+		return s
+	}
+
+	tests := []struct {
+		name string
+		keep int64 // messages kept by a trim after the first page, 0 for none
+		want []string
+	}{
+		{"no trim", 0, names(1, 20)},
+		{"trimmed", 15, names(11, 20)},
+		{"cursor trimmed away", 3, names(16, 20)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			ctx := context.Background()
+			appendTexts(t, s.store, "general", names(1, 20)...)
+
+			var got []string
+			before := ""
+			for page := 0; ; page++ {
+				rec := httptest.NewRecorder()
+				s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/rooms/general/messages?limit=5&before="+before, nil))
+				if rec.Code != http.StatusOK {
+					t.Fatalf("page %d: status %d: %s", page, rec.Code, rec.Body)
+				}
+				var resp historyResponse
+				if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+				got = append(texts(resp.Messages), got...)
+
+				if page == 0 && tt.keep > 0 {
+					appendTexts(t, s.store, "general", names(21, 25)...)
+					if err := s.store.Trim(ctx, "general", tt.keep); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if before = resp.NextBefore; before == "" {
+					break
+				}
+			}
+
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("paged through %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListMessagesLimit(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	for _, limit := range []string{"0", "-1", "many"} {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/rooms/general/messages?limit="+limit, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("limit %s: status %d, want 400", limit, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on the identity a client presents when connecting.
+const (
+	maxDisplayNameLen = 64
+	maxAvatarURLLen   = 512
+)
+
+const (
+	// defaultMaxUsernameLen is the longest username, in characters,
+	// unless USERNAME_MAX_LENGTH says otherwise.
+	defaultMaxUsernameLen = 64
+
+	// defaultReservedUsernames are reserved unless RESERVED_USERNAMES
+	// says otherwise.
+	defaultReservedUsernames = "system,admin,server"
+)
+
+var (
+	errInvalidUsername     = errors.New("username must not be blank nor contain control or invisible characters")
+	errInvalidDisplayName  = errors.New("display_name must be at most 64 characters without control or invisible characters")
+	errInvalidAvatarURL    = errors.New("avatar_url must be an https URL of at most 512 characters on an allowed host")
+	errUsernameTooLong     = errors.New("username is too long")
+	errReservedUsername    = errors.New("username is reserved")
+	errReservedDisplayName = errors.New("display_name is reserved")
+)
+
+// avatarHosts reads AVATAR_HOSTS, a comma-separated allowlist of hosts avatar
+// URLs may point to. An empty list allows any host.
+func avatarHosts() []string {
+	var hosts []string
+	for _, h := range strings.Split(os.Getenv("AVATAR_HOSTS"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, strings.ToLower(h))
+		}
+	}
+	return hosts
+}
+
+// reservedUsernames reads RESERVED_USERNAMES, the comma-separated names
+// nobody may use, whatever their case. Set empty, it reserves none.
+func reservedUsernames() map[string]bool {
+	list, ok := os.LookupEnv("RESERVED_USERNAMES")
+	if !ok {
+		list = defaultReservedUsernames
+	}
+
+	names := make(map[string]bool)
+	for _, name := range splitList(list) {
+		names[strings.ToLower(name)] = true
+	}
+	return names
+}
+
+// normalizeUsername trims name and collapses its runs of whitespace, after
+// NFKC normalization when USERNAME_NFKC is set, so that lookalikes of a name
+// become that name. Control and format characters, such as zero-width
+// spaces and direction overrides, are refused, as are names left blank and
+// those checkUsername refuses. An empty name stays empty: it is anonymous.
+func (s *Server) normalizeUsername(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	if !utf8.ValidString(name) {
+		return "", errInvalidUsername
+	}
+	if s.usernameNFKC {
+		name = nfkc(name)
+	}
+
+	// tabs and newlines are whitespace before being control characters
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		return "", errInvalidUsername
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return "", errInvalidUsername
+		}
+	}
+	if err := s.checkUsername(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// checkUsername refuses the names over USERNAME_MAX_LENGTH characters, and
+// the reserved ones, in any case. The names of the bots are reserved too.
+func (s *Server) checkUsername(name string) error {
+	if n := utf8.RuneCountInString(name); s.maxUsernameLen > 0 && n > s.maxUsernameLen {
+		return fmt.Errorf("%w: at most %d characters", errUsernameTooLong, s.maxUsernameLen)
+	}
+	if s.reservedUsernames[strings.ToLower(name)] {
+		return fmt.Errorf("%w: %q", errReservedUsername, name)
+	}
+	return nil
+}
+
+// usernameErrorCode is the code of the error frame refusing a username for
+// err.
+func usernameErrorCode(err error) string {
+	switch {
+	case errors.Is(err, errReservedUsername):
+		return "reserved_username"
+	case errors.Is(err, errUsernameTooLong):
+		return "username_too_long"
+	}
+	return "invalid_username"
+}
+
+// validDisplayName normalizes name like a username and checks it is short
+// and printable. Shown in place of the username, it may not be a reserved
+// name either, in any case.
+func (s *Server) validDisplayName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", errInvalidDisplayName
+	}
+	if s.usernameNFKC {
+		name = nfkc(name)
+	}
+
+	name = strings.Join(strings.Fields(name), " ")
+	if utf8.RuneCountInString(name) > maxDisplayNameLen {
+		return "", errInvalidDisplayName
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return "", errInvalidDisplayName
+		}
+	}
+	if s.reservedUsernames[strings.ToLower(name)] {
+		return "", fmt.Errorf("%w: %q", errReservedDisplayName, name)
+	}
+	return name, nil
+}
+
+// validAvatarURL checks raw is an https URL on one of hosts, if any.
+func validAvatarURL(raw string, hosts []string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	if len(raw) > maxAvatarURLLen {
+		return "", errInvalidAvatarURL
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil {
+		return "", errInvalidAvatarURL
+	}
+	if len(hosts) == 0 {
+		return u.String(), nil
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, h := range hosts {
+		if host == h {
+			return u.String(), nil
+		}
+	}
+	return "", errInvalidAvatarURL
+}
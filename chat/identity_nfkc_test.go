@@ -0,0 +1,32 @@
+//go:build nfkc
+
+package chat
+
+import "testing"
+
+func TestNormalizeUsernameNFKC(t *testing.T) {
+	t.Setenv("USERNAME_NFKC", "1")
+	s, _ := newTestServer(t)
+
+	tests := []struct {
+		name, in string
+		want     string
+	}{
+		{"plain", "alice", "alice"},
+		{"fullwidth", "\uff41\uff4c\uff49\uff43\uff45", "alice"},
+		{"ligature", "\ufb01ona", "fiona"},
+		{"ideographic space", "alice\u3000smith", "alice smith"},
+		{"circled digit", "agent\u2460", "agent1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.normalizeUsername(tt.in)
+			if err != nil {
+				t.Fatalf("normalizeUsername(%q): %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("normalizeUsername(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
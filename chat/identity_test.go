@@ -0,0 +1,197 @@
+package chat
+
+import (
+	"errors"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidDisplayName(t *testing.T) {
+	t.Setenv("RESERVED_USERNAMES", "system,admin")
+	s, _ := newTestServer(t)
+
+	tests := []struct {
+		name, in string
+		want     string
+		err      error
+	}{
+		{"empty", "", "", nil},
+		{"plain", "Ann Smith", "Ann Smith", nil},
+		{"normalized", "  Ann \t Smith ", "Ann Smith", nil},
+		{"reserved", "admin", "", errReservedDisplayName},
+		{"reserved in another case", "System", "", errReservedDisplayName},
+		{"reserved after normalization", " ADMIN ", "", errReservedDisplayName},
+		{"containing a reserved name", "admin fan", "admin fan", nil},
+		{"invisible", "sys\u200btem", "", errInvalidDisplayName},
+		{"control", "ann\x00", "", errInvalidDisplayName},
+		{"too long", strings.Repeat("a", maxDisplayNameLen+1), "", errInvalidDisplayName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.validDisplayName(tt.in)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("validDisplayName(%q) error = %v, want %v", tt.in, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("validDisplayName(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReservedUsernames(t *testing.T) {
+	tests := []struct {
+		name string
+		set  bool
+		env  string
+		want []string
+	}{
+		{"default", false, "", []string{"admin", "server", "system"}},
+		{"configured", true, " Root, BOT ,,", []string{"bot", "root"}},
+		{"none", true, "", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RESERVED_USERNAMES", tt.env)
+			if !tt.set {
+				os.Unsetenv("RESERVED_USERNAMES")
+			}
+			if got := slices.Sorted(maps.Keys(reservedUsernames())); !slices.Equal(got, tt.want) {
+				t.Errorf("reserved %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckUsername(t *testing.T) {
+	t.Setenv("USERNAME_MAX_LENGTH", "8")
+	t.Setenv("RESERVED_USERNAMES", "system,admin")
+	s, _ := newTestServer(t)
+
+	tests := []struct {
+		name, in string
+		err      error
+		code     string
+	}{
+		{"plain", "alice", nil, ""},
+		{"at the limit", "abcdefgh", nil, ""},
+		{"at the limit in characters", strings.Repeat("\u00e9", 8), nil, ""},
+		{"containing a reserved name", "admin2", nil, ""},
+		{"too long", "abcdefghi", errUsernameTooLong, "username_too_long"},
+		{"too long in characters", strings.Repeat("\u00e9", 9), errUsernameTooLong, "username_too_long"},
+		{"reserved", "system", errReservedUsername, "reserved_username"},
+		{"reserved in another case", "AdMiN", errReservedUsername, "reserved_username"},
+		{"not reserved", "server", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.checkUsername(tt.in)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("checkUsername(%q) = %v, want %v", tt.in, err, tt.err)
+			}
+			if err != nil {
+				if code := usernameErrorCode(err); code != tt.code {
+					t.Errorf("code %q, want %q", code, tt.code)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	tests := []struct {
+		name, in string
+		want     string
+		err      error
+	}{
+		{"anonymous", "", "", nil},
+		{"plain", "alice", "alice", nil},
+		{"leading space", " alice", "alice", nil},
+		{"trailing space", "alice ", "alice", nil},
+		{"collapsed", "alice \t\n smith", "alice smith", nil},
+		{"non-breaking space", "alice\u00a0smith", "alice smith", nil},
+		{"blank", " \t ", "", errInvalidUsername},
+		{"zero-width space", "ali\u200bce", "", errInvalidUsername},
+		{"zero-width joiner", "alice\u200d", "", errInvalidUsername},
+		{"direction override", "\u202ealice", "", errInvalidUsername},
+		{"control", "alice\x07", "", errInvalidUsername},
+		{"invalid UTF-8", "alice\xff", "", errInvalidUsername},
+		{"reserved", " Admin ", "", errReservedUsername},
+		{"too long", strings.Repeat("a", defaultMaxUsernameLen+1), "", errUsernameTooLong},
+		{"fullwidth without NFKC", "\uff41\uff4c\uff49\uff43\uff45", "\uff41\uff4c\uff49\uff43\uff45", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.normalizeUsername(tt.in)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("normalizeUsername(%q) error = %v, want %v", tt.in, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("normalizeUsername(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestUsernameRefused checks that connecting with a username that doesn't
+// normalize is refused.
+func TestUsernameRefused(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	tests := []struct {
+		username string
+		want     int
+	}{
+		{"%20alice%20", http.StatusSwitchingProtocols},
+		{"%20%20", http.StatusBadRequest},
+		{"ali%E2%80%8Bce", http.StatusBadRequest},
+		{"Admin", http.StatusBadRequest},
+		{strings.Repeat("a", defaultMaxUsernameLen), http.StatusSwitchingProtocols},
+		{strings.Repeat("a", defaultMaxUsernameLen+1), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if _, code := tryDial(t, s, "room=general&username="+tt.username); code != tt.want {
+			t.Errorf("username %s: status %d, want %d", tt.username, code, tt.want)
+		}
+	}
+}
+
+// TestUsernameRefusedInFrame checks that a username a frame names is refused
+// with an error frame saying why.
+func TestUsernameRefusedInFrame(t *testing.T) {
+	s, _ := newTestServer(t)
+	ws := dialTestServer(t, s, "room=general", "chat.v2")
+	waitClients(t, s, 1)
+
+	tests := []struct {
+		username string
+		want     string
+	}{
+		{"SYSTEM", "reserved_username"},
+		{strings.Repeat("a", defaultMaxUsernameLen+1), "username_too_long"},
+		{"ali\u200bce", "invalid_username"},
+	}
+	for _, tt := range tests {
+		if err := ws.WriteJSON(ChatMessage{Username: tt.username, Text: "hi"}); err != nil {
+			t.Fatal(err)
+		}
+		var f errorFrame
+		readFrameInto(t, ws, messageTypeError, &f)
+		if f.Code != tt.want {
+			t.Errorf("username %q: error %q, want %q", tt.username, f.Code, tt.want)
+		}
+	}
+
+	if err := ws.WriteJSON(ChatMessage{Username: "alice", Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readFrameOf(t, ws, messageTypeChat, nil); msg.Username != "alice" {
+		t.Errorf("posted as %q, want alice", msg.Username)
+	}
+}
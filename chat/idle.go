@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// touch records inbound activity from c. It is called from the connection
+// goroutine, so the time is kept atomically for the hub to read.
+func (c *Client) touch() {
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+// idleFor is how long c has been silent.
+func (c *Client) idleFor(now time.Time) time.Duration {
+	if c.parent != nil {
+		return c.parent.idleFor(now)
+	}
+	return now.Sub(time.Unix(0, c.lastSeen.Load()))
+}
+
+// sweepIdle disconnects the clients that were silent for longer than the
+// idle timeout. It runs on the hub.
+func (s *Server) sweepIdle(h *hub) {
+	now := time.Now()
+
+	var idle []*Client
+	for c := range h.clients {
+		if c.idleFor(now) >= s.idleTimeout {
+			idle = append(idle, c)
+		}
+	}
+
+	for _, c := range idle {
+		c.logger.Info("disconnecting idle client", "idle", c.idleFor(now))
+		f := systemFrame{Type: messageTypeSystem, Code: "idle", Text: "disconnected due to inactivity"}
+		if err := c.deliver("", f.forVersion(c.version)); err != nil && unsafeError(err) {
+			c.logger.Warn("sending system notice", "err", err)
+		}
+		removeClient(h, c, websocket.CloseNormalClosure, "idle timeout")
+	}
+}
+
+// Member is a participant listed in a room roster.
+type Member struct {
+	Username    string `json:"username"`
+	IdleSeconds int64  `json:"idle_seconds"`
+}
+
+// Roster lists who is in a room. Participants that didn't connect with a
+// username are only counted, and observers are left out. Count is everyone,
+// as in occupancy frames.
+type Roster struct {
+	Members   []Member `json:"members"`
+	Anonymous int      `json:"anonymous"`
+	Count     int      `json:"count"`
+}
+
+// roster snapshots the participants of room from the hub.
+func (s *Server) roster(room string) Roster {
+	reply := make(chan Roster, 1)
+
+	s.ops <- func(h *hub) {
+		roster := Roster{Members: []Member{}}
+		defer func() { reply <- roster }()
+
+		now := time.Now()
+
+		for c := range h.clients {
+			if c.room != room || !c.present() {
+				continue
+			}
+			roster.Count++
+			if c.claimed == "" {
+				roster.Anonymous++
+				continue
+			}
+			roster.Members = append(roster.Members, Member{
+				Username:    c.claimed,
+				IdleSeconds: int64(c.idleFor(now) / time.Second),
+			})
+		}
+	}
+
+	roster := <-reply
+	sort.Slice(roster.Members, func(i, j int) bool {
+		return roster.Members[i].Username < roster.Members[j].Username
+	})
+	return roster
+}
+
+// handleRoster lists the participants of a room and how long each has been
+// idle. Private rooms are hidden, as in the room list.
+func (s *Server) handleRoster(w http.ResponseWriter, r *http.Request) {
+	room := r.PathValue("name")
+	if !validRoomName(room) {
+		http.NotFound(w, r)
+		return
+	}
+
+	fields, err := s.store.RoomFields(r.Context(), room)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if len(fields) == 0 || parseRoomOptions(fields).Private {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSONResponse(w, http.StatusOK, s.roster(room))
+}
@@ -0,0 +1,95 @@
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"sync"
+)
+
+// clientConfig is what the front-end needs to know about the server,
+// injected into index.html and served at /api/config.
+type clientConfig struct {
+	BasePath      string          `json:"base_path"`
+	WebSocketPath string          `json:"websocket_path"`
+	Subprotocols  []string        `json:"subprotocols"`
+	AuthRequired  bool            `json:"auth_required"`
+	HistoryLimit  int64           `json:"history_limit"`
+	Features      map[string]bool `json:"features"`
+}
+
+func (s *Server) clientConfig() clientConfig {
+	return clientConfig{
+		BasePath:      s.cfg.BasePath,
+		WebSocketPath: s.cfg.BasePath + "/websocket",
+		Subprotocols:  s.supportedSubprotocols(),
+		AuthRequired:  s.verifiesUsers(),
+		HistoryLimit:  s.historyCap,
+		Features: map[string]bool{
+			"push":            s.push != nil && s.verifiesUsers(),
+			"history":         !s.dryRun,
+			"strict_protocol": s.strictProtocol,
+			"expiry":          true,
+			"acks":            true,
+			"resync":          true,
+			"direct_messages": s.verifiesUsers(),
+		},
+	}
+}
+
+// handleClientConfig returns the clientConfig, for front-ends served from
+// elsewhere.
+func (s *Server) handleClientConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSONResponse(w, http.StatusOK, s.clientConfig())
+}
+
+// indexPage renders index.html as an html/template, given the clientConfig.
+// The template is parsed once, or on every request with reload set so that
+// edits show up right away during development.
+type indexPage struct {
+	s      *Server
+	path   string
+	reload bool
+
+	mu   sync.Mutex
+	tmpl *template.Template
+}
+
+func (ip *indexPage) template() (*template.Template, error) {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+
+	if ip.tmpl != nil && !ip.reload {
+		return ip.tmpl, nil
+	}
+	tmpl, err := template.ParseFiles(ip.path)
+	if err != nil {
+		return nil, err
+	}
+	ip.tmpl = tmpl
+	return tmpl, nil
+}
+
+func (ip *indexPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := ip.template()
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, ip.s.clientConfig()); err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf.Bytes())
+}
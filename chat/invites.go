@@ -0,0 +1,168 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// invite is the Redis hash describing one invite token of room. Its TTL is
+// the invite's expiry.
+func (ks keyspace) invite(room, token string) string {
+	return ks.key("invite:" + room + ":" + token)
+}
+
+// roomMembers is the Redis set of the verified users let into private room
+// with an invite, whose mentions may be pushed to them.
+func (ks keyspace) roomMembers(room string) string {
+	return ks.key("room_members:" + room)
+}
+
+// unlimitedUses marks an invite that can be redeemed any number of times.
+const unlimitedUses = -1
+
+// redeemInvite atomically consumes one use of an invite, deleting it once it
+// is used up, so that a single-use invite can't be raced.
+var redeemInvite = redis.NewScript(`
+local uses = redis.call("HGET", KEYS[1], "uses")
+if not uses then
+	return 0
+end
+uses = tonumber(uses)
+if uses < 0 then
+	return 1
+end
+if uses <= 1 then
+	redis.call("DEL", KEYS[1])
+else
+	redis.call("HINCRBY", KEYS[1], "uses", -1)
+end
+return 1
+`)
+
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// createInvite stores a new invite for room. A zero ttl never expires and
+// maxUses of unlimitedUses allows any number of joins.
+func (s *Server) createInvite(ctx context.Context, room string, ttl time.Duration, maxUses int64) (string, error) {
+	token := newToken()
+	key := s.keys.invite(room, token)
+
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "uses", maxUses)
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// deleteInvite revokes the invite token of room.
+func (s *Server) deleteInvite(ctx context.Context, room, token string) error {
+	return s.rdb.Del(ctx, s.keys.invite(room, token)).Err()
+}
+
+// checkInvite reports whether token grants access to room, consuming one use.
+func (s *Server) checkInvite(ctx context.Context, room, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+
+	ok, err := redeemInvite.Run(ctx, s.rdb, []string{s.keys.invite(room, token)}).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return ok == 1, nil
+}
+
+// addRoomMember records that the verified user joined private room.
+func (s *Server) addRoomMember(ctx context.Context, room, user string) error {
+	return s.rdb.SAdd(ctx, s.keys.roomMembers(room), user).Err()
+}
+
+type createInviteRequest struct {
+	// ExpiresIn is the invite lifetime in seconds, 0 meaning no expiry.
+	ExpiresIn int64 `json:"expires_in"`
+
+	// MaxUses is the number of joins allowed, 0 meaning unlimited.
+	MaxUses int64 `json:"max_uses"`
+}
+
+type inviteResponse struct {
+	Token     string     `json:"token"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	MaxUses   int64      `json:"max_uses"`
+}
+
+// handleCreateInvite mints an invite for a private room. Only the room creator,
+// identified by the owner token returned at creation, may call it.
+func (s *Server) handleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	room := r.PathValue("name")
+
+	fields, err := s.store.RoomFields(ctx, room)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if len(fields) == 0 || !parseRoomOptions(fields).Private {
+		http.NotFound(w, r)
+		return
+	}
+
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	owner := fields["owner_token"]
+	if owner == "" || subtle.ConstantTimeCompare([]byte(token), []byte(owner)) != 1 {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	var req createInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresIn < 0 || req.MaxUses < 0 {
+		http.Error(w, "expires_in and max_uses must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	maxUses := req.MaxUses
+	if maxUses == 0 {
+		maxUses = unlimitedUses
+	}
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+
+	invite, err := s.createInvite(ctx, room, ttl, maxUses)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	resp := inviteResponse{Token: invite, MaxUses: req.MaxUses}
+	if ttl > 0 {
+		t := time.Now().UTC().Add(ttl)
+		resp.ExpiresAt = &t
+	}
+	writeJSONResponse(w, http.StatusCreated, resp)
+}
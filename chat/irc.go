@@ -0,0 +1,622 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// ircServerName prefixes the replies of the server.
+	ircServerName = "chat"
+
+	// ircMaxLine is the longest IRC line, CRLF included.
+	ircMaxLine = 512
+
+	// ircRegisterTimeout bounds how long a connection may take to send NICK
+	// and USER.
+	ircRegisterTimeout = time.Minute
+)
+
+var errIRCNotReadable = errors.New("irc: frames are read by the session")
+
+// ircCodec renders the frames sent to an IRC client joined to room as IRC
+// lines. Frames IRC has no notion of, such as acks, render as nothing.
+type ircCodec struct {
+	room string
+}
+
+func (ircCodec) Name() string   { return "irc" }
+func (ircCodec) FrameType() int { return websocket.TextMessage }
+
+func (ic ircCodec) Marshal(v interface{}) ([]byte, error) {
+	var b strings.Builder
+	switch f := v.(type) {
+	case ChatMessage:
+		nick := ircNick(f.Username)
+		prefix := fmt.Sprintf(":%s!%s@%s PRIVMSG #%s :", nick, nick, ircServerName, ic.room)
+		for _, line := range ircLines(prefix, f.plainText()) {
+			b.WriteString(line)
+		}
+	case systemFrame:
+		for _, line := range ircLines(fmt.Sprintf(":%s NOTICE #%s :", ircServerName, ic.room), f.Text) {
+			b.WriteString(line)
+		}
+	case errorFrame:
+		for _, line := range ircLines(fmt.Sprintf(":%s NOTICE #%s :", ircServerName, ic.room), f.Message) {
+			b.WriteString(line)
+		}
+	}
+	return []byte(b.String()), nil
+}
+
+func (ircCodec) Unmarshal(data []byte, v interface{}) error {
+	return errIRCNotReadable
+}
+
+// ircNick turns a username into a nick, which can't hold the characters
+// delimiting IRC messages.
+func ircNick(username string) string {
+	if username == "" {
+		return "anonymous"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '!', '@', ':', ',', '#', '\r', '\n', 0:
+			return '_'
+		}
+		return r
+	}, username)
+}
+
+// ircLines splits text into as many lines starting with prefix as it takes
+// to fit the IRC line length, without cutting a character in two.
+func ircLines(prefix, text string) []string {
+	room := ircMaxLine - 2 - len(prefix)
+
+	var lines []string
+	for _, part := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		for {
+			n := len(part)
+			if n > room {
+				n = room
+				for n > 0 && !utf8.RuneStart(part[n]) {
+					n--
+				}
+			}
+			lines = append(lines, prefix+part[:n]+"\r\n")
+			part = part[n:]
+			if part == "" {
+				break
+			}
+		}
+	}
+	return lines
+}
+
+// ircSession is a connection from an IRC client. Every channel it joins is
+// a Client of the hub, whose frames are written to the connection.
+type ircSession struct {
+	s    *Server
+	conn net.Conn
+	ip   string
+
+	nick, user string
+
+	// pass is the password sent with PASS, handed to the Authenticator as
+	// a bearer token. verified is set once it vouched for the nick, and
+	// admin if it gave the admin role.
+	pass     string
+	verified bool
+	admin    bool
+
+	// mu serializes the writes of the session and of the hub, and guards
+	// channels.
+	mu       sync.Mutex
+	channels map[string]*Client
+
+	logger *slog.Logger
+}
+
+// ircChannel is the connection of a Client joined through an IRC session.
+type ircChannel struct {
+	sess   *ircSession
+	room   string
+	reason string
+}
+
+func (ch *ircChannel) WriteMessage(_ int, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return ch.sess.write(string(data))
+}
+
+// WriteControl only keeps the reason of a close frame, which Close sends as
+// a kick.
+func (ch *ircChannel) WriteControl(messageType int, data []byte, _ time.Time) error {
+	if messageType == websocket.CloseMessage && len(data) > 2 {
+		ch.reason = string(data[2:])
+	}
+	return nil
+}
+
+// SetWriteDeadline is a no-op: the session bounds every write itself.
+func (ch *ircChannel) SetWriteDeadline(time.Time) error { return nil }
+
+func (ch *ircChannel) NextReader() (int, io.Reader, error) {
+	return 0, nil, errIRCNotReadable
+}
+
+func (ch *ircChannel) RemoteAddr() net.Addr { return ch.sess.conn.RemoteAddr() }
+
+// Close takes the session out of the channel, as the hub does when kicking
+// a client, leaving the rest of the session alone.
+func (ch *ircChannel) Close() error {
+	sess := ch.sess
+	sess.mu.Lock()
+	_, joined := sess.channels[ch.room]
+	delete(sess.channels, ch.room)
+	sess.mu.Unlock()
+
+	if !joined {
+		return nil
+	}
+	reason := ch.reason
+	if reason == "" {
+		reason = "disconnected"
+	}
+	return sess.write(fmt.Sprintf(":%s KICK #%s %s :%s\r\n", ircServerName, ch.room, sess.nick, reason))
+}
+
+// serveIRC accepts IRC clients on ln until it is closed.
+func (s *Server) serveIRC(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			s.logger.Error("accepting IRC connection", "err", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		go s.handleIRC(conn)
+	}
+}
+
+// handleIRC runs an IRC session until the client quits or goes away.
+func (s *Server) handleIRC(conn net.Conn) {
+	defer conn.Close()
+
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	connID := newConnID()
+	sess := &ircSession{
+		s:        s,
+		conn:     conn,
+		ip:       ip,
+		channels: make(map[string]*Client),
+		logger:   s.logger.With("conn", connID, "ip", ip, "transport", "irc"),
+	}
+	ctx, cancel := context.WithCancel(withConnID(context.Background(), connID))
+	defer cancel()
+
+	if s.draining.Load() {
+		sess.write("ERROR :Server is going away, try again later\r\n")
+		return
+	}
+	if s.maxConnsPerIP > 0 && s.connsFrom(ip) >= s.maxConnsPerIP {
+		sess.write("ERROR :Too many connections from this address\r\n")
+		return
+	}
+
+	defer sess.partAll()
+
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, ircMaxLine), 8192)
+
+	conn.SetReadDeadline(time.Now().Add(ircRegisterTimeout))
+	for sc.Scan() {
+		sess.touch()
+
+		cmd, params := parseIRCLine(sc.Text())
+		if cmd == "" {
+			continue
+		}
+		if !sess.handle(ctx, cmd, params) {
+			return
+		}
+	}
+	if err := sc.Err(); err != nil && unsafeError(err) {
+		sess.logger.Info("IRC connection ended", "err", err)
+	}
+}
+
+// parseIRCLine splits a line into its command, in upper case, and its
+// parameters, dropping the prefix.
+func parseIRCLine(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r")
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	if strings.HasPrefix(line, ":") {
+		line, trailing, hasTrailing = "", line[1:], true
+	}
+	params := strings.Fields(line)
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	if len(params) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+// write sends raw lines to the client.
+func (sess *ircSession) write(lines string) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.s.writeTimeout > 0 {
+		if err := sess.conn.SetWriteDeadline(time.Now().Add(sess.s.writeTimeout)); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(sess.conn, lines)
+	return err
+}
+
+// reply sends a numeric reply.
+func (sess *ircSession) reply(numeric string, params ...string) {
+	nick := sess.nick
+	if nick == "" {
+		nick = "*"
+	}
+	sess.write(fmt.Sprintf(":%s %s %s %s\r\n", ircServerName, numeric, nick, strings.Join(params, " ")))
+}
+
+func (sess *ircSession) registered() bool {
+	return sess.nick != "" && sess.user != ""
+}
+
+// touch marks every channel of the session as active.
+func (sess *ircSession) touch() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	for _, c := range sess.channels {
+		c.touch()
+	}
+}
+
+func (sess *ircSession) channel(room string) *Client {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	return sess.channels[room]
+}
+
+// handle runs one command. It reports false once the session is over.
+func (sess *ircSession) handle(ctx context.Context, cmd string, params []string) bool {
+	switch cmd {
+	case "PING":
+		sess.write(fmt.Sprintf(":%s PONG %s :%s\r\n", ircServerName, ircServerName, strings.Join(params, " ")))
+		return true
+	case "PONG":
+		return true
+	case "QUIT":
+		sess.write("ERROR :Closing link\r\n")
+		return false
+
+	case "NICK":
+		if len(params) == 0 || params[0] == "" {
+			sess.reply("431", ":No nickname given")
+			return true
+		}
+		if sess.nick != "" {
+			sess.reply("400", "NICK", ":Changing nick isn't supported")
+			return true
+		}
+		if nick := params[0]; ircNick(nick) != nick || len(nick) > 32 {
+			sess.reply("432", nick, ":Erroneous nickname")
+			return true
+		}
+		if err := sess.s.checkUsername(params[0]); err != nil {
+			sess.reply("432", params[0], ":"+err.Error())
+			return true
+		}
+		sess.nick = params[0]
+		return sess.welcome(ctx)
+
+	case "USER":
+		if len(params) < 4 {
+			sess.reply("461", "USER", ":Not enough parameters")
+			return true
+		}
+		if sess.user != "" {
+			sess.reply("462", ":You may not reregister")
+			return true
+		}
+		sess.user = params[0]
+		return sess.welcome(ctx)
+
+	case "PASS":
+		if len(params) == 0 {
+			sess.reply("461", "PASS", ":Not enough parameters")
+			return true
+		}
+		if sess.registered() {
+			sess.reply("462", ":You may not reregister")
+			return true
+		}
+		sess.pass = params[0]
+		return true
+	}
+
+	if !sess.registered() {
+		sess.reply("451", ":You have not registered")
+		return true
+	}
+
+	switch cmd {
+	case "JOIN":
+		if len(params) == 0 {
+			sess.reply("461", "JOIN", ":Not enough parameters")
+			return true
+		}
+		for _, name := range strings.Split(params[0], ",") {
+			sess.join(ctx, name)
+		}
+
+	case "PART":
+		if len(params) == 0 {
+			sess.reply("461", "PART", ":Not enough parameters")
+			return true
+		}
+		for _, name := range strings.Split(params[0], ",") {
+			sess.part(strings.TrimPrefix(name, "#"))
+		}
+
+	case "NAMES":
+		if len(params) == 0 {
+			sess.reply("366", "*", ":End of /NAMES list")
+			return true
+		}
+		for _, name := range strings.Split(params[0], ",") {
+			sess.names(strings.TrimPrefix(name, "#"))
+		}
+
+	case "PRIVMSG":
+		if len(params) < 2 {
+			sess.reply("412", ":No text to send")
+			return true
+		}
+		sess.privmsg(ctx, params[0], params[1])
+
+	default:
+		sess.reply("421", cmd, ":Unknown command")
+	}
+	return true
+}
+
+// welcome completes the registration once both NICK and USER were sent,
+// authenticating the session. It reports false when it was turned away.
+func (sess *ircSession) welcome(ctx context.Context) bool {
+	if !sess.registered() {
+		return true
+	}
+	if err := sess.authenticate(ctx); err != nil {
+		sess.logger.Info("IRC authentication failed", "err", err)
+		sess.reply("464", ":Password incorrect")
+		sess.write("ERROR :Closing link\r\n")
+		return false
+	}
+	sess.conn.SetReadDeadline(time.Time{})
+	sess.logger = sess.logger.With("username", sess.nick)
+
+	sess.reply("001", ":Welcome to the chat, "+sess.nick)
+	sess.reply("422", ":MOTD File is missing")
+	return true
+}
+
+// authenticate runs the Authenticator of the server on the session, as on
+// a WebSocket request passing the nick as the username and the password
+// as a bearer token, such as a JWT. A verified username must be the nick.
+func (sess *ircSession) authenticate(ctx context.Context) error {
+	s := sess.s
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "/irc?"+url.Values{"username": {sess.nick}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	r.RemoteAddr = sess.conn.RemoteAddr().String()
+	if sess.pass != "" {
+		r.Header.Set("Authorization", "Bearer "+sess.pass)
+	}
+
+	username, roles, err := s.auth.Authenticate(r)
+	if err != nil {
+		return err
+	}
+	if !s.verifiesUsers() {
+		return nil
+	}
+	if username, err = s.normalizeUsername(username); err != nil {
+		return err
+	}
+	if username == "" || username != sess.nick {
+		return fmt.Errorf("authenticated as %q, not as the nick %q", username, sess.nick)
+	}
+	sess.verified = true
+	sess.admin = hasRole(roles, roleAdmin)
+	return nil
+}
+
+// join adds the session to a channel, which maps to the room of the same
+// name. Private rooms need an invite, which IRC has no way to give.
+func (sess *ircSession) join(ctx context.Context, name string) {
+	s := sess.s
+	room := strings.TrimPrefix(name, "#")
+	if !strings.HasPrefix(name, "#") || !validRoomName(room) {
+		sess.reply("403", name, ":No such channel")
+		return
+	}
+	if sess.channel(room) != nil {
+		return
+	}
+
+	ok, err := s.ensureRoom(ctx, room)
+	if err != nil {
+		sess.logger.Error("joining room", "room", room, "err", err)
+		sess.reply("403", name, ":Couldn't join the channel")
+		return
+	}
+	if !ok {
+		sess.reply("403", name, ":No such channel")
+		return
+	}
+	opts, err := s.roomOptions(ctx, room)
+	if err != nil {
+		sess.logger.Error("loading room options", "room", room, "err", err)
+		sess.reply("403", name, ":Couldn't join the channel")
+		return
+	}
+	if opts.Private {
+		sess.reply("473", name, ":Cannot join channel (+i)")
+		return
+	}
+
+	c := &Client{
+		ws:           &ircChannel{sess: sess, room: room},
+		version:      protocolV2,
+		codec:        ircCodec{room: room},
+		room:         room,
+		ip:           sess.ip,
+		noEcho:       true,
+		noReplay:     true,
+		admin:        sess.admin,
+		claimed:      sess.nick,
+		session:      sess,
+		writeTimeout: s.writeTimeout,
+		connectedAt:  time.Now(),
+		bp:           s.backpressure,
+		logger:       sess.logger.With("room", room),
+		recent:       new(recentTexts),
+	}
+	c.username = c.claimed
+	if sess.verified {
+		c.verified = c.claimed
+	}
+	c.touch()
+
+	// the hub may write to the channel as soon as it knows the client
+	sess.mu.Lock()
+	sess.channels[room] = c
+	sess.mu.Unlock()
+
+	if !s.addClient(c, opts) {
+		sess.mu.Lock()
+		delete(sess.channels, room)
+		sess.mu.Unlock()
+		return
+	}
+
+	sess.write(fmt.Sprintf(":%s!%s@%s JOIN %s\r\n", sess.nick, sess.user, ircServerName, name))
+	sess.reply("331", name, ":No topic is set")
+	sess.names(room)
+
+	s.replayHistory(ctx, c)
+	s.emitEvent(ctx, eventConnect, room, c.claimed)
+}
+
+// part takes the session out of the channel of room.
+func (sess *ircSession) part(room string) {
+	c := sess.channel(room)
+	if c == nil {
+		sess.reply("442", "#"+room, ":You're not on that channel")
+		return
+	}
+
+	sess.mu.Lock()
+	delete(sess.channels, room)
+	sess.mu.Unlock()
+
+	sess.s.delClient(c)
+	sess.write(fmt.Sprintf(":%s!%s@%s PART #%s\r\n", sess.nick, sess.user, ircServerName, room))
+}
+
+// partAll leaves every channel when the session ends.
+func (sess *ircSession) partAll() {
+	sess.mu.Lock()
+	channels := sess.channels
+	sess.channels = make(map[string]*Client)
+	sess.mu.Unlock()
+
+	for _, c := range channels {
+		sess.s.delClient(c)
+	}
+}
+
+// names lists the members of room, WebSocket and IRC alike.
+func (sess *ircSession) names(room string) {
+	var nicks []string
+	for _, m := range sess.s.roster(room).Members {
+		nicks = append(nicks, ircNick(m.Username))
+	}
+
+	// keep each reply within the line length
+	prefix := fmt.Sprintf(":%s 353 %s = #%s :", ircServerName, sess.nick, room)
+	var line strings.Builder
+	for _, nick := range nicks {
+		if line.Len() > 0 && len(prefix)+line.Len()+1+len(nick) > ircMaxLine-2 {
+			sess.write(prefix + line.String() + "\r\n")
+			line.Reset()
+		}
+		if line.Len() > 0 {
+			line.WriteByte(' ')
+		}
+		line.WriteString(nick)
+	}
+	if line.Len() > 0 {
+		sess.write(prefix + line.String() + "\r\n")
+	}
+	sess.reply("366", "#"+room, ":End of /NAMES list")
+}
+
+// privmsg sends text to a channel through the same path as WebSocket
+// messages. CTCP actions become /me.
+func (sess *ircSession) privmsg(ctx context.Context, target, text string) {
+	room := strings.TrimPrefix(target, "#")
+	c := sess.channel(room)
+	if !strings.HasPrefix(target, "#") || c == nil {
+		sess.reply("404", target, ":Cannot send to channel")
+		return
+	}
+
+	if action, ok := strings.CutPrefix(text, "\x01ACTION "); ok {
+		text = "/me " + strings.TrimSuffix(action, "\x01")
+	} else if strings.HasPrefix(text, "\x01") {
+		// other CTCP requests aren't chat
+		return
+	}
+
+	if !sess.s.handleFrame(ctx, c, ChatMessage{Username: sess.nick, Text: text}) {
+		sess.mu.Lock()
+		delete(sess.channels, room)
+		sess.mu.Unlock()
+	}
+}
@@ -0,0 +1,179 @@
+package chat
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ircTestConn is an IRC client connected to a test server.
+type ircTestConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialIRC starts an IRC listener for s and connects to it.
+func dialIRC(t *testing.T, s *Server) *ircTestConn {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.serveIRC(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &ircTestConn{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (ic *ircTestConn) send(t *testing.T, lines ...string) {
+	t.Helper()
+
+	for _, line := range lines {
+		if _, err := ic.conn.Write([]byte(line + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// expect reads lines until one containing want, failing the test if the
+// connection ends first.
+func (ic *ircTestConn) expect(t *testing.T, want string) string {
+	t.Helper()
+
+	ic.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := ic.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("waiting for %q: %v", want, err)
+		}
+		if strings.Contains(line, want) {
+			return line
+		}
+	}
+}
+
+// expectClosed reads lines until the server closes the connection, and
+// returns them.
+func (ic *ircTestConn) expectClosed(t *testing.T) string {
+	t.Helper()
+
+	var lines strings.Builder
+	ic.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := ic.r.ReadString('\n')
+		lines.WriteString(line)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatalf("connection still open after %q", lines.String())
+			}
+			return lines.String()
+		}
+	}
+}
+
+// TestIRCAuthentication checks that IRC sessions are authenticated like
+// WebSocket clients, with the password as a bearer token.
+func TestIRCAuthentication(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+	s, _ := newTestServer(t)
+	ann := signJWT(t, "secret", "HS256", jwtClaims{Subject: "ann"})
+
+	tests := []struct {
+		name  string
+		lines []string
+	}{
+		{"no password", []string{"NICK ann", "USER ann 0 * :Ann"}},
+		{"wrong password", []string{"PASS " + signJWT(t, "other", "HS256", jwtClaims{Subject: "ann"}), "NICK ann", "USER ann 0 * :Ann"}},
+		{"someone else's password", []string{"PASS " + ann, "NICK bob", "USER bob 0 * :Bob"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ic := dialIRC(t, s)
+			ic.send(t, tt.lines...)
+			if got := ic.expectClosed(t); !strings.Contains(got, " 464 ") || strings.Contains(got, " 001 ") {
+				t.Errorf("got %q, want the password refused", got)
+			}
+		})
+	}
+
+	ic := dialIRC(t, s)
+	ic.send(t, "PASS "+ann, "NICK ann", "USER ann 0 * :Ann", "JOIN #general")
+	ic.expect(t, " 001 ann ")
+	ic.expect(t, " 366 ")
+	waitClients(t, s, 1)
+
+	bob := dialTestServer(t, s, "room=general&access_token="+signJWT(t, "secret", "HS256", jwtClaims{Subject: "bob"}), "chat.v2")
+	waitClients(t, s, 2)
+	if err := bob.WriteJSON(ChatMessage{Text: "psst", To: "ann"}); err != nil {
+		t.Fatal(err)
+	}
+	if line := ic.expect(t, "PRIVMSG"); !strings.Contains(line, ":bob!") || !strings.HasSuffix(line, ":psst\r\n") {
+		t.Errorf("got %q, want bob's direct message", line)
+	}
+}
+
+// TestIRCWithoutAuth checks that without an Authenticator verifying users,
+// IRC sessions need no password and go by their nick.
+func TestIRCWithoutAuth(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	ic := dialIRC(t, s)
+	ic.send(t, "NICK ann", "USER ann 0 * :Ann", "JOIN #general")
+	ic.expect(t, " 001 ann ")
+	ic.expect(t, " 366 ")
+	waitClients(t, s, 1)
+
+	bob := dialTestServer(t, s, "room=general&username=bob", "chat.v2")
+	waitClients(t, s, 2)
+	if err := bob.WriteJSON(ChatMessage{Text: "hello all"}); err != nil {
+		t.Fatal(err)
+	}
+	if line := ic.expect(t, "PRIVMSG"); !strings.Contains(line, ":bob!") || !strings.HasSuffix(line, ":hello all\r\n") {
+		t.Errorf("got %q, want bob's message", line)
+	}
+}
+
+// TestIRCDuplicateUsers checks that the channels an IRC session joins share
+// its username under every duplicate policy, and keep it while any of them
+// is left.
+func TestIRCDuplicateUsers(t *testing.T) {
+	for _, policy := range []string{duplicateAllow, duplicateReject, duplicateReplace} {
+		t.Run(policy, func(t *testing.T) {
+			t.Setenv("DUPLICATE_USERS", policy)
+			s, _ := newTestServer(t)
+
+			ic := dialIRC(t, s)
+			ic.send(t, "NICK ann", "USER ann 0 * :Ann", "JOIN #general")
+			ic.expect(t, " 366 ")
+			ic.send(t, "JOIN #random")
+			ic.expect(t, " 366 ")
+			waitClients(t, s, 2)
+
+			ic.send(t, "PART #general")
+			ic.expect(t, "PART #general")
+			waitClients(t, s, 1)
+			online := make(chan *Client)
+			s.ops <- func(h *hub) { online <- h.users["ann"] }
+			if c := <-online; c == nil || c.room != "random" {
+				t.Fatalf("ann held by %v, want the #random channel", c)
+			}
+
+			if policy == duplicateReject {
+				ws := dialTestServer(t, s, "room=general&username=ann")
+				if got := closedWith(t, ws); got != websocket.ClosePolicyViolation {
+					t.Errorf("other connection closed with %d, want %d", got, websocket.ClosePolicyViolation)
+				}
+			}
+		})
+	}
+}
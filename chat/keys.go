@@ -0,0 +1,13 @@
+package chat
+
+// keyspace builds the Redis keys of one chat. Every key goes through it, so
+// that deployments sharing a Redis instance under different prefixes never
+// see each other's data.
+type keyspace struct {
+	prefix string
+}
+
+// key joins prefix and name.
+func (ks keyspace) key(name string) string {
+	return ks.prefix + name
+}
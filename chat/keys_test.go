@@ -0,0 +1,89 @@
+package chat
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestKeyspace(t *testing.T) {
+	builders := map[string]func(keyspace) string{
+		"message":    func(ks keyspace) string { return ks.message("1") },
+		"roomIndex":  func(ks keyspace) string { return ks.roomIndex("general") },
+		"messageSeq": func(ks keyspace) string { return ks.messageSeq() },
+		"rooms":      func(ks keyspace) string { return ks.rooms() },
+		"room":       func(ks keyspace) string { return ks.room("general") },
+		"sanction":   func(ks keyspace) string { return ks.sanction(sanctionBan, "ann") },
+		"replies":    func(ks keyspace) string { return ks.replies("1") },
+		"invite":     func(ks keyspace) string { return ks.invite("general", "abc") },
+		"lock":       func(ks keyspace) string { return ks.lock(retentionLock) },
+	}
+	for name, build := range builders {
+		t.Run(name, func(t *testing.T) {
+			bare := build(keyspace{})
+			for _, prefix := range []string{"one:", "two:"} {
+				if got := build(keyspace{prefix: prefix}); got != prefix+bare {
+					t.Errorf("under %q: %q, want %q", prefix, got, prefix+bare)
+				}
+			}
+		})
+	}
+}
+
+// TestKeyPrefixIsolation checks that two chats sharing a Redis instance
+// under different prefixes don't see each other's messages.
+func TestKeyPrefixIsolation(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	t.Setenv("REDIS_URL", "redis://"+mr.Addr())
+
+	prefixes := []string{"one:", "two:"}
+	servers := make([]*Server, len(prefixes))
+	for i, prefix := range prefixes {
+		cfg := loadTestConfig(t)
+		cfg.RedisKeyPrefix = prefix
+		servers[i] = startTestServer(t, cfg)
+	}
+
+	watcher := dialTestServer(t, servers[1], "room=general&username=watcher")
+	waitClients(t, servers[1], 1)
+	for i, s := range servers {
+		ws := dialTestServer(t, s, "room=general&username=ann")
+		if err := ws.WriteJSON(ChatMessage{Username: "ann", Text: "hi from " + prefixes[i]}); err != nil {
+			t.Fatal(err)
+		}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := ws.ReadJSON(new(ChatMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first broadcast the watcher gets is its own chat's
+	watcher.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg ChatMessage
+	if err := watcher.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Text != "hi from two:" {
+		t.Errorf("watcher got %q, want the message of its own chat", msg.Text)
+	}
+
+	for i, s := range servers {
+		msgs, err := s.store.Recent(context.Background(), "general", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "hi from " + prefixes[i]; len(msgs) != 1 || msgs[0].Text != want {
+			t.Errorf("history under %q = %q, want %q", prefixes[i], texts(msgs), want)
+		}
+	}
+
+	for _, key := range mr.Keys() {
+		if !strings.HasPrefix(key, prefixes[0]) && !strings.HasPrefix(key, prefixes[1]) {
+			t.Errorf("key %q outside both prefixes", key)
+		}
+	}
+}
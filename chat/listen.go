@@ -0,0 +1,110 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSocketMode lets the socket's group, nginx's for example, connect.
+const defaultSocketMode fs.FileMode = 0o660
+
+// parseSocketMode parses the octal permissions of SOCKET_MODE.
+func parseSocketMode(v string) (fs.FileMode, error) {
+	if v == "" {
+		return defaultSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("SOCKET_MODE: %q is not octal permissions", v)
+	}
+	return fs.FileMode(mode), nil
+}
+
+// listen opens the listener of the HTTP server: the socket passed by
+// systemd socket activation if any, else LISTEN_ADDR, a TCP address or
+// unix:/path, else PORT on every interface.
+func (s *Server) listen() (net.Listener, error) {
+	if ln, err := systemdListener(); ln != nil || err != nil {
+		return ln, err
+	}
+
+	path, ok := strings.CutPrefix(s.cfg.ListenAddr, "unix:")
+	if !ok {
+		addr := s.cfg.ListenAddr
+		if addr == "" {
+			addr = ":" + s.cfg.Port
+		}
+		return net.Listen("tcp", addr)
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	// closing it on shutdown removes the socket file
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, s.cfg.SocketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket file at path left behind by a process
+// that didn't shut down cleanly. A socket still accepting connections
+// belongs to a running server and is left alone.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another server", path)
+	}
+	return os.Remove(path)
+}
+
+// systemdListenFD is the first file descriptor systemd passes.
+const systemdListenFD = 3
+
+// systemdListener returns the socket passed by systemd socket activation,
+// nil when the process wasn't started that way. Only the first socket is
+// used.
+func systemdListener() (net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+
+	// not for the processes started from this one
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(systemdListenFD, "LISTEN_FD_3")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("using the socket passed by systemd: %w", err)
+	}
+	return ln, nil
+}
@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// NewLogHandler builds the handler for the process logger from LOG_FORMAT
+// ("text" or "json") and LOG_LEVEL.
+func NewLogHandler(w io.Writer) slog.Handler {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "json") {
+		return contextHandler{slog.NewJSONHandler(w, opts)}
+	}
+	return contextHandler{slog.NewTextHandler(w, opts)}
+}
+
+// messageAttrs describes msg for the debug logs. Only its metadata is
+// logged, unless LOG_PAYLOADS is set. The room is left to the logger when
+// msg doesn't name one.
+func (s *Server) messageAttrs(msg ChatMessage) []interface{} {
+	attrs := []interface{}{"type", msg.Type, "id", msg.ID, "username", msg.Username, "length", len(msg.Text)}
+	if msg.Room != "" {
+		attrs = append(attrs, "room", msg.Room)
+	}
+	if s.logPayloads {
+		attrs = append(attrs, "text", msg.Text)
+	}
+	return attrs
+}
+
+type connIDKey struct{}
+
+// newConnID returns a short random ID correlating the log lines of one
+// connection.
+func newConnID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// withConnID returns a copy of ctx carrying the connection ID id.
+func withConnID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, connIDKey{}, id)
+}
+
+// connIDFrom returns the connection ID carried by ctx, if any.
+func connIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(connIDKey{}).(string)
+	return id
+}
+
+// contextHandler adds the connection ID of the context to records logged
+// with one, such as through slog.InfoContext.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := connIDFrom(ctx); id != "" {
+		r.AddAttrs(slog.String("conn", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
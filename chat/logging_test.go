@@ -0,0 +1,175 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer collects the lines logged by a server.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *logBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(p)
+}
+
+// records decodes the JSON lines logged so far.
+func (lb *logBuffer) records(t *testing.T) []map[string]interface{} {
+	t.Helper()
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	var records []map[string]interface{}
+	sc := bufio.NewScanner(bytes.NewReader(lb.buf.Bytes()))
+	for sc.Scan() {
+		var rec map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("log line %q: %v", sc.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestContextHandler(t *testing.T) {
+	t.Setenv("LOG_FORMAT", "json")
+	t.Setenv("LOG_LEVEL", "")
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want interface{}
+	}{
+		{"without ID", context.Background(), nil},
+		{"with ID", withConnID(context.Background(), "abc123"), "abc123"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lb logBuffer
+			logger := slog.New(NewLogHandler(&lb)).With("room", "general")
+			logger.InfoContext(tt.ctx, "hello")
+
+			records := lb.records(t)
+			if len(records) != 1 {
+				t.Fatalf("%d lines logged, want 1", len(records))
+			}
+			if got := records[0]["conn"]; got != tt.want {
+				t.Errorf("conn = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestConnectionLogs checks that the lines logged over the lifetime of a
+// connection all carry its ID, and no other connection's.
+func TestConnectionLogs(t *testing.T) {
+	t.Setenv("LOG_FORMAT", "json")
+	t.Setenv("LOG_LEVEL", "debug")
+	var lb logBuffer
+	s, _ := newTestServer(t, WithLogger(slog.New(NewLogHandler(&lb))))
+
+	for _, username := range []string{"ann", "bob"} {
+		ws := dialTestServer(t, s, "room=general&username="+username)
+		if err := ws.WriteJSON(ChatMessage{Username: username, Text: "hi from " + username}); err != nil {
+			t.Fatal(err)
+		}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := ws.ReadJSON(new(ChatMessage)); err != nil {
+			t.Fatal(err)
+		}
+		ws.Close()
+		waitClients(t, s, 0)
+	}
+
+	// the lifecycle of each connection, by its ID
+	lifecycles := make(map[string][]string)
+	for _, rec := range lb.records(t) {
+		id, _ := rec["conn"].(string)
+		msg, _ := rec["msg"].(string)
+		switch msg {
+		case "connected", "disconnected":
+			if id == "" {
+				t.Errorf("%q logged without a connection ID", msg)
+				continue
+			}
+			lifecycles[id] = append(lifecycles[id], msg)
+		}
+	}
+
+	if len(lifecycles) != 2 {
+		t.Fatalf("%d connection IDs logged, want 2: %v", len(lifecycles), lifecycles)
+	}
+	want := "connected,disconnected"
+	for id, msgs := range lifecycles {
+		if got := strings.Join(msgs, ","); got != want {
+			t.Errorf("connection %s logged %s, want %s", id, got, want)
+		}
+	}
+}
+
+// TestLogPayloads checks that the debug logs of messages leave out their
+// text unless LOG_PAYLOADS is set.
+func TestLogPayloads(t *testing.T) {
+	const text = "my secret plans"
+
+	tests := []struct {
+		name    string
+		enabled bool
+	}{
+		{"default", false},
+		{"enabled", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LOG_FORMAT", "json")
+			t.Setenv("LOG_LEVEL", "debug")
+			if tt.enabled {
+				t.Setenv("LOG_PAYLOADS", "1")
+			}
+			var lb logBuffer
+			s, _ := newTestServer(t, WithLogger(slog.New(NewLogHandler(&lb))))
+
+			ws := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+			if err := ws.WriteJSON(ChatMessage{Text: text}); err != nil {
+				t.Fatal(err)
+			}
+			readFrameOf(t, ws, messageTypeChat, nil)
+
+			var logged int
+			for _, rec := range lb.records(t) {
+				if msg := rec["msg"]; msg != "received frame" && msg != "broadcasting message" {
+					continue
+				}
+				logged++
+				if rec["room"] != "general" || rec["username"] != "ann" || rec["length"] != float64(len(text)) {
+					t.Errorf("%q logged without the message metadata: %v", rec["msg"], rec)
+				}
+				if got := rec["text"] == text; got != tt.enabled {
+					t.Errorf("%q logged the text %v, want %v", rec["msg"], got, tt.enabled)
+				}
+			}
+			if logged != 2 {
+				t.Errorf("%d messages logged, want 2", logged)
+			}
+			if !tt.enabled {
+				lb.mu.Lock()
+				defer lb.mu.Unlock()
+				if strings.Contains(lb.buf.String(), text) {
+					t.Error("the message text was logged")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// schemaVersion is the version of the records written by RedisStore.
+//
+//   - Records without a version are bare {username, text} JSON objects with
+//     no ID, kept in a list per room.
+//   - Version 1 records are the same JSON with an ID, in the same list, and
+//     indexed by ID in the rs.keys.legacyIndex() hash.
+//   - Version 2 moved every message to its own hash and the room order to a
+//     sorted set.
+const schemaVersion = 2
+
+// legacyRecord is a message as kept in the history list.
+type legacyRecord struct {
+	Schema int `json:"schema"`
+	ChatMessage
+}
+
+// legacyHistory is the Redis list that held the messages of room before
+// version 2. The default room used the original key.
+func (ks keyspace) legacyHistory(room string) string {
+	if room == defaultRoom {
+		return ks.key("chat_messages")
+	}
+	return ks.key("chat_messages:" + room)
+}
+
+// legacyBackup keeps the migrated records of room, in case they are needed
+// after the upgrade.
+func (ks keyspace) legacyBackup(room string) string {
+	return ks.legacyHistory(room) + ":migrated"
+}
+
+// legacyIndex is the version 1 hash from message ID to record.
+func (ks keyspace) legacyIndex() string {
+	return ks.key("chat_message_index")
+}
+
+// replaceHead swaps the head of a history list for an updated record, unless
+// it changed since it was read.
+var replaceHead = redis.NewScript(`
+if redis.call("LINDEX", KEYS[1], 0) ~= ARGV[1] then
+	return 0
+end
+redis.call("LSET", KEYS[1], 0, ARGV[2])
+return 1
+`)
+
+// popHead moves the head of a history list to the backup list, unless it
+// changed since it was read.
+var popHead = redis.NewScript(`
+if redis.call("LINDEX", KEYS[1], 0) ~= ARGV[1] then
+	return 0
+end
+redis.call("LPOP", KEYS[1])
+redis.call("RPUSH", KEYS[2], ARGV[1])
+return 1
+`)
+
+// Migrate moves the history of every room out of the legacy lists into the
+// current layout. Each record is written before it is popped off its list and
+// the writes are idempotent, so it is safe to run repeatedly and to resume
+// after an interruption.
+func (rs *RedisStore) Migrate(ctx context.Context) error {
+	rooms, err := rs.rdb.SMembers(ctx, rs.keys.rooms()).Result()
+	if err != nil {
+		return err
+	}
+	rooms = append(rooms, defaultRoom)
+
+	seen := make(map[string]bool)
+	for _, room := range rooms {
+		if seen[room] {
+			continue
+		}
+		seen[room] = true
+
+		n, err := rs.migrateRoom(ctx, room)
+		if err != nil {
+			return fmt.Errorf("migrating %s: %w", room, err)
+		}
+		if n > 0 {
+			slog.Info("migrated messages", "room", room, "count", n, "schema", schemaVersion)
+		}
+	}
+
+	// every record now has its own hash
+	return rs.rdb.Del(ctx, rs.keys.legacyIndex()).Err()
+}
+
+func (rs *RedisStore) migrateRoom(ctx context.Context, room string) (int, error) {
+	key := rs.keys.legacyHistory(room)
+	keys := []string{key, rs.keys.legacyBackup(room)}
+
+	var migrated int
+	for {
+		old, err := rs.rdb.LIndex(ctx, key, 0).Result()
+		if err == redis.Nil {
+			return migrated, nil
+		}
+		if err != nil {
+			return migrated, err
+		}
+
+		var rec legacyRecord
+		if err := json.Unmarshal([]byte(old), &rec); err != nil {
+			// it stays in the backup list for someone to look at
+			slog.Warn("skipping undecodable record", "room", room, "err", err)
+			if err := popHead.Run(ctx, rs.rdb, keys, old).Err(); err != nil {
+				return migrated, err
+			}
+			continue
+		}
+
+		if rec.ID == "" {
+			// persist the new ID first, so that a resumed run keeps it.
+			// The record keeps schema 0 to remember it had none.
+			if err := rs.assignID(ctx, &rec); err != nil {
+				return migrated, err
+			}
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return migrated, err
+			}
+			if err := replaceHead.Run(ctx, rs.rdb, []string{key}, old, data).Err(); err != nil {
+				return migrated, err
+			}
+			continue
+		}
+
+		msg := rec.ChatMessage
+		msg.Room = room
+
+		score, _ := strconv.ParseFloat(msg.ID, 64)
+		if rec.Schema == 0 {
+			// IDs given out now are newer than every other message, so
+			// order these before all of them, by their place in the list.
+			// A resumed run sees a shorter list and keeps the order.
+			n, err := rs.rdb.LLen(ctx, key).Result()
+			if err != nil {
+				return migrated, err
+			}
+			score = -float64(n)
+		}
+
+		_, err = rs.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			rs.writeMessage(ctx, pipe, room, &msg, score)
+			return nil
+		})
+		if err != nil {
+			return migrated, err
+		}
+
+		ok, err := popHead.Run(ctx, rs.rdb, keys, old).Int()
+		if err != nil {
+			return migrated, err
+		}
+		if ok == 1 {
+			migrated++
+		}
+	}
+}
+
+// assignID gives a record that predates IDs a new one.
+func (rs *RedisStore) assignID(ctx context.Context, rec *legacyRecord) error {
+	id, err := rs.rdb.Incr(ctx, rs.keys.messageSeq()).Result()
+	if err != nil {
+		return err
+	}
+	rec.ID = strconv.FormatInt(id, 10)
+	return nil
+}
@@ -0,0 +1,90 @@
+package chat
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisStoreMigrate(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	rs := NewRedisStore(rdb, "test:")
+
+	// history as left by the earlier versions: bare records, one that
+	// isn't JSON, and records of version 1 with their IDs
+	legacy := map[string][]string{
+		defaultRoom: {
+			`{"username":"ann","text":"first"}`,
+			`not json`,
+			`{"username":"bob","text":"second"}`,
+			`{"schema":1,"id":"5","username":"ann","text":"third"}`,
+		},
+		"random": {
+			`{"schema":1,"id":"6","username":"carol","text":"elsewhere"}`,
+		},
+	}
+	for room, records := range legacy {
+		for _, rec := range records {
+			mr.RPush(rs.keys.legacyHistory(room), rec)
+		}
+	}
+	mr.SAdd(rs.keys.rooms(), "random")
+	mr.Set(rs.keys.messageSeq(), "6")
+	mr.HSet(rs.keys.legacyIndex(), "5", legacy[defaultRoom][3])
+
+	// a second run finds nothing left to do
+	for run := 0; run < 2; run++ {
+		if err := rs.Migrate(ctx); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+	}
+
+	tests := []struct {
+		room string
+		want []string
+	}{
+		{defaultRoom, []string{"first", "second", "third"}},
+		{"random", []string{"elsewhere"}},
+	}
+	for _, tt := range tests {
+		msgs, err := rs.Recent(ctx, tt.room, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var texts []string
+		ids := make(map[string]bool)
+		for _, msg := range msgs {
+			texts = append(texts, msg.Text)
+			if msg.ID == "" || ids[msg.ID] {
+				t.Errorf("%s: message %q has ID %q, want a unique one", tt.room, msg.Text, msg.ID)
+			}
+			ids[msg.ID] = true
+		}
+		if !reflect.DeepEqual(texts, tt.want) {
+			t.Errorf("history of %s = %q, want %q", tt.room, texts, tt.want)
+		}
+
+		if mr.Exists(rs.keys.legacyHistory(tt.room)) {
+			t.Errorf("legacy list of %s still there", tt.room)
+		}
+		backup, err := mr.List(rs.keys.legacyBackup(tt.room))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(backup) != len(legacy[tt.room]) {
+			t.Errorf("backup of %s has %d records, want %d", tt.room, len(backup), len(legacy[tt.room]))
+		}
+	}
+
+	if msg, err := rs.Get(ctx, "5"); err != nil || msg.Text != "third" {
+		t.Errorf("Get(5) = %+v, %v, want the version 1 record", msg, err)
+	}
+	if mr.Exists(rs.keys.legacyIndex()) {
+		t.Error("version 1 index still there")
+	}
+}
@@ -0,0 +1,15 @@
+CREATE TABLE messages (
+	id             BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	room           TEXT    NOT NULL,
+	username       TEXT    NOT NULL,
+	text           TEXT    NOT NULL,
+	created_at     BIGINT  NOT NULL,
+	deleted        BOOLEAN NOT NULL DEFAULT FALSE,
+	reply_to       TEXT    NOT NULL DEFAULT '',
+	parent_deleted BOOLEAN NOT NULL DEFAULT FALSE,
+	display_name   TEXT    NOT NULL DEFAULT '',
+	avatar_url     TEXT    NOT NULL DEFAULT ''
+);
+
+CREATE INDEX messages_room_id ON messages (room, id);
+CREATE INDEX messages_reply_to ON messages (reply_to) WHERE reply_to != '';
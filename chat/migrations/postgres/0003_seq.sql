@@ -0,0 +1 @@
+ALTER TABLE messages ADD COLUMN seq BIGINT NOT NULL DEFAULT 0;
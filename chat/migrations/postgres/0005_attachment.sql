@@ -0,0 +1 @@
+ALTER TABLE messages ADD COLUMN attachment TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS messages (
+	id             INTEGER PRIMARY KEY AUTOINCREMENT,
+	room           TEXT    NOT NULL,
+	username       TEXT    NOT NULL,
+	text           TEXT    NOT NULL,
+	created_at     INTEGER NOT NULL,
+	deleted        BOOLEAN NOT NULL DEFAULT FALSE,
+	reply_to       TEXT    NOT NULL DEFAULT '',
+	parent_deleted BOOLEAN NOT NULL DEFAULT FALSE,
+	display_name   TEXT    NOT NULL DEFAULT '',
+	avatar_url     TEXT    NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS messages_room_id ON messages (room, id);
+CREATE INDEX IF NOT EXISTS messages_reply_to ON messages (reply_to) WHERE reply_to != '';
@@ -0,0 +1 @@
+ALTER TABLE messages ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;
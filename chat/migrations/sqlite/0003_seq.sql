@@ -0,0 +1 @@
+ALTER TABLE messages ADD COLUMN seq INTEGER NOT NULL DEFAULT 0;
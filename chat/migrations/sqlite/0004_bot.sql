@@ -0,0 +1 @@
+ALTER TABLE messages ADD COLUMN bot BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,2 @@
+ALTER TABLE messages ADD COLUMN recipient TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN status TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,21 @@
+CREATE TABLE rooms (
+	name TEXT PRIMARY KEY
+);
+
+CREATE TABLE room_fields (
+	room  TEXT NOT NULL,
+	field TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (room, field)
+);
+
+CREATE TABLE room_seqs (
+	room TEXT PRIMARY KEY,
+	seq  INTEGER NOT NULL
+);
+
+CREATE TABLE locks (
+	name       TEXT PRIMARY KEY,
+	token      TEXT    NOT NULL,
+	expires_at INTEGER NOT NULL
+);
@@ -0,0 +1,202 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// A sanction restricts a username across all of its connections. Sanctions
+// are Redis keys whose TTL is the sanction's remaining time, so they expire
+// on their own and survive restarts.
+type sanction string
+
+const (
+	// sanctionMute rejects everything the user sends while still
+	// delivering messages to them.
+	sanctionMute sanction = "mute"
+
+	// sanctionBan disconnects the user as soon as they send anything.
+	sanctionBan sanction = "ban"
+)
+
+// sanction is the Redis key of sanction k on username.
+func (ks keyspace) sanction(k sanction, username string) string {
+	return ks.key(string(k) + ":" + username)
+}
+
+// remaining reports how long the sanction on username lasts. ok is false when
+// there is none; a zero duration with ok set means it never expires.
+func (s *Server) sanctionRemaining(ctx context.Context, k sanction, username string) (d time.Duration, ok bool, err error) {
+	// sanctions live in Redis, so without it there are none
+	if !s.hasRedis() {
+		return 0, false, nil
+	}
+
+	d, err = s.rdb.TTL(ctx, s.keys.sanction(k, username)).Result()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch d {
+	case -2: // no such key
+		return 0, false, nil
+	case -1: // no expiry
+		return 0, true, nil
+	}
+	return d, true, nil
+}
+
+// checkSanctions reports whether username may send a message from c. Muted
+// users are told how long the mute lasts; banned users get an error and
+// should be disconnected.
+func (s *Server) checkSanctions(ctx context.Context, c *Client, username string) (allowed, disconnect bool, err error) {
+	_, banned, err := s.sanctionRemaining(ctx, sanctionBan, username)
+	if err != nil {
+		return false, false, err
+	}
+	if banned {
+		s.sendError(c, "banned", "you are banned from this server")
+		return false, true, nil
+	}
+
+	d, muted, err := s.sanctionRemaining(ctx, sanctionMute, username)
+	if err != nil {
+		return false, false, err
+	}
+	if muted {
+		f := errorFrame{Code: "muted", Message: "you are muted"}
+		if d > 0 {
+			f.ExpiresIn = int64((d + time.Second - 1) / time.Second)
+		}
+		s.sendErrorFrame(c, f)
+		return false, false, nil
+	}
+
+	return true, false, nil
+}
+
+// Sanction is a mute or ban as reported by the admin API.
+type Sanction struct {
+	Username  string     `json:"username"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type sanctionRequest struct {
+	Username string `json:"username"`
+
+	// Duration is in seconds, 0 meaning until lifted.
+	Duration int64 `json:"duration"`
+}
+
+// handleAddSanction returns a handler applying k to the user in the body.
+func (s *Server) handleAddSanction(k sanction) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req sanctionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Username == "" {
+			http.Error(w, "username is required", http.StatusBadRequest)
+			return
+		}
+		if req.Duration < 0 {
+			http.Error(w, "duration must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		d := time.Duration(req.Duration) * time.Second
+		if err := s.rdb.Set(r.Context(), s.keys.sanction(k, req.Username), time.Now().Unix(), d).Err(); err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		s.audit(AuditEntry{Action: string(k), Actor: auditActorAdmin, Target: req.Username, IP: s.clientIP(r)})
+
+		resp := Sanction{Username: req.Username}
+		if d > 0 {
+			t := time.Now().UTC().Add(d)
+			resp.ExpiresAt = &t
+		}
+		writeJSONResponse(w, http.StatusCreated, resp)
+	}
+}
+
+// handleListSanctions returns a handler listing the active sanctions of kind k.
+func (s *Server) handleListSanctions(k sanction) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		prefix := s.keys.sanction(k, "")
+
+		var keys []string
+		iter := s.rdb.Scan(ctx, 0, prefix+"*", 100).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			internalError(w, r, err)
+			return
+		}
+		sort.Strings(keys)
+
+		cmds, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys {
+				pipe.TTL(ctx, key)
+			}
+			return nil
+		})
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		now := time.Now().UTC()
+		list := make([]Sanction, 0, len(keys))
+		for i, key := range keys {
+			ttl := cmds[i].(*redis.DurationCmd).Val()
+			if ttl == -2 {
+				continue // expired in the meantime
+			}
+
+			sc := Sanction{Username: strings.TrimPrefix(key, prefix)}
+			if ttl > 0 {
+				t := now.Add(ttl)
+				sc.ExpiresAt = &t
+			}
+			list = append(list, sc)
+		}
+
+		writeJSONResponse(w, http.StatusOK, list)
+	}
+}
+
+// handleLiftSanction returns a handler removing k from the user in the path.
+// Lifting a mute also resets the escalation of the user's auto-mutes.
+func (s *Server) handleLiftSanction(k sanction) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.PathValue("username")
+		n, err := s.rdb.Del(r.Context(), s.keys.sanction(k, username)).Result()
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		if n == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		if k == sanctionMute {
+			if err := s.rdb.Del(r.Context(), s.keys.floodLevel(username), s.keys.violations(username)).Err(); err != nil {
+				s.logger.Warn("resetting auto-mutes", "username", username, "err", err)
+			}
+		}
+
+		s.audit(AuditEntry{Action: "un" + string(k), Actor: auditActorAdmin, Target: username, IP: s.clientIP(r)})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,155 @@
+package chat
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// messageTypeMonitor is the frame type of the events sent to monitors.
+const messageTypeMonitor = "monitor"
+
+// Events of the monitor feed.
+const (
+	monitorMessage   = "message"
+	monitorJoin      = "join"
+	monitorLeave     = "leave"
+	monitorViolation = "violation"
+	monitorError     = "error"
+)
+
+// monitorFrame is an event of the monitor feed. IP is the client's, empty
+// for the messages posted over HTTP or by bots. Code is the rule broken or
+// the failure, Reason why a client was disconnected, if it was.
+type monitorFrame struct {
+	Type      string       `json:"type"`
+	Event     string       `json:"event"`
+	Room      string       `json:"room,omitempty"`
+	IP        string       `json:"ip,omitempty"`
+	Username  string       `json:"username,omitempty"`
+	Code      string       `json:"code,omitempty"`
+	Reason    string       `json:"reason,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	Message   *ChatMessage `json:"message,omitempty"`
+	Timestamp int64        `json:"ts"`
+}
+
+// monitor is an admin connection watching every room of this instance. It
+// isn't a Client: nothing is broadcast to it, it can't post, and it counts
+// toward no room, roster or connection limit.
+type monitor struct {
+	ws           *websocket.Conn
+	writeTimeout time.Duration
+	logger       *slog.Logger
+
+	// count is the number of monitors of the server, which publishAsync
+	// checks without going through the hub.
+	count *atomic.Int64
+}
+
+// addMonitor registers m with the hub. It runs on the hub.
+func addMonitor(h *hub, m *monitor) {
+	h.monitors[m] = true
+	m.count.Add(1)
+}
+
+// removeMonitor unregisters m, reporting false when it was already
+// removed. It runs on the hub.
+func removeMonitor(h *hub, m *monitor) bool {
+	if !h.monitors[m] {
+		return false
+	}
+	delete(h.monitors, m)
+	m.count.Add(-1)
+	return true
+}
+
+// publish sends f to every monitor, dropping those that can't keep up. It
+// runs on the hub.
+func publish(h *hub, f monitorFrame) {
+	if len(h.monitors) == 0 {
+		return
+	}
+	f.Type = messageTypeMonitor
+	f.Timestamp = time.Now().UnixMilli()
+
+	for m := range h.monitors {
+		if m.writeTimeout > 0 {
+			m.ws.SetWriteDeadline(time.Now().Add(m.writeTimeout))
+		}
+		if err := m.ws.WriteJSON(f); err != nil {
+			if unsafeError(err) {
+				m.logger.Warn("writing to monitor", "err", err)
+			}
+			removeMonitor(h, m)
+			m.ws.Close()
+		}
+	}
+}
+
+// publishAsync sends f to the monitors from outside the hub. It costs
+// nothing while nobody is watching.
+func (s *Server) publishAsync(f monitorFrame) {
+	if s.monitors.Load() == 0 {
+		return
+	}
+	s.ops <- func(h *hub) {
+		publish(h, f)
+	}
+}
+
+// handleMonitor streams the events of every room to an admin: the messages,
+// joins and leaves, the rules clients broke and the messages that couldn't
+// be stored. Frames sent by the monitor are ignored.
+func (s *Server) handleMonitor(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.WarnContext(r.Context(), "monitor upgrade failed", "err", err)
+		return
+	}
+	defer ws.Close()
+
+	ip := s.clientIP(r)
+	m := &monitor{
+		ws:           ws,
+		writeTimeout: s.writeTimeout,
+		logger:       s.logger.With("monitor", newConnID(), "ip", ip),
+		count:        &s.monitors,
+	}
+	m.logger.Info("monitor connected")
+	s.audit(AuditEntry{Action: auditMonitor, Actor: auditActorAdmin, IP: ip})
+
+	s.ops <- func(h *hub) {
+		addMonitor(h, m)
+	}
+	defer func() {
+		s.ops <- func(h *hub) {
+			removeMonitor(h, m)
+		}
+	}()
+
+	// reading answers pings and notices the monitor going away
+	for {
+		_, r, err := ws.NextReader()
+		if err != nil {
+			m.logger.Info("monitor disconnected", "err", err)
+			return
+		}
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return
+		}
+	}
+}
+
+// monitorViolation tells the monitors c broke the rule code.
+func (s *Server) monitorViolation(c *Client, code string) {
+	username := c.claimed
+	if username == "" {
+		username = c.username
+	}
+	s.publishAsync(monitorFrame{Event: monitorViolation, Room: c.room, IP: c.ip, Username: username, Code: code})
+}
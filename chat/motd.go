@@ -0,0 +1,80 @@
+package chat
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// motd is the Redis key of the message of the day set by admins, which
+// replaces the MOTD setting.
+func (ks keyspace) motd() string {
+	return ks.key("motd")
+}
+
+func init() {
+	registerCommand("motd", "/motd [text|clear]", "show the message of the day; admins may set or clear it", runMOTD)
+}
+
+// currentMOTD returns the message of the day, empty when there is none.
+func (s *Server) currentMOTD(ctx context.Context) (string, error) {
+	if !s.hasRedis() {
+		return s.motd, nil
+	}
+
+	text, err := s.rdb.Get(ctx, s.keys.motd()).Result()
+	if err == redis.Nil {
+		return s.motd, nil
+	}
+	return text, err
+}
+
+// sendMOTD greets c with the message of the day, if any, before its history
+// is replayed. It runs on the connection goroutine.
+func (s *Server) sendMOTD(ctx context.Context, c *Client) error {
+	text, err := s.currentMOTD(ctx)
+	if err != nil {
+		c.logger.Error("loading message of the day", "err", err)
+		return nil
+	}
+	if text == "" {
+		return nil
+	}
+
+	f := systemFrame{Type: messageTypeSystem, Code: "motd", Text: text}
+	return c.writeFrame(f.forVersion(c.version))
+}
+
+// runMOTD shows the message of the day or, for admins, replaces it. Clearing
+// it goes back to the MOTD setting.
+func runMOTD(ctx context.Context, s *Server, c *Client, msg ChatMessage, args string) (commandReply, error) {
+	if args == "" {
+		text, err := s.currentMOTD(ctx)
+		if err != nil {
+			return commandReply{}, err
+		}
+		if text == "" {
+			return commandReply{text: "There is no message of the day."}, nil
+		}
+		return commandReply{text: text}, nil
+	}
+
+	if !c.admin {
+		return commandReply{text: "only admins can change the message of the day"}, nil
+	}
+
+	var err error
+	reply := "The message of the day was updated."
+	if args == "clear" {
+		err = s.rdb.Del(ctx, s.keys.motd()).Err()
+		reply = "The message of the day was cleared."
+	} else {
+		err = s.rdb.Set(ctx, s.keys.motd(), args, 0).Err()
+	}
+	if err != nil {
+		return commandReply{}, err
+	}
+
+	s.audit(AuditEntry{Action: auditMOTD, Actor: c.claimed, Room: c.room, IP: c.ip, Reason: args})
+	return commandReply{text: reply}, nil
+}
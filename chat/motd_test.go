@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// runCommandAs sends the command text from a new connection to s, as an
+// admin if admin is set, and returns the reply.
+func runCommandAs(t *testing.T, s *Server, admin bool, text string) string {
+	t.Helper()
+
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	header := make(http.Header)
+	if admin {
+		header.Set("Authorization", "Bearer secret")
+	}
+	dialer := websocket.Dialer{Subprotocols: []string{"chat.v2"}}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket?room=general&username=root", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if err := ws.WriteJSON(ChatMessage{Text: text}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var f systemFrame
+		readFrameInto(t, ws, messageTypeSystem, &f)
+		if f.Code == "command" {
+			return f.Text
+		}
+	}
+}
+
+func TestMOTD(t *testing.T) {
+	tests := []struct {
+		name    string
+		setting string
+		command string // run by an admin before connecting
+		want    string
+	}{
+		{"none", "", "", ""},
+		{"setting", "Welcome", "", "Welcome"},
+		{"updated", "Welcome", "/motd Be nice", "Be nice"},
+		{"set without setting", "", "/motd Be nice", "Be nice"},
+		{"cleared", "Welcome", "/motd clear", "Welcome"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ADMIN_TOKEN", "secret")
+			t.Setenv("MOTD", tt.setting)
+			s, _ := newTestServer(t)
+			appendTexts(t, s.store, "general", "earlier")
+			if tt.command != "" {
+				runCommandAs(t, s, true, tt.command)
+			}
+
+			// the MOTD comes ahead of the history
+			ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+			var got string
+			ann.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				var msg struct{ Type, Code, Text string }
+				if err := ann.ReadJSON(&msg); err != nil {
+					t.Fatal(err)
+				}
+				if msg.Type == messageTypeSystem && msg.Code == "motd" {
+					got = msg.Text
+				}
+				if msg.Text == "earlier" {
+					break
+				}
+			}
+			if got != tt.want {
+				t.Errorf("MOTD %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMOTDCommand(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	t.Setenv("MOTD", "Welcome")
+	s, _ := newTestServer(t)
+
+	tests := []struct {
+		admin    bool
+		text     string
+		wantText string
+		wantMOTD string
+	}{
+		{false, "/motd", "Welcome", "Welcome"},
+		{false, "/motd Be rude", "only admins can change the message of the day", "Welcome"},
+		{true, "/motd Be nice", "The message of the day was updated.", "Be nice"},
+		{false, "/motd", "Be nice", "Be nice"},
+		{true, "/motd clear", "The message of the day was cleared.", "Welcome"},
+	}
+	for _, tt := range tests {
+		if got := runCommandAs(t, s, tt.admin, tt.text); got != tt.wantText {
+			t.Errorf("%s replied %q, want %q", tt.text, got, tt.wantText)
+		}
+		if got, err := s.currentMOTD(context.Background()); err != nil || got != tt.wantMOTD {
+			t.Errorf("after %s: MOTD %q, %v, want %q", tt.text, got, err, tt.wantMOTD)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build nfkc
+
+package chat
+
+import "golang.org/x/text/unicode/norm"
+
+const nfkcAvailable = true
+
+// nfkc returns the NFKC normalization of s, which folds compatibility
+// characters, such as fullwidth letters, into their plain form.
+func nfkc(s string) string {
+	return norm.NFKC.String(s)
+}
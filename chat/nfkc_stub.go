@@ -0,0 +1,11 @@
+//go:build !nfkc
+
+package chat
+
+// nfkcAvailable is false unless the binary is built with the nfkc tag,
+// which links golang.org/x/text.
+const nfkcAvailable = false
+
+func nfkc(s string) string {
+	return s
+}
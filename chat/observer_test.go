@@ -0,0 +1,81 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestObserver(t *testing.T) {
+	tests := []struct {
+		name      string
+		protocols []string
+		wantError bool
+	}{
+		// version 1 has no error frames, so the send is only dropped
+		{"v1", nil, false},
+		{"v2", []string{"chat.v2"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			viewer := dialTestServer(t, s, "room=general&mode=observe", tt.protocols...)
+			ann := dialTestServer(t, s, "room=general")
+			waitClients(t, s, 2)
+
+			if err := viewer.WriteJSON(ChatMessage{Username: "viewer", Text: "let me in"}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantError {
+				viewer.SetReadDeadline(time.Now().Add(5 * time.Second))
+				var f errorFrame
+				if err := viewer.ReadJSON(&f); err != nil {
+					t.Fatal(err)
+				}
+				if f.Type != messageTypeError || f.Code != "read_only" {
+					t.Errorf("got %+v, want a read_only error", f)
+				}
+			}
+
+			// broadcasts still reach the observer, the refused send before
+			// them going nowhere
+			if err := ann.WriteJSON(ChatMessage{Username: "ann", Text: "hi"}); err != nil {
+				t.Fatal(err)
+			}
+			viewer.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var msg ChatMessage
+			if err := viewer.ReadJSON(&msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Username != "ann" || msg.Text != "hi" {
+				t.Errorf("observer got %+v, want ann's message", msg)
+			}
+
+			msgs, err := s.store.Recent(context.Background(), "general", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msgs) != 1 || msgs[0].Username != "ann" {
+				t.Errorf("stored %q, want ann's message only", texts(msgs))
+			}
+
+			// observers count as viewers, not occupants
+			var stats Stats
+			if err := json.NewDecoder(getStats(t, s, "").Body).Decode(&stats); err != nil {
+				t.Fatal(err)
+			}
+			if want := (RoomStats{Connections: 2, Viewers: 1, Messages: 1, MessagesPerMinute: 1}); stats.Rooms["general"] != want {
+				t.Errorf("stats of general = %+v, want %+v", stats.Rooms["general"], want)
+			}
+			if stats.Viewers != 1 {
+				t.Errorf("%d viewers, want 1", stats.Viewers)
+			}
+			count := make(chan int)
+			s.ops <- func(h *hub) { count <- roomCount(h, "general") }
+			if n := <-count; n != 1 {
+				t.Errorf("%d present in general, want 1", n)
+			}
+		})
+	}
+}
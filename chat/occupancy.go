@@ -0,0 +1,80 @@
+package chat
+
+import "time"
+
+// messageTypeOccupancy is the frame telling v2 clients how many people are
+// in their room.
+const messageTypeOccupancy = "occupancy"
+
+// occupancyInterval is how often the count of a room is broadcast at most,
+// so that a storm of joins and leaves doesn't flood the room.
+const occupancyInterval = time.Second
+
+type occupancyFrame struct {
+	Type  string `json:"type"`
+	Room  string `json:"room"`
+	Count int    `json:"count"`
+}
+
+// present reports whether c counts as being in its room, like in the
+// roster: observers and clients waiting in the lobby don't.
+func (c *Client) present() bool {
+	return !c.observer && !c.waiting.Load()
+}
+
+// roomCount counts the clients present in room. It runs on the hub.
+func roomCount(h *hub, room string) int {
+	var n int
+	for c := range h.clients {
+		if c.room == room && c.present() {
+			n++
+		}
+	}
+	return n
+}
+
+// sendOccupancy tells c how many people are in its room. It runs on the hub.
+func sendOccupancy(c *Client, count int) {
+	if c.version < protocolV2 {
+		return
+	}
+	f := occupancyFrame{Type: messageTypeOccupancy, Room: c.room, Count: count}
+	if err := c.deliver("", f); err != nil && unsafeError(err) {
+		c.logger.Warn("sending occupancy", "err", err)
+	}
+}
+
+// broadcastOccupancy tells the rooms whose count changed since the last
+// broadcast about it. The hub runs it every occupancyInterval rather than on
+// each join and leave, which debounces it. It runs on the hub.
+func (s *Server) broadcastOccupancy(h *hub) {
+	counts := make(map[string]int, len(h.announced))
+	for c := range h.clients {
+		if c.present() {
+			counts[c.room]++
+		}
+	}
+
+	changed := make(map[string]bool)
+	for room, n := range counts {
+		if h.announced[room] != n {
+			changed[room] = true
+			h.announced[room] = n
+		}
+	}
+	for room := range h.announced {
+		if _, ok := counts[room]; !ok {
+			// nobody is left to tell
+			delete(h.announced, room)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	for c := range h.clients {
+		if changed[c.room] {
+			sendOccupancy(c, counts[c.room])
+		}
+	}
+}
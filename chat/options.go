@@ -0,0 +1,58 @@
+package chat
+
+import (
+	"log/slog"
+
+	"github.com/gorilla/websocket"
+)
+
+// An Option changes a Server built by NewServer from what its Config
+// alone would give.
+type Option func(*Server)
+
+// WithStore keeps the message history and the rooms in store instead of
+// Redis.
+func WithStore(store MessageStore) Option {
+	return func(s *Server) {
+		s.store = store
+	}
+}
+
+// WithLogger logs through logger instead of the default slog logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithUpgrader upgrades the WebSocket connections with u, for example to
+// check their origin.
+func WithUpgrader(u *websocket.Upgrader) Option {
+	return func(s *Server) {
+		s.upgrader = u
+	}
+}
+
+// WithReloader makes Reload read the configuration with load instead of
+// LoadConfig.
+func WithReloader(load func() (Config, error)) Option {
+	return func(s *Server) {
+		s.reloader = load
+	}
+}
+
+// WithBot adds b to the bots of the server, along with the built-in ones
+// enabled by Config.Bots.
+func WithBot(b Bot) Option {
+	return func(s *Server) {
+		s.bots = append(s.bots, b)
+	}
+}
+
+// WithHistoryLimit caps the history of the rooms created without a cap of
+// their own to n messages, overriding Config.HistoryCap.
+func WithHistoryLimit(n int64) Option {
+	return func(s *Server) {
+		s.historyCap = n
+	}
+}
@@ -0,0 +1,82 @@
+//go:build postgres
+
+package chat
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// postgresChannel is the channel instances relay messages on with
+// LISTEN/NOTIFY.
+const postgresChannel = "chat_broadcast"
+
+// postgresNotifyLimit is the size NOTIFY payloads must stay under.
+const postgresNotifyLimit = 8000
+
+var errNotPostgres = errors.New("the Postgres relay needs the postgres history backend")
+
+// postgresBus relays over Postgres LISTEN/NOTIFY, the analogue of Redis
+// Pub/Sub for deployments keeping history in Postgres.
+type postgresBus struct {
+	db  *sql.DB
+	url string
+}
+
+func newPostgresBus(store MessageStore, url string) (relayBus, error) {
+	st, ok := unwrapStore(store).(*SQLStore)
+	if !ok || st.dialect.name != postgresDialect.name {
+		return nil, errNotPostgres
+	}
+	return &postgresBus{db: st.db, url: url}, nil
+}
+
+func (pb *postgresBus) publish(ctx context.Context, payload []byte) error {
+	_, err := pb.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, postgresChannel, string(payload))
+	return err
+}
+
+// subscribe listens on a connection of its own, reconnecting when it drops.
+// Messages sent while it is down are missed, as with Redis Pub/Sub.
+func (pb *postgresBus) subscribe(ctx context.Context) <-chan []byte {
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		for {
+			err := pb.listen(ctx, out)
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("listening for relayed messages", "err", err)
+			time.Sleep(time.Second)
+		}
+	}()
+	return out
+}
+
+func (pb *postgresBus) listen(ctx context.Context, out chan<- []byte) error {
+	conn, err := pgx.Connect(ctx, pb.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+postgresChannel); err != nil {
+		return err
+	}
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		out <- []byte(n.Payload)
+	}
+}
+
+func (pb *postgresBus) maxPayload() int { return postgresNotifyLimit - 1 }
@@ -0,0 +1,11 @@
+//go:build !postgres
+
+package chat
+
+import "errors"
+
+// newPostgresBus is only available in binaries built with the postgres tag,
+// which pulls in pgx.
+func newPostgresBus(store MessageStore, url string) (relayBus, error) {
+	return nil, errors.New("HISTORY_BACKEND=postgres requires a binary built with -tags postgres")
+}
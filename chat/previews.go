@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// maxPreviewRooms bounds the rooms a preview request may name.
+const maxPreviewRooms = 100
+
+// RoomPreview is what a room list shows of a room.
+type RoomPreview struct {
+	Room     string `json:"room"`
+	Messages int64  `json:"messages"`
+
+	// LastMessage is the newest message, nil for empty rooms.
+	LastMessage *ChatMessage `json:"last_message"`
+}
+
+// handleRoomPreviews returns the message count and newest message of the
+// rooms listed in the rooms parameter, or of every public room. Private and
+// unknown rooms are left out.
+func (s *Server) handleRoomPreviews(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var rooms map[string]map[string]string
+	if v := r.URL.Query().Get("rooms"); v != "" {
+		names := splitList(v)
+		if len(names) > maxPreviewRooms {
+			http.Error(w, "too many rooms", http.StatusBadRequest)
+			return
+		}
+		for _, name := range names {
+			if !validRoomName(name) {
+				http.Error(w, "invalid room name "+strings.TrimSpace(name), http.StatusBadRequest)
+				return
+			}
+		}
+
+		rooms = make(map[string]map[string]string, len(names))
+		for _, name := range names {
+			fields, err := s.store.RoomFields(ctx, name)
+			if err != nil {
+				internalError(w, r, err)
+				return
+			}
+			rooms[name] = fields
+		}
+	} else {
+		var err error
+		if rooms, err = s.store.Rooms(ctx); err != nil {
+			internalError(w, r, err)
+			return
+		}
+	}
+	names := slices.Sorted(maps.Keys(rooms))
+	user := s.requester(r)
+
+	previews := make([]RoomPreview, 0, len(names))
+	for _, name := range names {
+		fields := rooms[name]
+		if len(fields) == 0 || parseRoomOptions(fields).Private {
+			continue
+		}
+
+		n, err := s.store.Len(ctx, name)
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		p := RoomPreview{Room: name, Messages: n}
+		last, err := s.store.Recent(ctx, name, 1)
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		if len(last) > 0 && last[0].visibleTo(user) {
+			p.LastMessage = &last[0]
+		}
+		previews = append(previews, p)
+	}
+
+	writeJSONResponse(w, http.StatusOK, previews)
+}
@@ -0,0 +1,80 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoomPreviews(t *testing.T) {
+	s, _ := newTestServer(t)
+	ctx := context.Background()
+
+	for room, private := range map[string]bool{"general": false, "random": false, "secret": true} {
+		opts := defaultRoomOptions()
+		opts.Private = private
+		if _, err := s.createRoom(ctx, room, opts, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendTexts(t, s.store, "general", "one", "two", "three")
+	appendTexts(t, s.store, "secret", "hush")
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		want     map[string]string // last message of each room listed
+		counts   map[string]int64
+	}{
+		{
+			"all rooms", "", http.StatusOK,
+			map[string]string{"general": "three", "random": ""},
+			map[string]int64{"general": 3, "random": 0},
+		},
+		{"named", "?rooms=general", http.StatusOK, map[string]string{"general": "three"}, map[string]int64{"general": 3}},
+		{"private and unknown left out", "?rooms=secret,nowhere", http.StatusOK, map[string]string{}, map[string]int64{}},
+		{"invalid name", "?rooms=general,no+room", http.StatusBadRequest, nil, nil},
+		{"too many", "?rooms=" + strings.Repeat("a,", maxPreviewRooms) + "a", http.StatusBadRequest, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.handleRoomPreviews(rec, httptest.NewRequest(http.MethodGet, "/api/rooms/previews"+tt.query, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var previews []RoomPreview
+			if err := json.NewDecoder(rec.Body).Decode(&previews); err != nil {
+				t.Fatal(err)
+			}
+			if len(previews) != len(tt.want) {
+				t.Fatalf("%d previews, want %d: %+v", len(previews), len(tt.want), previews)
+			}
+			for _, p := range previews {
+				want, ok := tt.want[p.Room]
+				if !ok {
+					t.Errorf("unexpected preview of %s", p.Room)
+					continue
+				}
+				if p.Messages != tt.counts[p.Room] {
+					t.Errorf("%s has %d messages, want %d", p.Room, p.Messages, tt.counts[p.Room])
+				}
+				var last string
+				if p.LastMessage != nil {
+					last = p.LastMessage.Text
+				}
+				if last != want {
+					t.Errorf("last message of %s = %q, want %q", p.Room, last, want)
+				}
+			}
+		})
+	}
+}
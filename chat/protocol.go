@@ -0,0 +1,194 @@
+package chat
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Protocol versions negotiated through the WebSocket subprotocol. Version 1
+// is the original {username, text} frame; version 2 also carries the frame
+// type and the room.
+const (
+	protocolV1 = 1
+	protocolV2 = 2
+
+	// defaultProtocolVersion is used by clients that don't ask for a
+	// subprotocol, so that old clients keep working unchanged.
+	defaultProtocolVersion = protocolV1
+)
+
+// protocolVersions lists every version this server can speak.
+var protocolVersions = []int{protocolV1, protocolV2}
+
+// protocol is the version and codec spoken on one connection.
+type protocol struct {
+	version int
+	codec   Codec
+}
+
+// subprotocol is the name clients request protocol with, e.g. "chat.v2" for
+// JSON frames or "chat.v2.msgpack" for MessagePack.
+func (p protocol) subprotocol() string {
+	name := "chat.v" + strconv.Itoa(p.version)
+	if p.codec.Name() != (jsonCodec{}).Name() {
+		name += "." + p.codec.Name()
+	}
+	return name
+}
+
+// lookupVersions resolves a comma-separated list of protocol versions. An
+// empty list enables every version.
+func lookupVersions(list string) ([]int, error) {
+	if list == "" {
+		return protocolVersions, nil
+	}
+
+	var versions []int
+	for _, field := range strings.Split(list, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid protocol version %q", field)
+		}
+		if v < protocolV1 || v > protocolVersions[len(protocolVersions)-1] {
+			return nil, fmt.Errorf("unsupported protocol version %d", v)
+		}
+		versions = append(versions, v)
+	}
+
+	return versions, nil
+}
+
+// buildProtocols indexes every supported version and codec combination by
+// its subprotocol name.
+func buildProtocols(versions []int, codecs []Codec) map[string]protocol {
+	protocols := make(map[string]protocol, len(versions)*len(codecs))
+	for _, v := range versions {
+		for _, c := range codecs {
+			p := protocol{version: v, codec: c}
+			protocols[p.subprotocol()] = p
+		}
+	}
+	return protocols
+}
+
+// negotiateProtocol picks the first subprotocol offered by the client that
+// the server supports. Clients that offer none get the default protocol;
+// ok is false when a client only offers unsupported ones.
+func (s *Server) negotiateProtocol(r *http.Request) (p protocol, ok bool) {
+	offered := websocket.Subprotocols(r)
+	if len(offered) == 0 {
+		return protocol{version: defaultProtocolVersion, codec: s.codecs[0]}, true
+	}
+
+	for _, name := range offered {
+		if p, ok := s.protocols[name]; ok {
+			return p, true
+		}
+	}
+
+	return protocol{}, false
+}
+
+// supportedSubprotocols lists the subprotocols advertised to clients that
+// fail negotiation.
+func (s *Server) supportedSubprotocols() []string {
+	names := make([]string, 0, len(s.protocols))
+	for _, v := range protocolVersions {
+		for _, c := range s.codecs {
+			p := protocol{version: v, codec: c}
+			if _, ok := s.protocols[p.subprotocol()]; ok {
+				names = append(names, p.subprotocol())
+			}
+		}
+	}
+	return names
+}
+
+// forVersion strips the fields a client speaking version doesn't know about.
+func (m ChatMessage) forVersion(version int) ChatMessage {
+	if version < protocolV2 {
+		return ChatMessage{Username: m.Username, Text: m.Text}
+	}
+	return m
+}
+
+const messageTypeError = "error"
+
+// messageTypeAck confirms to its sender that a message was stored, giving
+// the ID and time the server assigned, and messageTypeNack tells it the
+// message reached the room without being stored.
+const (
+	messageTypeAck  = "ack"
+	messageTypeNack = "nack"
+)
+
+type ackFrame struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Timestamp int64  `json:"ts"`
+
+	// ClientID is the ID the client gave the message, if any.
+	ClientID string `json:"client_id,omitempty"`
+
+	// TraceID identifies the server-side trace of the message, when traced.
+	TraceID string `json:"trace_id,omitempty"`
+
+	// ResumeToken replaces the last resume token the client got, resuming
+	// after this message.
+	ResumeToken string `json:"resume_token,omitempty"`
+}
+
+type nackFrame struct {
+	Type     string `json:"type"`
+	ClientID string `json:"client_id,omitempty"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+// errorFrame tells a client why its last frame was rejected.
+type errorFrame struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	// ExpiresIn is the number of seconds a restriction, such as a mute,
+	// still lasts.
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+}
+
+// sendError reports a rejected frame to c.
+func (s *Server) sendError(c *Client, code, message string) {
+	s.sendErrorFrame(c, errorFrame{Code: code, Message: message})
+}
+
+// sendErrorFrame sends f to c. Clients speaking version 1 have no notion of
+// frame types, so they only get the log line.
+func (s *Server) sendErrorFrame(c *Client, f errorFrame) {
+	if c.version < protocolV2 {
+		c.logger.Info("rejected frame", "code", f.Code, "reason", f.Message)
+		return
+	}
+	f.Type = messageTypeError
+
+	s.sendFrame(c, f)
+}
+
+// sendFrame sends v to c alone.
+func (s *Server) sendFrame(c *Client, v interface{}) {
+	s.ops <- func(h *hub) {
+		// writes must come from the hub, which owns the connection writer
+		if !h.clients[c] {
+			return
+		}
+
+		err := c.deliver("", v)
+		if err != nil && unsafeError(err) {
+			c.logger.Warn("sending frame", "err", err)
+			removeClient(h, c, 0, "")
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package chat
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLookupVersions(t *testing.T) {
+	tests := []struct {
+		list string
+		want []int
+		err  bool
+	}{
+		{"", protocolVersions, false},
+		{"1", []int{1}, false},
+		{"2, 1", []int{2, 1}, false},
+		{"3", nil, true},
+		{"0", nil, true},
+		{"v2", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := lookupVersions(tt.list)
+		if (err != nil) != tt.err {
+			t.Errorf("lookupVersions(%q) error = %v, want error %v", tt.list, err, tt.err)
+			continue
+		}
+		if !tt.err && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lookupVersions(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	codecs := []Codec{jsonCodec{}}
+	s := &Server{codecs: codecs, protocols: buildProtocols(protocolVersions, codecs)}
+
+	tests := []struct {
+		offered string
+		want    string
+		ok      bool
+	}{
+		{"", "chat.v1", true},
+		{"chat.v2", "chat.v2", true},
+		{"chat.v9, chat.v2", "chat.v2", true},
+		{"chat.v1, chat.v2", "chat.v1", true},
+		{"chat.v2.msgpack", "", false},
+		{"chat.v9", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/websocket", nil)
+		if tt.offered != "" {
+			r.Header.Set("Sec-WebSocket-Protocol", tt.offered)
+		}
+
+		p, ok := s.negotiateProtocol(r)
+		if ok != tt.ok {
+			t.Errorf("offering %q: ok = %v, want %v", tt.offered, ok, tt.ok)
+			continue
+		}
+		if ok && p.subprotocol() != tt.want {
+			t.Errorf("offering %q negotiated %q, want %q", tt.offered, p.subprotocol(), tt.want)
+		}
+	}
+
+	if got, want := s.supportedSubprotocols(), []string{"chat.v1", "chat.v2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("supportedSubprotocols() = %v, want %v", got, want)
+	}
+}
+
+func TestForVersion(t *testing.T) {
+	msg := ChatMessage{Type: messageTypeChat, Room: "general", Username: "ann", Text: "hi"}
+
+	if got, want := msg.forVersion(protocolV1), (ChatMessage{Username: "ann", Text: "hi"}); got != want {
+		t.Errorf("forVersion(1) = %+v, want %+v", got, want)
+	}
+	if got := msg.forVersion(protocolV2); got != msg {
+		t.Errorf("forVersion(2) = %+v, want it unchanged", got)
+	}
+}
+
+// TestUnsupportedSubprotocol checks that a client only offering unknown
+// versions is refused before the upgrade, and told which ones exist.
+func TestUnsupportedSubprotocol(t *testing.T) {
+	s, _ := newTestServer(t)
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleConnetions))
+	t.Cleanup(ts.Close)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"chat.v9"}}
+	_, resp, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/?room=general", nil)
+	if err == nil {
+		t.Fatal("connected with an unsupported subprotocol")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %v, want a 400 response", resp)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "chat.v2") {
+		t.Errorf("refusal %q doesn't list the supported subprotocols", body)
+	}
+}
@@ -0,0 +1,56 @@
+package chat
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{trustedProxies: trusted}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		realIP     string
+		want       string
+	}{
+		{"direct", "203.0.113.7:4000", nil, "", "203.0.113.7"},
+		{"untrusted peer", "203.0.113.7:4000", []string{"198.51.100.1"}, "", "203.0.113.7"},
+		{"untrusted peer with X-Real-IP", "203.0.113.7:4000", nil, "198.51.100.1", "203.0.113.7"},
+		{"trusted peer", "10.1.2.3:4000", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"rightmost untrusted hop", "10.1.2.3:4000", []string{"198.51.100.1, 198.51.100.2, 10.0.0.5, 192.0.2.1"}, "", "198.51.100.2"},
+		{"hops over several headers", "10.1.2.3:4000", []string{"198.51.100.1", "198.51.100.2, 10.0.0.5"}, "", "198.51.100.2"},
+		{"spoofed leftmost hop", "10.1.2.3:4000", []string{"10.9.9.9, 198.51.100.2"}, "", "198.51.100.2"},
+		{"every hop trusted", "10.1.2.3:4000", []string{"10.0.0.5, 192.0.2.1"}, "", "10.1.2.3"},
+		{"mapped IPv4", "10.1.2.3:4000", []string{"::ffff:198.51.100.1"}, "", "198.51.100.1"},
+		{"IPv6 hop", "10.1.2.3:4000", []string{"2001:db8::1"}, "", "2001:db8::1"},
+		{"X-Real-IP", "10.1.2.3:4000", nil, "198.51.100.1", "198.51.100.1"},
+		{"malformed hop", "10.1.2.3:4000", []string{"198.51.100.1, not-an-ip"}, "", "10.1.2.3"},
+		{"empty hop", "10.1.2.3:4000", []string{"198.51.100.1, "}, "", "10.1.2.3"},
+		{"hop with a port", "10.1.2.3:4000", []string{"198.51.100.1:5000"}, "", "10.1.2.3"},
+		{"malformed X-Real-IP", "10.1.2.3:4000", nil, "not-an-ip", "10.1.2.3"},
+		{"remote address without a port", "203.0.113.7", nil, "", "203.0.113.7"},
+		{"malformed remote address", "@", []string{"198.51.100.1"}, "", "@"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			if got := s.clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
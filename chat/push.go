@@ -0,0 +1,532 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// defaultPushHourlyLimit caps the pushes a user gets per hour unless
+	// PUSH_HOURLY_LIMIT says otherwise.
+	defaultPushHourlyLimit = 10
+
+	// pushOutbox is how many mentions wait to be pushed before new ones are
+	// dropped.
+	pushOutbox = 256
+
+	// pushTextLimit is how many characters of the message a push carries.
+	pushTextLimit = 120
+
+	// pushTTL is how long push services hold a notification for an offline
+	// device.
+	pushTTL = 24 * time.Hour
+
+	// pushRecordSize is the record size of the encrypted payload, which
+	// always fits in one record.
+	pushRecordSize = 4096
+)
+
+// pushSubscriptions is the Redis hash of the push subscriptions of user,
+// keyed by endpoint.
+func (ks keyspace) pushSubscriptions(user string) string {
+	return ks.key("push_subs:" + user)
+}
+
+// pushRate counts the pushes sent to user in the given hour.
+func (ks keyspace) pushRate(user string, hour int64) string {
+	return ks.key("push_rate:" + user + ":" + strconv.FormatInt(hour, 10))
+}
+
+// PushSubscription is a browser's Web Push subscription, as returned by
+// PushSubscription.toJSON().
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// validate checks that ps holds a usable endpoint and keys.
+func (ps PushSubscription) validate() error {
+	u, err := url.Parse(ps.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.New("endpoint must be an https URL")
+	}
+	if key, err := decodeBase64URL(ps.Keys.P256dh); err != nil || len(key) != 65 {
+		return errors.New("invalid p256dh key")
+	}
+	if auth, err := decodeBase64URL(ps.Keys.Auth); err != nil || len(auth) != 16 {
+		return errors.New("invalid auth secret")
+	}
+	return nil
+}
+
+// decodeBase64URL decodes base64url, padded or not, as browsers hand out.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// vapidKeys is the key pair identifying the server to push services.
+type vapidKeys struct {
+	private *ecdsa.PrivateKey
+
+	// public is the uncompressed public key, base64url encoded as the
+	// browser's applicationServerKey.
+	public string
+}
+
+// parseVAPIDKeys parses the base64url private key of VAPID_PRIVATE_KEY,
+// checking that VAPID_PUBLIC_KEY matches it.
+func parseVAPIDKeys(public, private string) (*vapidKeys, error) {
+	d, err := decodeBase64URL(private)
+	if err != nil {
+		return nil, errors.New("VAPID_PRIVATE_KEY: invalid base64url")
+	}
+	key, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, fmt.Errorf("VAPID_PRIVATE_KEY: %w", err)
+	}
+
+	pub := key.PublicKey().Bytes()
+	if got, err := decodeBase64URL(public); err != nil || !bytes.Equal(got, pub) {
+		return nil, errors.New("VAPID_PUBLIC_KEY: doesn't match VAPID_PRIVATE_KEY")
+	}
+
+	priv := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	priv.Curve = elliptic.P256()
+	priv.X = new(big.Int).SetBytes(pub[1:33])
+	priv.Y = new(big.Int).SetBytes(pub[33:])
+
+	return &vapidKeys{private: priv, public: base64.RawURLEncoding.EncodeToString(pub)}, nil
+}
+
+// authorization is the Authorization header of a push to endpoint, a VAPID
+// token signed for the origin of the push service.
+func (vk *vapidKeys) authorization(endpoint, subject string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, vk.private, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	token := signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	return "vapid t=" + token + ", k=" + vk.public, nil
+}
+
+// hkdf is HKDF-SHA256 for outputs of at most one hash.
+func hkdf(salt, ikm, info []byte, n int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:n]
+}
+
+// encryptPush encrypts payload for the subscription, in the aes128gcm
+// content encoding of RFC 8291.
+func encryptPush(ps PushSubscription, payload []byte) ([]byte, error) {
+	uaPublic, err := decodeBase64URL(ps.Keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := decodeBase64URL(ps.Keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+	uaKey, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asKey.PublicKey().Bytes()
+	secret, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	info := append([]byte("WebPush: info\x00"), uaPublic...)
+	info = append(info, asPublic...)
+	ikm := hkdf(authSecret, secret, info, 32)
+
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// a single record, ended by the last record delimiter
+	plaintext := append(append([]byte(nil), payload...), 2)
+	if len(plaintext)+gcm.Overhead() > pushRecordSize {
+		return nil, errors.New("push payload too large")
+	}
+
+	body := append([]byte(nil), salt...)
+	body = binary.BigEndian.AppendUint32(body, pushRecordSize)
+	body = append(body, byte(len(asPublic)))
+	body = append(body, asPublic...)
+	return gcm.Seal(body, nonce, plaintext, nil), nil
+}
+
+// pushPayload is what the service worker gets for a mention.
+type pushPayload struct {
+	Type     string `json:"type"`
+	Room     string `json:"room"`
+	Username string `json:"username"`
+	Text     string `json:"text"`
+	ID       string `json:"id,omitempty"`
+}
+
+// truncateText shortens text to n characters, marking the cut.
+func truncateText(text string, n int) string {
+	if utf8.RuneCountInString(text) <= n {
+		return text
+	}
+	runes := []rune(text)
+	return string(runes[:n-1]) + "…"
+}
+
+var mentionRe = regexp.MustCompile(`(?:^|\s)@([\pL\pN_-]+)`)
+
+// mentions returns the users mentioned in text, once each.
+func mentions(text string) []string {
+	var users []string
+	seen := make(map[string]bool)
+	for _, m := range mentionRe.FindAllStringSubmatch(text, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			users = append(users, m[1])
+		}
+	}
+	return users
+}
+
+// pushMention is a mention of user in msg, to be pushed.
+type pushMention struct {
+	user string
+	msg  ChatMessage
+}
+
+// pusher sends Web Push notifications to the users mentioned while they
+// are away.
+type pusher struct {
+	s       *Server
+	keys    *vapidKeys
+	subject string
+	limit   int64
+	client  *http.Client
+
+	outbox chan pushMention
+}
+
+// newPusher returns the pusher using the given VAPID keys, nil when there
+// are none.
+func newPusher(s *Server, cfg Config) (*pusher, error) {
+	if cfg.VAPIDPrivateKey == "" {
+		return nil, nil
+	}
+
+	keys, err := parseVAPIDKeys(cfg.VAPIDPublicKey, cfg.VAPIDPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &pusher{
+		s:       s,
+		keys:    keys,
+		subject: cfg.VAPIDSubject,
+		limit:   int64(cfg.PushHourlyLimit),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		outbox:  make(chan pushMention, pushOutbox),
+	}, nil
+}
+
+// notify queues a push for the users msg mentions who have no connection.
+// It runs on the hub.
+func (p *pusher) notify(h *hub, msg ChatMessage) {
+	if p == nil {
+		return
+	}
+
+	for _, user := range mentions(msg.Text) {
+		if user == msg.Username || connected(h, user) || !msg.visibleTo(user) {
+			continue
+		}
+
+		select {
+		case p.outbox <- pushMention{user: user, msg: msg}:
+		default:
+			p.s.logger.Warn("push outbox full, dropping mention", "user", user, "id", msg.ID)
+		}
+	}
+}
+
+// connected reports whether user has a connection on the hub. h.users only
+// holds one of them, and none once it left when usernames may be shared.
+// It runs on the hub.
+func connected(h *hub, user string) bool {
+	for c := range h.clients {
+		if c.claimed == user {
+			return true
+		}
+	}
+	return false
+}
+
+// run sends the queued pushes.
+func (p *pusher) run() {
+	for m := range p.outbox {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := p.push(ctx, m); err != nil {
+			p.s.logger.Warn("pushing mention", "user", m.user, "id", m.msg.ID, "err", err)
+		}
+		cancel()
+	}
+}
+
+// mayNotify reports whether the user of m may see its message while away:
+// mentions in private rooms only reach their members.
+func (p *pusher) mayNotify(ctx context.Context, m pushMention) (bool, error) {
+	s := p.s
+
+	opts, err := s.roomOptions(ctx, m.msg.Room)
+	if err != nil || !opts.Private {
+		return err == nil, err
+	}
+	return s.rdb.SIsMember(ctx, s.keys.roomMembers(m.msg.Room), m.user).Result()
+}
+
+// push sends m to every subscription of its user, within the hourly cap.
+func (p *pusher) push(ctx context.Context, m pushMention) error {
+	s := p.s
+
+	if ok, err := p.mayNotify(ctx, m); !ok {
+		return err
+	}
+
+	subs, err := s.rdb.HGetAll(ctx, s.keys.pushSubscriptions(m.user)).Result()
+	if err != nil || len(subs) == 0 {
+		return err
+	}
+
+	if p.limit > 0 {
+		key := s.keys.pushRate(m.user, time.Now().Unix()/3600)
+		n, err := s.rdb.Incr(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if n == 1 {
+			s.rdb.Expire(ctx, key, time.Hour)
+		}
+		if n > p.limit {
+			return nil
+		}
+	}
+
+	payload, err := json.Marshal(pushPayload{
+		Type:     "mention",
+		Room:     m.msg.Room,
+		Username: m.msg.Username,
+		Text:     truncateText(m.msg.plainText(), pushTextLimit),
+		ID:       m.msg.ID,
+	})
+	if err != nil {
+		return err
+	}
+
+	for endpoint, v := range subs {
+		var ps PushSubscription
+		if err := json.Unmarshal([]byte(v), &ps); err != nil {
+			continue
+		}
+
+		gone, err := p.send(ctx, ps, payload)
+		if gone {
+			// the browser unsubscribed, or the subscription expired
+			s.rdb.HDel(ctx, s.keys.pushSubscriptions(m.user), endpoint)
+			continue
+		}
+		if err != nil {
+			s.logger.Warn("sending push", "user", m.user, "err", err)
+		}
+	}
+	return nil
+}
+
+// send delivers payload to the push service of ps, reporting whether the
+// subscription is gone for good.
+func (p *pusher) send(ctx context.Context, ps PushSubscription, payload []byte) (bool, error) {
+	body, err := encryptPush(ps, payload)
+	if err != nil {
+		return false, err
+	}
+	auth, err := p.keys.authorization(ps.Endpoint, p.subject)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ps.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(pushTTL/time.Second)))
+	req.Header.Set("Urgency", "high")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusGone:
+		return true, nil
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("push service: %s", resp.Status)
+	}
+	return false, nil
+}
+
+// pushUser identifies the user managing their push subscriptions.
+func (s *Server) pushUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if s.push == nil {
+		http.Error(w, "push notifications are not configured", http.StatusNotFound)
+		return "", false
+	}
+	// anyone could get the mentions of the user they name
+	if !s.verifiesUsers() {
+		http.Error(w, "push notifications need authenticated users", http.StatusForbidden)
+		return "", false
+	}
+	user, _, err := s.auth.Authenticate(r)
+	if err != nil || user == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	if user, err = s.normalizeUsername(user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return user, true
+}
+
+// handleVAPIDKey returns the public key browsers subscribe with.
+func (s *Server) handleVAPIDKey(w http.ResponseWriter, r *http.Request) {
+	if s.push == nil {
+		http.Error(w, "push notifications are not configured", http.StatusNotFound)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]string{"public_key": s.push.keys.public})
+}
+
+// handlePushSubscribe stores a push subscription of the user.
+func (s *Server) handlePushSubscribe(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.pushUser(w, r)
+	if !ok {
+		return
+	}
+
+	var ps PushSubscription
+	if err := json.NewDecoder(r.Body).Decode(&ps); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := ps.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := json.Marshal(ps)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if err := s.rdb.HSet(r.Context(), s.keys.pushSubscriptions(user), ps.Endpoint, data).Err(); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePushUnsubscribe forgets the push subscription of the user with the
+// given endpoint.
+func (s *Server) handlePushUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.pushUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Endpoint == "" {
+		http.Error(w, "endpoint is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.rdb.HDel(r.Context(), s.keys.pushSubscriptions(user), req.Endpoint).Err(); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
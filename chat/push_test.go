@@ -0,0 +1,130 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestPushNeedsVerifiedUsers checks that push subscriptions are refused
+// when anyone may connect under any name.
+func TestPushNeedsVerifiedUsers(t *testing.T) {
+	tests := []struct {
+		name     string
+		verified bool
+		want     int
+	}{
+		{"unverified", false, http.StatusForbidden},
+		// let in, to be turned away for the empty subscription
+		{"verified", true, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s *Server
+			if tt.verified {
+				s, _ = newDMTestServer(t)
+			} else {
+				s, _ = newTestServer(t)
+			}
+			s.push = &pusher{s: s}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/push/subscribe?username=ann", strings.NewReader(`{}`))
+			rec := httptest.NewRecorder()
+			s.handlePushSubscribe(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestPushNotify(t *testing.T) {
+	// ann is still connected, though no longer the one holding her name
+	ann := &Client{claimed: "ann"}
+	h := &hub{clients: map[*Client]bool{ann: true}, users: make(map[string]*Client)}
+
+	tests := []struct {
+		name string
+		msg  ChatMessage
+		want []string
+	}{
+		{"mentions", ChatMessage{Username: "carol", Text: "@ann @bob @dave hi"}, []string{"bob", "dave"}},
+		{"own name", ChatMessage{Username: "bob", Text: "@bob"}, nil},
+		{"direct message", ChatMessage{Username: "carol", To: "dave", Text: "@bob @dave"}, []string{"dave"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &pusher{outbox: make(chan pushMention, 8)}
+			p.notify(h, tt.msg)
+			close(p.outbox)
+
+			var got []string
+			for m := range p.outbox {
+				got = append(got, m.user)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("pushed to %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPushPrivateRooms checks that mentions in private rooms are only
+// pushed to their members.
+func TestPushPrivateRooms(t *testing.T) {
+	s, _ := newDMTestServer(t)
+	ctx := context.Background()
+
+	opts := s.newRoomOptions()
+	opts.Private = true
+	if _, err := s.store.CreateRoom(ctx, "secret", opts.fields()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.addRoomMember(ctx, "secret", "ann"); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &pusher{s: s}
+	tests := []struct {
+		room, user string
+		want       bool
+	}{
+		{"secret", "ann", true},
+		{"secret", "bob", false},
+		{"general", "bob", true},
+	}
+	for _, tt := range tests {
+		got, err := p.mayNotify(ctx, pushMention{user: tt.user, msg: ChatMessage{Room: tt.room}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("notify %s of %s: %v, want %v", tt.user, tt.room, got, tt.want)
+		}
+	}
+}
+
+// TestPrivateRoomMembers checks that verified users joining a private room
+// with an invite become its members.
+func TestPrivateRoomMembers(t *testing.T) {
+	s, mr := newDMTestServer(t)
+	ctx := context.Background()
+
+	opts := s.newRoomOptions()
+	opts.Private = true
+	if _, err := s.store.CreateRoom(ctx, "secret", opts.fields()); err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.createInvite(ctx, "secret", 0, unlimitedUses)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialTestServer(t, s, "room=secret&username=ann&invite="+token)
+	waitClients(t, s, 1)
+	if ok, err := mr.SIsMember(s.keys.roomMembers("secret"), "ann"); err != nil || !ok {
+		t.Errorf("ann not a member of secret: %v", err)
+	}
+}
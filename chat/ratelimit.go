@@ -0,0 +1,100 @@
+package chat
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// rateAbuseThreshold is the number of rejected frames in a row after which a
+// client is disconnected instead of just told to slow down.
+const rateAbuseThreshold = 20
+
+// rateLimiter is a token bucket per key. A nil *rateLimiter allows everything.
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+
+	// lru holds the buckets, the most recently used first, and max bounds
+	// how many are kept.
+	lru *list.List
+	max int
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// maxBuckets bounds the number of buckets kept before idle ones are pruned.
+const maxBuckets = 10000
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+		max:     maxBuckets,
+	}
+}
+
+// allow takes a token from the bucket of key, reporting whether one was left.
+func (l *rateLimiter) allow(key string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	var b *bucket
+	if e, ok := l.buckets[key]; ok {
+		b = e.Value.(*bucket)
+		l.lru.MoveToFront(e)
+	} else {
+		if len(l.buckets) >= l.max {
+			l.prune(now)
+		}
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets buckets that have refilled completely, since a fresh bucket
+// behaves the same, and then the least recently used ones until there is room
+// for another. The buckets are ordered by last use, so the refilled ones are
+// all at the back.
+func (l *rateLimiter) prune(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for e := l.lru.Back(); e != nil; e = l.lru.Back() {
+		b := e.Value.(*bucket)
+		if now.Sub(b.last) < full && len(l.buckets) < l.max {
+			break
+		}
+		l.lru.Remove(e)
+		delete(l.buckets, b.key)
+	}
+}
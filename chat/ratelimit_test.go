@@ -0,0 +1,77 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		calls int
+		want  int
+	}{
+		{"disabled", 0, 0, 10, 10},
+		{"burst", 1, 3, 10, 3},
+		{"burst of one", 1, 0, 5, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(tt.rate, tt.burst)
+			var allowed int
+			for i := 0; i < tt.calls; i++ {
+				if l.allow("1.2.3.4") {
+					allowed++
+				}
+			}
+			if allowed != tt.want {
+				t.Errorf("allowed %d of %d, want %d", allowed, tt.calls, tt.want)
+			}
+		})
+	}
+}
+
+// TestRateLimiterEvictsLRU checks that the limiter stays bounded when none
+// of its buckets refilled, forgetting the least recently used.
+func TestRateLimiterEvictsLRU(t *testing.T) {
+	l := newRateLimiter(0.001, 2)
+	l.max = 3
+
+	for _, key := range []string{"a", "b", "c"} {
+		l.allow(key)
+	}
+	// a is used again, so b is the least recently used
+	l.allow("a")
+	l.allow("d")
+
+	if len(l.buckets) != l.max || l.lru.Len() != l.max {
+		t.Fatalf("kept %d buckets, %d in the list, want %d", len(l.buckets), l.lru.Len(), l.max)
+	}
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := l.buckets[key]; ok != want {
+			t.Errorf("bucket %q kept: %v, want %v", key, ok, want)
+		}
+	}
+	// a spent both its tokens, and eviction didn't reset it
+	if l.allow("a") {
+		t.Error("a allowed a third message")
+	}
+}
+
+// TestRateLimiterPrunesRefilled checks that refilled buckets go first.
+func TestRateLimiterPrunesRefilled(t *testing.T) {
+	l := newRateLimiter(1000, 1)
+	l.max = 3
+
+	for _, key := range []string{"a", "b", "c"} {
+		l.allow(key)
+	}
+	time.Sleep(5 * time.Millisecond)
+	l.allow("d")
+
+	if len(l.buckets) != 1 {
+		t.Errorf("kept %d buckets, want only the new one", len(l.buckets))
+	}
+}
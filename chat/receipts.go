@@ -0,0 +1,233 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// messageTypeRead is both the frame marking a message as read and the frame
+// telling a client where its marker is.
+const messageTypeRead = "read"
+
+// readFrame carries the last message a user read in a room.
+type readFrame struct {
+	Type      string `json:"type"`
+	Room      string `json:"room"`
+	MessageID string `json:"message_id"`
+}
+
+// readMarkers is the Redis hash of the last message each user read in room.
+func (ks keyspace) readMarkers(room string) string {
+	return ks.key("read:" + room)
+}
+
+// readRooms is the Redis set of the rooms user has a read marker in.
+func (ks keyspace) readRooms(user string) string {
+	return ks.key("read_rooms:" + user)
+}
+
+// setMarker moves a read marker, unless it changed since it was read.
+var setMarker = redis.NewScript(`
+if (redis.call("HGET", KEYS[1], ARGV[1]) or "") ~= ARGV[2] then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+return 1
+`)
+
+// markRead moves the read marker of user in room to message id. Markers
+// only move forward: a message before the current marker, or not in the
+// room, is ignored.
+func (s *Server) markRead(ctx context.Context, room, user, id string) error {
+	rank, err := s.store.Rank(ctx, room, id)
+	if err == errMessageNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	key := s.keys.readMarkers(room)
+
+	// a concurrent update from another connection of user makes the
+	// script fail, so look again
+	for attempt := 0; attempt < 3; attempt++ {
+		cur, err := s.rdb.HGet(ctx, key, user).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if cur == id {
+			return nil
+		}
+		if cur != "" {
+			curRank, err := s.store.Rank(ctx, room, cur)
+			if err == nil && curRank >= rank {
+				return nil
+			}
+			if err != nil && err != errMessageNotFound {
+				return err
+			}
+		}
+
+		ok, err := setMarker.Run(ctx, s.rdb, []string{key}, user, cur, id).Int()
+		if err != nil {
+			return err
+		}
+		if ok == 1 {
+			if err := s.rdb.SAdd(ctx, s.keys.readRooms(user), room).Err(); err != nil {
+				return err
+			}
+			return s.refreshUnread(ctx, room, user)
+		}
+	}
+	return nil
+}
+
+// handleReadFrame applies a read frame from c.
+func (s *Server) handleReadFrame(ctx context.Context, c *Client, msg ChatMessage) {
+	if c.username == "" {
+		s.sendError(c, "anonymous", "read markers need a username")
+		return
+	}
+	if msg.Room != "" && msg.Room != c.room {
+		s.sendError(c, "not_found", "no such message in this room")
+		return
+	}
+
+	// the direct messages passed since the marker last moved are read now
+	prev, err := s.rdb.HGet(ctx, s.keys.readMarkers(c.room), c.username).Result()
+	if err != nil && err != redis.Nil {
+		c.logger.Error("loading read marker", "err", err)
+	}
+	if err := s.markRead(ctx, c.room, c.username, msg.MessageID); err != nil {
+		c.logger.Error("marking read", "err", err)
+	}
+	if c.claimed != "" {
+		if err := s.markDirectRead(ctx, c.room, c.claimed, prev, msg.MessageID); err != nil {
+			c.logger.Error("marking direct messages read", "err", err)
+		}
+	}
+}
+
+// sendReadMarker tells c where its read marker is, after its history was
+// replayed. It runs on the connection goroutine.
+func (s *Server) sendReadMarker(ctx context.Context, c *Client) error {
+	if c.version < protocolV2 || c.username == "" {
+		return nil
+	}
+
+	id, err := s.rdb.HGet(ctx, s.keys.readMarkers(c.room), c.username).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		c.logger.Error("loading read marker", "err", err)
+		return nil
+	}
+
+	return c.writeFrame(readFrame{Type: messageTypeRead, Room: c.room, MessageID: id})
+}
+
+// readRanks returns the position in the history of room of every read
+// marker that still points into it, in ascending order.
+func (s *Server) readRanks(ctx context.Context, room string) ([]int64, error) {
+	markers, err := s.rdb.HGetAll(ctx, s.keys.readMarkers(room)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ranks := make([]int64, 0, len(markers))
+	for _, id := range markers {
+		rank, err := s.store.Rank(ctx, room, id)
+		if err == errMessageNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ranks = append(ranks, rank)
+	}
+
+	sort.Slice(ranks, func(i, j int) bool { return ranks[i] < ranks[j] })
+	return ranks, nil
+}
+
+// readBy counts the markers at or past the message at rank.
+func readBy(ranks []int64, rank int64) int64 {
+	i := sort.Search(len(ranks), func(i int) bool { return ranks[i] >= rank })
+	return int64(len(ranks) - i)
+}
+
+// Unread is the reply of the unread endpoint.
+type Unread struct {
+	Room     string `json:"room"`
+	User     string `json:"user"`
+	LastRead string `json:"last_read,omitempty"`
+	Unread   int64  `json:"unread"`
+}
+
+// unreadCount returns the read marker of user in room and how many messages
+// follow it.
+func (s *Server) unreadCount(ctx context.Context, room, user string) (string, int64, error) {
+	n, err := s.store.Len(ctx, room)
+	if err != nil {
+		return "", 0, err
+	}
+
+	id, err := s.rdb.HGet(ctx, s.keys.readMarkers(room), user).Result()
+	if err == redis.Nil {
+		return "", n, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	rank, err := s.store.Rank(ctx, room, id)
+	if err == errMessageNotFound {
+		return id, n, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return id, n - rank - 1, nil
+}
+
+// handleUnread counts the messages of a room after the read marker of a
+// user. Users without a marker, or whose marker left the history, haven't
+// read anything still stored.
+func (s *Server) handleUnread(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	room := r.PathValue("name")
+	user := r.URL.Query().Get("user")
+	if !validRoomName(room) {
+		http.NotFound(w, r)
+		return
+	}
+	if user == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+
+	fields, err := s.store.RoomFields(ctx, room)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	// like the roster, private rooms don't tell outsiders about members
+	if len(fields) == 0 || parseRoomOptions(fields).Private {
+		http.NotFound(w, r)
+		return
+	}
+
+	resp := Unread{Room: room, User: user}
+	resp.LastRead, resp.Unread, err = s.unreadCount(ctx, room, user)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	writeJSONResponse(w, http.StatusOK, resp)
+}
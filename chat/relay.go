@@ -0,0 +1,276 @@
+package chat
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// relayQueue is how many messages wait to be published to the other
+// instances before new ones are dropped.
+const relayQueue = 1024
+
+// relayChannel is the Redis Pub/Sub channel instances relay the messages of
+// their clients on.
+func (ks keyspace) relayChannel() string {
+	return ks.key("relay")
+}
+
+// relayEnvelope is a message relayed between instances, or, when Ref is
+// set, the ID of a stored message too large to relay. Timestamp is when it
+// was published, in Unix milliseconds.
+type relayEnvelope struct {
+	Origin    string      `json:"origin"`
+	Message   ChatMessage `json:"message"`
+	Ref       string      `json:"ref,omitempty"`
+	Timestamp int64       `json:"ts"`
+}
+
+// signedRelay is the payload published when a signing secret is configured:
+// the encoded envelope, and an HMAC of exactly those bytes.
+type signedRelay struct {
+	Envelope json.RawMessage `json:"envelope"`
+	Sig      string          `json:"sig"`
+}
+
+// relaySkew is how far the timestamp of a signed envelope may be from the
+// clock of the instance receiving it. Older envelopes are refused as
+// replays, as are those seen already within the window.
+const relaySkew = 30 * time.Second
+
+var (
+	errRelayUnsigned     = errors.New("relayed message is not signed")
+	errRelayBadSignature = errors.New("relayed message has an invalid signature")
+	errRelayStale        = errors.New("relayed message is too old or from the future")
+	errRelayReplayed     = errors.New("relayed message was already received")
+)
+
+// relaySigner signs and verifies relay payloads with a shared secret. A nil
+// signer neither signs nor requires signatures. Only the relay's subscriber
+// opens payloads, so seen, the signatures received lately, needs no lock.
+// It is swept once per skew window.
+type relaySigner struct {
+	secret []byte
+	seen   map[string]time.Time
+	swept  time.Time
+}
+
+func newRelaySigner(secret string) *relaySigner {
+	if secret == "" {
+		return nil
+	}
+	return &relaySigner{secret: []byte(secret), seen: make(map[string]time.Time)}
+}
+
+func (rs *relaySigner) mac(data []byte) []byte {
+	mac := hmac.New(sha256.New, rs.secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// seal wraps the encoded envelope data with its signature.
+func (rs *relaySigner) seal(data []byte) ([]byte, error) {
+	if rs == nil {
+		return data, nil
+	}
+	return json.Marshal(signedRelay{Envelope: data, Sig: hex.EncodeToString(rs.mac(data))})
+}
+
+// open decodes the envelope of payload. With a signer, the signature must
+// match the encoded envelope, which must have been published within the skew
+// window of now, and not received before.
+func (rs *relaySigner) open(payload []byte, now time.Time) (relayEnvelope, error) {
+	var env relayEnvelope
+	if rs == nil {
+		err := json.Unmarshal(payload, &env)
+		return env, err
+	}
+
+	var sr signedRelay
+	if err := json.Unmarshal(payload, &sr); err != nil {
+		return env, err
+	}
+	if sr.Sig == "" || len(sr.Envelope) == 0 {
+		return env, errRelayUnsigned
+	}
+	sig, err := hex.DecodeString(sr.Sig)
+	if err != nil || !hmac.Equal(sig, rs.mac(sr.Envelope)) {
+		return env, errRelayBadSignature
+	}
+	if err := json.Unmarshal(sr.Envelope, &env); err != nil {
+		return env, err
+	}
+
+	if d := now.Sub(time.UnixMilli(env.Timestamp)); d > relaySkew || d < -relaySkew {
+		return env, errRelayStale
+	}
+	if now.Sub(rs.swept) > relaySkew {
+		for s, t := range rs.seen {
+			if now.Sub(t) > relaySkew {
+				delete(rs.seen, s)
+			}
+		}
+		rs.swept = now
+	}
+	if _, ok := rs.seen[sr.Sig]; ok {
+		return env, errRelayReplayed
+	}
+	rs.seen[sr.Sig] = now
+	return env, nil
+}
+
+// relay queues msg for the other instances, when relaying is on. It never
+// blocks, so it is safe to call from the hub.
+func (s *Server) relay(msg ChatMessage) {
+	if s.relayOut == nil {
+		return
+	}
+
+	select {
+	case s.relayOut <- msg:
+	default:
+		s.logger.Warn("relay queue full, dropping message", "room", msg.Room, "id", msg.ID)
+	}
+}
+
+// relayBus carries relay envelopes between the instances.
+type relayBus interface {
+	publish(ctx context.Context, payload []byte) error
+
+	// subscribe delivers the payloads every instance publishes.
+	subscribe(ctx context.Context) <-chan []byte
+
+	// maxPayload is the size of the largest payload, 0 when unlimited.
+	maxPayload() int
+}
+
+// redisBus relays over Redis Pub/Sub.
+type redisBus struct {
+	rdb     *redis.Client
+	channel string
+}
+
+func (rb redisBus) publish(ctx context.Context, payload []byte) error {
+	return rb.rdb.Publish(ctx, rb.channel, payload).Err()
+}
+
+func (rb redisBus) subscribe(ctx context.Context) <-chan []byte {
+	out := make(chan []byte)
+	sub := rb.rdb.Subscribe(ctx, rb.channel)
+	go func() {
+		defer close(out)
+		for m := range sub.Channel() {
+			out <- []byte(m.Payload)
+		}
+	}()
+	return out
+}
+
+func (rb redisBus) maxPayload() int { return 0 }
+
+// envelope encodes msg for the bus. Messages too large for it are sent by
+// reference, to be read back from the store.
+func (s *Server) envelope(msg ChatMessage) ([]byte, error) {
+	data, err := s.seal(relayEnvelope{Origin: s.instanceID, Message: msg})
+	if err != nil {
+		return nil, err
+	}
+	if limit := s.relayBus.maxPayload(); limit > 0 && len(data) > limit {
+		if msg.ID == "" {
+			return nil, errors.New("message too large to relay and not stored")
+		}
+		return s.seal(relayEnvelope{Origin: s.instanceID, Ref: msg.ID})
+	}
+	return data, nil
+}
+
+// seal timestamps env and encodes it, signed when signing is on.
+func (s *Server) seal(env relayEnvelope) ([]byte, error) {
+	env.Timestamp = time.Now().UnixMilli()
+	data, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	return s.relaySigner.seal(data)
+}
+
+// runRelay publishes the messages of this instance's clients and delivers
+// those of the other instances.
+func (s *Server) runRelay() {
+	ctx := context.Background()
+
+	go func() {
+		for msg := range s.relayOut {
+			data, err := s.envelope(msg)
+			if err != nil {
+				s.logger.Error("encoding relayed message", "room", msg.Room, "id", msg.ID, "err", err)
+				continue
+			}
+			if err := s.relayBus.publish(ctx, data); err != nil {
+				s.logger.Warn("relaying message", "room", msg.Room, "err", err)
+			}
+		}
+	}()
+
+	for payload := range s.relayBus.subscribe(ctx) {
+		env, err := s.relaySigner.open(payload, time.Now())
+		if env.Origin == s.instanceID {
+			continue
+		}
+		if err != nil {
+			s.logger.Warn("dropping relayed message", "origin", env.Origin, "room", env.Message.Room, "err", err)
+			continue
+		}
+
+		msg := env.Message
+		if msg.Type == messageTypeExpired {
+			s.ops <- func(h *hub) {
+				broadcastExpired(h, msg.Room, msg.MessageID)
+			}
+			continue
+		}
+		if msg.Type == messageTypeStatus {
+			s.ops <- func(h *hub) {
+				broadcastStatus(h, msg)
+			}
+			continue
+		}
+		if env.Ref != "" {
+			var err error
+			if msg, err = s.store.Get(ctx, env.Ref); err != nil {
+				s.logger.Warn("reading relayed message", "origin", env.Origin, "id", env.Ref, "err", err)
+				continue
+			}
+			msg.Type = messageTypeChat
+		}
+
+		s.ops <- func(h *hub) {
+			var failed []*Client
+			var delivered bool
+			frames := make(frameCache)
+			for c := range h.clients {
+				if c.room != msg.Room || !c.wants(msg) {
+					continue
+				}
+				err := c.deliverMessage(msg, frames)
+				if err != nil && unsafeError(err) {
+					c.logger.Warn("delivering relayed message", "err", err)
+					failed = append(failed, c)
+				}
+				delivered = delivered || err == nil && msg.To != "" && c.verified == msg.To
+			}
+			for _, c := range failed {
+				removeClient(h, c, 0, "")
+			}
+			if delivered && msg.ID != "" {
+				go s.advanceStatus(msg, dmDelivered)
+			}
+		}
+	}
+}
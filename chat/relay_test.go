@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// relayPayload encodes a relayed message with text, sealed by signer.
+func relayPayload(t *testing.T, signer *relaySigner, text string, published time.Time) []byte {
+	t.Helper()
+
+	env := relayEnvelope{
+		Origin:    "other",
+		Message:   ChatMessage{Type: messageTypeChat, Room: "general", Username: "ann", Text: text},
+		Timestamp: published.UnixMilli(),
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err = signer.seal(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRelaySigner(t *testing.T) {
+	now := time.Now()
+	signer := newRelaySigner("secret")
+
+	// the envelope is signed as is, so editing it in place breaks the signature
+	tampered := bytes.ReplaceAll(relayPayload(t, signer, "hello", now), []byte("hello"), []byte("hijacked"))
+
+	replayed := relayPayload(t, signer, "hello", now)
+	if _, err := signer.open(replayed, now); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		signer  *relaySigner
+		payload []byte
+		wantErr error
+	}{
+		{"signed", signer, relayPayload(t, signer, "hello again", now), nil},
+		{"signing off", nil, relayPayload(t, nil, "hello", now), nil},
+		{"tampered", signer, tampered, errRelayBadSignature},
+		{"other secret", signer, relayPayload(t, newRelaySigner("other"), "hello", now), errRelayBadSignature},
+		{"unsigned", signer, relayPayload(t, nil, "hello", now), errRelayUnsigned},
+		{"stale", signer, relayPayload(t, signer, "hello", now.Add(-2*relaySkew)), errRelayStale},
+		{"replayed", signer, replayed, errRelayReplayed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, err := tt.signer.open(tt.payload, now)
+			if err != tt.wantErr {
+				t.Fatalf("open error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !strings.HasPrefix(env.Message.Text, "hello") {
+				t.Errorf("opened %q, want the message relayed", env.Message.Text)
+			}
+		})
+	}
+}
+
+// TestRelayVerified checks that only the relayed messages whose signature
+// checks out reach the clients.
+func TestRelayVerified(t *testing.T) {
+	t.Setenv("PUBSUB_RELAY", "1")
+	t.Setenv("RELAY_SIGNING_SECRET", "secret")
+	s, mr := newTestServer(t)
+	ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	waitClients(t, s, 1)
+
+	channel := s.keys.relayChannel()
+	for mr.PubSubNumSub(channel)[channel] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	now := time.Now()
+	signer := newRelaySigner("secret")
+	for _, payload := range [][]byte{
+		bytes.ReplaceAll(relayPayload(t, signer, "forged", now), []byte("forged"), []byte("hacked")),
+		relayPayload(t, nil, "unsigned", now),
+		relayPayload(t, newRelaySigner("other"), "other secret", now),
+		relayPayload(t, signer, "signed", now),
+	} {
+		mr.Publish(channel, string(payload))
+	}
+
+	if msg := readFrameOf(t, ann, messageTypeChat, nil); msg.Text != "signed" {
+		t.Errorf("got %q, want only the signed message", msg.Text)
+	}
+}
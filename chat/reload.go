@@ -0,0 +1,219 @@
+package chat
+
+import (
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// liveSettings are the settings Reload changes without a restart. They are
+// swapped as a whole, so that a request sees them all from the same load.
+type liveSettings struct {
+	// adminToken authorizes the admin endpoints. They are disabled when
+	// it is empty.
+	adminToken string
+
+	// cors is the cross-origin policy of the HTTP API, and wsOrigins the
+	// origins WebSocket connections may come from.
+	cors      corsConfig
+	wsOrigins []string
+
+	// bannedWords are the words messages may not contain.
+	bannedWords map[string]bool
+
+	// limiter throttles the messages sent from each address, in the rooms
+	// not setting their own limit. rateBurst is the burst of rooms that
+	// only set a rate.
+	limiter   *rateLimiter
+	rateLimit float64
+	rateBurst int
+
+	// handshakes throttles the requests from each address, allowing
+	// handshakeLimit per handshakeWindow.
+	handshakes      *rateLimiter
+	handshakeLimit  int
+	handshakeWindow time.Duration
+}
+
+func newLiveSettings(cfg Config) *liveSettings {
+	return &liveSettings{
+		adminToken:  cfg.AdminToken,
+		cors:        cfg.CORS,
+		wsOrigins:   cfg.WSOrigins,
+		bannedWords: cfg.BannedWords,
+		limiter:     newRateLimiter(cfg.RateLimit, cfg.RateBurst),
+		rateLimit:   cfg.RateLimit,
+		rateBurst:   cfg.RateBurst,
+
+		handshakes:      newHandshakeLimiter(cfg.HandshakeLimit, cfg.HandshakeWindow),
+		handshakeLimit:  cfg.HandshakeLimit,
+		handshakeWindow: cfg.HandshakeWindow,
+	}
+}
+
+// settings returns the current live settings.
+func (s *Server) settings() *liveSettings {
+	return s.live.Load()
+}
+
+// liveFields are the fields of Config that Reload swaps in. A change to
+// any other one only takes effect on a restart.
+var liveFields = map[string]bool{
+	"AdminToken":      true,
+	"CORS":            true,
+	"WSOrigins":       true,
+	"BannedWordsFile": true,
+	"BannedWords":     true,
+	"RateLimit":       true,
+	"RateBurst":       true,
+	"HandshakeLimit":  true,
+	"HandshakeWindow": true,
+}
+
+// settingVars are the variables of the fields of Config whose names don't
+// spell them.
+var settingVars = map[string]string{
+	"SQLitePath":       "SQLITE_PATH",
+	"Authenticator":    "JWT_SECRET",
+	"Codecs":           "WS_CODECS",
+	"ResumeTTL":        "RESUME_TOKEN_TTL",
+	"MaxUsernameLen":   "USERNAME_MAX_LENGTH",
+	"RediSearch":       "REDISEARCH",
+	"SlowQueue":        "SLOW_CONSUMER_QUEUE",
+	"SlowWrite":        "SLOW_CONSUMER_WRITE",
+	"PubSubRelay":      "PUBSUB_RELAY",
+	"RelaySecret":      "RELAY_SIGNING_SECRET",
+	"TelegramToken":    "TELEGRAM_BOT_TOKEN",
+	"EventsMaxLen":     "EVENTS_MAXLEN",
+	"AuditMaxLen":      "AUDIT_MAXLEN",
+	"TemplateReload":   "PUBLIC_DIR",
+	"ProtocolVersions": "WS_PROTOCOL_VERSIONS",
+}
+
+// settingVar returns the variable the field of Config is read from, by
+// default its name in upper snake case: RedisKeyPrefix is REDIS_KEY_PREFIX.
+func settingVar(field string) string {
+	if name, ok := settingVars[field]; ok {
+		return name
+	}
+
+	runes := []rune(field)
+	var b strings.Builder
+	for i, r := range runes {
+		// a word starts at an upper case letter after a lower case one,
+		// or at the last of a run of them followed by a lower case one
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// restartOnly returns the settings that differ between cfg and the running
+// configuration but aren't swapped in, by variable name.
+func (s *Server) restartOnly(cfg Config) []string {
+	var names []string
+	next, cur := reflect.ValueOf(cfg), reflect.ValueOf(s.cfg)
+	for i := 0; i < next.NumField(); i++ {
+		field := next.Type().Field(i).Name
+		if liveFields[field] || reflect.DeepEqual(next.Field(i).Interface(), cur.Field(i).Interface()) {
+			continue
+		}
+		names = append(names, settingVar(field))
+	}
+	return names
+}
+
+// reloadResult lists the settings a reload changed, and those that changed
+// but need a restart to take effect.
+type reloadResult struct {
+	Reloaded []string `json:"reloaded"`
+	Skipped  []string `json:"skipped"`
+}
+
+// Reload reads the configuration again, through the function given to
+// WithReloader, and swaps in the settings that can change while the server
+// runs: the admin token, the CORS policy, the WebSocket origins, the banned
+// words and the rate limits. A configuration that doesn't load or validate
+// leaves the current one in place.
+func (s *Server) Reload() error {
+	_, err := s.reload()
+	return err
+}
+
+func (s *Server) reload() (reloadResult, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	var result reloadResult
+
+	cfg, err := s.reloader()
+	if err != nil {
+		s.logger.Error("reload failed, keeping the current configuration", "err", err)
+		return result, err
+	}
+
+	result.Skipped = s.restartOnly(cfg)
+
+	cur := s.settings()
+	next := *cur
+	if cfg.AdminToken != cur.adminToken {
+		next.adminToken = cfg.AdminToken
+		result.Reloaded = append(result.Reloaded, "ADMIN_TOKEN")
+	}
+	if !cfg.CORS.equal(cur.cors) {
+		next.cors = cfg.CORS
+		result.Reloaded = append(result.Reloaded, "CORS")
+	}
+	if !slices.Equal(cfg.WSOrigins, cur.wsOrigins) {
+		next.wsOrigins = cfg.WSOrigins
+		result.Reloaded = append(result.Reloaded, "WS_ALLOWED_ORIGINS")
+	}
+	if !maps.Equal(cfg.BannedWords, cur.bannedWords) {
+		next.bannedWords = cfg.BannedWords
+		result.Reloaded = append(result.Reloaded, "BANNED_WORDS_FILE")
+	}
+	// the buckets are kept unless the limit changed
+	if cfg.RateLimit != cur.rateLimit || cfg.RateBurst != cur.rateBurst {
+		next.limiter = newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+		next.rateLimit = cfg.RateLimit
+		next.rateBurst = cfg.RateBurst
+		result.Reloaded = append(result.Reloaded, "RATE_LIMIT")
+	}
+	if cfg.HandshakeLimit != cur.handshakeLimit || cfg.HandshakeWindow != cur.handshakeWindow {
+		next.handshakes = newHandshakeLimiter(cfg.HandshakeLimit, cfg.HandshakeWindow)
+		next.handshakeLimit = cfg.HandshakeLimit
+		next.handshakeWindow = cfg.HandshakeWindow
+		result.Reloaded = append(result.Reloaded, "HANDSHAKE_LIMIT")
+	}
+	s.live.Store(&next)
+
+	if len(result.Skipped) != 0 {
+		s.logger.Warn("settings need a restart to change, skipped", "settings", result.Skipped)
+	}
+	s.logger.Info("reloaded configuration", "changed", result.Reloaded)
+	return result, nil
+}
+
+// equal reports whether cfg and other are the same policy.
+func (cfg corsConfig) equal(other corsConfig) bool {
+	return slices.Equal(cfg.origins, other.origins) &&
+		cfg.methods == other.methods &&
+		cfg.headers == other.headers
+}
+
+// handleReload reloads the configuration, answering with what changed.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	result, err := s.reload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, result)
+}
@@ -0,0 +1,174 @@
+package chat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func writeWordlist(t *testing.T, path string, words ...string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(strings.Join(words, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadModeration(t *testing.T) {
+	wordlist := filepath.Join(t.TempDir(), "banned.txt")
+	writeWordlist(t, wordlist, "# nothing yet")
+	t.Setenv("BANNED_WORDS_FILE", wordlist)
+	s, _ := newTestServer(t)
+
+	allowed := func(origin string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/websocket", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		return s.checkOrigin(req)
+	}
+	if !allowed("https://evil.example") {
+		t.Error("origin refused without an allowlist")
+	}
+	if hasBannedWord(s.settings().bannedWords, "darn it") {
+		t.Error("word banned before it was listed")
+	}
+
+	writeWordlist(t, wordlist, "Darn", "heck")
+	t.Setenv("WS_ALLOWED_ORIGINS", "https://app.example")
+	result, err := s.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"WS_ALLOWED_ORIGINS", "BANNED_WORDS_FILE"}
+	if !slices.Equal(result.Reloaded, want) {
+		t.Errorf("reloaded %q, want %q", result.Reloaded, want)
+	}
+	if allowed("https://evil.example") || !allowed("https://APP.example") || !allowed("") {
+		t.Error("origins not checked against the reloaded allowlist")
+	}
+	if !hasBannedWord(s.settings().bannedWords, "darn it") {
+		t.Error("reloaded word not banned")
+	}
+
+	// a bad wordlist leaves the current settings alone
+	writeWordlist(t, wordlist, "two words")
+	t.Setenv("WS_ALLOWED_ORIGINS", "*")
+	if _, err := s.reload(); err == nil || !strings.Contains(err.Error(), "BANNED_WORDS_FILE") {
+		t.Fatalf("reload err %v, want a BANNED_WORDS_FILE error", err)
+	}
+	if allowed("https://evil.example") || !hasBannedWord(s.settings().bannedWords, "heck") {
+		t.Error("failed reload changed the settings")
+	}
+}
+
+func TestBannedWords(t *testing.T) {
+	wordlist := filepath.Join(t.TempDir(), "banned.txt")
+	writeWordlist(t, wordlist, "darn")
+	t.Setenv("BANNED_WORDS_FILE", wordlist)
+	t.Setenv("API_KEY", "key")
+	s, _ := newTestServer(t)
+
+	ws := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	if err := ws.WriteJSON(ChatMessage{Text: "DARN!"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteJSON(ChatMessage{Text: "darning socks"}); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var codes []string
+	for len(codes) < 2 {
+		var f ChatMessage
+		if err := ws.ReadJSON(&f); err != nil {
+			t.Fatal(err)
+		}
+		switch f.Type {
+		case messageTypeError:
+			codes = append(codes, "error")
+		case messageTypeChat:
+			if f.Username == "ann" {
+				codes = append(codes, f.Text)
+			}
+		}
+	}
+	if want := []string{"error", "darning socks"}; !slices.Equal(codes, want) {
+		t.Errorf("got %q, want %q", codes, want)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(`{"username":"bob","text":"darn"}`))
+	req.Header.Set("X-API-Key", "key")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("send status %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	t.Setenv("WS_ALLOWED_ORIGINS", "https://app.example")
+	s, _ := newTestServer(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleConnetions))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/?room=general"
+
+	for origin, want := range map[string]int{
+		"https://app.example":  http.StatusSwitchingProtocols,
+		"https://evil.example": http.StatusForbidden,
+	} {
+		ws, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {origin}})
+		if ws != nil {
+			ws.Close()
+		}
+		if resp == nil {
+			t.Fatalf("dial from %s: %v", origin, err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("dial from %s: status %d, want %d", origin, resp.StatusCode, want)
+		}
+	}
+}
+
+// TestReloadReportsRestartOnly checks that a reload reports every changed
+// setting it didn't apply, and only those.
+func TestReloadReportsRestartOnly(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	t.Setenv("IRC_PORT", "6667")
+	t.Setenv("RESUME_TOKEN_TTL", "1h")
+	t.Setenv("FLOOD_THRESHOLD", "3")
+	t.Setenv("RATE_LIMIT", "2")
+	result, err := s.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"IRC_PORT", "RESUME_TOKEN_TTL", "FLOOD_THRESHOLD"}; !slices.Equal(result.Skipped, want) {
+		t.Errorf("skipped %q, want %q", result.Skipped, want)
+	}
+	if want := []string{"RATE_LIMIT"}; !slices.Equal(result.Reloaded, want) {
+		t.Errorf("reloaded %q, want %q", result.Reloaded, want)
+	}
+}
+
+func TestSettingVar(t *testing.T) {
+	for field, want := range map[string]string{
+		"Port":           "PORT",
+		"RedisKeyPrefix": "REDIS_KEY_PREFIX",
+		"IRCPort":        "IRC_PORT",
+		"MaxConnsPerIP":  "MAX_CONNS_PER_IP",
+		"SPAFallback":    "SPA_FALLBACK",
+		"ResumeTTL":      "RESUME_TOKEN_TTL",
+	} {
+		if got := settingVar(field); got != want {
+			t.Errorf("settingVar(%q) = %q, want %q", field, got, want)
+		}
+	}
+}
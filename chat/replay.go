@@ -0,0 +1,176 @@
+package chat
+
+import (
+	"context"
+	"time"
+)
+
+// replayChunk is the number of history messages loaded at a time.
+const replayChunk = 200
+
+// pendingFrame is a frame held back while a client replays history. id is the
+// ID of the chat message it carries, if any.
+type pendingFrame struct {
+	id string
+	v  interface{}
+}
+
+// deliver queues v for the writer of c, or holds it back while c is
+// replaying history. Either way c may only fall as far behind as its send
+// queue is long, past which deliver fails with errSendQueueFull. It runs on
+// the hub.
+func (c *Client) deliver(id string, v interface{}) error {
+	if c.pending != nil {
+		if len(c.pending) >= cap(c.send) {
+			c.overflowed.Store(true)
+			return errSendQueueFull
+		}
+		c.pending = append(c.pending, pendingFrame{id: id, v: v})
+		c.checkBackpressure()
+		return nil
+	}
+
+	err := c.enqueue(pendingFrame{id: id, v: v})
+	if err == nil {
+		if id != "" {
+			c.lastDelivered = id
+		}
+		c.checkBackpressure()
+	}
+	return err
+}
+
+// replayHistory sends the room history to c from the connection's own
+// goroutine, so that a long history doesn't hold up the hub. The hub queues
+// whatever the room sends meanwhile; it is flushed afterwards, minus the
+// messages the replay already included, so nothing is lost or reordered.
+func (s *Server) replayHistory(ctx context.Context, c *Client) {
+	replayed := make(map[string]bool)
+	err := s.sendMOTD(ctx, c)
+	if err == nil {
+		err = s.sendHistory(ctx, c, replayed)
+	}
+	if err != nil && unsafeError(err) {
+		c.logger.Warn("replaying history", "err", err)
+		// the read loop notices and unregisters the client
+		c.ws.Close()
+	}
+
+	unread, err := s.loadUnread(ctx, c)
+	if err != nil {
+		c.logger.Error("loading unread counts", "err", err)
+	}
+
+	done := make(chan struct{})
+	s.ops <- func(h *hub) {
+		defer close(done)
+
+		pending := c.pending
+		c.pending = nil
+		if !h.clients[c] {
+			return
+		}
+
+		if unread != nil {
+			c.unread = unread
+			pending = append([]pendingFrame{{v: unreadFrame{Type: messageTypeUnread, Counts: unread}}}, pending...)
+		}
+
+		for _, f := range pending {
+			if f.id != "" && replayed[f.id] {
+				continue
+			}
+			if err := c.deliver(f.id, f.v); err != nil {
+				c.logger.Warn("flushing queued frames", "err", err)
+				removeClient(h, c, 0, "")
+				return
+			}
+		}
+
+		if session, ok := s.newSession(c); ok {
+			if err := c.deliver("", session); err != nil {
+				c.logger.Warn("sending session", "err", err)
+				removeClient(h, c, 0, "")
+			}
+		}
+	}
+	<-done
+}
+
+// sendHistory writes the history of the room of c in chunks, recording the
+// IDs it sent in replayed.
+func (s *Server) sendHistory(ctx context.Context, c *Client, replayed map[string]bool) error {
+	if s.dryRun {
+		return nil
+	}
+
+	opts, err := s.roomOptions(ctx, c.room)
+	if err != nil {
+		c.logger.Error("loading room options", "err", err)
+		return nil
+	}
+	if !opts.Replay || c.noReplay {
+		return nil
+	}
+
+	var readRanks []int64
+	if opts.ReadReceipts {
+		if readRanks, err = s.readRanks(ctx, c.room); err != nil {
+			c.logger.Error("loading read markers", "err", err)
+		}
+	}
+
+	// a resumed session only gets what it missed, unless the message it
+	// resumes after left the history
+	var first int64
+	if c.resumeAfter != "" {
+		rank, err := s.store.Rank(ctx, c.room, c.resumeAfter)
+		switch {
+		case err == nil:
+			first = rank + 1
+		case err != errMessageNotFound:
+			c.logger.Error("finding resume point", "err", err)
+		}
+	}
+
+	for start := first; ; start += replayChunk {
+		msgs, err := s.store.Range(ctx, c.room, start, start+replayChunk-1)
+		if err != nil {
+			c.logger.Error("loading history", "err", err)
+			return nil
+		}
+
+		for i := range msgs {
+			msgs[i].Type = messageTypeChat
+			msgs[i].Room = c.room
+			if opts.ReadReceipts {
+				msgs[i].ReadBy = readBy(readRanks, start+int64(i))
+			}
+		}
+		if err := s.countReplies(ctx, msgs); err != nil {
+			c.logger.Error("counting replies", "err", err)
+		}
+
+		now := time.Now()
+		for _, msg := range msgs {
+			replayed[msg.ID] = true
+			// the sweeper may not have got to it yet
+			if msg.expired(now) || !msg.visibleTo(c.verified) {
+				continue
+			}
+
+			if err := c.writeFrame(msg.forVersion(c.version)); err != nil {
+				return err
+			}
+			c.lastDelivered = msg.ID
+			// the recipient catching up drains their inbox
+			if msg.To != "" && msg.To == c.verified && msg.Status == dmSent {
+				s.advanceStatus(msg, dmDelivered)
+			}
+		}
+
+		if len(msgs) < replayChunk {
+			return s.sendReadMarker(ctx, c)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package chat
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatedStore holds up history reads while its gate is set, until the gate is
+// closed.
+type gatedStore struct {
+	MessageStore
+	gate atomic.Pointer[chan struct{}]
+}
+
+func (gs *gatedStore) Range(ctx context.Context, room string, start, stop int64) ([]ChatMessage, error) {
+	if gate := gs.gate.Load(); gate != nil {
+		<-*gate
+	}
+	return gs.MessageStore.Range(ctx, room, start, stop)
+}
+
+// waitReplayed waits for the clients of s to be done replaying history.
+func waitReplayed(t *testing.T, s *Server) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		replaying := make(chan bool)
+		s.ops <- func(h *hub) {
+			for c := range h.clients {
+				if c.pending != nil {
+					replaying <- true
+					return
+				}
+			}
+			replaying <- false
+		}
+		if !<-replaying {
+			return
+		}
+	}
+	t.Fatal("clients still replaying history")
+}
+
+// TestReplayDoesNotBlockHub checks that the room goes on while a client
+// replays a long history, and that the client gets what was said meanwhile
+// right after the history, once.
+func TestReplayDoesNotBlockHub(t *testing.T) {
+	gs := &gatedStore{MessageStore: NewMemoryStore()}
+	s, _ := newTestServer(t, WithStore(gs))
+	ann := dialTestServer(t, s, "room=general&username=ann")
+	waitClients(t, s, 1)
+	waitReplayed(t, s)
+
+	var want []string
+	for i := 0; i < 2*replayChunk+50; i++ {
+		want = append(want, strconv.Itoa(i))
+	}
+	appendTexts(t, gs, "general", want...)
+
+	gate := make(chan struct{})
+	gs.gate.Store(&gate)
+	late := dialTestServer(t, s, "room=general&username=bob")
+	waitClients(t, s, 2)
+
+	// bob is stuck replaying, yet ann's message goes round
+	if err := ann.WriteJSON(ChatMessage{Username: "ann", Text: "live"}); err != nil {
+		t.Fatal(err)
+	}
+	ann.SetReadDeadline(time.Now().Add(time.Second))
+	var msg ChatMessage
+	if err := ann.ReadJSON(&msg); err != nil {
+		t.Fatalf("broadcast held up by the replay: %v", err)
+	}
+	if msg.Text != "live" {
+		t.Errorf("ann got %q, want live", msg.Text)
+	}
+
+	close(gate)
+	want = append(want, "live")
+	late.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i, text := range want {
+		var msg ChatMessage
+		if err := late.ReadJSON(&msg); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if msg.Text != text {
+			t.Fatalf("message %d = %q, want %q", i, msg.Text, text)
+		}
+	}
+
+	// nothing is sent twice
+	late.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if err := late.ReadJSON(&msg); err == nil {
+		t.Errorf("extra message %q after the replay", msg.Text)
+	}
+}
@@ -0,0 +1,273 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Retry and circuit-breaker tuning of resilientStore.
+const (
+	storeAttempts     = 3
+	storeRetryBackoff = 50 * time.Millisecond
+
+	// breakerThreshold consecutive failures open the breaker, which then
+	// waits breakerCooldown before probing the primary again, doubling up
+	// to breakerMaxCooldown while it keeps failing.
+	breakerThreshold   = 5
+	breakerCooldown    = 2 * time.Second
+	breakerMaxCooldown = time.Minute
+)
+
+// resilientStore keeps the chat going while its primary store, Redis, is
+// unreachable. Operations are retried with backoff; after repeated failures
+// a circuit breaker opens and history goes to an in-memory fallback until a
+// probe finds the primary healthy again. Messages sent during an outage are
+// only kept in memory.
+type resilientStore struct {
+	primary  MessageStore
+	fallback *MemoryStore
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	cooldown time.Duration
+	retryAt  time.Time
+}
+
+func newResilientStore(primary MessageStore) *resilientStore {
+	fallback := NewMemoryStore()
+	// keep fallback IDs from colliding with the primary's
+	fallback.idPrefix = "mem-"
+
+	return &resilientStore{primary: primary, fallback: fallback}
+}
+
+// unwrapStore returns the store behind any resilientStore.
+func unwrapStore(store MessageStore) MessageStore {
+	if rs, ok := store.(*resilientStore); ok {
+		return rs.primary
+	}
+	return store
+}
+
+// healthy reports whether the primary should be tried.
+func (rs *resilientStore) healthy() bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	// once the cooldown is over, let a call through as a probe
+	return !rs.open || !time.Now().Before(rs.retryAt)
+}
+
+func (rs *resilientStore) succeeded() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.open {
+		slog.Info("message store recovered, persisting again")
+	}
+	rs.failures = 0
+	rs.open = false
+	rs.cooldown = 0
+}
+
+func (rs *resilientStore) failed(err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.failures++
+	if !rs.open && rs.failures < breakerThreshold {
+		return
+	}
+
+	if rs.open {
+		rs.cooldown = min(rs.cooldown*2, breakerMaxCooldown)
+	} else {
+		slog.Error("message store unavailable, keeping history in memory", "err", err)
+		rs.open = true
+		rs.cooldown = breakerCooldown
+	}
+	rs.retryAt = time.Now().Add(rs.cooldown)
+}
+
+// transient reports whether err may go away by retrying, as opposed to an
+// answer from a healthy store.
+func transient(err error) bool {
+	return err != nil &&
+		err != errMessageNotFound &&
+		err != errMessageGone &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded)
+}
+
+// do runs op against the primary, retrying transient failures, or against
+// the fallback while the breaker is open.
+func (rs *resilientStore) do(ctx context.Context, op func(MessageStore) error) error {
+	if !rs.healthy() {
+		return op(rs.fallback)
+	}
+
+	var err error
+	backoff := storeRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err = op(rs.primary)
+		if !transient(err) {
+			rs.succeeded()
+			return err
+		}
+		if attempt == storeAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+
+	rs.failed(err)
+	return op(rs.fallback)
+}
+
+func (rs *resilientStore) Append(ctx context.Context, room string, msg *ChatMessage) error {
+	return rs.do(ctx, func(s MessageStore) error {
+		return s.Append(ctx, room, msg)
+	})
+}
+
+func (rs *resilientStore) Recent(ctx context.Context, room string, limit int64) (msgs []ChatMessage, err error) {
+	err = rs.do(ctx, func(s MessageStore) error {
+		msgs, err = s.Recent(ctx, room, limit)
+		return err
+	})
+	return msgs, err
+}
+
+func (rs *resilientStore) Range(ctx context.Context, room string, start, stop int64) (msgs []ChatMessage, err error) {
+	err = rs.do(ctx, func(s MessageStore) error {
+		msgs, err = s.Range(ctx, room, start, stop)
+		return err
+	})
+	return msgs, err
+}
+
+func (rs *resilientStore) Exists(ctx context.Context, room string) (ok bool, err error) {
+	err = rs.do(ctx, func(s MessageStore) error {
+		ok, err = s.Exists(ctx, room)
+		return err
+	})
+	return ok, err
+}
+
+func (rs *resilientStore) Len(ctx context.Context, room string) (n int64, err error) {
+	err = rs.do(ctx, func(s MessageStore) error {
+		n, err = s.Len(ctx, room)
+		return err
+	})
+	return n, err
+}
+
+func (rs *resilientStore) Trim(ctx context.Context, room string, limit int64) error {
+	return rs.do(ctx, func(s MessageStore) error {
+		return s.Trim(ctx, room, limit)
+	})
+}
+
+func (rs *resilientStore) PruneBefore(ctx context.Context, room string, cutoff time.Time) (n int64, err error) {
+	err = rs.do(ctx, func(s MessageStore) error {
+		n, err = s.PruneBefore(ctx, room, cutoff)
+		return err
+	})
+	return n, err
+}
+
+func (rs *resilientStore) Clear(ctx context.Context, room string) (n int64, err error) {
+	err = rs.do(ctx, func(s MessageStore) error {
+		n, err = s.Clear(ctx, room)
+		return err
+	})
+	return n, err
+}
+
+func (rs *resilientStore) Get(ctx context.Context, id string) (msg ChatMessage, err error) {
+	err = rs.do(ctx, func(s MessageStore) error {
+		msg, err = s.Get(ctx, id)
+		return err
+	})
+	return msg, err
+}
+
+func (rs *resilientStore) Replies(ctx context.Context, id string) (msgs []ChatMessage, err error) {
+	err = rs.do(ctx, func(s MessageStore) error {
+		msgs, err = s.Replies(ctx, id)
+		return err
+	})
+	return msgs, err
+}
+
+func (rs *resilientStore) ReplyCounts(ctx context.Context, ids []string) (counts []int64, err error) {
+	err = rs.do(ctx, func(s MessageStore) error {
+		counts, err = s.ReplyCounts(ctx, ids)
+		return err
+	})
+	return counts, err
+}
+
+func (rs *resilientStore) Remove(ctx context.Context, room, id string) error {
+	return rs.do(ctx, func(s MessageStore) error {
+		return s.Remove(ctx, room, id)
+	})
+}
+
+func (rs *resilientStore) Rank(ctx context.Context, room, id string) (n int64, err error) {
+	err = rs.do(ctx, func(s MessageStore) error {
+		n, err = s.Rank(ctx, room, id)
+		return err
+	})
+	return n, err
+}
+
+func (rs *resilientStore) SetStatus(ctx context.Context, id, status string) (moved bool, err error) {
+	err = rs.do(ctx, func(s MessageStore) error {
+		moved, err = s.SetStatus(ctx, id, status)
+		return err
+	})
+	return moved, err
+}
+
+// The rooms, their numbering and the locks are shared by the instances, so
+// they go to the primary alone: the fallback would hand out numbers and
+// rooms the others don't know about.
+
+func (rs *resilientStore) NextSeq(ctx context.Context, room string) (int64, error) {
+	return rs.primary.NextSeq(ctx, room)
+}
+
+func (rs *resilientStore) CreateRoom(ctx context.Context, room string, fields map[string]string) (bool, error) {
+	return rs.primary.CreateRoom(ctx, room, fields)
+}
+
+func (rs *resilientStore) RoomFields(ctx context.Context, room string) (map[string]string, error) {
+	return rs.primary.RoomFields(ctx, room)
+}
+
+func (rs *resilientStore) SetRoomFields(ctx context.Context, room string, fields map[string]string) error {
+	return rs.primary.SetRoomFields(ctx, room, fields)
+}
+
+func (rs *resilientStore) Rooms(ctx context.Context) (map[string]map[string]string, error) {
+	return rs.primary.Rooms(ctx)
+}
+
+func (rs *resilientStore) Lock(ctx context.Context, name, token string, ttl time.Duration) (bool, error) {
+	return rs.primary.Lock(ctx, name, token, ttl)
+}
+
+func (rs *resilientStore) Unlock(ctx context.Context, name, token string) error {
+	return rs.primary.Unlock(ctx, name, token)
+}
@@ -0,0 +1,176 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errStoreDown = errors.New("dial tcp: connection refused")
+
+// flakyStore is a MemoryStore failing its appends and reads while down, or
+// for the next failNext calls.
+type flakyStore struct {
+	*MemoryStore
+
+	mu       sync.Mutex
+	down     bool
+	failNext int
+	calls    int
+}
+
+func (fs *flakyStore) fail() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.calls++
+	if fs.down {
+		return errStoreDown
+	}
+	if fs.failNext > 0 {
+		fs.failNext--
+		return errStoreDown
+	}
+	return nil
+}
+
+func (fs *flakyStore) setDown(down bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.down = down
+}
+
+func (fs *flakyStore) callCount() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.calls
+}
+
+func (fs *flakyStore) Append(ctx context.Context, room string, msg *ChatMessage) error {
+	if err := fs.fail(); err != nil {
+		return err
+	}
+	return fs.MemoryStore.Append(ctx, room, msg)
+}
+
+func (fs *flakyStore) Recent(ctx context.Context, room string, limit int64) ([]ChatMessage, error) {
+	if err := fs.fail(); err != nil {
+		return nil, err
+	}
+	return fs.MemoryStore.Recent(ctx, room, limit)
+}
+
+func (fs *flakyStore) Get(ctx context.Context, id string) (ChatMessage, error) {
+	if err := fs.fail(); err != nil {
+		return ChatMessage{}, err
+	}
+	return fs.MemoryStore.Get(ctx, id)
+}
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errMessageNotFound, false},
+		{errMessageGone, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{errStoreDown, true},
+	}
+	for _, tt := range tests {
+		if got := transient(tt.err); got != tt.want {
+			t.Errorf("transient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestResilientStoreRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		failNext    int
+		wantPrimary bool
+	}{
+		{"healthy", 0, true},
+		{"one failure", 1, true},
+		{"two failures", storeAttempts - 1, true},
+		{"out of attempts", storeAttempts, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			primary := &flakyStore{MemoryStore: NewMemoryStore(), failNext: tt.failNext}
+			rs := newResilientStore(primary)
+
+			msg := ChatMessage{Username: "ann", Text: "hi", Timestamp: time.Now().UnixMilli()}
+			if err := rs.Append(ctx, "general", &msg); err != nil {
+				t.Fatal(err)
+			}
+
+			stored, _ := primary.MemoryStore.Recent(ctx, "general", 0)
+			if got := len(stored) == 1; got != tt.wantPrimary {
+				t.Errorf("stored in the primary %v, want %v", got, tt.wantPrimary)
+			}
+			fallback, _ := rs.fallback.Recent(ctx, "general", 0)
+			if got := len(fallback) == 1; got == tt.wantPrimary {
+				t.Errorf("stored in the fallback %v, want %v", got, !tt.wantPrimary)
+			}
+		})
+	}
+}
+
+// TestResilientStoreOutage takes the primary down until the breaker opens,
+// and brings it back.
+func TestResilientStoreOutage(t *testing.T) {
+	ctx := context.Background()
+	primary := &flakyStore{MemoryStore: NewMemoryStore()}
+	rs := newResilientStore(primary)
+	appendTexts(t, rs, "general", "before")
+
+	primary.setDown(true)
+	for i := 0; i < breakerThreshold; i++ {
+		appendTexts(t, rs, "general", "during")
+	}
+	if !rs.open {
+		t.Fatalf("breaker closed after %d failures", breakerThreshold)
+	}
+
+	// while open, the primary is left alone and the chat goes on in memory
+	calls := primary.callCount()
+	appendTexts(t, rs, "general", "open")
+	if primary.callCount() != calls {
+		t.Error("primary called while the breaker is open")
+	}
+	msgs, err := rs.Recent(ctx, "general", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != breakerThreshold+1 {
+		t.Errorf("fallback history %q, want the messages of the outage", texts(msgs))
+	}
+
+	// a failed probe doubles the cooldown
+	rs.retryAt = time.Now()
+	appendTexts(t, rs, "general", "probe")
+	if !rs.open || rs.cooldown != 2*breakerCooldown {
+		t.Errorf("after a failed probe: open %v, cooldown %v, want open, %v", rs.open, rs.cooldown, 2*breakerCooldown)
+	}
+
+	primary.setDown(false)
+	rs.retryAt = time.Now()
+	appendTexts(t, rs, "general", "after")
+	if rs.open {
+		t.Error("breaker still open after the primary recovered")
+	}
+	msgs, err = rs.Recent(ctx, "general", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := texts(msgs), []string{"before", "after"}; !slices.Equal(got, want) {
+		t.Errorf("history %q, want %q persisted", got, want)
+	}
+}
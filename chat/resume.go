@@ -0,0 +1,106 @@
+package chat
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// messageTypeSession is the frame handing v2 clients their resume token.
+const messageTypeSession = "session"
+
+// defaultResumeTTL is how long resume tokens are valid unless
+// RESUME_TOKEN_TTL says otherwise.
+const defaultResumeTTL = 5 * time.Minute
+
+// sessionFrame carries a token to resume the session with after a reconnect.
+type sessionFrame struct {
+	Type      string `json:"type"`
+	Token     string `json:"resume_token"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// resumePoint is what a resume token restores: who the client was, in which
+// room, and the last message it was sent.
+type resumePoint struct {
+	Username string `json:"u"`
+	Room     string `json:"r"`
+	LastID   string `json:"m,omitempty"`
+	Expires  int64  `json:"e"`
+}
+
+var errInvalidResume = errors.New("invalid resume token")
+
+// resumeKey is the key resume tokens are signed with. Without RESUME_SECRET
+// a random one is used, so tokens only work on the instance that issued them
+// until it restarts.
+func resumeKey(secret string) []byte {
+	if secret != "" {
+		return []byte(secret)
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (s *Server) signResume(payload string) string {
+	mac := hmac.New(sha256.New, s.resumeKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueResume returns a resume token for c, positioned after message
+// lastID, and when it expires.
+func (s *Server) issueResume(c *Client, lastID string) (string, time.Time) {
+	expires := time.Now().Add(s.resumeTTL)
+	p := resumePoint{Username: c.claimed, Room: c.room, LastID: lastID, Expires: expires.Unix()}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + s.signResume(payload), expires
+}
+
+// verifyResume checks token and returns the point it resumes, if it was
+// issued for room and hasn't expired.
+func (s *Server) verifyResume(token, room string) (resumePoint, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.signResume(payload))) {
+		return resumePoint{}, errInvalidResume
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return resumePoint{}, errInvalidResume
+	}
+	var p resumePoint
+	if err := json.Unmarshal(data, &p); err != nil {
+		return resumePoint{}, errInvalidResume
+	}
+
+	if p.Room != room || p.Username == "" || time.Now().Unix() > p.Expires {
+		return resumePoint{}, errInvalidResume
+	}
+	return p, nil
+}
+
+// newSession returns the frame handing c a fresh resume token, positioned
+// after the last message c was sent. It reports false when c can't resume:
+// it has no username or doesn't speak v2. It runs on the hub.
+func (s *Server) newSession(c *Client) (sessionFrame, bool) {
+	if c.version < protocolV2 || c.claimed == "" || c.parent != nil {
+		return sessionFrame{}, false
+	}
+
+	token, expires := s.issueResume(c, c.lastDelivered)
+	return sessionFrame{Type: messageTypeSession, Token: token, ExpiresAt: expires.UnixMilli()}, true
+}
@@ -0,0 +1,75 @@
+package chat
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// maxResync is the most recent messages a resync looks through.
+	maxResync = 500
+
+	// resyncInterval is how long a client waits between resyncs.
+	resyncInterval = 5 * time.Second
+)
+
+// messageTypeResync is both the frame asking for the messages of the room
+// after a seq and the frame answering it.
+const messageTypeResync = "resync"
+
+// resyncFrame carries the messages after FromSeq. Truncated is set when
+// some of them are older than the last maxResync messages and left out.
+type resyncFrame struct {
+	Type      string        `json:"type"`
+	Room      string        `json:"room"`
+	FromSeq   int64         `json:"from_seq"`
+	Messages  []ChatMessage `json:"messages"`
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+// roomSeq is the Redis counter the messages of room are numbered from.
+func (ks keyspace) roomSeq(room string) string {
+	return ks.key("room_seq:" + room)
+}
+
+// handleResync answers a resync frame from c, which noticed a gap after
+// message fromSeq, with the stored messages it missed.
+func (s *Server) handleResync(ctx context.Context, c *Client, fromSeq int64) {
+	if c.version < protocolV2 {
+		return
+	}
+	if time.Since(c.lastResync) < resyncInterval {
+		s.sendError(c, "rate_limited", "you are resyncing too often")
+		s.violation(ctx, c, "rate_limited")
+		return
+	}
+	c.lastResync = time.Now()
+
+	n, err := s.store.Len(ctx, c.room)
+	if err != nil {
+		c.logger.Error("loading history for resync", "err", err)
+		return
+	}
+	start := max(n-maxResync, 0)
+	msgs, err := s.store.Range(ctx, c.room, start, -1)
+	if err != nil {
+		c.logger.Error("loading history for resync", "err", err)
+		return
+	}
+
+	f := resyncFrame{Type: messageTypeResync, Room: c.room, FromSeq: fromSeq, Messages: []ChatMessage{}}
+	now := time.Now()
+	for _, msg := range msgs {
+		if msg.Seq <= fromSeq || msg.expired(now) || !msg.visibleTo(c.verified) {
+			continue
+		}
+		msg.Type = messageTypeChat
+		msg.Room = c.room
+		f.Messages = append(f.Messages, msg)
+	}
+	if start > 0 && len(f.Messages) > 0 && f.Messages[0].Seq > fromSeq+1 {
+		f.Truncated = true
+	}
+
+	s.sendFrame(c, f)
+}
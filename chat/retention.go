@@ -0,0 +1,85 @@
+package chat
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// retentionLock makes sure a single instance prunes history at a time.
+const retentionLock = "retention"
+
+// runRetention prunes messages older than their room's max age, or else
+// retentionMaxAge, from every room every retentionInterval. It complements
+// the per-room count cap, so a room keeps whichever of the two is smaller.
+// It only runs when retention is on.
+func (s *Server) runRetention() {
+	ticker := time.NewTicker(s.retentionInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.pruneHistory(context.Background())
+	}
+}
+
+// pruneHistory runs one retention pass, unless another instance holds the
+// lock, which the store keeps. The lock expires after an interval in case its
+// holder dies.
+func (s *Server) pruneHistory(ctx context.Context) {
+	token := newToken()
+
+	ok, err := s.store.Lock(ctx, retentionLock, token, s.retentionInterval)
+	if err != nil {
+		s.logger.Error("acquiring retention lock", "err", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	defer func() {
+		if err := s.store.Unlock(ctx, retentionLock, token); err != nil {
+			s.logger.Warn("releasing retention lock", "err", err)
+		}
+	}()
+
+	rooms, err := s.store.Rooms(ctx)
+	if err != nil {
+		s.logger.Error("listing rooms for retention", "err", err)
+		return
+	}
+
+	now := time.Now()
+
+	var total int64
+	for room := range rooms {
+		opts, err := s.roomOptions(ctx, room)
+		if err != nil {
+			s.logger.Error("loading room options", "room", room, "err", err)
+			continue
+		}
+		maxAge := s.retentionMaxAge
+		if opts.MaxAge > 0 {
+			maxAge = time.Duration(opts.MaxAge) * time.Second
+		}
+		if maxAge <= 0 {
+			continue
+		}
+
+		n, err := s.store.PruneBefore(ctx, room, now.Add(-maxAge))
+		total += n
+		if err != nil {
+			s.logger.Error("pruning history", "room", room, "err", err)
+			continue
+		}
+		if n > 0 {
+			s.logger.Info("pruned history", "room", room, "count", n)
+		}
+	}
+
+	s.pruned.Add(total)
+	level := slog.LevelDebug
+	if total > 0 {
+		level = slog.LevelInfo
+	}
+	s.logger.Log(ctx, level, "retention pass done", "rooms", len(rooms), "pruned", total)
+}
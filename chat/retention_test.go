@@ -0,0 +1,105 @@
+package chat
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// appendAged appends a message to room for each of ages, stamped that long
+// ago.
+func appendAged(t *testing.T, store MessageStore, room string, now time.Time, ages ...time.Duration) {
+	t.Helper()
+
+	for _, age := range ages {
+		msg := ChatMessage{Username: "ann", Text: age.String(), Timestamp: now.Add(-age).UnixMilli()}
+		if err := store.Append(context.Background(), room, &msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStorePruneBefore(t *testing.T) {
+	now := time.Now()
+	ages := []time.Duration{48 * time.Hour, 25 * time.Hour, 23 * time.Hour, time.Minute}
+
+	tests := []struct {
+		name   string
+		maxAge time.Duration
+		want   []string
+	}{
+		{"none expired", 72 * time.Hour, []string{"48h0m0s", "25h0m0s", "23h0m0s", "1m0s"}},
+		{"some expired", 24 * time.Hour, []string{"23h0m0s", "1m0s"}},
+		{"all expired", time.Second, nil},
+	}
+	for name, open := range testStores(t) {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				store := open()
+				appendAged(t, store, "general", now, ages...)
+				appendAged(t, store, "random", now, 48*time.Hour)
+
+				n, err := store.PruneBefore(ctx, "general", now.Add(-tt.maxAge))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := int64(len(ages) - len(tt.want)); n != want {
+					t.Errorf("pruned %d, want %d", n, want)
+				}
+
+				msgs, err := store.Recent(ctx, "general", 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := texts(msgs); !slices.Equal(got, tt.want) {
+					t.Errorf("kept %q, want %q", got, tt.want)
+				}
+
+				// other rooms are left alone
+				if msgs, err := store.Recent(ctx, "random", 0); err != nil || len(msgs) != 1 {
+					t.Errorf("random has %d messages, %v, want 1", len(msgs), err)
+				}
+			})
+		}
+	}
+}
+
+// TestPruneHistory checks that a retention pass applies the rooms' own max
+// age, or else the default.
+func TestPruneHistory(t *testing.T) {
+	t.Setenv("RETENTION_MAX_AGE", "24h")
+	s, _ := newTestServer(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	for room, maxAge := range map[string]int64{"general": 0, "random": 3600} {
+		if _, err := s.createRoom(ctx, room, RoomOptions{Replay: true, MaxAge: maxAge}, ""); err != nil {
+			t.Fatal(err)
+		}
+		appendAged(t, s.store, room, now, 48*time.Hour, 23*time.Hour, time.Minute)
+	}
+
+	s.pruneHistory(ctx)
+
+	tests := []struct {
+		room string
+		want []string
+	}{
+		{"general", []string{"23h0m0s", "1m0s"}},
+		{"random", []string{"1m0s"}},
+	}
+	for _, tt := range tests {
+		msgs, err := s.store.Recent(ctx, tt.room, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := texts(msgs); !slices.Equal(got, tt.want) {
+			t.Errorf("%s kept %q, want %q", tt.room, got, tt.want)
+		}
+	}
+	if got := s.pruned.Load(); got != 3 {
+		t.Errorf("%d pruned in all, want 3", got)
+	}
+}
@@ -0,0 +1,315 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultRoomConfigTTL is how long room options are cached unless
+// ROOM_CONFIG_TTL says otherwise. Changes made through another instance are
+// picked up once it runs out.
+const defaultRoomConfigTTL = 10 * time.Second
+
+// roomConfigCache keeps the options of recently used rooms, so that the
+// message path doesn't read them from Redis for every frame.
+type roomConfigCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedRoomOptions
+}
+
+type cachedRoomOptions struct {
+	opts    RoomOptions
+	expires time.Time
+}
+
+func newRoomConfigCache(ttl time.Duration) *roomConfigCache {
+	return &roomConfigCache{ttl: ttl, entries: make(map[string]cachedRoomOptions)}
+}
+
+func (rc *roomConfigCache) get(room string) (RoomOptions, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	e, ok := rc.entries[room]
+	if !ok || time.Now().After(e.expires) {
+		return RoomOptions{}, false
+	}
+	return e.opts, true
+}
+
+func (rc *roomConfigCache) put(room string, opts RoomOptions) {
+	if rc.ttl <= 0 {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	now := time.Now()
+	if len(rc.entries) >= maxBuckets {
+		for k, e := range rc.entries {
+			if now.After(e.expires) {
+				delete(rc.entries, k)
+			}
+		}
+	}
+	rc.entries[room] = cachedRoomOptions{opts: opts, expires: now.Add(rc.ttl)}
+}
+
+func (rc *roomConfigCache) invalidate(room string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	delete(rc.entries, room)
+}
+
+// roomLimiters holds the rate limiters of the rooms that override the
+// server's rate limit.
+type roomLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]roomLimiter
+}
+
+type roomLimiter struct {
+	rate  float64
+	burst int
+	l     *rateLimiter
+}
+
+// limiterFor returns the rate limiter applying to room, given its options.
+// A room whose limit changed gets a fresh limiter.
+func (s *Server) limiterFor(room string, opts RoomOptions) *rateLimiter {
+	live := s.settings()
+	if opts.RateLimit <= 0 {
+		return live.limiter
+	}
+
+	burst := opts.RateBurst
+	if burst <= 0 {
+		burst = live.rateBurst
+	}
+
+	rl := &s.roomLimiters
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	cur, ok := rl.limiters[room]
+	if !ok || cur.rate != opts.RateLimit || cur.burst != burst {
+		if rl.limiters == nil {
+			rl.limiters = make(map[string]roomLimiter)
+		}
+		cur = roomLimiter{rate: opts.RateLimit, burst: burst, l: newRateLimiter(opts.RateLimit, burst)}
+		rl.limiters[room] = cur
+	}
+	return cur.l
+}
+
+// roomOptionsUpdate holds the options a request sets, nil fields being left
+// as they are.
+type roomOptionsUpdate struct {
+	HistoryCap *int64   `json:"history_cap"`
+	Replay     *bool    `json:"replay"`
+	RateLimit  *float64 `json:"rate_limit"`
+	RateBurst  *int     `json:"rate_burst"`
+	MaxAge     *int64   `json:"max_age"`
+	MaxBytes   *int64   `json:"max_bytes"`
+
+	ReadReceipts *bool  `json:"read_receipts"`
+	SlowMode     *int64 `json:"slow_mode"`
+	ReadOnly     *bool  `json:"read_only"`
+	Capacity     *int64 `json:"capacity"`
+	Lobby        *bool  `json:"lobby"`
+}
+
+// apply validates u and sets its fields on opts.
+func (u roomOptionsUpdate) apply(opts *RoomOptions) error {
+	if u.HistoryCap != nil {
+		if *u.HistoryCap < 0 {
+			return errors.New("history_cap must not be negative")
+		}
+		opts.HistoryCap = *u.HistoryCap
+	}
+	if u.Replay != nil {
+		opts.Replay = *u.Replay
+	}
+	if u.RateLimit != nil {
+		if *u.RateLimit < 0 {
+			return errors.New("rate_limit must not be negative")
+		}
+		opts.RateLimit = *u.RateLimit
+	}
+	if u.RateBurst != nil {
+		if *u.RateBurst < 0 {
+			return errors.New("rate_burst must not be negative")
+		}
+		opts.RateBurst = *u.RateBurst
+	}
+	if u.MaxAge != nil {
+		if *u.MaxAge < 0 {
+			return errors.New("max_age must not be negative")
+		}
+		opts.MaxAge = *u.MaxAge
+	}
+	if u.MaxBytes != nil {
+		if *u.MaxBytes < 0 {
+			return errors.New("max_bytes must not be negative")
+		}
+		opts.MaxBytes = *u.MaxBytes
+	}
+	if u.ReadReceipts != nil {
+		opts.ReadReceipts = *u.ReadReceipts
+	}
+	if u.SlowMode != nil {
+		if *u.SlowMode < 0 {
+			return errors.New("slow_mode must not be negative")
+		}
+		opts.SlowMode = *u.SlowMode
+	}
+	if u.ReadOnly != nil {
+		opts.ReadOnly = *u.ReadOnly
+	}
+	if u.Capacity != nil {
+		if *u.Capacity < 0 {
+			return errors.New("capacity must not be negative")
+		}
+		opts.Capacity = *u.Capacity
+	}
+	if u.Lobby != nil {
+		opts.Lobby = *u.Lobby
+	}
+	return nil
+}
+
+// fields returns the room fields of the options u sets.
+func (u roomOptionsUpdate) fields(opts RoomOptions) map[string]string {
+	all := opts.fields()
+	fields := make(map[string]string)
+	if u.HistoryCap != nil {
+		fields["history_cap"] = all["history_cap"]
+	}
+	if u.Replay != nil {
+		fields["replay"] = all["replay"]
+	}
+	if u.RateLimit != nil {
+		fields["rate_limit"] = all["rate_limit"]
+	}
+	if u.RateBurst != nil {
+		fields["rate_burst"] = all["rate_burst"]
+	}
+	if u.MaxAge != nil {
+		fields["max_age"] = all["max_age"]
+	}
+	if u.MaxBytes != nil {
+		fields["max_bytes"] = all["max_bytes"]
+	}
+	if u.ReadReceipts != nil {
+		fields["read_receipts"] = all["read_receipts"]
+	}
+	if u.SlowMode != nil {
+		fields["slow_mode"] = all["slow_mode"]
+	}
+	if u.ReadOnly != nil {
+		fields["read_only"] = all["read_only"]
+	}
+	if u.Capacity != nil {
+		fields["capacity"] = all["capacity"]
+	}
+	if u.Lobby != nil {
+		fields["lobby"] = all["lobby"]
+	}
+	return fields
+}
+
+var errRoomNotFound = errors.New("room does not exist")
+
+// updateRoom applies u to the stored options of room. The change takes
+// effect on this instance right away.
+func (s *Server) updateRoom(ctx context.Context, room string, u roomOptionsUpdate) (RoomOptions, error) {
+	fields, err := s.store.RoomFields(ctx, room)
+	if err != nil {
+		return RoomOptions{}, err
+	}
+	if len(fields) == 0 {
+		return RoomOptions{}, errRoomNotFound
+	}
+
+	opts := parseRoomOptions(fields)
+	if err := u.apply(&opts); err != nil {
+		return RoomOptions{}, err
+	}
+
+	if values := u.fields(opts); len(values) > 0 {
+		if err := s.store.SetRoomFields(ctx, room, values); err != nil {
+			return RoomOptions{}, err
+		}
+	}
+	s.roomConfig.invalidate(room)
+
+	return opts, nil
+}
+
+// handleUpdateRoom changes the options of a room.
+func (s *Server) handleUpdateRoom(w http.ResponseWriter, r *http.Request) {
+	room := r.PathValue("name")
+	if !validRoomName(room) {
+		http.NotFound(w, r)
+		return
+	}
+
+	var u roomOptionsUpdate
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// validate before touching the stored options
+	if err := u.apply(new(RoomOptions)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts, err := s.updateRoom(r.Context(), room, u)
+	if err == errRoomNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	s.announceSettings(room, u, opts)
+
+	writeJSONResponse(w, http.StatusOK, Room{Name: room, RoomOptions: opts})
+}
+
+// announceSettings tells the clients in room about the changes of u that
+// affect who may post, so that they can update their composer.
+func (s *Server) announceSettings(room string, u roomOptionsUpdate, opts RoomOptions) {
+	if u.SlowMode == nil && u.ReadOnly == nil {
+		return
+	}
+
+	s.ops <- func(h *hub) {
+		if u.SlowMode != nil {
+			if opts.SlowMode > 0 {
+				broadcastSystem(h, room, "slow_mode_on", fmt.Sprintf("Slow mode is on: one message every %d seconds.", opts.SlowMode))
+			} else {
+				broadcastSystem(h, room, "slow_mode_off", "Slow mode is off.")
+			}
+		}
+		if u.ReadOnly != nil {
+			if opts.ReadOnly {
+				broadcastSystem(h, room, "read_only_on", "The room is read-only.")
+			} else {
+				broadcastSystem(h, room, "read_only_off", "The room is open for posting again.")
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRoomOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]string
+		want   RoomOptions
+	}{
+		{"defaults", nil, RoomOptions{Replay: true}},
+		{
+			"set",
+			map[string]string{"history_cap": "50", "replay": "false", "rate_limit": "0.5", "rate_burst": "3", "max_age": "3600", "slow_mode": "10", "read_only": "true"},
+			RoomOptions{HistoryCap: 50, RateLimit: 0.5, RateBurst: 3, MaxAge: 3600, SlowMode: 10, ReadOnly: true},
+		},
+		{"invalid values ignored", map[string]string{"history_cap": "many", "replay": "maybe"}, RoomOptions{Replay: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRoomOptions(tt.fields); got != tt.want {
+				t.Errorf("parseRoomOptions = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoomOptionsUpdateApply(t *testing.T) {
+	neg, zero := int64(-1), int64(0)
+	negRate := -0.5
+	tests := []struct {
+		name    string
+		u       roomOptionsUpdate
+		wantErr bool
+	}{
+		{"empty", roomOptionsUpdate{}, false},
+		{"zero cap", roomOptionsUpdate{HistoryCap: &zero}, false},
+		{"negative cap", roomOptionsUpdate{HistoryCap: &neg}, true},
+		{"negative rate", roomOptionsUpdate{RateLimit: &negRate}, true},
+		{"negative max age", roomOptionsUpdate{MaxAge: &neg}, true},
+		{"negative slow mode", roomOptionsUpdate{SlowMode: &neg}, true},
+		{"negative capacity", roomOptionsUpdate{Capacity: &neg}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := defaultRoomOptions()
+			if err := tt.u.apply(&opts); (err != nil) != tt.wantErr {
+				t.Errorf("apply = %v, want an error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRoomConfigCache(t *testing.T) {
+	opts := RoomOptions{HistoryCap: 10}
+
+	rc := newRoomConfigCache(50 * time.Millisecond)
+	if _, ok := rc.get("general"); ok {
+		t.Error("empty cache hit")
+	}
+	rc.put("general", opts)
+	if got, ok := rc.get("general"); !ok || got != opts {
+		t.Errorf("get = %+v, %v, want the options put", got, ok)
+	}
+	rc.invalidate("general")
+	if _, ok := rc.get("general"); ok {
+		t.Error("hit after invalidating")
+	}
+	rc.put("general", opts)
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := rc.get("general"); ok {
+		t.Error("hit after expiring")
+	}
+
+	off := newRoomConfigCache(0)
+	off.put("general", opts)
+	if _, ok := off.get("general"); ok {
+		t.Error("hit with caching off")
+	}
+}
+
+// patchRoom changes the options of room through the API.
+func patchRoom(t *testing.T, s *Server, room, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/rooms/"+room, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.SetPathValue("name", room)
+	rec := httptest.NewRecorder()
+	s.adminOnly(s.handleUpdateRoom)(rec, req)
+	return rec
+}
+
+// TestRoomConfigUpdates checks that the options of a room are cached, that
+// changes made elsewhere show once the cache expires, and that changes made
+// through the API apply right away.
+func TestRoomConfigUpdates(t *testing.T) {
+	t.Setenv("ROOM_CONFIG_TTL", "100ms")
+	t.Setenv("ADMIN_TOKEN", "secret")
+	s, _ := newTestServer(t)
+	ctx := context.Background()
+
+	if _, err := s.createRoom(ctx, "general", defaultRoomOptions(), ""); err != nil {
+		t.Fatal(err)
+	}
+	check := func(want int64) {
+		t.Helper()
+		opts, err := s.roomOptions(ctx, "general")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.SlowMode != want {
+			t.Errorf("slow mode %d, want %d", opts.SlowMode, want)
+		}
+	}
+	check(0)
+
+	// another instance changes the stored options
+	if err := s.rdb.HSet(ctx, s.keys.room("general"), "slow_mode", "5").Err(); err != nil {
+		t.Fatal(err)
+	}
+	check(0)
+	time.Sleep(150 * time.Millisecond)
+	check(5)
+
+	if rec := patchRoom(t, s, "general", `{"slow_mode":30}`); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	check(30)
+
+	if rec := patchRoom(t, s, "nowhere", `{"slow_mode":30}`); rec.Code != http.StatusNotFound {
+		t.Errorf("updating a missing room: status %d, want 404", rec.Code)
+	}
+}
+
+// TestRoomConfigEnforced checks that the hub applies the options of the
+// room to the messages posted in it.
+func TestRoomConfigEnforced(t *testing.T) {
+	s, _ := newTestServer(t)
+	ctx := context.Background()
+	ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	waitClients(t, s, 1)
+
+	// joining created the room
+	readOnly := true
+	if _, err := s.updateRoom(ctx, "general", roomOptionsUpdate{ReadOnly: &readOnly}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ann.WriteJSON(ChatMessage{Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	var f errorFrame
+	readFrameInto(t, ann, messageTypeError, &f)
+	if f.Code != "room_read_only" {
+		t.Errorf("error %q, want room_read_only", f.Code)
+	}
+}
@@ -0,0 +1,378 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// defaultRoom is joined by clients that don't ask for a room.
+const defaultRoom = "general"
+
+var roomNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// validRoomName reports whether name is lowercase alphanumerics and dashes,
+// at most 32 characters long.
+func validRoomName(name string) bool {
+	return roomNameRe.MatchString(name)
+}
+
+// rooms is the Redis set holding the name of every known room.
+func (ks keyspace) rooms() string {
+	return ks.key("rooms")
+}
+
+// room is the Redis hash holding the options of room.
+func (ks keyspace) room(room string) string {
+	return ks.key("room:" + room)
+}
+
+// RoomOptions are the per-room settings persisted in the store.
+type RoomOptions struct {
+	// HistoryCap is the number of messages kept, 0 meaning unlimited.
+	HistoryCap int64 `json:"history_cap"`
+
+	// Replay controls whether history is sent to joining clients.
+	Replay bool `json:"replay"`
+
+	// Private rooms can only be joined with an invite token.
+	Private bool `json:"private"`
+
+	// RateLimit and RateBurst override the server's message rate limit
+	// in this room when RateLimit is set.
+	RateLimit float64 `json:"rate_limit"`
+	RateBurst int     `json:"rate_burst"`
+
+	// MaxAge is how long messages are kept, in seconds, overriding the
+	// server's retention when set.
+	MaxAge int64 `json:"max_age"`
+
+	// MaxBytes caps the bytes of the messages kept, overriding the
+	// server's byte cap when set. Only the Redis store enforces it.
+	MaxBytes int64 `json:"max_bytes"`
+
+	// ReadReceipts adds to replayed messages how many members read them.
+	ReadReceipts bool `json:"read_receipts"`
+
+	// SlowMode is the least number of seconds between two messages of a
+	// connection. Only admins may post in ReadOnly rooms.
+	SlowMode int64 `json:"slow_mode"`
+	ReadOnly bool  `json:"read_only"`
+
+	// Capacity caps the clients posting in the room, 0 meaning no cap.
+	// Once it is reached, newcomers wait read-only in a lobby when Lobby
+	// is set, and are turned away otherwise.
+	Capacity int64 `json:"capacity"`
+	Lobby    bool  `json:"lobby"`
+}
+
+func defaultRoomOptions() RoomOptions {
+	return RoomOptions{Replay: true}
+}
+
+// newRoomOptions are the options of the rooms created without any.
+func (s *Server) newRoomOptions() RoomOptions {
+	opts := defaultRoomOptions()
+	opts.HistoryCap = s.historyCap
+	return opts
+}
+
+// Room describes a room as returned by the rooms API.
+type Room struct {
+	Name string `json:"name"`
+	RoomOptions
+
+	CreatedAt    time.Time  `json:"created_at"`
+	Occupants    int        `json:"occupants"`
+	Viewers      int        `json:"viewers"`
+	LastActivity *time.Time `json:"last_activity"`
+}
+
+var errRoomExists = errors.New("room already exists")
+
+// createRoom persists a new room, failing with errRoomExists if the name is
+// already taken. ownerToken, if set, is the token of the owner of a private
+// room.
+func (s *Server) createRoom(ctx context.Context, name string, opts RoomOptions, ownerToken string) (time.Time, error) {
+	now := time.Now().UTC()
+
+	fields := opts.fields()
+	fields["created_at"] = now.Format(time.RFC3339)
+	if ownerToken != "" {
+		fields["owner_token"] = ownerToken
+	}
+
+	created, err := s.store.CreateRoom(ctx, name, fields)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !created {
+		return time.Time{}, errRoomExists
+	}
+	s.roomConfig.invalidate(name)
+
+	return now, nil
+}
+
+// ensureRoom reports whether room may be joined, creating it with default
+// options unless the server runs in strict mode.
+func (s *Server) ensureRoom(ctx context.Context, room string) (bool, error) {
+	fields, err := s.store.RoomFields(ctx, room)
+	if err != nil {
+		return false, err
+	}
+	if len(fields) != 0 {
+		return true, nil
+	}
+	if s.roomsStrict {
+		return false, nil
+	}
+
+	_, err = s.createRoom(ctx, room, s.newRoomOptions(), "")
+	if err != nil && err != errRoomExists {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// roomOptions loads the options of room, falling back to the defaults for
+// rooms that predate the rooms API. They are cached for a while.
+func (s *Server) roomOptions(ctx context.Context, room string) (RoomOptions, error) {
+	if opts, ok := s.roomConfig.get(room); ok {
+		return opts, nil
+	}
+
+	fields, err := s.store.RoomFields(ctx, room)
+	if err != nil {
+		return RoomOptions{}, err
+	}
+
+	opts := parseRoomOptions(fields)
+	s.roomConfig.put(room, opts)
+	return opts, nil
+}
+
+// fields flattens opts into the fields of their room.
+func (opts RoomOptions) fields() map[string]string {
+	return map[string]string{
+		"history_cap":   strconv.FormatInt(opts.HistoryCap, 10),
+		"replay":        strconv.FormatBool(opts.Replay),
+		"private":       strconv.FormatBool(opts.Private),
+		"rate_limit":    strconv.FormatFloat(opts.RateLimit, 'f', -1, 64),
+		"rate_burst":    strconv.Itoa(opts.RateBurst),
+		"max_age":       strconv.FormatInt(opts.MaxAge, 10),
+		"max_bytes":     strconv.FormatInt(opts.MaxBytes, 10),
+		"read_receipts": strconv.FormatBool(opts.ReadReceipts),
+		"slow_mode":     strconv.FormatInt(opts.SlowMode, 10),
+		"read_only":     strconv.FormatBool(opts.ReadOnly),
+		"capacity":      strconv.FormatInt(opts.Capacity, 10),
+		"lobby":         strconv.FormatBool(opts.Lobby),
+	}
+}
+
+func parseRoomOptions(fields map[string]string) RoomOptions {
+	opts := defaultRoomOptions()
+	if v, err := strconv.ParseInt(fields["history_cap"], 10, 64); err == nil {
+		opts.HistoryCap = v
+	}
+	if v, err := strconv.ParseBool(fields["replay"]); err == nil {
+		opts.Replay = v
+	}
+	if v, err := strconv.ParseBool(fields["private"]); err == nil {
+		opts.Private = v
+	}
+	if v, err := strconv.ParseFloat(fields["rate_limit"], 64); err == nil {
+		opts.RateLimit = v
+	}
+	if v, err := strconv.Atoi(fields["rate_burst"]); err == nil {
+		opts.RateBurst = v
+	}
+	if v, err := strconv.ParseInt(fields["max_age"], 10, 64); err == nil {
+		opts.MaxAge = v
+	}
+	if v, err := strconv.ParseInt(fields["max_bytes"], 10, 64); err == nil {
+		opts.MaxBytes = v
+	}
+	if v, err := strconv.ParseBool(fields["read_receipts"]); err == nil {
+		opts.ReadReceipts = v
+	}
+	if v, err := strconv.ParseInt(fields["slow_mode"], 10, 64); err == nil {
+		opts.SlowMode = v
+	}
+	if v, err := strconv.ParseBool(fields["read_only"]); err == nil {
+		opts.ReadOnly = v
+	}
+	if v, err := strconv.ParseInt(fields["capacity"], 10, 64); err == nil {
+		opts.Capacity = v
+	}
+	if v, err := strconv.ParseBool(fields["lobby"]); err == nil {
+		opts.Lobby = v
+	}
+	return opts
+}
+
+type roomActivity struct {
+	occupants         int
+	viewers           int
+	lastActivity      time.Time
+	messagesPerMinute int64
+}
+
+// roomActivity snapshots per-room occupancy and message rate from the hub.
+func (s *Server) roomActivity() map[string]roomActivity {
+	reply := make(chan map[string]roomActivity, 1)
+
+	s.ops <- func(h *hub) {
+		rooms := make(map[string]roomActivity, len(h.lastActivity))
+		defer func() { reply <- rooms }()
+
+		now := time.Now()
+		for room, t := range h.lastActivity {
+			a := roomActivity{lastActivity: t}
+			if rate := h.messageRate[room]; rate != nil {
+				a.messagesPerMinute = rate.count(now)
+			}
+			rooms[room] = a
+		}
+		for c := range h.clients {
+			a := rooms[c.room]
+			if c.observer {
+				a.viewers++
+			} else {
+				a.occupants++
+			}
+			rooms[c.room] = a
+		}
+	}
+
+	return <-reply
+}
+
+func (s *Server) handleListRooms(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	all, err := s.store.Rooms(ctx)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	names := slices.Sorted(maps.Keys(all))
+
+	activity := s.roomActivity()
+
+	rooms := make([]Room, 0, len(names))
+	for _, name := range names {
+		fields := all[name]
+
+		room := Room{Name: name, RoomOptions: parseRoomOptions(fields)}
+		// private rooms are only discoverable through their invites
+		if room.Private {
+			continue
+		}
+		room.CreatedAt, _ = time.Parse(time.RFC3339, fields["created_at"])
+		if a, ok := activity[name]; ok {
+			room.Occupants = a.occupants
+			room.Viewers = a.viewers
+			if !a.lastActivity.IsZero() {
+				t := a.lastActivity.UTC()
+				room.LastActivity = &t
+			}
+		}
+		rooms = append(rooms, room)
+	}
+
+	writeJSONResponse(w, http.StatusOK, rooms)
+}
+
+type createRoomRequest struct {
+	Name    string `json:"name"`
+	Private bool   `json:"private"`
+	roomOptionsUpdate
+}
+
+type createRoomResponse struct {
+	Room
+
+	// Invite and OwnerToken are only set for private rooms. The owner token
+	// authorizes minting further invites.
+	Invite     string `json:"invite,omitempty"`
+	OwnerToken string `json:"owner_token,omitempty"`
+}
+
+func (s *Server) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	var req createRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !validRoomName(req.Name) {
+		http.Error(w, "room name must be 1-32 lowercase letters, digits or dashes", http.StatusBadRequest)
+		return
+	}
+
+	opts := s.newRoomOptions()
+	if err := req.apply(&opts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.Private = req.Private
+
+	// invites live in Redis, and a private room nobody can be invited to
+	// would be lost for good
+	if opts.Private && !s.hasRedis() {
+		http.Error(w, "private rooms need REDIS_URL to keep their invites in", http.StatusNotImplemented)
+		return
+	}
+
+	ctx := r.Context()
+
+	// the first invite is minted before the room, so that no private room
+	// is ever created without one
+	var ownerToken, invite string
+	if opts.Private {
+		ownerToken = newToken()
+
+		var err error
+		invite, err = s.createInvite(ctx, req.Name, 0, unlimitedUses)
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+	}
+
+	createdAt, err := s.createRoom(ctx, req.Name, opts, ownerToken)
+	if err != nil && invite != "" {
+		// nobody learnt the token, but it must not let anyone into a room
+		// of that name later
+		if err := s.deleteInvite(ctx, req.Name, invite); err != nil {
+			s.logger.ErrorContext(ctx, "deleting the invite of a room not created", "room", req.Name, "err", err)
+		}
+	}
+	if err == errRoomExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	resp := createRoomResponse{
+		Room: Room{
+			Name:        req.Name,
+			RoomOptions: opts,
+			CreatedAt:   createdAt,
+		},
+		OwnerToken: ownerToken,
+		Invite:     invite,
+	}
+	writeJSONResponse(w, http.StatusCreated, resp)
+}
@@ -0,0 +1,102 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// createTestRoom posts body to the room creation endpoint of s.
+func createTestRoom(t *testing.T, s *Server, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/rooms", strings.NewReader(body))
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+// TestCreatePrivateRoomWithoutRedis checks that private rooms are refused
+// without Redis to keep their invites in, before the room is created.
+func TestCreatePrivateRoomWithoutRedis(t *testing.T) {
+	t.Setenv("REDIS_URL", "")
+	t.Setenv("HISTORY_BACKEND", "memory")
+	store := NewMemoryStore()
+	s := startTestServer(t, loadTestConfig(t), WithStore(store))
+
+	for range 2 {
+		if rec := createTestRoom(t, s, `{"name":"secret","private":true}`); rec.Code != http.StatusNotImplemented {
+			t.Fatalf("got %d %q, want %d", rec.Code, rec.Body, http.StatusNotImplemented)
+		}
+	}
+	if fields, err := store.RoomFields(context.Background(), "secret"); err != nil || len(fields) != 0 {
+		t.Errorf("room created anyway: %v, %v", fields, err)
+	}
+
+	if rec := createTestRoom(t, s, `{"name":"open"}`); rec.Code != http.StatusCreated {
+		t.Errorf("public room: got %d %q, want %d", rec.Code, rec.Body, http.StatusCreated)
+	}
+}
+
+// TestCreatePrivateRoomInviteFails checks that a private room isn't created
+// when its invite can't be, so that creating it again succeeds.
+func TestCreatePrivateRoomInviteFails(t *testing.T) {
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", "redis://"+mr.Addr())
+	t.Setenv("HISTORY_BACKEND", "memory")
+	store := NewMemoryStore()
+	s := startTestServer(t, loadTestConfig(t), WithStore(store))
+
+	mr.SetError("LOADING")
+	if rec := createTestRoom(t, s, `{"name":"secret","private":true}`); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d %q, want %d", rec.Code, rec.Body, http.StatusInternalServerError)
+	}
+	if fields, err := store.RoomFields(context.Background(), "secret"); err != nil || len(fields) != 0 {
+		t.Errorf("room created without an invite: %v, %v", fields, err)
+	}
+
+	mr.SetError("")
+	rec := createTestRoom(t, s, `{"name":"secret","private":true}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("retry: got %d %q, want %d", rec.Code, rec.Body, http.StatusCreated)
+	}
+	var resp createRoomResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.OwnerToken == "" || resp.Invite == "" {
+		t.Errorf("got owner token %q and invite %q, want both", resp.OwnerToken, resp.Invite)
+	}
+}
+
+// TestCreateExistingPrivateRoom checks that the invite minted for a room that
+// turned out to exist already is revoked.
+func TestCreateExistingPrivateRoom(t *testing.T) {
+	s, mr := newTestServer(t)
+
+	if rec := createTestRoom(t, s, `{"name":"secret","private":true}`); rec.Code != http.StatusCreated {
+		t.Fatalf("got %d %q, want %d", rec.Code, rec.Body, http.StatusCreated)
+	}
+	if rec := createTestRoom(t, s, `{"name":"secret","private":true}`); rec.Code != http.StatusConflict {
+		t.Fatalf("got %d %q, want %d", rec.Code, rec.Body, http.StatusConflict)
+	}
+	if keys := mr.Keys(); len(filterKeys(keys, "invite:secret:")) != 1 {
+		t.Errorf("invites left: %v, want only the first room's", filterKeys(keys, "invite:secret:"))
+	}
+}
+
+// filterKeys returns the keys containing substr.
+func filterKeys(keys []string, substr string) []string {
+	var out []string
+	for _, k := range keys {
+		if strings.Contains(k, substr) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
@@ -0,0 +1,286 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// schedulerInterval is how often due messages are looked for.
+	schedulerInterval = time.Second
+
+	// scheduleBatch is the most messages one instance claims at a time.
+	scheduleBatch = 100
+
+	// maxScheduleAhead is how far in the future messages may be scheduled.
+	maxScheduleAhead = 365 * 24 * time.Hour
+)
+
+// scheduled is the Redis sorted set of the IDs of the scheduled messages,
+// scored by their send time in Unix milliseconds.
+func (ks keyspace) scheduled() string {
+	return ks.key("scheduled")
+}
+
+// scheduledMessage is the Redis hash holding scheduled message id.
+func (ks keyspace) scheduledMessage(id string) string {
+	return ks.key("scheduled:" + id)
+}
+
+// claimDue removes up to ARGV[2] messages due by ARGV[1] from the schedule
+// and returns their IDs. Only the instance whose script removed an ID sends
+// it, so each message fires at most once.
+var claimDue = redis.NewScript(`
+local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+for _, id in ipairs(ids) do
+	redis.call("ZREM", KEYS[1], id)
+end
+return ids
+`)
+
+// ScheduledMessage is a message waiting for its send time.
+type ScheduledMessage struct {
+	ID        string    `json:"id"`
+	Room      string    `json:"room"`
+	Username  string    `json:"username"`
+	Text      string    `json:"text"`
+	SendAt    time.Time `json:"send_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func parseScheduledMessage(fields map[string]string) ScheduledMessage {
+	m := ScheduledMessage{
+		ID:       fields["id"],
+		Room:     fields["room"],
+		Username: fields["username"],
+		Text:     fields["text"],
+	}
+	m.SendAt, _ = time.Parse(time.RFC3339Nano, fields["send_at"])
+	m.CreatedAt, _ = time.Parse(time.RFC3339Nano, fields["created_at"])
+	return m
+}
+
+// runScheduler sends the scheduled messages once they are due. Every
+// instance runs it; claimDue keeps them from sending a message twice.
+func (s *Server) runScheduler() {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.sendDue(context.Background())
+	}
+}
+
+// sendDue sends the scheduled messages that are due, through the same path
+// as live messages.
+func (s *Server) sendDue(ctx context.Context) {
+	for {
+		ids, err := claimDue.Run(ctx, s.rdb, []string{s.keys.scheduled()},
+			time.Now().UnixMilli(), scheduleBatch).StringSlice()
+		if err != nil {
+			s.logger.Error("claiming scheduled messages", "err", err)
+			return
+		}
+
+		for _, id := range ids {
+			key := s.keys.scheduledMessage(id)
+			fields, err := s.rdb.HGetAll(ctx, key).Result()
+			if err != nil {
+				// the claim is gone, so the message is lost rather than
+				// risking sending it twice
+				s.logger.Error("loading scheduled message", "id", id, "err", err)
+				continue
+			}
+			if err := s.rdb.Del(ctx, key).Err(); err != nil {
+				s.logger.Warn("deleting scheduled message", "id", id, "err", err)
+			}
+			if len(fields) == 0 {
+				continue
+			}
+
+			m := parseScheduledMessage(fields)
+			s.sendMessage(ctx, nil, m.Room, ChatMessage{Username: m.Username, Text: m.Text})
+			s.emitEvent(ctx, eventMessage, m.Room, m.Username)
+			s.logger.Info("sent scheduled message", "id", id, "room", m.Room)
+		}
+
+		if len(ids) < scheduleBatch {
+			return
+		}
+	}
+}
+
+type scheduleRequest struct {
+	Username string `json:"username"`
+	Text     string `json:"text"`
+	Room     string `json:"room"`
+	SendAt   string `json:"send_at"`
+}
+
+// canSchedule reports whether r may manage scheduled messages: bots holding
+// the API key and admins.
+func (s *Server) canSchedule(r *http.Request) bool {
+	return s.hasAPIKey(r) || s.isAdmin(r)
+}
+
+// handleSchedule stores a message to be sent to a room at a later time.
+func (s *Server) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	if !s.canSchedule(r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	var req scheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(req.Username) == "" || strings.TrimSpace(req.Text) == "" {
+		http.Error(w, "username and text are required", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if req.Username, err = s.normalizeUsername(req.Username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Room == "" {
+		req.Room = defaultRoom
+	}
+	if !validRoomName(req.Room) {
+		http.Error(w, "invalid room name", http.StatusBadRequest)
+		return
+	}
+
+	sendAt, err := time.Parse(time.RFC3339, req.SendAt)
+	if err != nil {
+		http.Error(w, "send_at must be an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	if !sendAt.After(now) || sendAt.Sub(now) > maxScheduleAhead {
+		http.Error(w, "send_at must be in the future, at most a year ahead", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	ok, err := s.ensureRoom(ctx, req.Room)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "room does not exist", http.StatusNotFound)
+		return
+	}
+
+	m := ScheduledMessage{
+		ID:        newToken(),
+		Room:      req.Room,
+		Username:  req.Username,
+		Text:      req.Text,
+		SendAt:    sendAt.UTC(),
+		CreatedAt: now.UTC(),
+	}
+
+	// the hash goes first, so that a due ID always finds it
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.keys.scheduledMessage(m.ID),
+			"id", m.ID,
+			"room", m.Room,
+			"username", m.Username,
+			"text", m.Text,
+			"send_at", m.SendAt.Format(time.RFC3339Nano),
+			"created_at", m.CreatedAt.Format(time.RFC3339Nano),
+		)
+		pipe.ZAdd(ctx, s.keys.scheduled(), redis.Z{Score: float64(m.SendAt.UnixMilli()), Member: m.ID})
+		return nil
+	})
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	writeJSONResponse(w, http.StatusCreated, m)
+}
+
+// handleListScheduled returns the pending scheduled messages, soonest
+// first, optionally only those of one room.
+func (s *Server) handleListScheduled(w http.ResponseWriter, r *http.Request) {
+	if !s.canSchedule(r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+	room := r.URL.Query().Get("room")
+
+	ids, err := s.rdb.ZRange(ctx, s.keys.scheduled(), 0, -1).Result()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	cmds, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			pipe.HGetAll(ctx, s.keys.scheduledMessage(id))
+		}
+		return nil
+	})
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	list := make([]ScheduledMessage, 0, len(cmds))
+	for _, cmd := range cmds {
+		fields := cmd.(*redis.MapStringStringCmd).Val()
+		if len(fields) == 0 {
+			continue
+		}
+		m := parseScheduledMessage(fields)
+		if room != "" && m.Room != room {
+			continue
+		}
+		list = append(list, m)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].SendAt.Before(list[j].SendAt) })
+
+	writeJSONResponse(w, http.StatusOK, list)
+}
+
+// handleCancelScheduled drops a scheduled message that wasn't sent yet.
+func (s *Server) handleCancelScheduled(w http.ResponseWriter, r *http.Request) {
+	if !s.canSchedule(r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+	id := r.PathValue("id")
+
+	// like sending, cancelling claims the ID, so only one of them wins
+	n, err := s.rdb.ZRem(ctx, s.keys.scheduled(), id).Result()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := s.rdb.Del(ctx, s.keys.scheduledMessage(id)).Err(); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
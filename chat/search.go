@@ -0,0 +1,291 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Bounds of a search request.
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+
+	// defaultSearchScanBudget is the most messages one request looks at,
+	// unless SEARCH_SCAN_BUDGET says otherwise. Searches that stop there
+	// return a cursor to carry on from.
+	defaultSearchScanBudget = 10000
+	searchChunk             = 500
+)
+
+// searchIndex is the RediSearch index of the messages.
+func (ks keyspace) searchIndex() string {
+	return ks.key("search_idx")
+}
+
+// searchDoc is the Redis hash indexing message id for RediSearch.
+func (ks keyspace) searchDoc(id string) string {
+	return ks.key("search:" + id)
+}
+
+// enableRediSearch creates the message index, unless it exists, and has the
+// searches use it. Without the module, searches keep scanning the history.
+func (s *Server) enableRediSearch(ctx context.Context) {
+	err := s.rdb.Do(ctx, "FT.CREATE", s.keys.searchIndex(),
+		"ON", "HASH", "PREFIX", 1, s.keys.searchDoc(""),
+		"SCHEMA", "room", "TAG", "text", "TEXT", "username", "TEXT", "ts", "NUMERIC", "SORTABLE",
+	).Err()
+	if err != nil && !strings.Contains(err.Error(), "Index already exists") {
+		s.logger.Warn("RediSearch unavailable, searches scan the history", "err", err)
+		return
+	}
+	s.searchEnabled = true
+}
+
+// indexMessage adds msg to the search index, when there is one.
+func (s *Server) indexMessage(ctx context.Context, msg *ChatMessage) error {
+	if !s.searchEnabled {
+		return nil
+	}
+	return s.rdb.HSet(ctx, s.keys.searchDoc(msg.ID),
+		"room", msg.Room,
+		"text", msg.Text,
+		"username", msg.Username,
+		"ts", msg.Timestamp,
+	).Err()
+}
+
+type searchResponse struct {
+	Results []ChatMessage `json:"results"`
+
+	// NextCursor resumes the search further back in the history, empty
+	// once all of it was scanned.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// matchesSearch reports whether the text or username of msg contains q,
+// which is lower case.
+func matchesSearch(msg ChatMessage, q string) bool {
+	return strings.Contains(strings.ToLower(msg.Text), q) ||
+		strings.Contains(strings.ToLower(msg.Username), q)
+}
+
+// handleSearch returns the messages of a room whose text or username
+// contains q, ignoring case, newest first. The history is scanned linearly
+// in chunks, at most searchScanBudget messages per request, unless RediSearch
+// is enabled. Expired messages are left out, like in the history, even
+// before the expiry worker removed them.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	params := r.URL.Query()
+
+	room := params.Get("room")
+	if room == "" {
+		room = defaultRoom
+	}
+	if !validRoomName(room) {
+		http.Error(w, "invalid room name", http.StatusBadRequest)
+		return
+	}
+
+	q := strings.ToLower(strings.TrimSpace(params.Get("q")))
+	if q == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSearchLimit
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSearchLimit)
+	}
+
+	// the cursor counts the messages already scanned from the newest, or
+	// the search results already returned with RediSearch
+	var offset int64
+	if v := params.Get("cursor"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	opts, err := s.roomOptions(ctx, room)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if opts.Private {
+		http.NotFound(w, r)
+		return
+	}
+
+	if s.searchEnabled {
+		if query := searchQuery(room, q); query != "" {
+			s.searchIndexed(w, r, room, q, query, offset, limit)
+			return
+		}
+	}
+
+	resp := searchResponse{Results: []ChatMessage{}}
+	end := offset + s.searchScanBudget
+	now, user := time.Now(), s.requester(r)
+
+	for offset < end && len(resp.Results) < limit {
+		n := min(searchChunk, end-offset)
+		msgs, err := s.store.Range(ctx, room, -(offset + n), -(offset + 1))
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		var i int
+		for i = len(msgs) - 1; i >= 0 && len(resp.Results) < limit; i-- {
+			if !msgs[i].expired(now) && msgs[i].visibleTo(user) && matchesSearch(msgs[i], q) {
+				msgs[i].Type = messageTypeChat
+				msgs[i].Room = room
+				resp.Results = append(resp.Results, msgs[i])
+			}
+		}
+		offset += int64(len(msgs) - 1 - i)
+
+		if int64(len(msgs)) < n && i < 0 {
+			// scanned up to the oldest message
+			writeJSONResponse(w, http.StatusOK, resp)
+			return
+		}
+	}
+
+	resp.NextCursor = strconv.FormatInt(offset, 10)
+	writeJSONResponse(w, http.StatusOK, resp)
+}
+
+// searchQuery turns q into a RediSearch query for its words anywhere in the
+// text or username of the messages of room. It is empty when q has no word
+// long enough for an infix query.
+func searchQuery(room, q string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "@room:{%s}", escapeSearch(room))
+
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var n int
+	for _, w := range words {
+		if len(w) < 2 {
+			continue
+		}
+		fmt.Fprintf(&b, " (@text:*%[1]s*|@username:*%[1]s*)", escapeSearch(w))
+		n++
+	}
+	if n == 0 {
+		return ""
+	}
+	return b.String()
+}
+
+// escapeSearch escapes the characters RediSearch gives a meaning to.
+func escapeSearch(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// searchIndexed answers a search through the RediSearch index. The index
+// matches words, so its hits are checked against q like a scan would.
+func (s *Server) searchIndexed(w http.ResponseWriter, r *http.Request, room, q, query string, offset int64, limit int) {
+	ctx := r.Context()
+
+	reply, err := s.rdb.Do(ctx, "FT.SEARCH", s.keys.searchIndex(), query,
+		"NOCONTENT", "SORTBY", "ts", "DESC", "LIMIT", offset, limit,
+	).Result()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	total, keys, err := parseSearchReply(reply)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	resp := searchResponse{Results: []ChatMessage{}}
+	user := s.requester(r)
+	for _, key := range keys {
+		id := strings.TrimPrefix(key, s.keys.searchDoc(""))
+		msg, err := s.store.Get(ctx, id)
+		if err == errMessageNotFound || err == errMessageGone {
+			// left the history since it was indexed
+			if err := s.rdb.Del(ctx, key).Err(); err != nil {
+				s.logger.WarnContext(ctx, "dropping search document", "id", id, "err", err)
+			}
+			continue
+		}
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		if msg.expired(time.Now()) || !msg.visibleTo(user) || !matchesSearch(msg, q) {
+			continue
+		}
+		msg.Type = messageTypeChat
+		msg.Room = room
+		resp.Results = append(resp.Results, msg)
+	}
+
+	if next := offset + int64(len(keys)); next < total {
+		resp.NextCursor = strconv.FormatInt(next, 10)
+	}
+	writeJSONResponse(w, http.StatusOK, resp)
+}
+
+// parseSearchReply returns the total number of hits and the document keys of
+// a FT.SEARCH reply made with NOCONTENT, in its RESP2 or RESP3 shape.
+func parseSearchReply(reply interface{}) (int64, []string, error) {
+	switch v := reply.(type) {
+	case []interface{}:
+		if len(v) == 0 {
+			break
+		}
+		total, ok := v[0].(int64)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(v)-1)
+		for _, k := range v[1:] {
+			if k, ok := k.(string); ok {
+				keys = append(keys, k)
+			}
+		}
+		return total, keys, nil
+
+	case map[interface{}]interface{}:
+		total, _ := v["total_results"].(int64)
+		results, _ := v["results"].([]interface{})
+		keys := make([]string, 0, len(results))
+		for _, res := range results {
+			if res, ok := res.(map[interface{}]interface{}); ok {
+				if k, ok := res["id"].(string); ok {
+					keys = append(keys, k)
+				}
+			}
+		}
+		return total, keys, nil
+	}
+	return 0, nil, fmt.Errorf("unexpected FT.SEARCH reply %T", reply)
+}
@@ -0,0 +1,147 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestSearchSkipsExpired checks that search leaves out the messages that
+// expired but weren't removed yet.
+func TestSearchSkipsExpired(t *testing.T) {
+	s, _ := newTestServer(t)
+	ctx := context.Background()
+
+	now := time.Now().UnixMilli()
+	for _, msg := range []ChatMessage{
+		{Username: "ann", Text: "hello old", Timestamp: now, ExpiresAt: now - 1000},
+		{Username: "ann", Text: "hello new", Timestamp: now, ExpiresAt: now + 60000},
+		{Username: "bob", Text: "hello forever", Timestamp: now},
+	} {
+		if err := s.store.Append(ctx, "general", &msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{"hello", []string{"hello forever", "hello new"}},
+		{"old", nil},
+		{"ann", []string{"hello new"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.q, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.handleSearch(rec, httptest.NewRequest(http.MethodGet, "/search?room=general&q="+tt.q, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+
+			var resp searchResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, msg := range resp.Results {
+				got = append(got, msg.Text)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// search runs a search on s and decodes its results.
+func search(t *testing.T, s *Server, query string) (int, searchResponse) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/search?"+query, nil))
+	var resp searchResponse
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func TestSearch(t *testing.T) {
+	t.Setenv("SEARCH_SCAN_BUDGET", "4")
+	s, _ := newTestServer(t)
+	appendTexts(t, s.store, "general", "Hello there", "unrelated", "say HELLO", "nothing", "hello again", "bye")
+	appendTexts(t, s.store, "random", "hello elsewhere")
+
+	tests := []struct {
+		name       string
+		query      string
+		wantCode   int
+		want       []string
+		wantCursor string
+	}{
+		{"case-insensitive", "room=general&q=HeLLo", http.StatusOK, []string{"hello again", "say HELLO"}, "4"},
+		{"next page", "room=general&q=hello&cursor=4", http.StatusOK, []string{"Hello there"}, ""},
+		{"limit", "room=general&q=hello&limit=1", http.StatusOK, []string{"hello again"}, "2"},
+		{"no match", "room=general&q=zebra", http.StatusOK, nil, "4"},
+		{"other room", "room=random&q=hello", http.StatusOK, []string{"hello elsewhere"}, ""},
+		{"username", "room=general&q=ANN&limit=2", http.StatusOK, []string{"bye", "hello again"}, "2"},
+		{"no query", "room=general&q=+", http.StatusBadRequest, nil, ""},
+		{"invalid limit", "room=general&q=hello&limit=0", http.StatusBadRequest, nil, ""},
+		{"invalid cursor", "room=general&q=hello&cursor=-1", http.StatusBadRequest, nil, ""},
+		{"invalid room", "room=no+room&q=hello", http.StatusBadRequest, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, resp := search(t, s, tt.query)
+			if code != tt.wantCode {
+				t.Fatalf("status %d, want %d", code, tt.wantCode)
+			}
+			if got := texts(resp.Results); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if resp.NextCursor != tt.wantCursor {
+				t.Errorf("next cursor %q, want %q", resp.NextCursor, tt.wantCursor)
+			}
+		})
+	}
+}
+
+// TestSearchLimitCapped checks that a limit over the maximum gets the
+// maximum.
+func TestSearchLimitCapped(t *testing.T) {
+	s, _ := newTestServer(t)
+	matches := make([]string, maxSearchLimit+5)
+	for i := range matches {
+		matches[i] = "match " + strconv.Itoa(i)
+	}
+	appendTexts(t, s.store, "general", matches...)
+
+	_, resp := search(t, s, "room=general&q=match&limit="+strconv.Itoa(2*maxSearchLimit))
+	if len(resp.Results) != maxSearchLimit {
+		t.Errorf("%d results, want %d", len(resp.Results), maxSearchLimit)
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	tests := []struct {
+		room, q, want string
+	}{
+		{"general", "hello", `@room:{general} (@text:*hello*|@username:*hello*)`},
+		{"general", "hi there", `@room:{general} (@text:*hi*|@username:*hi*) (@text:*there*|@username:*there*)`},
+		{"my-room", "a", ""},
+		{"my-room", "don't", `@room:{my\-room} (@text:*don*|@username:*don*)`},
+	}
+	for _, tt := range tests {
+		if got := searchQuery(tt.room, tt.q); got != tt.want {
+			t.Errorf("searchQuery(%q, %q) = %q, want %q", tt.room, tt.q, got, tt.want)
+		}
+	}
+}
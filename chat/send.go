@@ -0,0 +1,78 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type sendRequest struct {
+	Username   string      `json:"username"`
+	Text       string      `json:"text"`
+	Room       string      `json:"room"`
+	Attachment *Attachment `json:"attachment"`
+}
+
+// hasAPIKey reports whether r carries the API key. It is always false when no
+// API key is configured.
+func (s *Server) hasAPIKey(r *http.Request) bool {
+	key := r.Header.Get("X-API-Key")
+	return s.apiKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(s.apiKey)) == 1
+}
+
+// handleSend lets bots and webhooks post a message over plain HTTP. It goes
+// through the same path as messages read from a WebSocket.
+func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
+	if !s.hasAPIKey(r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	var req sendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(req.Username) == "" || (strings.TrimSpace(req.Text) == "" && req.Attachment == nil) {
+		http.Error(w, "username and text or attachment are required", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if req.Attachment != nil {
+		if err = s.checkAttachment(req.Attachment); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if hasBannedWord(s.settings().bannedWords, req.Text) {
+		http.Error(w, "the message contains a banned word", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Username, err = s.normalizeUsername(req.Username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Room == "" {
+		req.Room = defaultRoom
+	}
+	if !validRoomName(req.Room) {
+		http.Error(w, "invalid room name", http.StatusBadRequest)
+		return
+	}
+
+	ok, err := s.ensureRoom(r.Context(), req.Room)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "room does not exist", http.StatusNotFound)
+		return
+	}
+
+	s.sendMessage(r.Context(), nil, req.Room, ChatMessage{Username: req.Username, Text: req.Text, Attachment: req.Attachment})
+	s.emitEvent(r.Context(), eventMessage, req.Room, req.Username)
+	w.WriteHeader(http.StatusAccepted)
+}
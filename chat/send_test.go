@@ -0,0 +1,77 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleSend(t *testing.T) {
+	t.Setenv("API_KEY", "key")
+	s, _ := newTestServer(t)
+	watcher := dialTestServer(t, s, "room=general&username=watcher")
+	waitClients(t, s, 1)
+
+	tests := []struct {
+		name, key, body string
+		want            int
+	}{
+		{"no key", "", `{"username":"bot","text":"hi"}`, http.StatusUnauthorized},
+		{"wrong key", "nope", `{"username":"bot","text":"hi"}`, http.StatusUnauthorized},
+		{"invalid body", "key", `{"username":`, http.StatusBadRequest},
+		{"no username", "key", `{"username":" ","text":"hi"}`, http.StatusBadRequest},
+		{"no text", "key", `{"username":"bot","text":""}`, http.StatusBadRequest},
+		{"reserved username", "key", `{"username":"system","text":"hi"}`, http.StatusBadRequest},
+		{"invalid room", "key", `{"username":"bot","text":"hi","room":"no room"}`, http.StatusBadRequest},
+		{"sent", "key", `{"username":" bot ","text":"from the api"}`, http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(tt.body))
+			if tt.key != "" {
+				req.Header.Set("X-API-Key", tt.key)
+			}
+			rec := httptest.NewRecorder()
+			s.handleSend(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+
+	// only the accepted message reaches the room
+	watcher.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg ChatMessage
+	if err := watcher.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Username != "bot" || msg.Text != "from the api" {
+		t.Errorf("broadcast %+v, want bot's message", msg)
+	}
+
+	msgs, err := s.store.Recent(context.Background(), "general", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Text != "from the api" {
+		t.Errorf("stored %q, want the accepted message only", texts(msgs))
+	}
+}
+
+// TestHandleSendWithoutKey checks that /send is closed when no API key is
+// configured.
+func TestHandleSendWithoutKey(t *testing.T) {
+	t.Setenv("API_KEY", "")
+	s, _ := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(`{"username":"bot","text":"hi"}`))
+	req.Header.Set("X-API-Key", "")
+	rec := httptest.NewRecorder()
+	s.handleSend(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultSendQueue is the number of frames queued for a client past which it
+// is disconnected, unless SEND_QUEUE says otherwise.
+const defaultSendQueue = 256
+
+// errSendQueueFull is returned for the frames sent to a client whose queue is
+// full. The client is then removed, as for a failed write.
+var errSendQueueFull = errors.New("send queue full")
+
+// startWriter gives c a send queue of size frames and the goroutine writing
+// it out. It runs on the hub, as c is registered.
+func (c *Client) startWriter(size int) {
+	c.send = make(chan pendingFrame, size)
+	c.stop = make(chan struct{})
+	c.written = make(chan struct{})
+	go c.writeLoop()
+}
+
+// enqueue queues f for the writer, failing with errSendQueueFull rather than
+// waiting for room. It runs on the hub.
+func (c *Client) enqueue(f pendingFrame) error {
+	select {
+	case c.send <- f:
+		return nil
+	default:
+		c.overflowed.Store(true)
+		return errSendQueueFull
+	}
+}
+
+// queueDepth is the number of frames waiting to be written to c, held back
+// by the replay or queued. It runs on the hub.
+func (c *Client) queueDepth() int {
+	if c.pending != nil {
+		return len(c.pending)
+	}
+	return len(c.send)
+}
+
+// stopWriter has the writer close c with code and reason, or without a close
+// frame when code is 0, once the frames already queued went out. A client
+// dropped for overflowing its queue is closed right away. It runs on the
+// hub, as c is removed.
+func (c *Client) stopWriter(code int, reason string) {
+	if c.overflowed.Load() {
+		code, reason = websocket.ClosePolicyViolation, "slow consumer"
+	}
+	c.closeCode, c.closeReason = code, reason
+	close(c.stop)
+}
+
+// writeLoop writes the frames queued for c until the hub stops it. A failed
+// write closes the connection, which the read loop notices, and the frames
+// queued until c is removed are dropped.
+func (c *Client) writeLoop() {
+	defer close(c.written)
+
+	failed := false
+	for {
+		select {
+		case f := <-c.send:
+			if !failed && !c.writeQueued(f) {
+				failed = true
+				c.ws.Close()
+			}
+
+		case <-c.stop:
+			// what was sent before the client was removed still goes out,
+			// unless it is the backlog of a slow consumer
+			for !failed && !c.overflowed.Load() && len(c.send) > 0 {
+				failed = !c.writeQueued(<-c.send)
+			}
+			if c.closeCode != 0 && !failed {
+				closeClient(c, c.closeCode, c.closeReason)
+			} else {
+				c.ws.Close()
+			}
+			return
+		}
+	}
+}
+
+// writeQueued writes f, reporting whether that worked.
+func (c *Client) writeQueued(f pendingFrame) bool {
+	err := c.write(f.v)
+	if err != nil && unsafeError(err) {
+		c.logger.Warn("writing frame", "err", err)
+	}
+	return err == nil
+}
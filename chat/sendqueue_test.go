@@ -0,0 +1,300 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeConn is a clientConn recording the frames written to it. With stall
+// set, writes block until the write deadline and then time out.
+type fakeConn struct {
+	mu       sync.Mutex
+	stall    bool
+	deadline time.Time
+	frames   [][]byte
+	closeMsg []byte
+	closed   chan struct{}
+}
+
+func newFakeConn(stall bool) *fakeConn {
+	return &fakeConn{stall: stall, closed: make(chan struct{})}
+}
+
+func (fc *fakeConn) NextReader() (int, io.Reader, error) {
+	<-fc.closed
+	return 0, nil, net.ErrClosed
+}
+
+func (fc *fakeConn) WriteMessage(messageType int, data []byte) error {
+	fc.mu.Lock()
+	stall, deadline := fc.stall, fc.deadline
+	fc.mu.Unlock()
+
+	if stall {
+		if deadline.IsZero() {
+			<-fc.closed
+			return net.ErrClosed
+		}
+		time.Sleep(time.Until(deadline))
+		return os.ErrDeadlineExceeded
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.frames = append(fc.frames, data)
+	return nil
+}
+
+func (fc *fakeConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if messageType == websocket.CloseMessage {
+		fc.closeMsg = data
+	}
+	return nil
+}
+
+func (fc *fakeConn) SetWriteDeadline(t time.Time) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.deadline = t
+	return nil
+}
+
+func (fc *fakeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+}
+
+func (fc *fakeConn) Close() error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	select {
+	case <-fc.closed:
+	default:
+		close(fc.closed)
+	}
+	return nil
+}
+
+// closeCode returns the code of the close frame sent, or 0.
+func (fc *fakeConn) closeCode() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if len(fc.closeMsg) < 2 {
+		return 0
+	}
+	return int(fc.closeMsg[0])<<8 | int(fc.closeMsg[1])
+}
+
+// waitClosed waits for fc to be closed.
+func (fc *fakeConn) waitClosed(t *testing.T) {
+	t.Helper()
+
+	select {
+	case <-fc.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+// newFakeClient returns a client writing to fc as JSON.
+func newFakeClient(fc *fakeConn, writeTimeout time.Duration) *Client {
+	return &Client{
+		ws:           fc,
+		version:      protocolV2,
+		codec:        jsonCodec{},
+		writeTimeout: writeTimeout,
+		bp:           new(backpressure),
+		logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	tests := []struct {
+		name    string
+		stall   bool
+		timeout bool
+	}{
+		{"prompt", false, false},
+		{"stalled", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := newFakeConn(tt.stall)
+			c := newFakeClient(fc, 20*time.Millisecond)
+
+			start := time.Now()
+			err := c.write(ChatMessage{Text: "hi"})
+			if d := time.Since(start); d > time.Second {
+				t.Fatalf("write took %v despite the deadline", d)
+			}
+
+			var ne net.Error
+			if got := errors.As(err, &ne) && ne.Timeout(); got != tt.timeout {
+				t.Fatalf("write error %v, want a timeout %v", err, tt.timeout)
+			}
+			want := int64(0)
+			if tt.timeout {
+				want = 1
+			}
+			if c.deadlineMisses.Load() != want || c.bp.deadlineMisses.Load() != want {
+				t.Errorf("%d deadline misses, %d in all, want %d", c.deadlineMisses.Load(), c.bp.deadlineMisses.Load(), want)
+			}
+		})
+	}
+}
+
+func TestDurationEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		err   bool
+	}{
+		{"", 10 * time.Second, false},
+		{"250ms", 250 * time.Millisecond, false},
+		{"0", 0, false},
+		{"-1s", 0, true},
+		{"soon", 0, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("WRITE_TIMEOUT", tt.value)
+		got, err := durationEnv("WRITE_TIMEOUT", 10*time.Second)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("durationEnv with %q = %v, %v, want %v, error %v", tt.value, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// TestWriterDropsStalledClient checks that a write timing out closes the
+// connection, which ends its read loop.
+func TestWriterDropsStalledClient(t *testing.T) {
+	fc := newFakeConn(true)
+	c := newFakeClient(fc, 20*time.Millisecond)
+	c.startWriter(defaultSendQueue)
+
+	if err := c.enqueue(pendingFrame{v: ChatMessage{Text: "hi"}}); err != nil {
+		t.Fatal(err)
+	}
+	fc.waitClosed(t)
+	c.stopWriter(0, "")
+}
+
+func TestEnqueueFullQueue(t *testing.T) {
+	fc := newFakeConn(true)
+	c := newFakeClient(fc, 0)
+	c.send = make(chan pendingFrame, 2)
+	c.stop = make(chan struct{})
+
+	for i := 0; i < 2; i++ {
+		if err := c.enqueue(pendingFrame{v: i}); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	if err := c.enqueue(pendingFrame{v: 2}); err != errSendQueueFull {
+		t.Fatalf("enqueue on a full queue = %v, want errSendQueueFull", err)
+	}
+	if !c.overflowed.Load() {
+		t.Error("client not marked as overflowed")
+	}
+
+	c.stopWriter(websocket.CloseGoingAway, "bye")
+	if c.closeCode != websocket.ClosePolicyViolation || c.closeReason != "slow consumer" {
+		t.Errorf("closing with %d %q, want %d %q", c.closeCode, c.closeReason, websocket.ClosePolicyViolation, "slow consumer")
+	}
+}
+
+// TestStopWriterFlushes checks that the frames queued before a client is
+// removed go out ahead of its close frame.
+func TestStopWriterFlushes(t *testing.T) {
+	fc := newFakeConn(false)
+	c := newFakeClient(fc, time.Second)
+	c.send = make(chan pendingFrame, 4)
+	c.stop = make(chan struct{})
+	c.written = make(chan struct{})
+	for i := 0; i < 3; i++ {
+		c.send <- pendingFrame{v: i}
+	}
+
+	c.stopWriter(websocket.CloseTryAgainLater, "draining")
+	c.writeLoop()
+
+	if len(fc.frames) != 3 {
+		t.Errorf("%d frames written, want 3", len(fc.frames))
+	}
+	if got := fc.closeCode(); got != websocket.CloseTryAgainLater {
+		t.Errorf("closed with %d, want %d", got, websocket.CloseTryAgainLater)
+	}
+}
+
+// TestRemoveClientOnce checks that a client whose send queue overflows
+// during a broadcast is removed once, even though its read loop ending
+// removes it again.
+func TestRemoveClientOnce(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	s, _ := newTestServer(t)
+	ctx := context.Background()
+
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	mon, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket/admin", http.Header{"Authorization": {"Bearer secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mon.Close() })
+	for s.monitors.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the writer of c never runs, so its queue fills up
+	fc := newFakeConn(true)
+	c := newFakeClient(fc, 0)
+	c.room, c.claimed, c.username = "general", "slow", "slow"
+	c.send = make(chan pendingFrame, 1)
+	c.stop = make(chan struct{})
+	c.send <- pendingFrame{v: "backlog"}
+	s.ops <- func(h *hub) { h.clients[c] = true }
+
+	if _, err := s.postMessage(ctx, "general", ChatMessage{Username: "ann", Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	waitClients(t, s, 0)
+	if c.closeCode != websocket.ClosePolicyViolation {
+		t.Errorf("closed with %d, want %d", c.closeCode, websocket.ClosePolicyViolation)
+	}
+
+	// the read loop notices the connection closing
+	s.delClient(c)
+	if _, err := s.postMessage(ctx, "general", ChatMessage{Username: "ann", Text: "done"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var leaves int
+	mon.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var f monitorFrame
+		if err := mon.ReadJSON(&f); err != nil {
+			t.Fatal(err)
+		}
+		if f.Event == monitorLeave && f.Username == "slow" {
+			leaves++
+		}
+		if f.Event == monitorMessage && f.Message.Text == "done" {
+			break
+		}
+	}
+	if leaves != 1 {
+		t.Errorf("removed %d times, want once", leaves)
+	}
+}
@@ -0,0 +1,155 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Handler returns the handler of every HTTP route: the WebSocket endpoint,
+// the API and the static files, under BASE_PATH.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	index := &indexPage{s: s, path: filepath.Join(s.cfg.StaticDir, "index.html"), reload: s.cfg.TemplateReload}
+	static := staticHandler(s.cfg.StaticDir, s.cfg.SPAFallback, index)
+	if s.cfg.StaticGzip {
+		static = gzipFiles(static)
+	}
+	mux.Handle("/", static)
+	mux.HandleFunc("/websocket", s.HandleConnetions)
+	mux.HandleFunc("/websocket/admin", s.adminOnly(s.handleMonitor))
+	mux.HandleFunc("GET /api/config", s.handleClientConfig)
+	mux.HandleFunc("GET /api/rooms", s.handleListRooms)
+	mux.HandleFunc("POST /api/rooms", s.handleCreateRoom)
+	mux.HandleFunc("GET /api/rooms/previews", s.handleRoomPreviews)
+	mux.HandleFunc("PATCH /api/rooms/{name}", s.adminOnly(s.handleUpdateRoom))
+	mux.HandleFunc("POST /api/rooms/{name}/invites", s.handleCreateInvite)
+	mux.HandleFunc("GET /api/rooms/{name}/members", s.handleRoster)
+	mux.HandleFunc("GET /api/rooms/{name}/unread", s.handleUnread)
+	mux.HandleFunc("GET /api/rooms/{name}/messages", s.handleListMessages)
+	mux.HandleFunc("DELETE /api/rooms/{name}/messages", s.adminOnly(s.handleClearHistory))
+	mux.HandleFunc("GET /messages/{id}", s.handleGetMessage)
+	mux.HandleFunc("GET /api/messages/{id}", s.handleGetMessage)
+	mux.HandleFunc("GET /api/messages/{id}/replies", s.handleListReplies)
+	mux.HandleFunc("POST /api/messages/schedule", s.handleSchedule)
+	mux.HandleFunc("GET /api/messages/scheduled", s.handleListScheduled)
+	mux.HandleFunc("DELETE /api/messages/scheduled/{id}", s.handleCancelScheduled)
+	mux.HandleFunc("GET /api/push/vapid", s.handleVAPIDKey)
+	mux.HandleFunc("POST /api/push/subscribe", s.handlePushSubscribe)
+	mux.HandleFunc("POST /api/push/unsubscribe", s.handlePushUnsubscribe)
+	mux.HandleFunc("POST /send", s.handleSend)
+	mux.HandleFunc("GET /search", s.handleSearch)
+	mux.HandleFunc("GET /api/search", s.handleSearch)
+	mux.HandleFunc("GET /stats", s.adminIfConfigured(s.handleStats))
+	mux.HandleFunc("GET /api/stats", s.adminIfConfigured(s.handleStats))
+	mux.HandleFunc("GET /metrics", s.adminIfConfigured(s.handleMetrics))
+	mux.HandleFunc("GET /api/export", s.adminOnly(s.handleExport))
+	mux.HandleFunc("GET /readyz", s.handleReady)
+	mux.HandleFunc("GET /api/admin/audit", s.adminOnly(s.handleAudit))
+	mux.HandleFunc("POST /api/admin/drain", s.adminOnly(s.handleDrain))
+	mux.HandleFunc("POST /api/admin/reload", s.adminOnly(s.handleReload))
+	mux.HandleFunc("DELETE /api/admin/drain", s.adminOnly(s.handleUndrain))
+	mux.HandleFunc("POST /api/admin/mute", s.adminOnly(s.handleAddSanction(sanctionMute)))
+	mux.HandleFunc("GET /api/admin/mutes", s.adminOnly(s.handleListSanctions(sanctionMute)))
+	mux.HandleFunc("DELETE /api/admin/mutes/{username}", s.adminOnly(s.handleLiftSanction(sanctionMute)))
+	mux.HandleFunc("POST /api/admin/ban", s.adminOnly(s.handleAddSanction(sanctionBan)))
+	mux.HandleFunc("GET /api/admin/bans", s.adminOnly(s.handleListSanctions(sanctionBan)))
+	mux.HandleFunc("DELETE /api/admin/bans/{username}", s.adminOnly(s.handleLiftSanction(sanctionBan)))
+
+	// nothing is mounted unless asked for
+	if s.cfg.DebugEndpoints {
+		s.mountDebug(mux)
+	}
+
+	return mountAt(s.cfg.BasePath, s.cors(s.limitRequests(mux)))
+}
+
+// parseBasePath checks the path prefix of BASE_PATH, returning it without a
+// trailing slash. The root is the empty prefix.
+func parseBasePath(v string) (string, error) {
+	v = strings.TrimSuffix(v, "/")
+	if v == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(v, "/") || path.Clean(v) != v ||
+		strings.IndexFunc(v, func(r rune) bool { return !unreservedPathRune(r) }) >= 0 {
+		return "", fmt.Errorf("BASE_PATH: %q is not a plain path such as /chat", v)
+	}
+	return v, nil
+}
+
+// unreservedPathRune reports whether r may appear in BASE_PATH: it must
+// match itself in a ServeMux pattern, and need no escaping in a URL.
+func unreservedPathRune(r rune) bool {
+	return r == '/' || r == '-' || r == '_' || r == '.' || r == '~' ||
+		'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9'
+}
+
+// mountAt serves h under base, which is stripped from the paths h sees. The
+// paths outside base are not found, so that a proxy forwarding them by
+// mistake is noticed rather than half working; base itself redirects to
+// base/.
+func mountAt(base string, h http.Handler) http.Handler {
+	if base == "" {
+		return h
+	}
+	mux := http.NewServeMux()
+	mux.Handle(base+"/", http.StripPrefix(base, h))
+	mux.Handle(base, http.RedirectHandler(base+"/", http.StatusMovedPermanently))
+	return mux
+}
+
+// ListenAndServe serves Handler on PORT, LISTEN_ADDR or the socket passed
+// by systemd, and IRC and gRPC on their own ports when configured, until a
+// shutdown completed.
+func (s *Server) ListenAndServe() error {
+	srv := &http.Server{Handler: s.Handler()}
+
+	ln, err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	var irc net.Listener
+	if s.cfg.IRCPort != "" {
+		var err error
+		if irc, err = net.Listen("tcp", ":"+s.cfg.IRCPort); err != nil {
+			return err
+		}
+		s.logger.Info("IRC listener starting at localhost:" + s.cfg.IRCPort)
+		go s.serveIRC(irc)
+	}
+
+	stopGRPC, err := startGRPC(s, s.cfg)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-s.Drained()
+		if irc != nil {
+			irc.Close()
+		}
+		stopGRPC()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			s.logger.Error("shutting down", "err", err)
+		}
+	}()
+
+	s.logger.Info("Server starting at " + ln.Addr().Network() + ":" + ln.Addr().String())
+	if err := serve(srv, ln, s.cfg); err != http.ErrServerClosed {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.shutdownTracing(ctx); err != nil {
+		s.logger.Error("flushing traces", "err", err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseBasePath(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"/", "", false},
+		{"/chat", "/chat", false},
+		{"/chat/", "/chat", false},
+		{"/apps/chat-1", "/apps/chat-1", false},
+		{"chat", "", true},
+		{"/chat/../admin", "", true},
+		{"//chat", "", true},
+		{"/chat room", "", true},
+		{"/chat/{id}", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseBasePath(tt.v)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseBasePath(%q) = %q, %v, want %q, an error %v", tt.v, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	const index = `<script>const config = {{.}};</script>`
+
+	tests := []struct {
+		name     string
+		base     string
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		{"index", "/chat", "/chat/", http.StatusOK, `"websocket_path":"/chat/websocket"`},
+		{"config", "/chat", "/chat/api/config", http.StatusOK, `"base_path":"/chat"`},
+		{"base redirects", "/chat", "/chat", http.StatusMovedPermanently, ""},
+		{"websocket without upgrade", "/chat", "/chat/websocket", http.StatusBadRequest, ""},
+		{"root", "/chat", "/", http.StatusNotFound, ""},
+		{"unprefixed API", "/chat", "/api/config", http.StatusNotFound, ""},
+		{"unprefixed websocket", "/chat", "/websocket", http.StatusNotFound, ""},
+		{"other prefix", "/chat", "/chatroom/api/config", http.StatusNotFound, ""},
+		{"no base", "", "/api/config", http.StatusOK, `"websocket_path":"/websocket"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("BASE_PATH", tt.base)
+			s, _ := newTestServer(t)
+			if err := os.WriteFile(filepath.Join(s.cfg.StaticDir, "index.html"), []byte(index), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, tt.wantBody) {
+				t.Errorf("body %q, want it to contain %q", body, tt.wantBody)
+			}
+			if tt.wantCode == http.StatusMovedPermanently {
+				if loc := rec.Header().Get("Location"); loc != tt.base+"/" {
+					t.Errorf("redirected to %q, want %q", loc, tt.base+"/")
+				}
+			}
+		})
+	}
+}
+
+// TestBasePathWebSocket checks that clients connect at the WebSocket path
+// the front-end is given.
+func TestBasePathWebSocket(t *testing.T) {
+	t.Setenv("BASE_PATH", "/chat")
+	s, _ := newTestServer(t)
+
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	resp, err := http.Get(ts.URL + "/chat/api/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var cfg clientConfig
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+cfg.WebSocketPath+"?room=general&username=ann", nil)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", cfg.WebSocketPath, err)
+	}
+	defer ws.Close()
+	waitClients(t, s, 1)
+}
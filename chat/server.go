@@ -0,0 +1,1598 @@
+// Package chat is the chat server: the hub and its WebSocket, IRC and gRPC
+// clients, the message stores and the HTTP API. cmd/chatserver runs it.
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// messageTypeChat is the frame type of a chat message.
+const messageTypeChat = "message"
+
+// ChatMessage is a message as clients send and receive it, and as it is
+// stored. Username and text are always present, as the first clients expect;
+// every field added since is left out when empty, so that a plain message
+// stays small on the wire. The JSON names are part of the protocol and
+// shared by every codec: don't rename them.
+type ChatMessage struct {
+	Type     string `json:"type,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Room     string `json:"room,omitempty"`
+	Username string `json:"username"`
+	Text     string `json:"text"`
+
+	// DisplayName and AvatarURL are stamped from the sender's connection.
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+
+	// ReplyTo is the ID of the message this one answers.
+	ReplyTo       string `json:"reply_to,omitempty"`
+	ParentDeleted bool   `json:"parent_deleted,omitempty"`
+
+	// ReplyCount is only filled in during history replay, as is ReadBy in
+	// rooms with read receipts.
+	ReplyCount int64 `json:"reply_count,omitempty"`
+	ReadBy     int64 `json:"read_by,omitempty"`
+
+	// MessageID is the message a read frame marks as read.
+	MessageID string `json:"message_id,omitempty"`
+
+	// ClientID is an ID the sender picked, returned in the ack or nack of
+	// the message and not passed on.
+	ClientID string `json:"client_id,omitempty"`
+
+	// Timestamp is when the server received the message, in Unix
+	// milliseconds.
+	Timestamp int64 `json:"ts,omitempty"`
+
+	// ExpiresIn is the number of seconds the sender wants the message kept
+	// for. The server turns it into ExpiresAt, in Unix milliseconds, after
+	// which the message is removed from the history.
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+
+	// Seq numbers the messages of a room, without gaps, so that clients
+	// can tell when they missed one. An ack frame acknowledges every
+	// message up to Seq, and a resync frame asks for those after FromSeq.
+	Seq     int64 `json:"seq,omitempty"`
+	FromSeq int64 `json:"from_seq,omitempty"`
+
+	// Bot is set on the messages sent by a Bot of the server.
+	Bot bool `json:"bot,omitempty"`
+
+	// Attachment is the file shared with the message, whose text may then
+	// be empty.
+	Attachment *Attachment `json:"attachment,omitempty"`
+
+	// To makes the message a direct message to that user, seen only by
+	// them and its sender. Status is how far a direct message got: sent,
+	// delivered or read.
+	To     string `json:"to,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
+// clientConn is what a client needs from its connection: a WebSocket
+// connection, or a channel of an IRC session.
+type clientConn interface {
+	NextReader() (int, io.Reader, error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetWriteDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// Client is a single connection joined to a room.
+type Client struct {
+	ws clientConn
+
+	// version and codec are negotiated through the subprotocol
+	version int
+	codec   Codec
+
+	room string
+
+	// ip is the client address, resolved through trusted proxies.
+	ip string
+
+	// observer connections only receive broadcasts and may not send.
+	observer bool
+
+	// noReplay skips the history replay, for IRC clients.
+	noReplay bool
+
+	// seated is set, by the hub, once the client holds a seat in its room.
+	// Clients waiting for one in the lobby of a full room can't post.
+	seated  bool
+	waiting atomic.Bool
+
+	// noEcho skips the client when broadcasting its own messages.
+	noEcho bool
+
+	// filter picks the messages broadcast to the client.
+	filter messageFilter
+
+	// strict refuses frames with unknown types or keys, which are counted
+	// in protocolErrors.
+	strict         bool
+	protocolErrors int
+
+	// claimed is the username the client connected with, if any. Messages
+	// are then always sent under it. It never changes, so the hub may read
+	// it.
+	claimed string
+
+	// verified is claimed when the Authenticator vouched for it, and empty
+	// otherwise: only then may the client see direct messages. It never
+	// changes either.
+	verified string
+
+	// displayName and avatarURL are the validated identity the client
+	// connected with, stamped on its messages.
+	displayName string
+	avatarURL   string
+
+	// username is the name the client last sent a message as. It is only
+	// touched by the connection's own goroutine.
+	username string
+
+	// sendSeq numbers the messages sent from the client as they are handed
+	// to the hub. lastSent is the last of them the hub ran, and heldSends
+	// those that reached it ahead of their turn; both are owned by the hub.
+	sendSeq   atomic.Uint64
+	lastSent  uint64
+	heldSends map[uint64]func(*hub)
+
+	// throttled counts the frames in a row the rate limiter rejected, and
+	// lastPost is when the client last posted, for slow mode. Both are only
+	// touched by the connection's own goroutine.
+	throttled int
+	lastPost  time.Time
+
+	// lastResync is when the client last asked for a resync. It is only
+	// touched by the connection's own goroutine.
+	lastResync time.Time
+
+	// acks is set when the client acks the chat messages it receives,
+	// to the ID of the delivery log it resumes if any. delivery is that
+	// log, owned by the hub.
+	acks     string
+	delivery *deliveryLog
+
+	// recent are the texts the client's user sent lately, shared with
+	// the other connections of a claimed username.
+	recent *recentTexts
+
+	// admin is set when the client connected with the admin token, which
+	// exempts it from slow mode and read-only rooms.
+	admin bool
+
+	// resumeAfter is the message a resumed session replays the history
+	// after. lastDelivered is the last message the client was sent, set by
+	// the replay and then owned by the hub.
+	resumeAfter   string
+	lastDelivered string
+
+	// writeTimeout bounds every write, so a stalled peer can't hang the hub.
+	writeTimeout time.Duration
+
+	// maxFrameSize is the largest frame the client may send, in bytes, 0
+	// meaning unlimited.
+	maxFrameSize int64
+
+	// connectedAt is when the connection was upgraded.
+	connectedAt time.Time
+
+	// lastSeen is when the client last sent anything, pongs included, in
+	// Unix nanoseconds.
+	lastSeen atomic.Int64
+
+	// pending queues the frames sent to the client while its history is
+	// replayed, nil once it is live. It is owned by the hub.
+	pending []pendingFrame
+
+	// send queues the frames of a live client for its writer goroutine, so
+	// that a slow peer holds up nothing but itself. The hub closes stop
+	// when it removes the client, after setting closeCode and closeReason,
+	// the close frame the writer ends with, and the writer closes written
+	// once it is done. overflowed is set once the queue filled up, which
+	// gets the client dropped.
+	send        chan pendingFrame
+	stop        chan struct{}
+	written     chan struct{}
+	closeCode   int
+	closeReason string
+	overflowed  atomic.Bool
+
+	// writeLatency smooths the duration of the writes, deadlineMisses
+	// counts those that timed out; both are kept by the writer goroutine.
+	// slowWarned is set once the client was told it is a slow consumer, and
+	// is owned by the hub, which checks them against the thresholds in bp.
+	writeLatency   atomic.Int64
+	deadlineMisses atomic.Int64
+	slowWarned     bool
+	bp             *backpressure
+
+	// unread counts the messages the user hasn't read in each room they
+	// have a read marker in, for v2 clients that connected with a username,
+	// nil otherwise. It is owned by the hub.
+	unread map[string]int64
+
+	// cancel ends the context of the work done on behalf of the client,
+	// once it is removed. It is nil for clients without one.
+	cancel context.CancelFunc
+
+	// subs are the rooms a v2 WebSocket connection subscribed to beyond
+	// its own, nil for other clients. Each subscription is a Client whose
+	// parent is the connection's.
+	subs   *subscriptions
+	parent *Client
+
+	// session is the IRC session of a client standing for one of its
+	// channels, nil for other clients.
+	session *ircSession
+
+	logger *slog.Logger
+}
+
+// hub is the state owned by the run goroutine. It must only be touched from
+// inside an op.
+type hub struct {
+	clients map[*Client]bool
+
+	// lastActivity records when each room last saw a join or a message.
+	lastActivity map[string]time.Time
+
+	// messageRate counts the messages each room received in the last minute.
+	messageRate map[string]*slidingCounter
+
+	// users maps claimed usernames to their connection.
+	users map[string]*Client
+
+	// occupancy counts the clients holding a seat in each room.
+	occupancy map[string]int64
+
+	// announced is the count of each room last broadcast to it.
+	announced map[string]int
+
+	// deliveries are the logs of unacked messages of the clients that went
+	// away, by ID.
+	deliveries map[string]*deliveryLog
+
+	// monitors are the admin connections watching every room.
+	monitors map[*monitor]bool
+}
+
+type Server struct {
+	cfg Config
+	rdb *redis.Client
+
+	// logger is the parent of every connection logger
+	logger *slog.Logger
+
+	// logPayloads puts message texts in the logs
+	logPayloads bool
+
+	// motd is the message of the day unless one is set in Redis.
+	motd string
+
+	// usernameNFKC applies NFKC normalization to usernames.
+	usernameNFKC bool
+
+	// maxUsernameLen caps the length of usernames, in characters, and
+	// reservedUsernames may not be used, whatever their case.
+	maxUsernameLen    int
+	reservedUsernames map[string]bool
+
+	// flood is nil unless auto-mutes are enabled, and duplicates unless
+	// repeated texts are throttled.
+	flood      *floodGuard
+	duplicates *duplicateThrottle
+
+	// keys builds every Redis key, under REDIS_KEY_PREFIX
+	keys keyspace
+
+	// store keeps the message history, unless dryRun is set, in which case
+	// dryRunSeqs numbers the messages without a round trip to the store.
+	store      MessageStore
+	dryRun     bool
+	dryRunSeqs *MemoryStore
+
+	upgrader *websocket.Upgrader
+
+	// codecs are the wire formats clients may negotiate, the first being
+	// the default.
+	codecs []Codec
+
+	// protocols maps every supported subprotocol to its version and codec.
+	protocols map[string]protocol
+
+	// auth identifies the WebSocket clients.
+	auth Authenticator
+
+	// apiKey authorizes posting messages through /send.
+	apiKey string
+
+	startedAt time.Time
+
+	writeTimeout time.Duration
+	maxFrameSize int64
+
+	// strictProtocol refuses frames with unknown types or keys.
+	strictProtocol bool
+
+	// resumeKey signs the resume tokens, valid for resumeTTL.
+	resumeKey []byte
+	resumeTTL time.Duration
+
+	// searchScanBudget bounds the messages a search scans, and
+	// searchEnabled is set once the RediSearch index is available.
+	searchScanBudget int64
+	searchEnabled    bool
+
+	// draining is set while the server doesn't accept connections, and
+	// drainCancel, guarded by drainMu, cancels the drain in progress.
+	// shuttingDown is set once the process is going to exit, and drained
+	// is closed when every client was disconnected for it.
+	draining         atomic.Bool
+	drainMu          sync.Mutex
+	drainCancel      chan struct{}
+	shuttingDown     atomic.Bool
+	drained          chan struct{}
+	drainGracePeriod time.Duration
+
+	// lifetime outlives every connection, for the work that must finish
+	// even when the client that started it went away. stop cancels it once
+	// the server shut down.
+	lifetime context.Context
+	stop     context.CancelFunc
+
+	// roomsStrict rejects connections to rooms that were not created
+	// through the API instead of creating them on the fly.
+	roomsStrict bool
+
+	// historyCap is the cap of the rooms created without one.
+	historyCap int64
+
+	// historyMaxBytes is the byte cap of the rooms without one.
+	historyMaxBytes int64
+
+	// avatarHosts are the hosts avatar URLs may point to, any when empty.
+	avatarHosts []string
+
+	// idleTimeout disconnects clients silent for that long, 0 meaning never.
+	idleTimeout time.Duration
+
+	// trustedProxies may set the client address in forwarding headers.
+	trustedProxies []netip.Prefix
+
+	// duplicateUsers is the policy for a username connecting twice.
+	duplicateUsers string
+
+	// maxConnsPerIP caps concurrent connections from one address, 0
+	// meaning unlimited.
+	maxConnsPerIP int
+
+	// maxSubscriptions caps the rooms a connection subscribes to beyond
+	// its own.
+	maxSubscriptions int
+
+	// attachmentTypes are the media types of the files messages may
+	// attach, of up to attachmentMaxSize bytes.
+	attachmentTypes   []string
+	attachmentMaxSize int64
+
+	// backpressure decides which clients are slow consumers, and sendQueue
+	// is how many frames they may fall behind before being dropped.
+	backpressure *backpressure
+	sendQueue    int
+
+	// roomLimiters throttle the rooms setting their own rate limit.
+	roomLimiters roomLimiters
+
+	// live holds the settings Reload can change, read again through
+	// reloader, one reload at a time.
+	live     atomic.Pointer[liveSettings]
+	reloader func() (Config, error)
+	reloadMu sync.Mutex
+
+	// roomConfig caches the options of the rooms.
+	roomConfig *roomConfigCache
+
+	// eventsStream is the Redis stream lifecycle events are appended to,
+	// empty when disabled. eventsMaxLen approximately caps its length.
+	eventsStream string
+	eventsMaxLen int64
+
+	// auditLog queues the entries of the audit stream, which
+	// auditMaxLen approximately caps.
+	auditLog    chan AuditEntry
+	auditMaxLen int64
+
+	// retentionMaxAge is how long messages are kept in the rooms without a
+	// max age of their own, 0 keeping them until the count cap drops them.
+	// Expired messages are pruned every retentionInterval, unless it is 0.
+	retentionMaxAge   time.Duration
+	retentionInterval time.Duration
+
+	// pruned counts the messages this instance removed for their age.
+	pruned atomic.Int64
+
+	// tracer records the message pipeline, nil when tracing is off.
+	tracer tracer
+
+	// telegram is nil without a bot token.
+	telegram *telegramBridge
+
+	// push is nil without VAPID keys.
+	push *pusher
+
+	// writeBehind stores messages in the background, nil when they are
+	// stored before being broadcast.
+	writeBehind *writeBehind
+
+	// bots were registered with WithBot, and botDispatcher hands them and
+	// the built-in ones the stored messages.
+	bots          []Bot
+	botDispatcher *botDispatcher
+
+	// monitors counts the connections to the monitor feed.
+	monitors atomic.Int64
+
+	// relayOut queues the messages for the other instances, nil when not
+	// relaying, and relayBus carries them. instanceID tells apart the
+	// messages this instance relayed.
+	relayOut    chan ChatMessage
+	relayBus    relayBus
+	relaySigner *relaySigner
+	instanceID  string
+
+	ops chan func(*hub)
+}
+
+// NewServer creates a server configured by cfg and starts its hub and the
+// background workers cfg enables. History and rooms are kept in the Redis
+// instance at cfg.RedisURL unless WithStore picks another store, which is
+// required when cfg has no Redis instance; the other Options adjust the rest.
+func NewServer(cfg Config, opts ...Option) (*Server, error) {
+	rdb, err := newRedisClient(cfg.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer, err := newTracer()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		cfg:  cfg,
+		rdb:  rdb,
+		keys: keyspace{prefix: cfg.RedisKeyPrefix},
+
+		codecs:    cfg.Codecs,
+		protocols: buildProtocols(cfg.ProtocolVersions, cfg.Codecs),
+
+		auth:      cfg.Authenticator,
+		apiKey:    cfg.APIKey,
+		startedAt: time.Now(),
+
+		writeTimeout: cfg.WriteTimeout,
+		maxFrameSize: cfg.MaxFrameSize,
+
+		strictProtocol: cfg.StrictProtocol,
+
+		resumeKey: resumeKey(cfg.ResumeSecret),
+		resumeTTL: cfg.ResumeTTL,
+
+		searchScanBudget: cfg.SearchScanBudget,
+
+		drained:          make(chan struct{}),
+		drainGracePeriod: cfg.DrainGracePeriod,
+
+		roomsStrict: cfg.RoomsStrict,
+		historyCap:  cfg.HistoryCap,
+		dryRun:      cfg.DryRun,
+		logPayloads: cfg.LogPayloads,
+		motd:        cfg.MOTD,
+
+		usernameNFKC: cfg.UsernameNFKC,
+
+		avatarHosts:    cfg.AvatarHosts,
+		idleTimeout:    cfg.IdleTimeout,
+		trustedProxies: cfg.TrustedProxies,
+		duplicateUsers: cfg.DuplicateUsers,
+		maxConnsPerIP:  cfg.MaxConnsPerIP,
+		backpressure:   &backpressure{warnQueue: cfg.SlowQueue, warnWrite: cfg.SlowWrite},
+		sendQueue:      cfg.SendQueue,
+		flood:          newFloodGuard(cfg),
+		duplicates:     newDuplicateThrottle(cfg),
+		roomConfig:     newRoomConfigCache(cfg.RoomConfigTTL),
+
+		maxSubscriptions: cfg.MaxSubscriptions,
+
+		attachmentTypes:   cfg.AttachmentTypes,
+		attachmentMaxSize: cfg.AttachmentMaxSize,
+
+		historyMaxBytes: cfg.HistoryMaxBytes,
+
+		maxUsernameLen:    cfg.MaxUsernameLen,
+		reservedUsernames: make(map[string]bool),
+
+		eventsStream: cfg.EventsStream,
+		eventsMaxLen: int64(cfg.EventsMaxLen),
+
+		auditLog:    make(chan AuditEntry, auditQueue),
+		auditMaxLen: int64(cfg.AuditMaxLen),
+
+		retentionMaxAge:   cfg.RetentionMaxAge,
+		retentionInterval: cfg.RetentionInterval,
+
+		tracer: tracer,
+
+		relaySigner: newRelaySigner(cfg.RelaySecret),
+		instanceID:  newConnID(),
+
+		ops: make(chan func(*hub)),
+	}
+	s.lifetime, s.stop = context.WithCancel(context.Background())
+	s.live.Store(newLiveSettings(cfg))
+	s.upgrader = &websocket.Upgrader{CheckOrigin: s.checkOrigin}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	if s.reloader == nil {
+		s.reloader = func() (Config, error) { return LoadConfig(nil) }
+	}
+	if s.store == nil {
+		if !s.hasRedis() {
+			return nil, errors.New("no store to keep the history in: neither REDIS_URL nor WithStore is set")
+		}
+		// the key prefix keeps separate chats on one Redis instance apart
+		s.store = newResilientStore(NewRedisStore(rdb, cfg.RedisKeyPrefix))
+	}
+	if s.auth == nil {
+		s.auth = NoAuth{}
+	}
+
+	if cfg.DryRun {
+		s.dryRunSeqs = NewMemoryStore()
+		s.logger.Warn("dry run: messages are broadcast but neither stored nor replayed")
+	}
+	if cfg.LogPayloads {
+		s.logger.Warn("message texts are logged at debug level")
+	}
+
+	// history kept in the legacy lists is invisible until migrated, so
+	// this is on unless explicitly turned off
+	if cfg.MigrateOnStart {
+		if rs, ok := unwrapStore(s.store).(*RedisStore); ok {
+			if err := rs.Migrate(context.Background()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if cfg.RediSearch {
+		s.enableRediSearch(context.Background())
+	}
+
+	if cfg.PubSubRelay {
+		s.relayBus = redisBus{rdb: rdb, channel: s.keys.relayChannel()}
+		if cfg.HistoryBackend == "postgres" {
+			if s.relayBus, err = newPostgresBus(s.store, cfg.DatabaseURL); err != nil {
+				return nil, err
+			}
+		}
+		s.relayOut = make(chan ChatMessage, relayQueue)
+		go s.runRelay()
+	}
+	if s.telegram = newTelegramBridge(s, cfg.TelegramToken, cfg.TelegramRooms); s.telegram != nil {
+		go s.telegram.poll(s.lifetime)
+		go s.telegram.deliver(s.lifetime)
+	}
+	if s.writeBehind, err = newWriteBehind(s, cfg); err != nil {
+		return nil, err
+	} else if s.writeBehind != nil {
+		go s.writeBehind.run()
+	}
+	for name := range cfg.ReservedUsernames {
+		s.reservedUsernames[name] = true
+	}
+	if s.botDispatcher = newBotDispatcher(s, cfg); s.botDispatcher != nil {
+		// nobody may pass for a bot
+		for _, b := range s.botDispatcher.bots {
+			s.reservedUsernames[strings.ToLower(b.Name())] = true
+		}
+		go s.botDispatcher.run()
+	}
+	if s.push, err = newPusher(s, cfg); err != nil {
+		return nil, err
+	} else if s.push != nil {
+		go s.push.run()
+	}
+
+	go s.run()
+	go s.runAudit()
+	if s.retentionInterval > 0 {
+		go s.runRetention()
+	}
+	// both poll Redis, and expired messages are hidden when read anyway
+	if s.hasRedis() {
+		go s.runScheduler()
+		go s.runExpiry()
+	}
+
+	return s, nil
+}
+
+// errNoRedis fails the Redis commands of a server run without REDIS_URL, so
+// that the features keeping their state in Redis report it.
+var errNoRedis = errors.New("REDIS_URL is not set")
+
+// newRedisClient connects to the Redis instance at url, or, when url is
+// empty, returns a client failing every command with errNoRedis.
+func newRedisClient(url string) (*redis.Client, error) {
+	if url == "" {
+		return redis.NewClient(&redis.Options{
+			Dialer: func(context.Context, string, string) (net.Conn, error) {
+				return nil, errNoRedis
+			},
+			MaxRetries: -1,
+		}), nil
+	}
+
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return redis.NewClient(opt), nil
+}
+
+// hasRedis reports whether the server has a Redis instance.
+func (s *Server) hasRedis() bool {
+	return s.cfg.RedisURL != ""
+}
+
+func (s *Server) HandleConnetions(w http.ResponseWriter, r *http.Request) {
+	// every log line about this connection carries its ID
+	connID := newConnID()
+	r = r.WithContext(withConnID(r.Context(), connID))
+
+	if s.draining.Load() {
+		http.Error(w, "server is draining, connect to another instance", http.StatusServiceUnavailable)
+		return
+	}
+
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		room = defaultRoom
+	}
+	if !validRoomName(room) {
+		http.Error(w, "invalid room name", http.StatusBadRequest)
+		return
+	}
+
+	username, roles, err := s.auth.Authenticate(r)
+	if err != nil {
+		s.logger.InfoContext(r.Context(), "authentication failed", "err", err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if username, err = s.normalizeUsername(username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ok, err := s.ensureRoom(r.Context(), room)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "room does not exist", http.StatusForbidden)
+		return
+	}
+
+	opts, err := s.roomOptions(r.Context(), room)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	// a valid resume token restores the session; otherwise the client
+	// connects afresh
+	var resume resumePoint
+	if token := r.URL.Query().Get("resume"); token != "" {
+		if resume, err = s.verifyResume(token, room); err != nil {
+			s.logger.InfoContext(r.Context(), "not resuming session", "err", err)
+		}
+	}
+
+	// members resuming their session were already let in
+	if opts.Private && resume.Username == "" {
+		ok, err := s.checkInvite(r.Context(), room, r.URL.Query().Get("invite"))
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		if !ok {
+			http.Error(w, "a valid invite is required to join this room", http.StatusForbidden)
+			return
+		}
+		if username != "" && s.verifiesUsers() {
+			if err := s.addRoomMember(r.Context(), room, username); err != nil {
+				internalError(w, r, err)
+				return
+			}
+		}
+	}
+
+	displayName, err := s.validDisplayName(r.URL.Query().Get("display_name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	avatarURL, err := validAvatarURL(r.URL.Query().Get("avatar_url"), s.avatarHosts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := parseMessageFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip := s.clientIP(r)
+	if s.maxConnsPerIP > 0 && s.connsFrom(ip) >= s.maxConnsPerIP {
+		http.Error(w, "too many connections from this address", http.StatusTooManyRequests)
+		return
+	}
+
+	proto, ok := s.negotiateProtocol(r)
+	if !ok {
+		http.Error(w, "unsupported subprotocol, expected one of: "+strings.Join(s.supportedSubprotocols(), ", "), http.StatusBadRequest)
+		return
+	}
+
+	var header http.Header
+	if len(websocket.Subprotocols(r)) != 0 {
+		header = http.Header{"Sec-Websocket-Protocol": {proto.subprotocol()}}
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		s.logger.WarnContext(r.Context(), "upgrade failed", "ip", ip, "err", err)
+		return
+	}
+	// ensure connection close when function returns
+	defer ws.Close()
+
+	// a panic while handling this connection, from joining the room on, must
+	// not take the server down
+	defer func() {
+		if v := recover(); v != nil {
+			s.logger.ErrorContext(r.Context(), "panic serving connection", "ip", ip, "room", room, "panic", v, "stack", string(debug.Stack()))
+		}
+	}()
+
+	// the work done for the client stops when it goes away, even halfway
+	// through replaying its history
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	c := &Client{
+		ws:           &sharedConn{clientConn: ws},
+		version:      proto.version,
+		codec:        proto.codec,
+		room:         room,
+		ip:           ip,
+		observer:     r.URL.Query().Get("mode") == "observe",
+		noEcho:       r.URL.Query().Get("echo") == "off" && proto.version >= protocolV2,
+		filter:       filter,
+		strict:       s.strictProtocol,
+		admin:        s.isAdmin(r) || hasRole(roles, roleAdmin),
+		claimed:      username,
+		displayName:  displayName,
+		avatarURL:    avatarURL,
+		writeTimeout: s.writeTimeout,
+		maxFrameSize: s.maxFrameSize,
+		connectedAt:  time.Now(),
+		bp:           s.backpressure,
+		logger:       s.logger.With("conn", connID, "ip", ip, "room", room),
+		recent:       new(recentTexts),
+		cancel:       cancel,
+	}
+	if resume.Username != "" {
+		c.claimed = resume.Username
+		c.resumeAfter = resume.LastID
+	}
+	if s.verifiesUsers() {
+		c.verified = c.claimed
+	}
+	if c.version >= protocolV2 {
+		c.subs = &subscriptions{rooms: make(map[string]*Client)}
+	}
+	// acks need a name to resume the log under
+	if acks := r.URL.Query().Get("acks"); acks != "" && c.claimed != "" && c.version >= protocolV2 {
+		c.acks = acks
+	}
+	c.username = c.claimed
+	c.touch()
+	ws.SetPongHandler(func(string) error {
+		c.touch()
+		return nil
+	})
+
+	// answer the client's close frame before the read loop ends
+	ws.SetCloseHandler(func(code int, text string) error {
+		reply := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		if code != websocket.CloseNoStatusReceived {
+			reply = websocket.FormatCloseMessage(code, "")
+		}
+		err := ws.WriteControl(websocket.CloseMessage, reply, controlDeadline(s.writeTimeout))
+		if err != nil && unsafeError(err) {
+			c.logger.Warn("answering close frame", "err", err)
+		}
+		return nil
+	})
+	c.logger.Info("connected", "subprotocol", proto.subprotocol(), "observer", c.observer, "username", c.claimed)
+
+	if !s.addClient(c, opts) {
+		c.logger.Info("turned away", "username", c.claimed)
+		return
+	}
+	defer func() {
+		s.delClient(c)
+		// the close frame the server may have asked for goes out before
+		// the connection is closed
+		<-c.written
+	}()
+
+	s.replayHistory(ctx, c)
+
+	s.emitEvent(ctx, eventConnect, room, c.claimed)
+	defer func() {
+		// the request context is done once the handler returns
+		ctx := withConnID(context.Background(), connID)
+		if c.subs != nil {
+			s.unsubscribeAll(ctx, c)
+		}
+		s.emitEvent(ctx, eventDisconnect, room, c.username)
+	}()
+
+	for {
+		var msg ChatMessage
+
+		// Read in a new message and map it to a Message object
+		err := c.readFrame(&msg)
+		c.touch()
+		if fe, ok := err.(*frameError); ok {
+			c.protocolErrors++
+			if c.protocolErrors >= maxProtocolErrors {
+				c.logger.Warn("disconnecting client making protocol errors", "err", fe)
+				s.disconnect(c, websocket.ClosePolicyViolation, "too many protocol errors")
+				break
+			}
+			s.sendError(c, fe.Code, fe.Error())
+			s.violation(ctx, c, fe.Code)
+			continue
+		}
+		if err != nil {
+			switch ClassifyError(err) {
+			case ErrorExpected:
+				c.logger.Info("disconnected", "err", err)
+			case ErrorProtocol:
+				c.logger.Warn("disconnected misbehaving client", "err", err)
+				switch {
+				case errors.Is(err, errMalformedFrame):
+					closeClient(c, websocket.CloseInvalidFramePayloadData, "malformed frame")
+				case errors.Is(err, errFrameTooLarge):
+					closeClient(c, websocket.ClosePolicyViolation, fmt.Sprintf("frame larger than %d bytes", c.maxFrameSize))
+				}
+			default:
+				c.logger.Error("reading frame", "err", err)
+			}
+			break
+		}
+
+		// frames don't say who sent them
+		logged := msg
+		logged.Username = c.username
+		c.logger.Debug("received frame", s.messageAttrs(logged)...)
+
+		// frames for the rooms subscribed to name them
+		target := c
+		if msg.Room != "" && msg.Room != c.room && c.subs != nil &&
+			msg.Type != messageTypeSubscribe && msg.Type != messageTypeUnsubscribe {
+			if target = c.subs.get(msg.Room); target == nil {
+				s.sendError(c, "not_subscribed", "not subscribed to this room")
+				continue
+			}
+		}
+
+		frameCtx, sp := s.startSpan(ctx, "chat.receive")
+		sp.setAttr("room", target.room)
+		ok := s.handleFrame(frameCtx, target, msg)
+		sp.end()
+		// a subscription ending leaves the connection open
+		if !ok && target == c {
+			break
+		}
+	}
+}
+
+// handleFrame validates a frame read from c and acts on it. It reports false
+// when c was disconnected.
+func (s *Server) handleFrame(ctx context.Context, c *Client, msg ChatMessage) bool {
+	if msg.Type == messageTypeReplies {
+		s.sendReplies(ctx, c, msg.ID)
+		return true
+	}
+	if msg.Type == messageTypeRead {
+		s.handleReadFrame(ctx, c, msg)
+		return true
+	}
+	if msg.Type == messageTypeAck {
+		s.handleAck(c, msg.Seq)
+		return true
+	}
+	if msg.Type == messageTypeResync {
+		s.handleResync(ctx, c, msg.FromSeq)
+		return true
+	}
+	if msg.Type == messageTypeSubscribe {
+		s.subscribe(ctx, c, msg.Room)
+		return true
+	}
+	if msg.Type == messageTypeUnsubscribe {
+		s.unsubscribe(ctx, c, msg.Room)
+		return true
+	}
+
+	if c.observer {
+		s.sendError(c, "read_only", "observers can't send messages")
+		return true
+	}
+	if c.waiting.Load() {
+		s.sendError(c, "room_full", "the room is full, wait for a seat to post")
+		return true
+	}
+
+	opts, err := s.roomOptions(ctx, c.room)
+	if err != nil {
+		// the server-wide limit applies meanwhile
+		c.logger.Error("loading room options", "err", err)
+	}
+
+	if !s.limiterFor(c.room, opts).allow(c.ip) {
+		c.throttled++
+		if c.throttled >= rateAbuseThreshold {
+			c.logger.Warn("disconnecting flooding client")
+			s.disconnect(c, websocket.CloseTryAgainLater, "sending too fast")
+			return false
+		}
+		s.sendError(c, "rate_limited", "you are sending messages too fast")
+		s.violation(ctx, c, "rate_limited")
+		return true
+	}
+	c.throttled = 0
+
+	if !c.admin {
+		if opts.ReadOnly {
+			s.sendError(c, "room_read_only", "only admins can post in this room")
+			return true
+		}
+		if wait := time.Duration(opts.SlowMode)*time.Second - time.Since(c.lastPost); opts.SlowMode > 0 && wait > 0 {
+			s.sendErrorFrame(c, errorFrame{
+				Code:      "slow_mode",
+				Message:   fmt.Sprintf("slow mode allows one message every %d seconds", opts.SlowMode),
+				ExpiresIn: int64((wait + time.Second - 1) / time.Second),
+			})
+			s.violation(ctx, c, "slow_mode")
+			return true
+		}
+	}
+
+	// the server decides these, whatever the client sent
+	if c.claimed != "" {
+		msg.Username = c.claimed
+	} else if msg.Username, err = s.normalizeUsername(msg.Username); err != nil {
+		s.sendError(c, usernameErrorCode(err), err.Error())
+		return true
+	}
+	msg.DisplayName = c.displayName
+	msg.AvatarURL = c.avatarURL
+	msg.ID = ""
+	msg.ParentDeleted = false
+	msg.ReplyCount = 0
+	msg.ReadBy = 0
+	msg.MessageID = ""
+	msg.ExpiresAt = 0
+	msg.Seq = 0
+	msg.FromSeq = 0
+	msg.Bot = false
+	msg.Status = ""
+
+	if msg.To != "" {
+		// anyone could read them under the recipient's name
+		if !s.verifiesUsers() {
+			s.sendError(c, "unsupported", "direct messages need authenticated users")
+			return true
+		}
+		if c.claimed == "" {
+			s.sendError(c, "anonymous", "direct messages need a claimed username")
+			return true
+		}
+		if msg.To, err = s.normalizeUsername(msg.To); err != nil || msg.To == msg.Username {
+			s.sendError(c, "invalid_recipient", "direct messages go to another user")
+			return true
+		}
+	}
+
+	if msg.Attachment != nil {
+		if err := s.checkAttachment(msg.Attachment); err != nil {
+			s.sendError(c, "invalid_attachment", err.Error())
+			s.violation(ctx, c, "invalid_attachment")
+			return true
+		}
+	}
+
+	if msg.ExpiresIn < 0 || msg.ExpiresIn > int64(maxExpiry/time.Second) {
+		s.sendError(c, "invalid_expiry", fmt.Sprintf("expires_in must be a number of seconds up to %d", int64(maxExpiry/time.Second)))
+		s.violation(ctx, c, "invalid_expiry")
+		return true
+	}
+
+	allowed, disconnect, err := s.checkSanctions(ctx, c, msg.Username)
+	if err != nil {
+		c.logger.Error("checking sanctions", "err", err)
+		return true
+	}
+	if disconnect {
+		s.disconnect(c, websocket.ClosePolicyViolation, "banned")
+		return false
+	}
+	if !allowed {
+		return true
+	}
+
+	if err := s.resolveReply(ctx, c.room, &msg); err != nil {
+		if err != errInvalidReply {
+			c.logger.Error("resolving reply", "err", err)
+		}
+		s.sendError(c, "invalid_reply", err.Error())
+		s.violation(ctx, c, "invalid_reply")
+		return true
+	}
+
+	if strings.HasPrefix(msg.Text, "/") && !s.runCommand(ctx, c, &msg) {
+		return true
+	}
+
+	if hasBannedWord(s.settings().bannedWords, msg.Text) {
+		s.sendError(c, "banned_word", "your message contains a banned word")
+		s.violation(ctx, c, "banned_word")
+		return true
+	}
+
+	if !s.duplicates.allow(c.recent, msg.Text, time.Now()) {
+		s.sendError(c, "duplicate_message", "you already sent this message")
+		s.violation(ctx, c, "duplicate_message")
+		return true
+	}
+
+	c.username = msg.Username
+	c.lastPost = time.Now()
+	// sent before the next frame is read, which keeps the client's
+	// messages in order
+	s.sendMessage(ctx, c, c.room, msg)
+	s.emitEvent(ctx, eventMessage, c.room, msg.Username)
+	return true
+}
+
+// addClient registers c with the hub, which queues frames for it until
+// replayHistory is done. It reports false when c was turned away, for its
+// username or because the room is full.
+func (s *Server) addClient(c *Client, opts RoomOptions) bool {
+	reply := make(chan bool, 1)
+
+	s.ops <- func(h *hub) {
+		// the lobby notice may be sent before c is registered
+		c.startWriter(s.sendQueue)
+
+		// a failing op still answers, and doesn't leave c half registered
+		ok := false
+		defer func() {
+			if !ok && !removeClient(h, c, 0, "") {
+				releaseUsername(h, c)
+				c.stopWriter(0, "")
+			}
+			reply <- ok
+		}()
+
+		if !s.claimUsername(h, c) {
+			return
+		}
+		if !s.seat(h, c, opts) {
+			releaseUsername(h, c)
+			return
+		}
+
+		h.clients[c] = true
+		h.lastActivity[c.room] = time.Now()
+
+		// hold back what the room sends until the history was replayed
+		c.pending = []pendingFrame{}
+		if c.acks != "" {
+			attachDelivery(h, c, c.acks)
+		}
+		if c.present() {
+			sendOccupancy(c, roomCount(h, c.room))
+		}
+		publish(h, monitorFrame{Event: monitorJoin, Room: c.room, IP: c.ip, Username: c.claimed})
+		ok = true
+	}
+
+	if !<-reply {
+		return false
+	}
+	s.audit(AuditEntry{Action: auditJoin, Actor: c.claimed, Room: c.room, IP: c.ip})
+	return true
+}
+
+// delClient unregisters c once its read loop ended.
+func (s *Server) delClient(c *Client) {
+	s.ops <- func(h *hub) {
+		removeClient(h, c, 0, "")
+	}
+	s.audit(AuditEntry{Action: auditLeave, Actor: c.claimed, Room: c.room, IP: c.ip})
+}
+
+// removeClient is the one way clients leave the hub. It unregisters c, frees
+// its username and seat, and has its writer close its connection, with a
+// close frame carrying code and reason unless code is 0. A client that let
+// its send queue fill up is closed as a slow consumer. It reports false,
+// doing nothing, when c was already removed, so that a failed write and the
+// read loop ending because of it don't tear c down twice. Loops over
+// h.clients collect the clients to remove and remove them afterwards. It
+// runs on the hub.
+func removeClient(h *hub, c *Client, code int, reason string) bool {
+	if !h.clients[c] {
+		return false
+	}
+	delete(h.clients, c)
+	releaseUsername(h, c)
+	unseat(h, c)
+	parkDelivery(h, c)
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.stopWriter(code, reason)
+	publish(h, monitorFrame{Event: monitorLeave, Room: c.room, IP: c.ip, Username: c.claimed, Reason: c.closeReason})
+	return true
+}
+
+// sendMessage stores msg and broadcasts it to room. from is the connection it
+// came from, nil for messages posted over HTTP. When it speaks v2 it gets an
+// ack carrying the trace ID of ctx once msg is stored, or a nack when it
+// couldn't be; with echo off, that replaces its own message.
+func (s *Server) sendMessage(ctx context.Context, from *Client, room string, msg ChatMessage) {
+	s.sendMessageFunc(ctx, from, room, msg, nil)
+}
+
+// postMessage sends msg like sendMessage for a sender without a connection,
+// and waits for it to be stored, returning it with its ID and timestamp.
+func (s *Server) postMessage(ctx context.Context, room string, msg ChatMessage) (ChatMessage, error) {
+	type result struct {
+		msg ChatMessage
+		err error
+	}
+	reply := make(chan result, 1)
+
+	s.sendMessageFunc(ctx, nil, room, msg, func(msg ChatMessage, err error) {
+		reply <- result{msg, err}
+	})
+
+	r := <-reply
+	return r.msg, r.err
+}
+
+// sendMessageFunc is sendMessage, calling stored from the hub once msg was
+// stored, or failed to be.
+//
+// It returns once the hub took msg, which stores and broadcasts it before
+// taking the next one. The messages of a connection are numbered as they are
+// sent, and the hub holds back any that reaches it before those sent ahead
+// of it, so each connection's messages are stored, numbered and delivered in
+// the order they were sent, even from separate goroutines. The store must
+// not defer the writes of one message past the next; write-behind keeps the
+// order, as it allocates IDs here and writes its queue in order.
+func (s *Server) sendMessageFunc(ctx context.Context, from *Client, room string, msg ChatMessage, stored func(ChatMessage, error)) {
+	msg.Type = messageTypeChat
+	msg.Room = room
+	msg.Timestamp = time.Now().UnixMilli()
+	if msg.ExpiresIn > 0 {
+		msg.ExpiresAt = msg.Timestamp + msg.ExpiresIn*1000
+		msg.ExpiresIn = 0
+	}
+
+	clientID := msg.ClientID
+	msg.ClientID = ""
+
+	// the time spent waiting for the hub
+	_, queued := s.startSpan(ctx, "chat.hub_queue")
+
+	op := func(h *hub) {
+		queued.end()
+
+		// the sender waiting for stored hears back even if the op fails
+		if stored != nil {
+			defer func() {
+				if stored != nil {
+					stored(msg, errHubOp)
+				}
+			}()
+		}
+
+		_, storing := s.startSpan(ctx, "chat.store")
+		storeErr := s.storeMessage(room, &msg)
+		if storeErr != nil {
+			// the message still reaches the room, it just isn't kept
+			s.logger.Error("storing message", "room", room, "err", storeErr)
+			storing.recordError(storeErr)
+		}
+		storing.end()
+		if stored != nil {
+			stored(msg, storeErr)
+			stored = nil
+		}
+
+		now := time.Now()
+		h.lastActivity[room] = now
+
+		rate := h.messageRate[room]
+		if rate == nil {
+			rate = new(slidingCounter)
+			h.messageRate[room] = rate
+		}
+		rate.add(now)
+
+		s.logger.DebugContext(ctx, "broadcasting message", s.messageAttrs(msg)...)
+
+		_, fanout := s.startSpan(ctx, "chat.fanout")
+		defer fanout.end()
+
+		var recipients int
+		var failed []*Client
+		var delivered bool
+		frames := make(frameCache)
+		for c := range h.clients {
+			if c.room != room {
+				continue
+			}
+			recipients++
+
+			var err error
+			if (c != from || !c.noEcho) && c.wants(msg) {
+				err = c.deliverMessage(msg, frames)
+				delivered = delivered || err == nil && msg.To != "" && c.verified == msg.To
+			}
+			if err == nil && c == from && c.version >= protocolV2 {
+				err = c.deliver("", s.confirmation(ctx, c, msg, clientID, storeErr))
+			}
+			if err != nil && unsafeError(err) {
+				c.logger.Warn("broadcasting", "err", err)
+				failed = append(failed, c)
+			}
+		}
+		for _, c := range failed {
+			removeClient(h, c, 0, "")
+		}
+		fanout.setAttr("recipients", recipients)
+
+		var ip string
+		if from != nil {
+			ip = from.ip
+		}
+		publish(h, monitorFrame{Event: monitorMessage, Room: room, IP: ip, Username: msg.Username, Message: &msg})
+		if storeErr != nil {
+			publish(h, monitorFrame{Event: monitorError, Room: room, IP: ip, Username: msg.Username, Code: "not_stored", Error: storeErr.Error()})
+		}
+
+		s.relay(msg)
+		s.push.notify(h, msg)
+		// direct messages stay between their sender and recipient
+		if msg.To == "" {
+			s.telegram.forward(msg)
+			if storeErr == nil {
+				s.botDispatcher.forward(msg)
+			}
+		}
+		if storeErr == nil && delivered {
+			go s.advanceStatus(msg, dmDelivered)
+		}
+
+		countUnread(h, from, msg)
+	}
+
+	if from == nil {
+		s.ops <- op
+		return
+	}
+	seq := from.sendSeq.Add(1)
+	s.ops <- func(h *hub) {
+		s.runInOrder(h, from, seq, op)
+	}
+}
+
+// runInOrder runs op, sending the message numbered seq of c, once the
+// messages c sent before it ran, and then those held back after it. It runs
+// on the hub.
+func (s *Server) runInOrder(h *hub, c *Client, seq uint64, op func(*hub)) {
+	if seq != c.lastSent+1 {
+		if c.heldSends == nil {
+			c.heldSends = make(map[uint64]func(*hub))
+		}
+		c.heldSends[seq] = op
+		return
+	}
+
+	for op != nil {
+		c.lastSent = seq
+		s.runOp(op, h)
+
+		seq++
+		op = c.heldSends[seq]
+		delete(c.heldSends, seq)
+	}
+}
+
+// confirmation is the ack or nack telling c whether its message msg was
+// stored. It runs on the hub.
+func (s *Server) confirmation(ctx context.Context, c *Client, msg ChatMessage, clientID string, storeErr error) interface{} {
+	if storeErr != nil {
+		return nackFrame{
+			Type:     messageTypeNack,
+			ClientID: clientID,
+			Code:     "not_stored",
+			Message:  "the message was delivered but could not be stored",
+		}
+	}
+
+	c.lastDelivered = msg.ID
+	ack := ackFrame{
+		Type:      messageTypeAck,
+		ID:        msg.ID,
+		Timestamp: msg.Timestamp,
+		ClientID:  clientID,
+		TraceID:   s.traceID(ctx),
+	}
+	if session, ok := s.newSession(c); ok {
+		ack.ResumeToken = session.Token
+	}
+	return ack
+}
+
+// storeTimeout bounds the writes storing a message.
+const storeTimeout = 5 * time.Second
+
+// storeMessage numbers msg, assigns it its ID and appends it to the room
+// history in the message store.
+// The message was accepted already, so the writes are bound to the server
+// rather than to the sender's connection, with storeTimeout to keep a stuck
+// store from holding up the hub.
+func (s *Server) storeMessage(room string, msg *ChatMessage) error {
+	ctx, cancel := context.WithTimeout(s.lifetime, storeTimeout)
+	defer cancel()
+
+	// numbered even when not stored, so that clients still see gaps, but
+	// direct messages would be gaps to everyone else in the room
+	if msg.To != "" {
+		msg.Status = dmSent
+	} else {
+		var numbering MessageStore = s.store
+		if s.dryRun {
+			// the fan-out measured in a dry run must not wait on the store
+			numbering = s.dryRunSeqs
+		}
+		seq, err := numbering.NextSeq(ctx, room)
+		if err != nil {
+			s.logger.Error("numbering message", "room", room, "err", err)
+		}
+		msg.Seq = seq
+	}
+
+	if s.dryRun {
+		// the ID still tells acks and replies apart
+		msg.ID = newConnID()
+		return nil
+	}
+
+	if s.writeBehind != nil {
+		// written and trimmed in the background
+		if err := s.writeBehind.add(ctx, room, msg); err != nil {
+			return err
+		}
+	} else if err := s.store.Append(ctx, room, msg); err != nil {
+		return err
+	}
+	if err := s.indexMessage(ctx, msg); err != nil {
+		s.logger.Error("indexing message", "id", msg.ID, "err", err)
+	}
+	if msg.ExpiresAt != 0 && s.hasRedis() {
+		if err := s.scheduleExpiry(ctx, room, msg); err != nil {
+			s.logger.Error("scheduling expiry", "id", msg.ID, "err", err)
+		}
+	}
+
+	if s.writeBehind != nil {
+		return nil
+	}
+	return s.trimHistory(ctx, room)
+}
+
+// trimHistory drops the messages of room beyond its history cap, and then
+// the oldest ones until it is under its byte cap.
+func (s *Server) trimHistory(ctx context.Context, room string) error {
+	opts, err := s.roomOptions(ctx, room)
+	if err != nil {
+		return err
+	}
+	if opts.HistoryCap > 0 {
+		if err := s.store.Trim(ctx, room, opts.HistoryCap); err != nil {
+			return err
+		}
+	}
+
+	maxBytes := s.historyMaxBytes
+	if opts.MaxBytes > 0 {
+		maxBytes = opts.MaxBytes
+	}
+	if bt, ok := unwrapStore(s.store).(byteTrimmer); ok && maxBytes > 0 {
+		return bt.TrimBytes(ctx, room, maxBytes)
+	}
+	return nil
+}
+
+func (s *Server) run() {
+	h := &hub{
+		clients:      make(map[*Client]bool),
+		lastActivity: make(map[string]time.Time),
+		messageRate:  make(map[string]*slidingCounter),
+		users:        make(map[string]*Client),
+		occupancy:    make(map[string]int64),
+		announced:    make(map[string]int),
+		deliveries:   make(map[string]*deliveryLog),
+		monitors:     make(map[*monitor]bool),
+	}
+
+	occupancy := time.NewTicker(occupancyInterval)
+	defer occupancy.Stop()
+
+	// the idle sweep runs on the hub, which owns the clients; a nil
+	// channel never fires when it is off
+	var sweep <-chan time.Time
+	if s.idleTimeout > 0 {
+		ticker := time.NewTicker(max(s.idleTimeout/2, time.Second))
+		defer ticker.Stop()
+		sweep = ticker.C
+	}
+
+	for {
+		select {
+		case op, ok := <-s.ops:
+			if !ok {
+				return
+			}
+			s.runOp(op, h)
+		case <-sweep:
+			s.runOp(s.sweepIdle, h)
+		case <-occupancy.C:
+			s.runOp(s.broadcastOccupancy, h)
+			s.runOp(s.expireDeliveries, h)
+		}
+	}
+}
+
+// errHubOp is reported to the callers waiting on a hub op that failed
+// before answering them.
+var errHubOp = errors.New("the hub failed to handle the request")
+
+// runOp executes a single hub operation, recovering from any panic so that
+// one bad op doesn't stop the broadcast loop.
+func (s *Server) runOp(op func(*hub), h *hub) {
+	defer func() {
+		if v := recover(); v != nil {
+			s.logger.Error("panic in hub op", "panic", v, "stack", string(debug.Stack()))
+		}
+	}()
+
+	op(h)
+}
+
+// readFrame reads the next frame and decodes it with the client's codec.
+// In strict mode, frames of an unknown type or with unknown keys are refused
+// with a *frameError once decoded.
+//
+// Frames over maxFrameSize are refused with errFrameTooLarge without reading
+// them further. The limit isn't left to ws.SetReadLimit, which answers with a
+// bare 1009 close frame before the client can be told why.
+func (c *Client) readFrame(v interface{}) error {
+	_, r, err := c.ws.NextReader()
+	if err != nil {
+		return err
+	}
+	if c.maxFrameSize > 0 {
+		r = io.LimitReader(r, c.maxFrameSize+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if c.maxFrameSize > 0 && int64(len(data)) > c.maxFrameSize {
+		return errFrameTooLarge
+	}
+	if err := c.codec.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %v", errMalformedFrame, err)
+	}
+
+	// mistakes are only rejected in strict mode, but logged either way
+	if fe := checkFrame(c.codec, data); fe != nil {
+		if c.strict {
+			return fe
+		}
+		c.logger.Debug("lenient decode", "err", fe)
+	}
+	return nil
+}
+
+// writeFrame encodes v with the client's codec, unless it is a shared frame
+// encoded already, and sends it. Panics are
+// turned into errors, so the caller drops the offending connection instead
+// of the whole hub.
+func (c *Client) writeFrame(v interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic writing to %s: %v", c.ws.RemoteAddr(), r)
+		}
+	}()
+
+	var data []byte
+	if f, ok := v.(*sharedFrame); ok {
+		data, err = f.encode()
+	} else {
+		data, err = c.codec.Marshal(v)
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.writeTimeout > 0 {
+		if err := c.ws.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return err
+		}
+	}
+	return c.ws.WriteMessage(c.codec.FrameType(), data)
+}
@@ -0,0 +1,491 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer starts a server keeping its state in a fresh miniredis, and
+// shuts it down when the test ends.
+func newTestServer(t testing.TB, opts ...Option) (*Server, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", "redis://"+mr.Addr())
+	return startTestServer(t, loadTestConfig(t), opts...), mr
+}
+
+// loadTestConfig loads the configuration from the environment, with the
+// static files in a temporary directory and short drains.
+func loadTestConfig(t testing.TB) Config {
+	t.Helper()
+
+	t.Setenv("STATIC_DIR", t.TempDir())
+	t.Setenv("DRAIN_GRACE_PERIOD", "10ms")
+	cfg, err := LoadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// startTestServer starts a server configured by cfg, and shuts it down when
+// the test ends.
+func startTestServer(t testing.TB, cfg Config, opts ...Option) *Server {
+	t.Helper()
+
+	opts = append([]Option{WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))}, opts...)
+	s, err := NewServer(cfg, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// dialTestServer connects to s over a WebSocket with the query query,
+// offering subprotocols.
+func dialTestServer(t testing.TB, s *Server, query string, subprotocols ...string) *websocket.Conn {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleConnetions))
+	t.Cleanup(ts.Close)
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = subprotocols
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// waitClients waits for the hub of s to count n clients.
+func waitClients(t testing.TB, s *Server, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := s.ClientCount()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients, want %d", got, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChatMessageOmitsEmptyFields(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  ChatMessage
+		want string
+	}{
+		{"minimal", ChatMessage{Username: "ann", Text: "hi"}, `{"username":"ann","text":"hi"}`},
+		{"empty", ChatMessage{}, `{"username":"","text":""}`},
+		{"typed", ChatMessage{Type: messageTypeChat, ID: "1-0", Username: "ann", Text: "hi", Timestamp: 42}, `{"type":"message","id":"1-0","username":"ann","text":"hi","ts":42}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("got %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
+
+// TestChatMessageFieldNames pins the JSON names of ChatMessage, which clients
+// depend on.
+func TestChatMessageFieldNames(t *testing.T) {
+	want := []string{
+		"type", "id", "room", "username", "text", "display_name", "avatar_url",
+		"reply_to", "parent_deleted", "reply_count", "read_by", "message_id",
+		"client_id", "ts", "expires_in", "expires_at", "seq", "from_seq", "bot",
+		"attachment", "to", "status",
+	}
+
+	typ := reflect.TypeOf(ChatMessage{})
+	var got []string
+	for i := 0; i < typ.NumField(); i++ {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		got = append(got, name)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("JSON names changed:\n got %v\nwant %v", got, want)
+	}
+}
+
+func TestChatMessageRoundTrip(t *testing.T) {
+	full := ChatMessage{
+		Type:          messageTypeChat,
+		ID:            "1700000000000-0",
+		Room:          "general",
+		Username:      "ann",
+		Text:          "hello",
+		DisplayName:   "Ann",
+		AvatarURL:     "https://example.com/ann.png",
+		ReplyTo:       "1699999999999-0",
+		ParentDeleted: true,
+		ReplyCount:    2,
+		ReadBy:        3,
+		MessageID:     "1699999999999-1",
+		ClientID:      "c1",
+		Timestamp:     1700000000000,
+		ExpiresIn:     60,
+		ExpiresAt:     1700000060000,
+		Seq:           7,
+		FromSeq:       5,
+		Bot:           true,
+		Attachment:    &Attachment{URL: "https://example.com/a.png", MimeType: "image/png", Size: 10, Filename: "a.png"},
+		To:            "bob",
+		Status:        dmDelivered,
+	}
+
+	for _, codec := range codecs {
+		t.Run(codec.Name(), func(t *testing.T) {
+			data, err := codec.Marshal(full)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got ChatMessage
+			if err := codec.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, full) {
+				t.Errorf("round trip changed the message:\n got %+v\nwant %+v", got, full)
+			}
+		})
+	}
+}
+
+// TestSendBurstInOrder checks that a burst sent over one connection is
+// stored and broadcast in the order it was sent.
+func TestSendBurstInOrder(t *testing.T) {
+	const burst = 50
+
+	s, _ := newTestServer(t)
+	sender := dialTestServer(t, s, "room=general&username=ann")
+	watcher := dialTestServer(t, s, "room=general&username=bob")
+	waitClients(t, s, 2)
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < burst; i++ {
+			msg := ChatMessage{Text: fmt.Sprintf("m%d", i)}
+			if err := sender.WriteJSON(msg); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for _, ws := range []*websocket.Conn{watcher, sender} {
+		var got []string
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for len(got) < burst {
+			var msg ChatMessage
+			if err := ws.ReadJSON(&msg); err != nil {
+				t.Fatalf("after %d messages: %v", len(got), err)
+			}
+			if msg.Username == "ann" {
+				got = append(got, msg.Text)
+			}
+		}
+		for i, text := range got {
+			if want := fmt.Sprintf("m%d", i); text != want {
+				t.Fatalf("broadcast %d is %q, want %q", i, text, want)
+			}
+		}
+	}
+	<-sent
+
+	stored, err := s.store.Recent(context.Background(), "general", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, msg := range stored {
+		if msg.Username == "ann" {
+			texts = append(texts, msg.Text)
+		}
+	}
+	if len(texts) != burst {
+		t.Fatalf("stored %d messages, want %d", len(texts), burst)
+	}
+	for i, text := range texts {
+		if want := fmt.Sprintf("m%d", i); text != want {
+			t.Fatalf("stored message %d is %q, want %q", i, text, want)
+		}
+	}
+}
+
+// TestRunInOrder checks that the hub runs the messages of a connection in
+// the order they were numbered, whatever the order they reach it in.
+func TestRunInOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		arrival []uint64
+	}{
+		{"in order", []uint64{1, 2, 3, 4}},
+		{"reversed", []uint64{4, 3, 2, 1}},
+		{"interleaved", []uint64{2, 1, 4, 3}},
+		{"first last", []uint64{3, 4, 2, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+			c := new(Client)
+			var ran []uint64
+			for _, seq := range tt.arrival {
+				s.runInOrder(nil, c, seq, func(*hub) { ran = append(ran, seq) })
+			}
+
+			want := []uint64{1, 2, 3, 4}
+			if !reflect.DeepEqual(ran, want) {
+				t.Errorf("ran %v, want %v", ran, want)
+			}
+			if len(c.heldSends) != 0 {
+				t.Errorf("%d messages still held", len(c.heldSends))
+			}
+		})
+	}
+}
+
+// TestServerWithoutRedis checks that a server whose store keeps the rooms
+// stores, numbers and delivers messages without Redis.
+func TestServerWithoutRedis(t *testing.T) {
+	t.Setenv("REDIS_URL", "")
+	t.Setenv("HISTORY_BACKEND", "memory")
+	store := NewMemoryStore()
+	s := startTestServer(t, loadTestConfig(t), WithStore(store))
+
+	ws := dialTestServer(t, s, "room=lobby&username=ann")
+	for _, text := range []string{"one", "two"} {
+		if err := ws.WriteJSON(ChatMessage{Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{"one", "two"} {
+		var msg ChatMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Text != want {
+			t.Fatalf("got %q, want %q", msg.Text, want)
+		}
+	}
+
+	ctx := context.Background()
+	if fields, err := store.RoomFields(ctx, "lobby"); err != nil || fields["created_at"] == "" {
+		t.Errorf("room not created in the store: %v, %v", fields, err)
+	}
+	msgs, err := store.Recent(ctx, "lobby", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Seq != 1 || msgs[1].Seq != 2 {
+		t.Errorf("stored %+v, want two messages numbered 1 and 2", msgs)
+	}
+}
+
+// TestDryRun checks that a dry run numbers the messages it broadcasts
+// without a round trip to the store.
+func TestDryRun(t *testing.T) {
+	t.Setenv("DRY_RUN", "1")
+	s, mr := newTestServer(t)
+
+	ws := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	for _, text := range []string{"one", "two"} {
+		if err := ws.WriteJSON(ChatMessage{Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var seqs []int64
+	for len(seqs) < 2 {
+		var msg ChatMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Username == "ann" {
+			seqs = append(seqs, msg.Seq)
+		}
+	}
+	if seqs[0] != 1 || seqs[1] != 2 {
+		t.Errorf("numbered %v, want [1 2]", seqs)
+	}
+	if mr.Exists(s.keys.roomSeq("general")) {
+		t.Error("dry run numbered the messages in Redis")
+	}
+}
+
+// BenchmarkBroadcast measures how many messages a second a dry run fans out
+// to rooms of a growing number of clients.
+func BenchmarkBroadcast(b *testing.B) {
+	for _, n := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("clients=%d", n), func(b *testing.B) {
+			b.Setenv("DRY_RUN", "1")
+			s, _ := newTestServer(b)
+
+			// the sender is one of the clients
+			clients := []*websocket.Conn{dialTestServer(b, s, "room=general&username=ann", "chat.v2")}
+			for i := 1; i < n; i++ {
+				clients = append(clients, dialTestServer(b, s, fmt.Sprintf("room=general&username=user%d", i), "chat.v2"))
+			}
+			waitClients(b, s, n)
+
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for _, ws := range clients {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ws.SetReadDeadline(time.Now().Add(time.Minute))
+					for got := 0; got < b.N; {
+						var msg ChatMessage
+						if err := ws.ReadJSON(&msg); err != nil {
+							b.Errorf("after %d messages: %v", got, err)
+							return
+						}
+						if msg.Username == "ann" {
+							got++
+						}
+					}
+				}()
+			}
+			for i := 0; i < b.N; i++ {
+				if err := clients[0].WriteJSON(ChatMessage{Text: fmt.Sprintf("m%d", i)}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			wg.Wait()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
+
+// TestHubSurvivesPanic checks that an op panicking on the hub doesn't stop
+// it from broadcasting, and is logged through the server's logger.
+func TestHubSurvivesPanic(t *testing.T) {
+	t.Setenv("LOG_FORMAT", "json")
+	t.Setenv("LOG_LEVEL", "")
+	var lb logBuffer
+	s, _ := newTestServer(t, WithLogger(slog.New(NewLogHandler(&lb))))
+	ws := dialTestServer(t, s, "room=general&username=ann")
+	waitClients(t, s, 1)
+
+	tests := []struct {
+		name string
+		op   func(*hub)
+	}{
+		{"string", func(*hub) { panic("boom") }},
+		{"error", func(*hub) { panic(errors.New("boom")) }},
+		{"nil map", func(*hub) {
+			var m map[string]int
+			m["boom"]++
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.ops <- tt.op
+
+			if err := ws.WriteJSON(ChatMessage{Username: "ann", Text: "after " + tt.name}); err != nil {
+				t.Fatal(err)
+			}
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var msg ChatMessage
+			if err := ws.ReadJSON(&msg); err != nil {
+				t.Fatalf("no broadcast after the panic: %v", err)
+			}
+			if msg.Text != "after "+tt.name {
+				t.Errorf("got %q, want %q", msg.Text, "after "+tt.name)
+			}
+		})
+	}
+
+	var panics int
+	for _, rec := range lb.records(t) {
+		if rec["msg"] == "panic in hub op" {
+			panics++
+		}
+	}
+	if panics != len(tests) {
+		t.Errorf("logged %d panics, want %d", panics, len(tests))
+	}
+}
+
+// panicky panics when it is encoded.
+type panicky struct{}
+
+func (panicky) MarshalJSON() ([]byte, error) {
+	panic("boom")
+}
+
+// wsPair returns the server side of a WebSocket connection, and the client
+// side connected to it.
+func wsPair(t *testing.T) (server, client *websocket.Conn) {
+	t.Helper()
+
+	conns := make(chan *websocket.Conn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			close(conns)
+			return
+		}
+		conns <- ws
+	}))
+	t.Cleanup(ts.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server = <-conns
+	if server == nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, client
+}
+
+// TestWriteFrameRecovers checks that a frame panicking while it is written
+// fails the write instead.
+func TestWriteFrameRecovers(t *testing.T) {
+	ws, _ := wsPair(t)
+
+	c := &Client{ws: ws, codec: jsonCodec{}}
+	if err := c.writeFrame(panicky{}); err == nil {
+		t.Error("writing a panicking frame didn't fail")
+	}
+	if err := c.writeFrame(ChatMessage{Text: "ok"}); err != nil {
+		t.Errorf("writing after the panic: %v", err)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build sqlite
+
+package chat
+
+// the pure Go driver keeps the binary free of cgo
+import _ "modernc.org/sqlite"
@@ -0,0 +1,48 @@
+package chat
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// staticHandler serves the files in dir, except for the index page, which
+// index renders. With spa set, paths that match no file are answered with
+// the index page so that the client-side router can handle deep links,
+// except under the API prefixes and for paths that look like missing
+// assets.
+func staticHandler(dir string, spa bool, index http.Handler) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean("/" + r.URL.Path)
+
+		if p == "/" || p == "/index.html" {
+			index.ServeHTTP(w, r)
+			return
+		}
+		if !spa {
+			files.ServeHTTP(w, r)
+			return
+		}
+
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+			strings.HasPrefix(p, "/api/") || strings.HasPrefix(p, "/debug/") ||
+			path.Ext(p) != "" {
+			files.ServeHTTP(w, r)
+			return
+		}
+
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(p)))
+		if !errors.Is(err, fs.ErrNotExist) {
+			files.ServeHTTP(w, r)
+			return
+		}
+
+		index.ServeHTTP(w, r)
+	})
+}
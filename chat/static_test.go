@@ -0,0 +1,69 @@
+package chat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStaticHandler(t *testing.T) {
+	const indexHTML = "<title>chat index</title>"
+
+	tests := []struct {
+		name      string
+		spa       bool
+		method    string
+		path      string
+		wantCode  int
+		wantIndex bool
+		wantBody  string
+	}{
+		{"root", false, http.MethodGet, "/", http.StatusOK, true, ""},
+		{"asset", true, http.MethodGet, "/app.js", http.StatusOK, false, "console.log"},
+		{"nested asset", true, http.MethodGet, "/css/site.css", http.StatusOK, false, "body{}"},
+		{"deep link", true, http.MethodGet, "/rooms/general", http.StatusOK, true, ""},
+		{"deep link without fallback", false, http.MethodGet, "/rooms/general", http.StatusNotFound, false, ""},
+		{"missing asset", true, http.MethodGet, "/missing.js", http.StatusNotFound, false, ""},
+		{"api route", true, http.MethodGet, "/api/config", http.StatusOK, false, "{"},
+		{"unknown api route", true, http.MethodGet, "/api/nothing", http.StatusNotFound, false, ""},
+		{"websocket", true, http.MethodGet, "/websocket", http.StatusBadRequest, false, ""},
+		{"not a read", true, http.MethodPost, "/rooms/general", http.StatusNotFound, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.spa {
+				t.Setenv("SPA_FALLBACK", "1")
+			}
+			s, _ := newTestServer(t)
+			for name, data := range map[string]string{
+				"index.html":   indexHTML,
+				"app.js":       "console.log('hi')",
+				"css/site.css": "body{}",
+			} {
+				p := filepath.Join(s.cfg.StaticDir, name)
+				if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			body := rec.Body.String()
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantCode, body)
+			}
+			if got := strings.Contains(body, indexHTML); got != tt.wantIndex {
+				t.Errorf("served the index page %v, want %v", got, tt.wantIndex)
+			}
+			if !strings.Contains(body, tt.wantBody) {
+				t.Errorf("body %q, want it to contain %q", body, tt.wantBody)
+			}
+		})
+	}
+}
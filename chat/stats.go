@@ -0,0 +1,132 @@
+package chat
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Stats is the payload of the stats endpoint.
+type Stats struct {
+	Connections       int                  `json:"connections"`
+	Viewers           int                  `json:"viewers"`
+	MessagesPerMinute int64                `json:"messages_per_minute"`
+	Rooms             map[string]RoomStats `json:"rooms"`
+	UptimeSeconds     int64                `json:"uptime_seconds"`
+
+	// PrunedMessages is the number of messages this instance removed for
+	// exceeding the retention age.
+	PrunedMessages int64 `json:"pruned_messages"`
+
+	// SlowestClients are the clients with the most backpressure. They are
+	// only shown to admins.
+	SlowestClients []SlowClient `json:"slowest_clients,omitempty"`
+}
+
+// RoomStats are the numbers reported for a single room. Connections include
+// the read-only viewers, and Messages is the history length.
+type RoomStats struct {
+	Connections       int   `json:"connections"`
+	Viewers           int   `json:"viewers"`
+	Messages          int64 `json:"messages"`
+	MessagesPerMinute int64 `json:"messages_per_minute"`
+}
+
+// ClientCount returns the number of connected clients, viewers included.
+// The rooms a connection subscribed to don't count as connections of their
+// own.
+func (s *Server) ClientCount() int {
+	reply := make(chan int, 1)
+	s.ops <- func(h *hub) {
+		var n int
+		defer func() { reply <- n }()
+
+		for c := range h.clients {
+			if c.parent == nil {
+				n++
+			}
+		}
+	}
+	return <-reply
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	rooms, err := s.store.Rooms(ctx)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	names := slices.Collect(maps.Keys(rooms))
+
+	activity := s.roomActivity()
+	for room := range activity {
+		names = append(names, room)
+	}
+	sort.Strings(names)
+	names = slices.Compact(names)
+
+	stats := Stats{
+		Connections:    s.ClientCount(),
+		Rooms:          make(map[string]RoomStats, len(names)),
+		UptimeSeconds:  int64(time.Since(s.startedAt) / time.Second),
+		PrunedMessages: s.pruned.Load(),
+	}
+	for _, name := range names {
+		n, err := s.store.Len(ctx, name)
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		a := activity[name]
+		stats.Viewers += a.viewers
+		stats.MessagesPerMinute += a.messagesPerMinute
+		stats.Rooms[name] = RoomStats{
+			Connections:       a.occupants + a.viewers,
+			Viewers:           a.viewers,
+			Messages:          n,
+			MessagesPerMinute: a.messagesPerMinute,
+		}
+	}
+
+	if s.isAdmin(r) {
+		stats.SlowestClients = s.sampleBackpressure().slowest(slowestClients)
+	}
+
+	writeJSONResponse(w, http.StatusOK, stats)
+}
+
+// slidingCounter counts events over the last minute in one-second buckets,
+// so the rate is kept up to date as messages arrive instead of being
+// recomputed from the history. It is owned by the hub.
+type slidingCounter struct {
+	buckets [60]int64
+	seconds [60]int64
+}
+
+func (sc *slidingCounter) add(now time.Time) {
+	sec := now.Unix()
+	i := sec % int64(len(sc.buckets))
+	if sc.seconds[i] != sec {
+		sc.seconds[i] = sec
+		sc.buckets[i] = 0
+	}
+	sc.buckets[i]++
+}
+
+// count returns the number of events in the minute before now.
+func (sc *slidingCounter) count(now time.Time) int64 {
+	sec := now.Unix()
+
+	var n int64
+	for i, s := range sc.seconds {
+		if sec-s < int64(len(sc.buckets)) {
+			n += sc.buckets[i]
+		}
+	}
+	return n
+}
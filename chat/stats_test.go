@@ -0,0 +1,184 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// getStats fetches /stats from s with the bearer token, if any.
+func getStats(t *testing.T, s *Server, token string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.adminIfConfigured(s.handleStats)(rec, req)
+	return rec
+}
+
+func TestStats(t *testing.T) {
+	s, _ := newTestServer(t)
+	ann := dialTestServer(t, s, "room=general")
+	dialTestServer(t, s, "room=general")
+	dialTestServer(t, s, "room=random")
+	waitClients(t, s, 3)
+
+	if err := ann.WriteJSON(ChatMessage{Username: "ann", Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	ann.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := ann.ReadJSON(new(ChatMessage)); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := getStats(t, s, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	var stats Stats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Connections != 3 || stats.MessagesPerMinute != 1 {
+		t.Errorf("%d connections and %d messages per minute, want 3 and 1", stats.Connections, stats.MessagesPerMinute)
+	}
+	for room, want := range map[string]RoomStats{
+		"general": {Connections: 2, Messages: 1, MessagesPerMinute: 1},
+		"random":  {Connections: 1},
+	} {
+		if got := stats.Rooms[room]; got != want {
+			t.Errorf("stats of %s = %+v, want %+v", room, got, want)
+		}
+	}
+	if stats.SlowestClients != nil {
+		t.Error("slowest clients shown without the admin token")
+	}
+}
+
+func TestStatsAdminToken(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	s, _ := newTestServer(t)
+
+	tests := []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := getStats(t, s, tt.token); rec.Code != tt.want {
+			t.Errorf("with token %q: status %d, want %d", tt.token, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestSlidingCounter(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	var sc slidingCounter
+	for _, d := range []time.Duration{0, 0, 10 * time.Second, 59 * time.Second} {
+		sc.add(start.Add(d))
+	}
+
+	tests := []struct {
+		at   time.Duration
+		want int64
+	}{
+		{59 * time.Second, 4},
+		{60 * time.Second, 2},
+		{69 * time.Second, 2},
+		{70 * time.Second, 1},
+		{2 * time.Minute, 0},
+	}
+	for _, tt := range tests {
+		if got := sc.count(start.Add(tt.at)); got != tt.want {
+			t.Errorf("count after %v = %d, want %d", tt.at, got, tt.want)
+		}
+	}
+
+	// a bucket reused a minute later starts afresh
+	sc.add(start.Add(time.Minute))
+	if got := sc.count(start.Add(time.Minute)); got != 3 {
+		t.Errorf("count after reusing a bucket = %d, want 3", got)
+	}
+}
+
+// TestClientCount checks that the client count follows connections and
+// disconnections, and that /stats and /metrics report it.
+func TestClientCount(t *testing.T) {
+	s, _ := newTestServer(t)
+	conns := make(map[string]*websocket.Conn)
+
+	tests := []struct {
+		name  string
+		query string // connected if set, else name disconnects
+		want  int
+	}{
+		{"ann", "room=general&username=ann", 1},
+		{"bob", "room=random&username=bob", 2},
+		{"viewer", "room=general&mode=observe", 3},
+		{"ann", "", 2},
+		{"viewer", "", 1},
+		{"bob", "", 0},
+	}
+	for _, tt := range tests {
+		if tt.query != "" {
+			conns[tt.name] = dialTestServer(t, s, tt.query)
+		} else {
+			conns[tt.name].Close()
+		}
+		waitClients(t, s, tt.want)
+
+		var stats Stats
+		if err := json.NewDecoder(getStats(t, s, "").Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		if stats.Connections != tt.want {
+			t.Errorf("after %s: /stats shows %d connections, want %d", tt.name, stats.Connections, tt.want)
+		}
+
+		rec := httptest.NewRecorder()
+		s.handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if line := fmt.Sprintf("chat_clients %d\n", tt.want); !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("after %s: /metrics lacks %q", tt.name, line)
+		}
+	}
+}
+
+// TestClientCountSkipsSubscriptions checks that subscribing to more rooms
+// doesn't add to the client count.
+func TestClientCountSkipsSubscriptions(t *testing.T) {
+	s, _ := newTestServer(t)
+	ws := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	dialTestServer(t, s, "room=random&username=bob")
+	waitClients(t, s, 2)
+
+	if err := ws.WriteJSON(ChatMessage{Type: messageTypeSubscribe, Room: "random"}); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var f subscriptionFrame
+		if err := ws.ReadJSON(&f); err != nil {
+			t.Fatal(err)
+		}
+		if f.Type == messageTypeSubscribed {
+			break
+		}
+	}
+
+	if n := s.ClientCount(); n != 2 {
+		t.Errorf("ClientCount() = %d after subscribing, want 2", n)
+	}
+}
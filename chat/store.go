@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// errMessageNotFound is returned for IDs that were never allocated.
+	errMessageNotFound = errors.New("message not found")
+
+	// errMessageGone is returned for messages that existed but have since
+	// left the history.
+	errMessageGone = errors.New("message no longer stored")
+)
+
+// MessageStore persists the history of every room, along with the rooms
+// themselves, the numbers of their messages and the locks the instances
+// share, so that a server runs on any store alone. Moderation, read markers
+// and the rest stay in Redis, and the migration of legacy history only
+// applies to RedisStore.
+type MessageStore interface {
+	// Append assigns msg its ID and adds it to the history of room.
+	Append(ctx context.Context, room string, msg *ChatMessage) error
+
+	// Recent returns the latest limit messages of room, oldest first. A
+	// limit of 0 returns the whole history.
+	Recent(ctx context.Context, room string, limit int64) ([]ChatMessage, error)
+
+	// Range returns the messages of room from index start to stop
+	// inclusive, oldest first.
+	Range(ctx context.Context, room string, start, stop int64) ([]ChatMessage, error)
+
+	// Exists reports whether room has any history.
+	Exists(ctx context.Context, room string) (bool, error)
+
+	// Len is the number of messages stored for room.
+	Len(ctx context.Context, room string) (int64, error)
+
+	// Trim drops all but the latest limit messages of room.
+	Trim(ctx context.Context, room string, limit int64) error
+
+	// PruneBefore drops the messages of room received before cutoff and
+	// returns how many were removed. Messages without a timestamp predate
+	// timestamps and are pruned as well.
+	PruneBefore(ctx context.Context, room string, cutoff time.Time) (int64, error)
+
+	// Clear drops the whole history of room and returns how many messages
+	// it held.
+	Clear(ctx context.Context, room string) (int64, error)
+
+	// Get returns the message with the given ID, or errMessageNotFound or
+	// errMessageGone.
+	Get(ctx context.Context, id string) (ChatMessage, error)
+
+	// Replies returns the stored replies to message id, oldest first.
+	Replies(ctx context.Context, id string) ([]ChatMessage, error)
+
+	// ReplyCounts returns the number of replies to each of ids.
+	ReplyCounts(ctx context.Context, ids []string) ([]int64, error)
+
+	// Remove drops message id from the history of room. Removing a message
+	// that isn't there is not an error.
+	Remove(ctx context.Context, room, id string) error
+
+	// SetStatus moves the delivery status of direct message id forward to
+	// status, reporting false when the message is gone or got that far
+	// already.
+	SetStatus(ctx context.Context, id, status string) (bool, error)
+
+	// Rank returns the index of message id in the history of room, oldest
+	// first, or errMessageNotFound when it isn't there.
+	Rank(ctx context.Context, room, id string) (int64, error)
+
+	// NextSeq allocates the next number of the messages of room, from 1.
+	NextSeq(ctx context.Context, room string) (int64, error)
+
+	// CreateRoom records room with fields, which include its created_at,
+	// and reports false when a room of that name exists already. Nothing of
+	// the room is seen before all of it is written.
+	CreateRoom(ctx context.Context, room string, fields map[string]string) (bool, error)
+
+	// RoomFields returns the fields of room, none when it doesn't exist.
+	RoomFields(ctx context.Context, room string) (map[string]string, error)
+
+	// SetRoomFields changes the given fields of room, keeping the others.
+	SetRoomFields(ctx context.Context, room string, fields map[string]string) error
+
+	// Rooms returns the fields of every room by name.
+	Rooms(ctx context.Context) (map[string]map[string]string, error)
+
+	// Lock takes the lock name with token for ttl, reporting false while
+	// another token holds it. Unlock releases it if token still holds it.
+	Lock(ctx context.Context, name, token string, ttl time.Duration) (bool, error)
+	Unlock(ctx context.Context, name, token string) error
+}
@@ -0,0 +1,314 @@
+package chat
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps history in process memory. It suits tests and small
+// single-instance deployments; everything is lost on restart.
+type MemoryStore struct {
+	mu      sync.Mutex
+	lastID  int64
+	rooms   map[string][]ChatMessage
+	byID    map[string]ChatMessage
+	replies map[string][]string
+
+	// roomFields, seqs and locks hold the rooms, the last number of the
+	// messages of each and the locks taken.
+	roomFields map[string]map[string]string
+	seqs       map[string]int64
+	locks      map[string]memoryLock
+
+	// idPrefix is prepended to every ID handed out.
+	idPrefix string
+}
+
+// memoryLock is a lock held by token until expires.
+type memoryLock struct {
+	token   string
+	expires time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		rooms:      make(map[string][]ChatMessage),
+		byID:       make(map[string]ChatMessage),
+		replies:    make(map[string][]string),
+		roomFields: make(map[string]map[string]string),
+		seqs:       make(map[string]int64),
+		locks:      make(map[string]memoryLock),
+	}
+}
+
+func (m *MemoryStore) Append(ctx context.Context, room string, msg *ChatMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastID++
+	msg.ID = m.idPrefix + strconv.FormatInt(m.lastID, 10)
+	msg.Room = room
+
+	m.rooms[room] = append(m.rooms[room], *msg)
+	m.byID[msg.ID] = *msg
+	if msg.ReplyTo != "" {
+		m.replies[msg.ReplyTo] = append(m.replies[msg.ReplyTo], msg.ID)
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) Recent(ctx context.Context, room string, limit int64) ([]ChatMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgs := m.rooms[room]
+	if limit > 0 && int64(len(msgs)) > limit {
+		msgs = msgs[int64(len(msgs))-limit:]
+	}
+	return append([]ChatMessage(nil), msgs...), nil
+}
+
+func (m *MemoryStore) Range(ctx context.Context, room string, start, stop int64) ([]ChatMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// negative indexes count from the end, as with LRANGE
+	msgs := m.rooms[room]
+	n := int64(len(msgs))
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	start = max(start, 0)
+	stop = min(stop+1, n)
+	if start >= stop {
+		return nil, nil
+	}
+	return append([]ChatMessage(nil), msgs[start:stop]...), nil
+}
+
+func (m *MemoryStore) Exists(ctx context.Context, room string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.rooms[room]) > 0, nil
+}
+
+func (m *MemoryStore) Len(ctx context.Context, room string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return int64(len(m.rooms[room])), nil
+}
+
+func (m *MemoryStore) Trim(ctx context.Context, room string, limit int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgs := m.rooms[room]
+	if int64(len(msgs)) <= limit {
+		return nil
+	}
+
+	n := int64(len(msgs)) - limit
+	for _, msg := range msgs[:n] {
+		delete(m.byID, msg.ID)
+	}
+	m.rooms[room] = append([]ChatMessage(nil), msgs[n:]...)
+
+	return nil
+}
+
+func (m *MemoryStore) PruneBefore(ctx context.Context, room string, cutoff time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgs := m.rooms[room]
+	ms := cutoff.UnixMilli()
+
+	var n int
+	for n < len(msgs) && msgs[n].Timestamp < ms {
+		delete(m.byID, msgs[n].ID)
+		n++
+	}
+	if n > 0 {
+		m.rooms[room] = append([]ChatMessage(nil), msgs[n:]...)
+	}
+
+	return int64(n), nil
+}
+
+func (m *MemoryStore) Clear(ctx context.Context, room string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgs := m.rooms[room]
+	for _, msg := range msgs {
+		delete(m.byID, msg.ID)
+	}
+	delete(m.rooms, room)
+
+	return int64(len(msgs)), nil
+}
+
+func (m *MemoryStore) Remove(ctx context.Context, room, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgs := m.rooms[room]
+	for i, msg := range msgs {
+		if msg.ID == id {
+			delete(m.byID, id)
+			m.rooms[room] = append(msgs[:i:i], msgs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) Get(ctx context.Context, id string) (ChatMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if msg, ok := m.byID[id]; ok {
+		return msg, nil
+	}
+
+	n, err := strconv.ParseInt(strings.TrimPrefix(id, m.idPrefix), 10, 64)
+	if err != nil || n <= 0 || n > m.lastID {
+		return ChatMessage{}, errMessageNotFound
+	}
+	return ChatMessage{}, errMessageGone
+}
+
+func (m *MemoryStore) Replies(ctx context.Context, id string) ([]ChatMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var replies []ChatMessage
+	for _, rid := range m.replies[id] {
+		if msg, ok := m.byID[rid]; ok {
+			replies = append(replies, msg)
+		}
+	}
+	return replies, nil
+}
+
+func (m *MemoryStore) ReplyCounts(ctx context.Context, ids []string) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := make([]int64, len(ids))
+	for i, id := range ids {
+		counts[i] = int64(len(m.replies[id]))
+	}
+	return counts, nil
+}
+
+func (m *MemoryStore) SetStatus(ctx context.Context, id, status string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.byID[id]
+	if !ok || !slices.Contains(statusesBefore(status), msg.Status) {
+		return false, nil
+	}
+	msg.Status = status
+	m.byID[id] = msg
+	for i := range m.rooms[msg.Room] {
+		if m.rooms[msg.Room][i].ID == id {
+			m.rooms[msg.Room][i].Status = status
+		}
+	}
+	return true, nil
+}
+
+func (m *MemoryStore) Rank(ctx context.Context, room, id string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, msg := range m.rooms[room] {
+		if msg.ID == id {
+			return int64(i), nil
+		}
+	}
+	return 0, errMessageNotFound
+}
+
+func (m *MemoryStore) NextSeq(ctx context.Context, room string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seqs[room]++
+	return m.seqs[room], nil
+}
+
+func (m *MemoryStore) CreateRoom(ctx context.Context, room string, fields map[string]string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.roomFields[room]; ok {
+		return false, nil
+	}
+	m.roomFields[room] = maps.Clone(fields)
+	return true, nil
+}
+
+func (m *MemoryStore) RoomFields(ctx context.Context, room string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return maps.Clone(m.roomFields[room]), nil
+}
+
+func (m *MemoryStore) SetRoomFields(ctx context.Context, room string, fields map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.roomFields[room] == nil {
+		m.roomFields[room] = make(map[string]string, len(fields))
+	}
+	maps.Copy(m.roomFields[room], fields)
+	return nil
+}
+
+func (m *MemoryStore) Rooms(ctx context.Context) (map[string]map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rooms := make(map[string]map[string]string, len(m.roomFields))
+	for name, fields := range m.roomFields {
+		rooms[name] = maps.Clone(fields)
+	}
+	return rooms, nil
+}
+
+func (m *MemoryStore) Lock(ctx context.Context, name, token string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if l, ok := m.locks[name]; ok && now.Before(l.expires) {
+		return false, nil
+	}
+	m.locks[name] = memoryLock{token: token, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *MemoryStore) Unlock(ctx context.Context, name, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.locks[name].token == token {
+		delete(m.locks, name)
+	}
+	return nil
+}
@@ -0,0 +1,526 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// messageSeq is the Redis counter message IDs are allocated from.
+func (ks keyspace) messageSeq() string {
+	return ks.key("chat_message_seq")
+}
+
+// message is the Redis hash holding the fields of message id.
+func (ks keyspace) message(id string) string {
+	return ks.key("msg:" + id)
+}
+
+// roomIndex is the Redis sorted set of the IDs of the messages of room,
+// ordered oldest first. Messages are scored by ID, except for migrated ones
+// that predate IDs.
+func (ks keyspace) roomIndex(room string) string {
+	return ks.key("room_index:" + room)
+}
+
+// replies is the Redis list of the IDs of the replies to message id.
+func (ks keyspace) replies(id string) string {
+	return ks.key("chat_replies:" + id)
+}
+
+// quarantine is the Redis hash from message ID to the raw fields of records
+// that could not be decoded, kept for someone to look at.
+func (ks keyspace) quarantine() string {
+	return ks.key("chat_quarantine")
+}
+
+// RedisStore keeps each message in its own Redis hash, addressable by ID,
+// and orders each room's history with a sorted set of IDs. All of its keys
+// start with prefix.
+type RedisStore struct {
+	rdb  *redis.Client
+	keys keyspace
+}
+
+func NewRedisStore(rdb *redis.Client, prefix string) *RedisStore {
+	return &RedisStore{rdb: rdb, keys: keyspace{prefix: prefix}}
+}
+
+// messageFields flattens msg into the fields of its hash.
+func messageFields(msg *ChatMessage) map[string]interface{} {
+	fields := map[string]interface{}{
+		"schema":   schemaVersion,
+		"id":       msg.ID,
+		"room":     msg.Room,
+		"username": msg.Username,
+		"text":     msg.Text,
+		"ts":       msg.Timestamp,
+		"size":     messageSize(msg),
+	}
+	if msg.ReplyTo != "" {
+		fields["reply_to"] = msg.ReplyTo
+	}
+	if msg.ParentDeleted {
+		fields["parent_deleted"] = "1"
+	}
+	if msg.DisplayName != "" {
+		fields["display_name"] = msg.DisplayName
+	}
+	if msg.AvatarURL != "" {
+		fields["avatar_url"] = msg.AvatarURL
+	}
+	if msg.ExpiresAt != 0 {
+		fields["expires_at"] = msg.ExpiresAt
+	}
+	if msg.Seq != 0 {
+		fields["seq"] = msg.Seq
+	}
+	if msg.Bot {
+		fields["bot"] = "1"
+	}
+	if msg.Attachment != nil {
+		data, _ := json.Marshal(msg.Attachment)
+		fields["attachment"] = string(data)
+	}
+	if msg.To != "" {
+		fields["to"] = msg.To
+		fields["status"] = msg.Status
+	}
+	return fields
+}
+
+// errCorruptRecord is returned by parseMessageFields for hashes that were not
+// written by messageFields.
+var errCorruptRecord = errors.New("corrupt message record")
+
+// parseMessageFields is the inverse of messageFields. It refuses records
+// missing the fields every message has, rather than passing them on blank.
+func parseMessageFields(fields map[string]string) (ChatMessage, error) {
+	if fields["id"] == "" {
+		return ChatMessage{}, errCorruptRecord
+	}
+	for _, f := range [...]string{"username", "text"} {
+		if _, ok := fields[f]; !ok {
+			return ChatMessage{}, errCorruptRecord
+		}
+	}
+	ts, err := strconv.ParseInt(fields["ts"], 10, 64)
+	if err != nil {
+		return ChatMessage{}, errCorruptRecord
+	}
+
+	msg := ChatMessage{
+		ID:            fields["id"],
+		Room:          fields["room"],
+		Username:      fields["username"],
+		Text:          fields["text"],
+		ReplyTo:       fields["reply_to"],
+		ParentDeleted: fields["parent_deleted"] == "1",
+		Bot:           fields["bot"] == "1",
+		DisplayName:   fields["display_name"],
+		AvatarURL:     fields["avatar_url"],
+		Timestamp:     ts,
+		To:            fields["to"],
+		Status:        fields["status"],
+	}
+	msg.ExpiresAt, _ = strconv.ParseInt(fields["expires_at"], 10, 64)
+	msg.Seq, _ = strconv.ParseInt(fields["seq"], 10, 64)
+	if data := fields["attachment"]; data != "" {
+		msg.Attachment = new(Attachment)
+		if err := json.Unmarshal([]byte(data), msg.Attachment); err != nil {
+			return ChatMessage{}, errCorruptRecord
+		}
+	}
+	return msg, nil
+}
+
+// quarantine moves the undecodable record id out of the history, so that it
+// is neither delivered blank nor reported again on every read.
+func (rs *RedisStore) quarantine(ctx context.Context, id string, fields map[string]string, err error) {
+	slog.Warn("skipping corrupt message", "id", id, "fields", fields, "err", err)
+
+	raw, _ := json.Marshal(fields)
+	_, qerr := rs.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, rs.keys.quarantine(), id, raw)
+		if room := fields["room"]; room != "" {
+			keys := []string{rs.keys.roomIndex(room), rs.keys.roomBytes(room), rs.keys.message(id), rs.keys.replies(id)}
+			removeFromIndex.Eval(ctx, pipe, keys, id)
+		} else {
+			pipe.Del(ctx, rs.keys.message(id), rs.keys.replies(id))
+		}
+		return nil
+	})
+	if qerr != nil {
+		slog.Warn("failed to quarantine message", "id", id, "err", qerr)
+	}
+}
+
+// writeMessage queues the writes storing msg in room at position score. They
+// are idempotent, so that the migration can safely redo them.
+func (rs *RedisStore) writeMessage(ctx context.Context, pipe redis.Pipeliner, room string, msg *ChatMessage, score float64) {
+	pipe.HSet(ctx, rs.keys.message(msg.ID), messageFields(msg))
+	addToIndex.Eval(ctx, pipe, []string{rs.keys.roomIndex(room), rs.keys.roomBytes(room)}, score, msg.ID, messageSize(msg))
+	if msg.ReplyTo != "" {
+		pipe.LRem(ctx, rs.keys.replies(msg.ReplyTo), 0, msg.ID)
+		pipe.RPush(ctx, rs.keys.replies(msg.ReplyTo), msg.ID)
+	}
+}
+
+func (rs *RedisStore) Append(ctx context.Context, room string, msg *ChatMessage) error {
+	id, err := rs.rdb.Incr(ctx, rs.keys.messageSeq()).Result()
+	if err != nil {
+		return err
+	}
+	msg.ID = strconv.FormatInt(id, 10)
+	msg.Room = room
+
+	_, err = rs.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		rs.writeMessage(ctx, pipe, room, msg, float64(id))
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) NextID(ctx context.Context) (string, error) {
+	id, err := rs.rdb.Incr(ctx, rs.keys.messageSeq()).Result()
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (rs *RedisStore) WriteBatch(ctx context.Context, msgs []ChatMessage) error {
+	_, err := rs.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := range msgs {
+			id, _ := strconv.ParseInt(msgs[i].ID, 10, 64)
+			rs.writeMessage(ctx, pipe, msgs[i].Room, &msgs[i], float64(id))
+		}
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStore) Recent(ctx context.Context, room string, limit int64) ([]ChatMessage, error) {
+	start := int64(0)
+	if limit > 0 {
+		start = -limit
+	}
+	return rs.Range(ctx, room, start, -1)
+}
+
+func (rs *RedisStore) Range(ctx context.Context, room string, start, stop int64) ([]ChatMessage, error) {
+	ids, err := rs.rdb.ZRange(ctx, rs.keys.roomIndex(room), start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	return rs.load(ctx, ids)
+}
+
+// load fetches the messages with the given IDs in one round trip, skipping
+// any that were removed in the meantime and quarantining corrupt ones.
+func (rs *RedisStore) load(ctx context.Context, ids []string) ([]ChatMessage, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	cmds, err := rs.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			pipe.HGetAll(ctx, rs.keys.message(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]ChatMessage, 0, len(cmds))
+	for i, cmd := range cmds {
+		fields := cmd.(*redis.MapStringStringCmd).Val()
+		if len(fields) == 0 {
+			continue
+		}
+		msg, err := parseMessageFields(fields)
+		if err != nil {
+			rs.quarantine(ctx, ids[i], fields, err)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (rs *RedisStore) Exists(ctx context.Context, room string) (bool, error) {
+	n, err := rs.rdb.Exists(ctx, rs.keys.roomIndex(room)).Result()
+	return n != 0, err
+}
+
+func (rs *RedisStore) Len(ctx context.Context, room string) (int64, error) {
+	return rs.rdb.ZCard(ctx, rs.keys.roomIndex(room)).Result()
+}
+
+// Trim drops the oldest messages of room beyond limit.
+func (rs *RedisStore) Trim(ctx context.Context, room string, limit int64) error {
+	key := rs.keys.roomIndex(room)
+
+	ids, err := rs.rdb.ZRange(ctx, key, 0, -limit-1).Result()
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	return rs.remove(ctx, room, ids)
+}
+
+// remove deletes the messages with the given IDs from room. Removing by ID
+// rather than by rank keeps concurrent trims and prunes from dropping more
+// than they meant to.
+func (rs *RedisStore) remove(ctx context.Context, room string, ids []string) error {
+	members := make([]interface{}, len(ids))
+	keys := []string{rs.keys.roomIndex(room), rs.keys.roomBytes(room)}
+	for i, id := range ids {
+		members[i] = id
+		keys = append(keys, rs.keys.message(id), rs.keys.replies(id))
+	}
+
+	return removeFromIndex.Run(ctx, rs.rdb, keys, members...).Err()
+}
+
+// pruneBatch is the number of messages PruneBefore inspects per round trip.
+const pruneBatch = 500
+
+func (rs *RedisStore) PruneBefore(ctx context.Context, room string, cutoff time.Time) (int64, error) {
+	ms := cutoff.UnixMilli()
+
+	var total int64
+	for {
+		ids, err := rs.rdb.ZRange(ctx, rs.keys.roomIndex(room), 0, pruneBatch-1).Result()
+		if err != nil || len(ids) == 0 {
+			return total, err
+		}
+
+		cmds, err := rs.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, id := range ids {
+				pipe.HGet(ctx, rs.keys.message(id), "ts")
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return total, err
+		}
+
+		// the history is in arrival order, so stop at the first message
+		// that is recent enough
+		var expired []string
+		for i, cmd := range cmds {
+			ts, _ := cmd.(*redis.StringCmd).Int64()
+			if ts >= ms {
+				break
+			}
+			expired = append(expired, ids[i])
+		}
+		if len(expired) == 0 {
+			return total, nil
+		}
+
+		if err := rs.remove(ctx, room, expired); err != nil {
+			return total, err
+		}
+		total += int64(len(expired))
+
+		if len(expired) < len(ids) {
+			return total, nil
+		}
+	}
+}
+
+func (rs *RedisStore) Clear(ctx context.Context, room string) (int64, error) {
+	var total int64
+	for {
+		ids, err := rs.rdb.ZRange(ctx, rs.keys.roomIndex(room), 0, pruneBatch-1).Result()
+		if err != nil || len(ids) == 0 {
+			return total, err
+		}
+		if err := rs.remove(ctx, room, ids); err != nil {
+			return total, err
+		}
+		total += int64(len(ids))
+	}
+}
+
+func (rs *RedisStore) Remove(ctx context.Context, room, id string) error {
+	return rs.remove(ctx, room, []string{id})
+}
+
+func (rs *RedisStore) Get(ctx context.Context, id string) (ChatMessage, error) {
+	fields, err := rs.rdb.HGetAll(ctx, rs.keys.message(id)).Result()
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	if len(fields) == 0 {
+		return ChatMessage{}, rs.missing(ctx, id)
+	}
+
+	msg, err := parseMessageFields(fields)
+	if err != nil {
+		rs.quarantine(ctx, id, fields, err)
+		return ChatMessage{}, errMessageGone
+	}
+	return msg, nil
+}
+
+// missing tells apart IDs that were never allocated from removed messages.
+func (rs *RedisStore) missing(ctx context.Context, id string) error {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n <= 0 {
+		return errMessageNotFound
+	}
+
+	last, err := rs.rdb.Get(ctx, rs.keys.messageSeq()).Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if n > last {
+		return errMessageNotFound
+	}
+	return errMessageGone
+}
+
+// Replies skips replies that left the history.
+func (rs *RedisStore) Replies(ctx context.Context, id string) ([]ChatMessage, error) {
+	ids, err := rs.rdb.LRange(ctx, rs.keys.replies(id), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return rs.load(ctx, ids)
+}
+
+func (rs *RedisStore) ReplyCounts(ctx context.Context, ids []string) ([]int64, error) {
+	cmds, err := rs.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			pipe.LLen(ctx, rs.keys.replies(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]int64, len(cmds))
+	for i, cmd := range cmds {
+		counts[i] = cmd.(*redis.IntCmd).Val()
+	}
+	return counts, nil
+}
+
+// raiseStatus sets the status field of the message hash KEYS[1] to ARGV[1]
+// if it holds one of the statuses ARGV[2:], which come before it.
+var raiseStatus = redis.NewScript(`
+local cur = redis.call("HGET", KEYS[1], "status")
+for i = 2, #ARGV do
+	if cur == ARGV[i] then
+		redis.call("HSET", KEYS[1], "status", ARGV[1])
+		return 1
+	end
+end
+return 0
+`)
+
+func (rs *RedisStore) SetStatus(ctx context.Context, id, status string) (bool, error) {
+	args := []interface{}{status}
+	for _, s := range statusesBefore(status) {
+		args = append(args, s)
+	}
+	moved, err := raiseStatus.Run(ctx, rs.rdb, []string{rs.keys.message(id)}, args...).Int()
+	return moved == 1, err
+}
+
+func (rs *RedisStore) Rank(ctx context.Context, room, id string) (int64, error) {
+	n, err := rs.rdb.ZRank(ctx, rs.keys.roomIndex(room), id).Result()
+	if err == redis.Nil {
+		return 0, errMessageNotFound
+	}
+	return n, err
+}
+
+// lock is the Redis key of the lock name.
+func (ks keyspace) lock(name string) string {
+	return ks.key(name + "_lock")
+}
+
+// insertRoom creates the hash KEYS[1] of a room from the field-value pairs
+// ARGV[2:] and adds the room ARGV[1] to the set KEYS[2], unless the hash has
+// a created_at already. Nothing of a room is thus seen before all of it is
+// written.
+var insertRoom = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], "created_at") == 1 then
+	return 0
+end
+redis.call("HSET", KEYS[1], unpack(ARGV, 2))
+redis.call("SADD", KEYS[2], ARGV[1])
+return 1
+`)
+
+// releaseLock deletes a lock only if it still holds our token, so that an
+// instance whose lock expired can't release another instance's.
+var releaseLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func (rs *RedisStore) NextSeq(ctx context.Context, room string) (int64, error) {
+	return rs.rdb.Incr(ctx, rs.keys.roomSeq(room)).Result()
+}
+
+func (rs *RedisStore) CreateRoom(ctx context.Context, room string, fields map[string]string) (bool, error) {
+	args := []interface{}{room}
+	for k, v := range fields {
+		args = append(args, k, v)
+	}
+	created, err := insertRoom.Run(ctx, rs.rdb, []string{rs.keys.room(room), rs.keys.rooms()}, args...).Int()
+	return created == 1, err
+}
+
+func (rs *RedisStore) RoomFields(ctx context.Context, room string) (map[string]string, error) {
+	return rs.rdb.HGetAll(ctx, rs.keys.room(room)).Result()
+}
+
+func (rs *RedisStore) SetRoomFields(ctx context.Context, room string, fields map[string]string) error {
+	return rs.rdb.HSet(ctx, rs.keys.room(room), fields).Err()
+}
+
+func (rs *RedisStore) Rooms(ctx context.Context) (map[string]map[string]string, error) {
+	names, err := rs.rdb.SMembers(ctx, rs.keys.rooms()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	cmds, err := rs.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, name := range names {
+			pipe.HGetAll(ctx, rs.keys.room(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := make(map[string]map[string]string, len(names))
+	for i, name := range names {
+		rooms[name] = cmds[i].(*redis.MapStringStringCmd).Val()
+	}
+	return rooms, nil
+}
+
+func (rs *RedisStore) Lock(ctx context.Context, name, token string, ttl time.Duration) (bool, error) {
+	return rs.rdb.SetNX(ctx, rs.keys.lock(name), token, ttl).Result()
+}
+
+func (rs *RedisStore) Unlock(ctx context.Context, name, token string) error {
+	return releaseLock.Run(ctx, rs.rdb, []string{rs.keys.lock(name)}, token).Err()
+}
@@ -0,0 +1,182 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestParseMessageFields(t *testing.T) {
+	valid := func() map[string]string {
+		return map[string]string{"id": "7", "room": "general", "username": "ann", "text": "hi", "ts": "1700000000000", "seq": "3"}
+	}
+
+	tests := []struct {
+		name    string
+		edit    func(map[string]string)
+		wantErr bool
+	}{
+		{"valid", func(map[string]string) {}, false},
+		{"empty text", func(f map[string]string) { f["text"] = "" }, false},
+		{"attachment", func(f map[string]string) { f["attachment"] = `{"url":"https://example.com/a.png"}` }, false},
+		{"no id", func(f map[string]string) { delete(f, "id") }, true},
+		{"no username", func(f map[string]string) { delete(f, "username") }, true},
+		{"no text", func(f map[string]string) { delete(f, "text") }, true},
+		{"bad timestamp", func(f map[string]string) { f["ts"] = "yesterday" }, true},
+		{"bad attachment", func(f map[string]string) { f["attachment"] = "{" }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := valid()
+			tt.edit(fields)
+			msg, err := parseMessageFields(fields)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMessageFields error = %v, want an error %v", err, tt.wantErr)
+			}
+			if err == nil && (msg.ID != "7" || msg.Username != "ann" || msg.Seq != 3) {
+				t.Errorf("parseMessageFields = %+v", msg)
+			}
+		})
+	}
+}
+
+// TestRedisStoreQuarantine checks that a corrupt record is skipped, moved to
+// the quarantine, and out of the history.
+func TestRedisStoreQuarantine(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	store := NewRedisStore(rdb, "test:")
+
+	msgs := appendTexts(t, store, "general", "one", "two", "three")
+	corrupt := msgs[1].ID
+	if err := rdb.HDel(ctx, store.keys.message(corrupt), "username").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		got, err := store.Recent(ctx, "general", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(texts(got), ",") != "one,three" {
+			t.Errorf("read %d: history %q, want one,three", i, texts(got))
+		}
+	}
+	if _, err := store.Get(ctx, corrupt); err != errMessageGone {
+		t.Errorf("Get of the corrupt record = %v, want errMessageGone", err)
+	}
+
+	raw, err := rdb.HGet(ctx, store.keys.quarantine(), corrupt).Result()
+	if err != nil {
+		t.Fatalf("record not quarantined: %v", err)
+	}
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil || fields["text"] != "two" {
+		t.Errorf("quarantined %s, want the raw record", raw)
+	}
+	if mr.Exists(store.keys.message(corrupt)) {
+		t.Error("corrupt record left in place")
+	}
+}
+
+// TestCorruptRecordNotReplayed checks that clients aren't sent a corrupt
+// record as a blank message.
+func TestCorruptRecordNotReplayed(t *testing.T) {
+	s, _ := newTestServer(t)
+	msgs := appendTexts(t, s.store, "general", "one", "two", "three")
+	if err := s.rdb.HSet(context.Background(), s.keys.message(msgs[1].ID), "ts", "soon").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	ws := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	var got []ChatMessage
+	for len(got) == 0 || got[len(got)-1].Text != "three" {
+		got = append(got, readFrameOf(t, ws, messageTypeChat, nil))
+	}
+	if strings.Join(texts(got), ",") != "one,three" {
+		t.Errorf("replayed %q, want one,three", texts(got))
+	}
+}
+
+// TestRedisStoreRemovesReplies checks that the list of the replies to a
+// message goes when the message does.
+func TestRedisStoreRemovesReplies(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	store := NewRedisStore(rdb, "test:")
+
+	msgs := appendTexts(t, store, "general", "one", "two")
+	reply := ChatMessage{Username: "bob", Text: "re: one", ReplyTo: msgs[0].ID}
+	if err := store.Append(ctx, "general", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if !mr.Exists(store.keys.replies(msgs[0].ID)) {
+		t.Fatal("reply not listed")
+	}
+
+	if err := store.Trim(ctx, "general", 2); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(store.keys.replies(msgs[0].ID)) {
+		t.Error("replies of a trimmed message left behind")
+	}
+}
+
+// BenchmarkReplay compares replaying the last 200 messages of a room from
+// the sorted set index and the message hashes to replaying them from the
+// list of JSON records RedisStore kept before version 2.
+func BenchmarkReplay(b *testing.B) {
+	const history, replay = 1000, 200
+
+	ctx := context.Background()
+	mr := miniredis.RunT(b)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	store := NewRedisStore(rdb, "test:")
+
+	for i := 0; i < history; i++ {
+		msg := ChatMessage{Username: "ann", Text: fmt.Sprintf("message %d", i), Timestamp: time.Now().UnixMilli()}
+		if err := store.Append(ctx, "general", &msg); err != nil {
+			b.Fatal(err)
+		}
+		data, err := json.Marshal(legacyRecord{Schema: 1, ChatMessage: msg})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := rdb.RPush(ctx, store.keys.legacyHistory("legacy"), data).Err(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			msgs, err := store.Recent(ctx, "general", replay)
+			if err != nil || len(msgs) != replay {
+				b.Fatalf("replayed %d messages: %v", len(msgs), err)
+			}
+		}
+	})
+	b.Run("list", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			records, err := rdb.LRange(ctx, store.keys.legacyHistory("legacy"), -replay, -1).Result()
+			if err != nil {
+				b.Fatal(err)
+			}
+			msgs := make([]ChatMessage, len(records))
+			for j, record := range records {
+				var rec legacyRecord
+				if err := json.Unmarshal([]byte(record), &rec); err != nil {
+					b.Fatal(err)
+				}
+				msgs[j] = rec.ChatMessage
+			}
+		}
+	})
+}
@@ -0,0 +1,546 @@
+package chat
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrations holds the schema of each SQL dialect, one numbered file per
+// version.
+//
+//go:embed migrations
+var migrations embed.FS
+
+// sqlDialect is what differs between the databases SQLStore supports.
+type sqlDialect struct {
+	// name is the directory of the dialect's migrations.
+	name string
+
+	// driver is the database/sql driver, only linked into binaries built
+	// with the tag of the same name as the dialect.
+	driver string
+
+	// numbered is set for the dialects taking $1-style placeholders.
+	numbered bool
+}
+
+var (
+	sqliteDialect   = sqlDialect{name: "sqlite", driver: "sqlite"}
+	postgresDialect = sqlDialect{name: "postgres", driver: "pgx", numbered: true}
+)
+
+// rebind rewrites the ? placeholders of query for the dialect.
+func (d sqlDialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// sqlColumns are the columns scanMessage reads, in order.
+const sqlColumns = `id, room, username, text, created_at, reply_to, parent_deleted, display_name, avatar_url, expires_at, seq, bot, attachment, recipient, status`
+
+// SQLStore keeps history in a SQL database: SQLite for single-instance
+// deployments, or Postgres. Messages leaving the history are only marked
+// deleted, with their content blanked, so that their IDs are never handed
+// out again and lookups can tell them from IDs that never existed.
+type SQLStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+
+	insert, page, count, exists, get, replies, replyCount, rank, nextSeq *sql.Stmt
+}
+
+// OpenSQLiteStore opens, creating it when needed, the database at path in
+// WAL mode, which lets readers proceed while a message is written.
+func OpenSQLiteStore(path string) (*SQLStore, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)"
+	return openSQLStore(sqliteDialect, dsn)
+}
+
+// OpenPostgresStore connects to the Postgres database at url.
+func OpenPostgresStore(url string) (*SQLStore, error) {
+	return openSQLStore(postgresDialect, url)
+}
+
+func openSQLStore(d sqlDialect, dsn string) (*SQLStore, error) {
+	if !slices.Contains(sql.Drivers(), d.driver) {
+		return nil, fmt.Errorf("HISTORY_BACKEND=%s requires a binary built with -tags %s", d.name, d.name)
+	}
+
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	st := &SQLStore{db: db, dialect: d}
+	if err := st.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	for _, p := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&st.insert, `INSERT INTO messages (room, username, text, created_at, reply_to, parent_deleted, display_name, avatar_url, expires_at, seq, bot, attachment, recipient, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`},
+		{&st.page, `SELECT ` + sqlColumns + ` FROM messages WHERE room = ? AND NOT deleted ORDER BY id LIMIT ? OFFSET ?`},
+		{&st.count, `SELECT COUNT(*) FROM messages WHERE room = ? AND NOT deleted`},
+		{&st.exists, `SELECT EXISTS (SELECT 1 FROM messages WHERE room = ? AND NOT deleted)`},
+		{&st.get, `SELECT ` + sqlColumns + `, deleted FROM messages WHERE id = ?`},
+		{&st.replies, `SELECT ` + sqlColumns + ` FROM messages WHERE reply_to = ? AND NOT deleted ORDER BY id`},
+		{&st.replyCount, `SELECT COUNT(*) FROM messages WHERE reply_to = ?`},
+		{&st.rank, `SELECT COUNT(*) FROM messages WHERE room = ? AND NOT deleted AND id < ?`},
+		{&st.nextSeq, `INSERT INTO room_seqs (room, seq) VALUES (?, 1) ON CONFLICT (room) DO UPDATE SET seq = room_seqs.seq + 1 RETURNING seq`},
+	} {
+		if *p.stmt, err = db.Prepare(d.rebind(p.query)); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// migrationLockID is the Postgres advisory lock held while migrating.
+const migrationLockID = 0x63686174
+
+// migrate applies the migrations of the dialect the database hasn't seen
+// yet. Instances starting together take turns: on Postgres they migrate
+// under an advisory lock, each migration in its own transaction, and on
+// SQLite in a single transaction begun IMMEDIATE, which takes the write lock
+// before reading the current version.
+func (st *SQLStore) migrate(ctx context.Context) error {
+	conn, err := st.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if st.dialect == postgresDialect {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+			return err
+		}
+		// the lock outlives the migrations if the connection goes back to
+		// the pool holding it
+		defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+		return st.applyMigrations(ctx, conn, true)
+	}
+
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		return err
+	}
+	if err := st.applyMigrations(ctx, conn, false); err != nil {
+		conn.ExecContext(context.Background(), `ROLLBACK`)
+		return err
+	}
+	_, err = conn.ExecContext(ctx, `COMMIT`)
+	return err
+}
+
+// applyMigrations applies the migrations newer than the current version
+// through conn, each in a transaction of its own when txEach is set.
+func (st *SQLStore) applyMigrations(ctx context.Context, conn *sql.Conn, txEach bool) error {
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var current int
+	if err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+
+	dir := path.Join("migrations", st.dialect.name)
+	files, err := fs.ReadDir(migrations, dir)
+	if err != nil {
+		return err
+	}
+	// ReadDir sorts by name, so by version
+	for _, f := range files {
+		prefix, _, _ := strings.Cut(f.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return fmt.Errorf("migration %s: no version number", f.Name())
+		}
+		if version <= current {
+			continue
+		}
+
+		schema, err := migrations.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			return err
+		}
+		if !txEach {
+			if err := st.applyMigration(ctx, conn, f.Name(), string(schema), version); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := st.applyMigration(ctx, tx, f.Name(), string(schema), version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlExecer is what sql.Conn and sql.Tx have in common for applyMigration.
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// applyMigration runs the migration name, with schema, and records version.
+func (st *SQLStore) applyMigration(ctx context.Context, db sqlExecer, name, schema string, version int) error {
+	if _, err := db.ExecContext(ctx, schema); err != nil {
+		return fmt.Errorf("migration %s: %w", name, err)
+	}
+	_, err := db.ExecContext(ctx, st.dialect.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version)
+	return err
+}
+
+func (st *SQLStore) Close() error {
+	return st.db.Close()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMessage reads the sqlColumns of a row, followed by extra.
+func scanMessage(row rowScanner, extra ...interface{}) (ChatMessage, error) {
+	var (
+		msg        ChatMessage
+		id         int64
+		attachment string
+	)
+	dest := append([]interface{}{&id, &msg.Room, &msg.Username, &msg.Text, &msg.Timestamp,
+		&msg.ReplyTo, &msg.ParentDeleted, &msg.DisplayName, &msg.AvatarURL, &msg.ExpiresAt, &msg.Seq, &msg.Bot, &attachment,
+		&msg.To, &msg.Status}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return ChatMessage{}, err
+	}
+	msg.ID = strconv.FormatInt(id, 10)
+	if attachment != "" {
+		msg.Attachment = new(Attachment)
+		if err := json.Unmarshal([]byte(attachment), msg.Attachment); err != nil {
+			return ChatMessage{}, fmt.Errorf("message %d: %w", id, err)
+		}
+	}
+	return msg, nil
+}
+
+// query runs stmt and reads the messages it returns.
+func (st *SQLStore) query(ctx context.Context, stmt *sql.Stmt, args ...interface{}) ([]ChatMessage, error) {
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []ChatMessage
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func (st *SQLStore) Append(ctx context.Context, room string, msg *ChatMessage) error {
+	// stored as JSON, which the attachment is small enough for
+	var attachment string
+	if msg.Attachment != nil {
+		data, err := json.Marshal(msg.Attachment)
+		if err != nil {
+			return err
+		}
+		attachment = string(data)
+	}
+
+	var id int64
+	err := st.insert.QueryRowContext(ctx, room, msg.Username, msg.Text, msg.Timestamp,
+		msg.ReplyTo, msg.ParentDeleted, msg.DisplayName, msg.AvatarURL, msg.ExpiresAt, msg.Seq, msg.Bot, attachment, msg.To, msg.Status).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	msg.ID = strconv.FormatInt(id, 10)
+	msg.Room = room
+	return nil
+}
+
+func (st *SQLStore) Recent(ctx context.Context, room string, limit int64) ([]ChatMessage, error) {
+	start := int64(0)
+	if limit > 0 {
+		start = -limit
+	}
+	return st.Range(ctx, room, start, -1)
+}
+
+func (st *SQLStore) Range(ctx context.Context, room string, start, stop int64) ([]ChatMessage, error) {
+	// negative indexes count from the end, as with LRANGE
+	if start < 0 || stop < 0 {
+		n, err := st.Len(ctx, room)
+		if err != nil {
+			return nil, err
+		}
+		if start < 0 {
+			start += n
+		}
+		if stop < 0 {
+			stop += n
+		}
+	}
+	start = max(start, 0)
+	if start > stop {
+		return nil, nil
+	}
+	return st.query(ctx, st.page, room, stop-start+1, start)
+}
+
+func (st *SQLStore) Exists(ctx context.Context, room string) (bool, error) {
+	var ok bool
+	err := st.exists.QueryRowContext(ctx, room).Scan(&ok)
+	return ok, err
+}
+
+func (st *SQLStore) Len(ctx context.Context, room string) (int64, error) {
+	var n int64
+	err := st.count.QueryRowContext(ctx, room).Scan(&n)
+	return n, err
+}
+
+// remove marks the messages of room matching cond as deleted.
+func (st *SQLStore) remove(ctx context.Context, room, cond string, args ...interface{}) (int64, error) {
+	query := `UPDATE messages SET deleted = TRUE, username = '', text = '', display_name = '', avatar_url = '', attachment = ''
+		WHERE room = ? AND NOT deleted`
+	if cond != "" {
+		query += " AND " + cond
+	}
+
+	res, err := st.db.ExecContext(ctx, st.dialect.rebind(query), append([]interface{}{room}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (st *SQLStore) Trim(ctx context.Context, room string, limit int64) error {
+	_, err := st.remove(ctx, room, `id <= (SELECT id FROM messages WHERE room = ? AND NOT deleted ORDER BY id DESC LIMIT 1 OFFSET ?)`, room, limit)
+	return err
+}
+
+func (st *SQLStore) PruneBefore(ctx context.Context, room string, cutoff time.Time) (int64, error) {
+	return st.remove(ctx, room, `created_at < ?`, cutoff.UnixMilli())
+}
+
+func (st *SQLStore) Clear(ctx context.Context, room string) (int64, error) {
+	return st.remove(ctx, room, "")
+}
+
+func (st *SQLStore) Remove(ctx context.Context, room, id string) error {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil
+	}
+	_, err = st.remove(ctx, room, `id = ?`, n)
+	return err
+}
+
+func (st *SQLStore) Get(ctx context.Context, id string) (ChatMessage, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n <= 0 {
+		return ChatMessage{}, errMessageNotFound
+	}
+
+	var deleted bool
+	msg, err := scanMessage(st.get.QueryRowContext(ctx, n), &deleted)
+	switch {
+	case err == sql.ErrNoRows:
+		return ChatMessage{}, errMessageNotFound
+	case err != nil:
+		return ChatMessage{}, err
+	case deleted:
+		return ChatMessage{}, errMessageGone
+	}
+	return msg, nil
+}
+
+// Replies skips replies that left the history.
+func (st *SQLStore) Replies(ctx context.Context, id string) ([]ChatMessage, error) {
+	return st.query(ctx, st.replies, id)
+}
+
+// ReplyCounts counts the replies that left the history too, like the other
+// stores.
+func (st *SQLStore) ReplyCounts(ctx context.Context, ids []string) ([]int64, error) {
+	counts := make([]int64, len(ids))
+	for i, id := range ids {
+		if err := st.replyCount.QueryRowContext(ctx, id).Scan(&counts[i]); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+func (st *SQLStore) SetStatus(ctx context.Context, id, status string) (bool, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	before := statusesBefore(status)
+	if err != nil || len(before) == 0 {
+		return false, nil
+	}
+
+	args := []interface{}{status, n}
+	for _, s := range before {
+		args = append(args, s)
+	}
+	query := `UPDATE messages SET status = ? WHERE id = ? AND NOT deleted AND status IN (?` + strings.Repeat(", ?", len(before)-1) + `)`
+	res, err := st.db.ExecContext(ctx, st.dialect.rebind(query), args...)
+	if err != nil {
+		return false, err
+	}
+	moved, err := res.RowsAffected()
+	return moved == 1, err
+}
+
+func (st *SQLStore) Rank(ctx context.Context, room, id string) (int64, error) {
+	msg, err := st.Get(ctx, id)
+	if err == errMessageGone || err == nil && msg.Room != room {
+		return 0, errMessageNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n, _ := strconv.ParseInt(msg.ID, 10, 64)
+	var rank int64
+	err = st.rank.QueryRowContext(ctx, room, n).Scan(&rank)
+	return rank, err
+}
+
+func (st *SQLStore) NextSeq(ctx context.Context, room string) (int64, error) {
+	var seq int64
+	err := st.nextSeq.QueryRowContext(ctx, room).Scan(&seq)
+	return seq, err
+}
+
+// setRoomFields upserts fields of room within tx.
+func (st *SQLStore) setRoomFields(ctx context.Context, tx *sql.Tx, room string, fields map[string]string) error {
+	query := st.dialect.rebind(`INSERT INTO room_fields (room, field, value) VALUES (?, ?, ?)
+		ON CONFLICT (room, field) DO UPDATE SET value = excluded.value`)
+	for field, value := range fields {
+		if _, err := tx.ExecContext(ctx, query, room, field, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *SQLStore) CreateRoom(ctx context.Context, room string, fields map[string]string) (bool, error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, st.dialect.rebind(`INSERT INTO rooms (name) VALUES (?) ON CONFLICT (name) DO NOTHING`), room)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if err := st.setRoomFields(ctx, tx, room, fields); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (st *SQLStore) RoomFields(ctx context.Context, room string) (map[string]string, error) {
+	rooms, err := st.roomFields(ctx, `WHERE room = ?`, room)
+	return rooms[room], err
+}
+
+func (st *SQLStore) SetRoomFields(ctx context.Context, room string, fields map[string]string) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := st.setRoomFields(ctx, tx, room, fields); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (st *SQLStore) Rooms(ctx context.Context) (map[string]map[string]string, error) {
+	return st.roomFields(ctx, "")
+}
+
+// roomFields reads the fields of the rooms matching cond.
+func (st *SQLStore) roomFields(ctx context.Context, cond string, args ...interface{}) (map[string]map[string]string, error) {
+	rows, err := st.db.QueryContext(ctx, st.dialect.rebind(`SELECT room, field, value FROM room_fields `+cond), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := make(map[string]map[string]string)
+	for rows.Next() {
+		var room, field, value string
+		if err := rows.Scan(&room, &field, &value); err != nil {
+			return nil, err
+		}
+		if rooms[room] == nil {
+			rooms[room] = make(map[string]string)
+		}
+		rooms[room][field] = value
+	}
+	return rooms, rows.Err()
+}
+
+// Lock takes over the lock once it expired.
+func (st *SQLStore) Lock(ctx context.Context, name, token string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := st.db.ExecContext(ctx, st.dialect.rebind(`INSERT INTO locks (name, token, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET token = excluded.token, expires_at = excluded.expires_at
+		WHERE locks.expires_at <= ?`), name, token, now.Add(ttl).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (st *SQLStore) Unlock(ctx context.Context, name, token string) error {
+	_, err := st.db.ExecContext(ctx, st.dialect.rebind(`DELETE FROM locks WHERE name = ? AND token = ?`), name, token)
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !sqlite
+
+package chat
+
+import "testing"
+
+// sqlTestStores are the SQL stores the store tests run against, none without
+// the sqlite tag.
+func sqlTestStores(t *testing.T) map[string]func() MessageStore {
+	return nil
+}
@@ -0,0 +1,63 @@
+//go:build sqlite
+
+package chat
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// sqlTestStores are the SQL stores the store tests run against.
+func sqlTestStores(t *testing.T) map[string]func() MessageStore {
+	return map[string]func() MessageStore{
+		"sqlite": func() MessageStore {
+			st, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "chat.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { st.Close() })
+			return st
+		},
+	}
+}
+
+// TestMigrateConcurrently checks that instances opening a fresh database
+// together apply each migration once.
+func TestMigrateConcurrently(t *testing.T) {
+	const instances = 8
+
+	path := filepath.Join(t.TempDir(), "chat.db")
+
+	var wg sync.WaitGroup
+	errs := make([]error, instances)
+	stores := make([]*SQLStore, instances)
+	for i := range stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stores[i], errs[i] = OpenSQLiteStore(path)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("instance %d: %v", i, err)
+		}
+		t.Cleanup(func() { stores[i].Close() })
+	}
+
+	files, err := fs.ReadDir(migrations, "migrations/sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied, versions int
+	if err := stores[0].db.QueryRow(`SELECT COUNT(*), COUNT(DISTINCT version) FROM schema_migrations`).Scan(&applied, &versions); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(files) || versions != len(files) {
+		t.Errorf("recorded %d migrations, %d distinct, want %d", applied, versions, len(files))
+	}
+}
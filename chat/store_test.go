@@ -0,0 +1,246 @@
+package chat
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// testStores are the stores every store test runs against, built afresh for
+// each test.
+func testStores(t *testing.T) map[string]func() MessageStore {
+	t.Helper()
+
+	stores := map[string]func() MessageStore{
+		"memory": func() MessageStore { return NewMemoryStore() },
+		"redis": func() MessageStore {
+			mr := miniredis.RunT(t)
+			return NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test:")
+		},
+	}
+	maps.Copy(stores, sqlTestStores(t))
+	return stores
+}
+
+func TestStoreNextSeq(t *testing.T) {
+	for name, open := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := open()
+
+			for _, tt := range []struct {
+				room string
+				want int64
+			}{
+				{"general", 1},
+				{"general", 2},
+				{"random", 1},
+				{"general", 3},
+			} {
+				seq, err := store.NextSeq(ctx, tt.room)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if seq != tt.want {
+					t.Errorf("NextSeq(%q) = %d, want %d", tt.room, seq, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreRooms(t *testing.T) {
+	for name, open := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := open()
+
+			fields := map[string]string{"created_at": "2024-01-01T00:00:00Z", "replay": "true"}
+			if created, err := store.CreateRoom(ctx, "general", fields); err != nil || !created {
+				t.Fatalf("CreateRoom = %v, %v, want true", created, err)
+			}
+			if created, err := store.CreateRoom(ctx, "general", map[string]string{"created_at": "2025-01-01T00:00:00Z"}); err != nil || created {
+				t.Fatalf("CreateRoom of an existing room = %v, %v, want false", created, err)
+			}
+
+			if err := store.SetRoomFields(ctx, "general", map[string]string{"replay": "false", "slow_mode": "5"}); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{"created_at": "2024-01-01T00:00:00Z", "replay": "false", "slow_mode": "5"}
+			got, err := store.RoomFields(ctx, "general")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, want) {
+				t.Errorf("RoomFields = %v, want %v", got, want)
+			}
+
+			if got, err := store.RoomFields(ctx, "nowhere"); err != nil || len(got) != 0 {
+				t.Errorf("RoomFields of a missing room = %v, %v, want none", got, err)
+			}
+
+			rooms, err := store.Rooms(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rooms) != 1 || !maps.Equal(rooms["general"], want) {
+				t.Errorf("Rooms = %v, want general only", rooms)
+			}
+		})
+	}
+}
+
+func TestStoreLock(t *testing.T) {
+	for name, open := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := open()
+
+			steps := []struct {
+				do    string
+				token string
+				want  bool
+			}{
+				{"lock", "a", true},
+				{"lock", "b", false},
+				{"unlock", "b", false},
+				{"lock", "b", false},
+				{"unlock", "a", false},
+				{"lock", "b", true},
+			}
+			for i, step := range steps {
+				switch step.do {
+				case "lock":
+					ok, err := store.Lock(ctx, "retention", step.token, time.Minute)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if ok != step.want {
+						t.Errorf("step %d: Lock(%q) = %v, want %v", i, step.token, ok, step.want)
+					}
+				case "unlock":
+					if err := store.Unlock(ctx, "retention", step.token); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// appendTexts appends a message from ann for each of texts to room.
+func appendTexts(t *testing.T, store MessageStore, room string, texts ...string) []ChatMessage {
+	t.Helper()
+
+	msgs := make([]ChatMessage, len(texts))
+	for i, text := range texts {
+		msgs[i] = ChatMessage{Username: "ann", Text: text, Timestamp: time.Now().UnixMilli()}
+		if err := store.Append(context.Background(), room, &msgs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return msgs
+}
+
+// texts returns the text of each of msgs.
+func texts(msgs []ChatMessage) []string {
+	texts := make([]string, len(msgs))
+	for i, msg := range msgs {
+		texts[i] = msg.Text
+	}
+	return texts
+}
+
+func TestStoreHistory(t *testing.T) {
+	for name, open := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := open()
+
+			msgs := appendTexts(t, store, "general", "a", "b", "c", "d", "e")
+			appendTexts(t, store, "random", "x")
+
+			reads := []struct {
+				name string
+				read func() ([]ChatMessage, error)
+				want []string
+			}{
+				{"Recent(3)", func() ([]ChatMessage, error) { return store.Recent(ctx, "general", 3) }, []string{"c", "d", "e"}},
+				{"Recent(0)", func() ([]ChatMessage, error) { return store.Recent(ctx, "general", 0) }, []string{"a", "b", "c", "d", "e"}},
+				{"Recent(10)", func() ([]ChatMessage, error) { return store.Recent(ctx, "general", 10) }, []string{"a", "b", "c", "d", "e"}},
+				{"Range(1, 2)", func() ([]ChatMessage, error) { return store.Range(ctx, "general", 1, 2) }, []string{"b", "c"}},
+				{"Range(-2, -1)", func() ([]ChatMessage, error) { return store.Range(ctx, "general", -2, -1) }, []string{"d", "e"}},
+				{"Range(4, 9)", func() ([]ChatMessage, error) { return store.Range(ctx, "general", 4, 9) }, []string{"e"}},
+				{"other room", func() ([]ChatMessage, error) { return store.Recent(ctx, "random", 0) }, []string{"x"}},
+				{"missing room", func() ([]ChatMessage, error) { return store.Recent(ctx, "nowhere", 0) }, []string{}},
+			}
+			for _, r := range reads {
+				got, err := r.read()
+				if err != nil {
+					t.Fatalf("%s: %v", r.name, err)
+				}
+				if !slices.Equal(texts(got), r.want) {
+					t.Errorf("%s = %q, want %q", r.name, texts(got), r.want)
+				}
+			}
+
+			if n, err := store.Len(ctx, "general"); err != nil || n != 5 {
+				t.Errorf("Len = %d, %v, want 5", n, err)
+			}
+			for room, want := range map[string]bool{"general": true, "nowhere": false} {
+				if ok, err := store.Exists(ctx, room); err != nil || ok != want {
+					t.Errorf("Exists(%s) = %v, %v, want %v", room, ok, err, want)
+				}
+			}
+
+			got, err := store.Get(ctx, msgs[1].ID)
+			if err != nil || got.Text != "b" || got.Room != "general" {
+				t.Errorf("Get(%s) = %+v, %v, want b in general", msgs[1].ID, got, err)
+			}
+			if _, err := store.Get(ctx, "999999"); err != errMessageNotFound {
+				t.Errorf("Get of an unknown ID: %v, want errMessageNotFound", err)
+			}
+			if rank, err := store.Rank(ctx, "general", msgs[3].ID); err != nil || rank != 3 {
+				t.Errorf("Rank(%s) = %d, %v, want 3", msgs[3].ID, rank, err)
+			}
+			if _, err := store.Rank(ctx, "random", msgs[3].ID); err != errMessageNotFound {
+				t.Errorf("Rank in another room: %v, want errMessageNotFound", err)
+			}
+
+			if err := store.Remove(ctx, "general", msgs[1].ID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Get(ctx, msgs[1].ID); err != errMessageGone {
+				t.Errorf("Get of a removed message: %v, want errMessageGone", err)
+			}
+			if _, err := store.Rank(ctx, "general", msgs[1].ID); err != errMessageNotFound {
+				t.Errorf("Rank of a removed message: %v, want errMessageNotFound", err)
+			}
+			if err := store.Remove(ctx, "general", msgs[1].ID); err != nil {
+				t.Errorf("removing twice: %v", err)
+			}
+
+			if err := store.Trim(ctx, "general", 2); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := store.Recent(ctx, "general", 0); err != nil || !slices.Equal(texts(got), []string{"d", "e"}) {
+				t.Errorf("after Trim(2): %q, %v, want d and e", texts(got), err)
+			}
+
+			if n, err := store.Clear(ctx, "general"); err != nil || n != 2 {
+				t.Errorf("Clear = %d, %v, want 2", n, err)
+			}
+			if ok, err := store.Exists(ctx, "general"); err != nil || ok {
+				t.Errorf("Exists after Clear = %v, %v, want false", ok, err)
+			}
+			if n, err := store.Len(ctx, "random"); err != nil || n != 1 {
+				t.Errorf("Clear touched another room: Len = %d, %v", n, err)
+			}
+		})
+	}
+}
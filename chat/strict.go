@@ -0,0 +1,88 @@
+package chat
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// maxProtocolErrors is how many frames a connection may get rejected for
+// protocol mistakes before it is disconnected, in strict mode.
+const maxProtocolErrors = 10
+
+// inboundTypes are the frame types clients send. Frames without a type are
+// chat messages, as sent by version 1 clients.
+var inboundTypes = map[string]bool{
+	"":                 true,
+	messageTypeChat:    true,
+	messageTypeReplies: true,
+	messageTypeRead:    true,
+	messageTypeAck:     true,
+	messageTypeResync:  true,
+
+	messageTypeSubscribe:   true,
+	messageTypeUnsubscribe: true,
+}
+
+// inboundFields are the keys a frame may have: those of ChatMessage, which
+// every frame decodes into.
+var inboundFields = jsonFields(reflect.TypeOf(ChatMessage{}))
+
+// jsonFields returns the JSON keys of the fields of struct type t.
+func jsonFields(t reflect.Type) map[string]bool {
+	fields := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch {
+		case name == "-" || !f.IsExported():
+			continue
+		case name == "":
+			name = f.Name
+		}
+		fields[name] = true
+	}
+	return fields
+}
+
+// frameError is a frame that decoded but doesn't follow the protocol: Code
+// is unknown_type or unknown_field, and Key the offending type or key.
+type frameError struct {
+	Code string
+	Key  string
+}
+
+func (fe *frameError) Error() string {
+	if fe.Code == "unknown_type" {
+		return fmt.Sprintf("unknown frame type %q", fe.Key)
+	}
+	return fmt.Sprintf("unknown field %q", fe.Key)
+}
+
+// checkFrame looks for an unknown type or key in data, a frame encoded with
+// codec. Keys are matched exactly, unlike the lenient decoding of frames
+// that ignores case.
+func checkFrame(codec Codec, data []byte) *frameError {
+	var frame map[string]interface{}
+	if err := codec.Unmarshal(data, &frame); err != nil {
+		// not an object; decoding into a message already failed then
+		return nil
+	}
+
+	if typ, _ := frame["type"].(string); !inboundTypes[typ] {
+		return &frameError{Code: "unknown_type", Key: typ}
+	}
+
+	keys := make([]string, 0, len(frame))
+	for k := range frame {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !inboundFields[k] {
+			return &frameError{Code: "unknown_field", Key: k}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package chat
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCheckFrame(t *testing.T) {
+	type test struct {
+		name  string
+		frame interface{}
+		want  *frameError
+	}
+	var tests []test
+	for typ := range inboundTypes {
+		tests = append(tests, test{"type " + typ, map[string]interface{}{"type": typ, "text": "hi", "room": "general"}, nil})
+	}
+	tests = append(tests,
+		test{"no type", map[string]interface{}{"text": "hi"}, nil},
+		test{"every field", map[string]interface{}{"type": messageTypeChat, "text": "hi", "client_id": "c1", "message_id": "m1", "to": "bob"}, nil},
+		test{"unknown type", map[string]interface{}{"type": "dance", "text": "hi"}, &frameError{Code: "unknown_type", Key: "dance"}},
+		test{"outbound type", map[string]interface{}{"type": messageTypeError}, &frameError{Code: "unknown_type", Key: messageTypeError}},
+		test{"unknown field", map[string]interface{}{"text": "hi", "colour": "red"}, &frameError{Code: "unknown_field", Key: "colour"}},
+		test{"first unknown field", map[string]interface{}{"text": "hi", "zz": 1, "aa": 2}, &frameError{Code: "unknown_field", Key: "aa"}},
+		test{"field case", map[string]interface{}{"Text": "hi"}, &frameError{Code: "unknown_field", Key: "Text"}},
+		test{"not an object", []string{"hi"}, nil},
+	)
+
+	for _, codec := range codecs {
+		for _, tt := range tests {
+			t.Run(codec.Name()+"/"+tt.name, func(t *testing.T) {
+				data, err := codec.Marshal(tt.frame)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := checkFrame(codec, data)
+				if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+					t.Errorf("checkFrame = %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestStrictProtocol(t *testing.T) {
+	tests := []struct {
+		name   string
+		strict bool
+	}{
+		{"strict", true},
+		{"lenient", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.strict {
+				t.Setenv("STRICT_PROTOCOL", "1")
+			}
+			s, _ := newTestServer(t)
+			ws := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+			waitClients(t, s, 1)
+
+			if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"text":"hi","colour":"red"}`)); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.strict {
+				if msg := readFrameOf(t, ws, messageTypeChat, nil); msg.Text != "hi" {
+					t.Errorf("got %q, want the message", msg.Text)
+				}
+				return
+			}
+
+			var f errorFrame
+			readFrameInto(t, ws, messageTypeError, &f)
+			if f.Code != "unknown_field" || !strings.Contains(f.Message, "colour") {
+				t.Errorf("error %q %q, want unknown_field naming colour", f.Code, f.Message)
+			}
+			if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"dance"}`)); err != nil {
+				t.Fatal(err)
+			}
+			readFrameInto(t, ws, messageTypeError, &f)
+			if f.Code != "unknown_type" || !strings.Contains(f.Message, "dance") {
+				t.Errorf("error %q %q, want unknown_type naming dance", f.Code, f.Message)
+			}
+
+			// too many mistakes end the connection
+			for i := 2; i < maxProtocolErrors; i++ {
+				if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"dance"}`)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				_, _, err := ws.ReadMessage()
+				if err == nil {
+					continue
+				}
+				var ce *websocket.CloseError
+				if !errors.As(err, &ce) || ce.Code != websocket.ClosePolicyViolation || ce.Text != "too many protocol errors" {
+					t.Errorf("got %v, want a close frame with %d", err, websocket.ClosePolicyViolation)
+				}
+				break
+			}
+		})
+	}
+}
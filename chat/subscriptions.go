@@ -0,0 +1,266 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	messageTypeSubscribe    = "subscribe"
+	messageTypeUnsubscribe  = "unsubscribe"
+	messageTypeSubscribed   = "subscribed"
+	messageTypeUnsubscribed = "unsubscribed"
+)
+
+// defaultMaxSubscriptions is the number of rooms a connection may subscribe
+// to beyond its own, unless MAX_SUBSCRIPTIONS says otherwise.
+const defaultMaxSubscriptions = 20
+
+// subscriptionFrame confirms a subscribe or unsubscribe frame, or tells the
+// client it was taken out of a room, with Reason.
+type subscriptionFrame struct {
+	Type   string `json:"type"`
+	Room   string `json:"room"`
+	Reason string `json:"reason,omitempty"`
+}
+
+var errSubscriptionNotReadable = errors.New("subscriptions are read through their connection")
+
+// sharedConn serializes the writes to a WebSocket connection, which its
+// subscriptions write to as well, from the goroutines replaying their
+// history.
+type sharedConn struct {
+	mu sync.Mutex
+	clientConn
+}
+
+func (sc *sharedConn) WriteMessage(messageType int, data []byte) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.clientConn.WriteMessage(messageType, data)
+}
+
+func (sc *sharedConn) SetWriteDeadline(t time.Time) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.clientConn.SetWriteDeadline(t)
+}
+
+// subscriptions are the rooms a connection subscribed to beyond the one it
+// connected to. Each is a Client of the hub, whose frames are written to the
+// connection.
+type subscriptions struct {
+	mu    sync.Mutex
+	rooms map[string]*Client
+}
+
+func (subs *subscriptions) get(room string) *Client {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+	return subs.rooms[room]
+}
+
+// take removes the subscription to room, reporting whether there was one.
+func (subs *subscriptions) take(room string) (*Client, bool) {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+	c, ok := subs.rooms[room]
+	delete(subs.rooms, room)
+	return c, ok
+}
+
+// subscriptionConn is the connection of a subscription.
+type subscriptionConn struct {
+	conn   *sharedConn
+	subs   *subscriptions
+	codec  Codec
+	room   string
+	reason string
+}
+
+func (sc *subscriptionConn) WriteMessage(messageType int, data []byte) error {
+	return sc.conn.WriteMessage(messageType, data)
+}
+
+// WriteControl only keeps the reason of a close frame, which Close sends in
+// an unsubscribed frame: closing the connection would end every room.
+func (sc *subscriptionConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType == websocket.CloseMessage {
+		if len(data) > 2 {
+			sc.reason = string(data[2:])
+		}
+		return nil
+	}
+	return sc.conn.WriteControl(messageType, data, deadline)
+}
+
+func (sc *subscriptionConn) SetWriteDeadline(t time.Time) error {
+	return sc.conn.SetWriteDeadline(t)
+}
+
+func (sc *subscriptionConn) NextReader() (int, io.Reader, error) {
+	return 0, nil, errSubscriptionNotReadable
+}
+
+func (sc *subscriptionConn) RemoteAddr() net.Addr { return sc.conn.RemoteAddr() }
+
+// Close ends the subscription, as the hub does when kicking a client,
+// leaving the connection and its other rooms alone.
+func (sc *subscriptionConn) Close() error {
+	if _, ok := sc.subs.take(sc.room); !ok {
+		return nil
+	}
+
+	data, err := sc.codec.Marshal(subscriptionFrame{Type: messageTypeUnsubscribed, Room: sc.room, Reason: sc.reason})
+	if err != nil {
+		return err
+	}
+	return sc.conn.WriteMessage(sc.codec.FrameType(), data)
+}
+
+// roomCodec encodes the frames of a subscription, adding the room to those
+// that don't carry one, so that the client can tell its rooms apart.
+type roomCodec struct {
+	Codec
+	room string
+}
+
+func (rc roomCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := rc.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	if err := rc.Codec.Unmarshal(data, &fields); err != nil {
+		// not an object
+		return data, nil
+	}
+	if room, _ := fields["room"].(string); room != "" {
+		return data, nil
+	}
+	fields["room"] = rc.room
+	return rc.Codec.Marshal(fields)
+}
+
+// subscribe adds the connection of c to room, replaying its history. The
+// room's frames then come over the connection too, tagged with the room.
+// Private rooms need an invite, which only connecting to them gives.
+func (s *Server) subscribe(ctx context.Context, c *Client, room string) {
+	if c.subs == nil {
+		s.sendError(c, "unsupported", "this connection can't subscribe to rooms")
+		return
+	}
+	if room == c.room || c.subs.get(room) != nil {
+		s.sendFrame(c, subscriptionFrame{Type: messageTypeSubscribed, Room: room})
+		return
+	}
+	if !validRoomName(room) {
+		s.sendError(c, "not_found", "no such room")
+		return
+	}
+
+	c.subs.mu.Lock()
+	n := len(c.subs.rooms)
+	c.subs.mu.Unlock()
+	if n >= s.maxSubscriptions {
+		s.sendError(c, "too_many_subscriptions", fmt.Sprintf("a connection may subscribe to at most %d rooms", s.maxSubscriptions))
+		return
+	}
+
+	ok, err := s.ensureRoom(ctx, room)
+	if err != nil {
+		c.logger.Error("subscribing", "room", room, "err", err)
+		return
+	}
+	if !ok {
+		s.sendError(c, "not_found", "no such room")
+		return
+	}
+	opts, err := s.roomOptions(ctx, room)
+	if err != nil {
+		c.logger.Error("loading room options", "room", room, "err", err)
+		return
+	}
+	if opts.Private {
+		s.sendError(c, "forbidden", "private rooms need a connection of their own, with an invite")
+		return
+	}
+
+	sub := &Client{
+		ws:           &subscriptionConn{conn: c.ws.(*sharedConn), subs: c.subs, codec: c.codec, room: room},
+		version:      c.version,
+		codec:        roomCodec{Codec: c.codec, room: room},
+		room:         room,
+		ip:           c.ip,
+		observer:     c.observer,
+		noEcho:       c.noEcho,
+		filter:       c.filter,
+		strict:       c.strict,
+		admin:        c.admin,
+		claimed:      c.claimed,
+		verified:     c.verified,
+		username:     c.username,
+		displayName:  c.displayName,
+		avatarURL:    c.avatarURL,
+		writeTimeout: c.writeTimeout,
+		maxFrameSize: c.maxFrameSize,
+		connectedAt:  time.Now(),
+		bp:           c.bp,
+		logger:       c.logger.With("subscription", room),
+		recent:       c.recent,
+		parent:       c,
+	}
+
+	// the hub may write to the subscription as soon as it knows it
+	c.subs.mu.Lock()
+	c.subs.rooms[room] = sub
+	c.subs.mu.Unlock()
+
+	if !s.addClient(sub, opts) {
+		c.subs.take(room)
+		s.sendError(c, "room_full", "the room is full")
+		return
+	}
+
+	s.sendFrame(c, subscriptionFrame{Type: messageTypeSubscribed, Room: room})
+	s.replayHistory(ctx, sub)
+	s.emitEvent(ctx, eventConnect, room, sub.claimed)
+}
+
+// unsubscribe takes the connection of c out of room.
+func (s *Server) unsubscribe(ctx context.Context, c *Client, room string) {
+	if c.subs == nil {
+		s.sendError(c, "unsupported", "this connection can't subscribe to rooms")
+		return
+	}
+	sub, ok := c.subs.take(room)
+	if !ok {
+		s.sendError(c, "not_subscribed", "not subscribed to this room")
+		return
+	}
+
+	s.delClient(sub)
+	s.sendFrame(c, subscriptionFrame{Type: messageTypeUnsubscribed, Room: room})
+	s.emitEvent(ctx, eventDisconnect, room, sub.username)
+}
+
+// unsubscribeAll ends the subscriptions of c once its connection closed.
+func (s *Server) unsubscribeAll(ctx context.Context, c *Client) {
+	c.subs.mu.Lock()
+	rooms := c.subs.rooms
+	c.subs.rooms = make(map[string]*Client)
+	c.subs.mu.Unlock()
+
+	for room, sub := range rooms {
+		s.delClient(sub)
+		s.emitEvent(ctx, eventDisconnect, room, sub.username)
+	}
+}
@@ -0,0 +1,303 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// telegramPrefix marks the usernames of messages bridged from
+	// Telegram, which therefore aren't sent back there.
+	telegramPrefix = "tg:"
+
+	// telegramPollTimeout is how long a getUpdates call waits for updates.
+	telegramPollTimeout = 30 * time.Second
+
+	// telegramPollBackoff is how long polling pauses after a failure,
+	// unless Telegram asks for longer.
+	telegramPollBackoff = 5 * time.Second
+
+	// telegramOutbox is how many messages wait to be forwarded before new
+	// ones are dropped.
+	telegramOutbox = 256
+
+	// telegramUpdateTTL is how long update IDs are remembered.
+	telegramUpdateTTL = 24 * time.Hour
+)
+
+// telegramUpdate is the Redis key marking update id as processed.
+func (ks keyspace) telegramUpdate(id int64) string {
+	return ks.key("telegram_update:" + strconv.FormatInt(id, 10))
+}
+
+// parseTelegramRooms parses TELEGRAM_ROOMS, a comma-separated list of
+// chat-id:room pairs.
+func parseTelegramRooms(v string) (map[int64]string, error) {
+	rooms := make(map[int64]string)
+	for _, pair := range splitList(v) {
+		chat, room, ok := strings.Cut(pair, ":")
+		id, err := strconv.ParseInt(strings.TrimSpace(chat), 10, 64)
+		room = strings.TrimSpace(room)
+		if !ok || err != nil || !validRoomName(room) {
+			return nil, fmt.Errorf("TELEGRAM_ROOMS: invalid pair %q, expected chat-id:room", pair)
+		}
+		rooms[id] = room
+	}
+	return rooms, nil
+}
+
+// telegramBridge relays messages between Telegram chats and the rooms they
+// are mapped to.
+type telegramBridge struct {
+	s      *Server
+	api    string
+	client *http.Client
+
+	chats map[int64]string
+	rooms map[string][]int64
+
+	// mu guards closed, which is set once outbox is closed.
+	mu     sync.Mutex
+	closed bool
+	outbox chan ChatMessage
+}
+
+// newTelegramBridge returns the bridge of the bot with the given token, nil
+// when there is none.
+func newTelegramBridge(s *Server, token string, chats map[int64]string) *telegramBridge {
+	if token == "" {
+		return nil
+	}
+
+	tb := &telegramBridge{
+		s:      s,
+		api:    "https://api.telegram.org/bot" + token + "/",
+		client: &http.Client{Timeout: telegramPollTimeout + 10*time.Second},
+		chats:  chats,
+		rooms:  make(map[string][]int64),
+		outbox: make(chan ChatMessage, telegramOutbox),
+	}
+	for chat, room := range chats {
+		tb.rooms[room] = append(tb.rooms[room], chat)
+	}
+	return tb
+}
+
+// forward queues msg for the Telegram chats its room is mapped to, unless it
+// came from Telegram. It never blocks, so it is safe to call from the hub.
+func (tb *telegramBridge) forward(msg ChatMessage) {
+	if tb == nil || len(tb.rooms[msg.Room]) == 0 || strings.HasPrefix(msg.Username, telegramPrefix) {
+		return
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.closed {
+		return
+	}
+	select {
+	case tb.outbox <- msg:
+	default:
+		tb.s.logger.Warn("telegram outbox full, dropping message", "room", msg.Room, "id", msg.ID)
+	}
+}
+
+// close stops forwarding, ending deliver once the queued messages are sent.
+func (tb *telegramBridge) close() {
+	if tb == nil {
+		return
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if !tb.closed {
+		tb.closed = true
+		close(tb.outbox)
+	}
+}
+
+// sleep waits for d, or until ctx is done, reporting whether it was not.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// telegramResponse is the envelope of every Bot API reply.
+type telegramResponse struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+type telegramUpdateMsg struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Text string `json:"text"`
+		From struct {
+			ID        int64  `json:"id"`
+			Username  string `json:"username"`
+			FirstName string `json:"first_name"`
+		} `json:"from"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+	} `json:"message"`
+}
+
+// call invokes a Bot API method.
+func (tb *telegramBridge) call(ctx context.Context, method string, body interface{}) (telegramResponse, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return telegramResponse{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tb.api+method, bytes.NewReader(data))
+	if err != nil {
+		return telegramResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := tb.client.Do(req)
+	if err != nil {
+		// the error quotes the URL, token included
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return telegramResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var tr telegramResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return telegramResponse{}, fmt.Errorf("%s: %s", method, resp.Status)
+	}
+	return tr, nil
+}
+
+// poll long-polls Telegram for messages and injects those of mapped chats
+// into their room, until ctx is done.
+func (tb *telegramBridge) poll(ctx context.Context) {
+	var offset int64
+
+	for ctx.Err() == nil {
+		tr, err := tb.call(ctx, "getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         int(telegramPollTimeout / time.Second),
+			"allowed_updates": []string{"message"},
+		})
+		if err == nil && !tr.OK {
+			err = fmt.Errorf("getUpdates: %d %s", tr.ErrorCode, tr.Description)
+		}
+		var updates []telegramUpdateMsg
+		if err == nil {
+			if err = json.Unmarshal(tr.Result, &updates); err != nil {
+				err = fmt.Errorf("decoding updates: %w", err)
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// the offset didn't move, so retrying at once would fetch
+			// the same batch again and again
+			tb.s.logger.Warn("polling telegram", "err", err)
+			sleep(ctx, max(telegramPollBackoff, time.Duration(tr.Parameters.RetryAfter)*time.Second))
+			continue
+		}
+
+		for _, u := range updates {
+			offset = max(offset, u.UpdateID+1)
+			tb.receive(ctx, u)
+		}
+	}
+}
+
+// receive injects the message of u into its room, unless it was already,
+// by this instance before a restart or by another one.
+func (tb *telegramBridge) receive(ctx context.Context, u telegramUpdateMsg) {
+	if u.Message == nil || strings.TrimSpace(u.Message.Text) == "" {
+		return
+	}
+	room, ok := tb.chats[u.Message.Chat.ID]
+	if !ok {
+		return
+	}
+
+	s := tb.s
+	first, err := s.rdb.SetNX(ctx, s.keys.telegramUpdate(u.UpdateID), 1, telegramUpdateTTL).Result()
+	if err != nil {
+		s.logger.Warn("deduplicating telegram update", "update", u.UpdateID, "err", err)
+		return
+	}
+	if !first {
+		return
+	}
+
+	name := u.Message.From.Username
+	if name == "" {
+		name = u.Message.From.FirstName
+	}
+	// names taken as they are could pass for reserved ones, or not be
+	// names at all; the numeric ID always makes one
+	username, err := s.normalizeUsername(telegramPrefix + name)
+	if err != nil || name == "" {
+		username, err = s.normalizeUsername(telegramPrefix + strconv.FormatInt(u.Message.From.ID, 10))
+	}
+	if err != nil {
+		s.logger.Warn("dropping telegram message", "update", u.UpdateID, "err", err)
+		return
+	}
+
+	s.sendMessage(ctx, nil, room, ChatMessage{Username: username, Text: u.Message.Text})
+	s.emitEvent(ctx, eventMessage, room, username)
+}
+
+// deliver forwards the queued messages to Telegram, waiting as long as
+// Telegram asks when rate limited, until the outbox is closed. Once ctx is
+// done, what is left is dropped.
+func (tb *telegramBridge) deliver(ctx context.Context) {
+	for msg := range tb.outbox {
+		if ctx.Err() != nil {
+			continue
+		}
+		for _, chat := range tb.rooms[msg.Room] {
+			body := map[string]interface{}{
+				"chat_id": chat,
+				"text":    msg.Username + ": " + msg.plainText(),
+			}
+
+			for attempt := 0; attempt < 3; attempt++ {
+				tr, err := tb.call(ctx, "sendMessage", body)
+				if err != nil {
+					tb.s.logger.Warn("forwarding to telegram", "chat", chat, "err", err)
+					break
+				}
+				if tr.ErrorCode == http.StatusTooManyRequests {
+					if !sleep(ctx, time.Duration(tr.Parameters.RetryAfter)*time.Second) {
+						break
+					}
+					continue
+				}
+				if !tr.OK {
+					tb.s.logger.Warn("forwarding to telegram", "chat", chat, "code", tr.ErrorCode, "err", tr.Description)
+				}
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestTelegramBridge returns a bridge of s relaying chat 42 to the
+// general room, calling api in place of the Bot API.
+func newTestTelegramBridge(t *testing.T, s *Server, api http.HandlerFunc) *telegramBridge {
+	t.Helper()
+
+	ts := httptest.NewServer(api)
+	t.Cleanup(ts.Close)
+
+	tb := newTelegramBridge(s, "token", map[int64]string{42: "general"})
+	tb.api = ts.URL + "/bottoken/"
+	return tb
+}
+
+// telegramSent records the texts a test Bot API was asked to send.
+type telegramSent struct {
+	mu    sync.Mutex
+	texts []string
+}
+
+func (ts *telegramSent) add(r *http.Request) {
+	var body struct {
+		Text string `json:"text"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.texts = append(ts.texts, body.Text)
+}
+
+// TestTelegramUpdatesDeduplicated checks that an update fetched twice, as
+// after a restart or by another instance, is only injected once.
+func TestTelegramUpdatesDeduplicated(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	const update = `{"update_id":7,"message":{"text":"hi","from":{"id":1,"username":"bob"},"chat":{"id":42}}}`
+	var calls atomic.Int32
+	waiting := make(chan struct{})
+	tb := newTestTelegramBridge(t, s, func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1, 2:
+			fmt.Fprintf(w, `{"ok":true,"result":[%s]}`, update)
+		case 3:
+			close(waiting)
+			fallthrough
+		default:
+			// a long poll without updates, until the client goes away,
+			// which the server only notices once the body was read
+			io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tb.poll(ctx)
+	}()
+
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("updates not polled again")
+	}
+	// the hub stored what it took before answering
+	s.ClientCount()
+
+	msgs, err := s.store.Recent(ctx, "general", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Username != "tg:bob" || msgs[0].Text != "hi" {
+		t.Errorf("stored %+v, want hi from tg:bob once", msgs)
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("polling went on after the server stopped")
+	}
+}
+
+// TestTelegramPollBacksOff checks that updates that can't be decoded aren't
+// fetched again right away.
+func TestTelegramPollBacksOff(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	var calls atomic.Int32
+	tb := newTestTelegramBridge(t, s, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		fmt.Fprint(w, `{"ok":true,"result":"not updates"}`)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tb.poll(ctx)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	<-stopped
+	if n := calls.Load(); n != 1 {
+		t.Errorf("polled %d times, want 1", n)
+	}
+}
+
+// TestTelegramUsernames checks that the names of Telegram users are
+// normalized like any other, falling back to their ID.
+func TestTelegramUsernames(t *testing.T) {
+	s, _ := newTestServer(t)
+	tb := newTelegramBridge(s, "token", map[int64]string{42: "general"})
+	ctx := context.Background()
+
+	tests := []struct {
+		username, firstName string
+		want                string
+	}{
+		{"bob", "Bob", "tg:bob"},
+		{"", "Carol  Jones", "tg:Carol Jones"},
+		{"", "", "tg:1"},
+		{"da\u200bve", "", "tg:1"},
+		{strings.Repeat("x", 64), "", "tg:1"},
+	}
+	for i, tt := range tests {
+		var u telegramUpdateMsg
+		if err := json.Unmarshal([]byte(`{"message":{"text":"hi","from":{"id":1},"chat":{"id":42}}}`), &u); err != nil {
+			t.Fatal(err)
+		}
+		u.UpdateID = int64(i)
+		u.Message.From.Username = tt.username
+		u.Message.From.FirstName = tt.firstName
+		tb.receive(ctx, u)
+	}
+	s.ClientCount()
+
+	msgs, err := s.store.Recent(ctx, "general", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != len(tests) {
+		t.Fatalf("stored %d messages, want %d", len(msgs), len(tests))
+	}
+	for i, tt := range tests {
+		if msgs[i].Username != tt.want {
+			t.Errorf("%q %q sent as %q, want %q", tt.username, tt.firstName, msgs[i].Username, tt.want)
+		}
+	}
+}
+
+// TestTelegramRetryAfter checks that a rate limited message is sent again
+// once Telegram said it may be.
+func TestTelegramRetryAfter(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	var calls atomic.Int32
+	var sent telegramSent
+	tb := newTestTelegramBridge(t, s, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			fmt.Fprint(w, `{"ok":false,"error_code":429,"description":"Too Many Requests","parameters":{"retry_after":1}}`)
+			return
+		}
+		sent.add(r)
+		fmt.Fprint(w, `{"ok":true,"result":{}}`)
+	})
+
+	tb.forward(ChatMessage{Room: "general", Username: "ann", Text: "hi"})
+	tb.close()
+	start := time.Now()
+	tb.deliver(context.Background())
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("sent again after %v, want at least 1s", elapsed)
+	}
+	if strings.Join(sent.texts, "|") != "ann: hi" {
+		t.Errorf("sent %q, want ann: hi once", sent.texts)
+	}
+}
+
+// TestTelegramNoEcho checks that messages bridged from Telegram, and those
+// of rooms without a chat, aren't forwarded there.
+func TestTelegramNoEcho(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	var sent telegramSent
+	tb := newTestTelegramBridge(t, s, func(w http.ResponseWriter, r *http.Request) {
+		sent.add(r)
+		fmt.Fprint(w, `{"ok":true,"result":{}}`)
+	})
+
+	tb.forward(ChatMessage{Room: "general", Username: "tg:bob", Text: "from telegram"})
+	tb.forward(ChatMessage{Room: "random", Username: "ann", Text: "elsewhere"})
+	tb.forward(ChatMessage{Room: "general", Username: "ann", Text: "hello"})
+	tb.close()
+	tb.deliver(context.Background())
+
+	// forwarding after the server stopped drops the message
+	tb.forward(ChatMessage{Room: "general", Username: "ann", Text: "too late"})
+
+	if strings.Join(sent.texts, "|") != "ann: hello" {
+		t.Errorf("sent %q, want ann: hello only", sent.texts)
+	}
+}
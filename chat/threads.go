@@ -0,0 +1,138 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var errInvalidReply = errors.New("reply_to does not reference a message in this room")
+
+// resolveReply checks the parent referenced by msg.ReplyTo. A parent that was
+// stored but has since left the history is accepted and flagged, while an
+// ID that never existed or belongs to another room is rejected.
+func (s *Server) resolveReply(ctx context.Context, room string, msg *ChatMessage) error {
+	if msg.ReplyTo == "" {
+		return nil
+	}
+
+	parent, err := s.store.Get(ctx, msg.ReplyTo)
+	switch err {
+	case nil:
+	case errMessageGone:
+		msg.ParentDeleted = true
+		return nil
+	case errMessageNotFound:
+		return errInvalidReply
+	default:
+		return err
+	}
+
+	if parent.Room != room {
+		return errInvalidReply
+	}
+
+	return nil
+}
+
+// countReplies fills in ReplyCount for every message in msgs.
+func (s *Server) countReplies(ctx context.Context, msgs []ChatMessage) error {
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+
+	counts, err := s.store.ReplyCounts(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range msgs {
+		msgs[i].ReplyCount = counts[i]
+	}
+	return nil
+}
+
+// messageTypeReplies is both the frame asking for the replies to a message and
+// the frame answering it.
+const messageTypeReplies = "replies"
+
+// repliesFrame carries the thread of message ID.
+type repliesFrame struct {
+	Type    string        `json:"type"`
+	ID      string        `json:"id"`
+	Replies []ChatMessage `json:"replies"`
+}
+
+// sendReplies answers a replies frame from c with the thread of message id.
+// Unlike the REST endpoint it works in private rooms, since c is a member.
+func (s *Server) sendReplies(ctx context.Context, c *Client, id string) {
+	if c.version < protocolV2 {
+		return
+	}
+
+	parent, err := s.store.Get(ctx, id)
+	if err == errMessageNotFound || err == errMessageGone || (err == nil && (parent.Room != c.room || !parent.visibleTo(c.verified))) {
+		s.sendError(c, "not_found", "no such message in this room")
+		return
+	}
+	if err != nil {
+		c.logger.Error("loading thread", "err", err)
+		return
+	}
+
+	replies, err := s.store.Replies(ctx, id)
+	if err != nil {
+		c.logger.Error("loading thread", "err", err)
+		return
+	}
+	replies = visibleMessages(replies, c.verified)
+	for i := range replies {
+		replies[i].Type = messageTypeChat
+	}
+	if replies == nil {
+		replies = []ChatMessage{}
+	}
+
+	s.sendFrame(c, repliesFrame{Type: messageTypeReplies, ID: id, Replies: replies})
+}
+
+// handleListReplies returns the replies to a message, oldest first.
+func (s *Server) handleListReplies(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+
+	user := s.requester(r)
+	parent, err := s.store.Get(ctx, id)
+	if err == errMessageNotFound || err == errMessageGone || (err == nil && !parent.visibleTo(user)) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	// threads in private rooms are only visible to members over the socket
+	opts, err := s.roomOptions(ctx, parent.Room)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if opts.Private {
+		http.NotFound(w, r)
+		return
+	}
+
+	replies, err := s.store.Replies(ctx, id)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	replies = visibleMessages(replies, user)
+	if replies == nil {
+		replies = []ChatMessage{}
+	}
+
+	writeJSONResponse(w, http.StatusOK, replies)
+}
@@ -0,0 +1,140 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readFrameInto reads from ws until a frame of type typ comes, and decodes
+// it into v.
+func readFrameInto(t *testing.T, ws *websocket.Conn, typ string, v interface{}) {
+	t.Helper()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var raw json.RawMessage
+		if err := ws.ReadJSON(&raw); err != nil {
+			t.Fatalf("waiting for a %s frame: %v", typ, err)
+		}
+		var head struct{ Type string }
+		if err := json.Unmarshal(raw, &head); err != nil {
+			t.Fatal(err)
+		}
+		if head.Type == typ {
+			if err := json.Unmarshal(raw, v); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+}
+
+// readFrameOf reads the frames of ws until one of type typ for which match,
+// if given, holds, and returns it.
+func readFrameOf(t *testing.T, ws *websocket.Conn, typ string, match func(ChatMessage) bool) ChatMessage {
+	t.Helper()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg ChatMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for a %s frame: %v", typ, err)
+		}
+		if msg.Type == typ && (match == nil || match(msg)) {
+			return msg
+		}
+	}
+}
+
+// getReplies fetches the replies to message id over REST.
+func getReplies(s *Server, id string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/messages/"+id+"/replies", nil)
+	req.SetPathValue("id", id)
+	rec := httptest.NewRecorder()
+	s.handleListReplies(rec, req)
+	return rec
+}
+
+func TestReplies(t *testing.T) {
+	s, _ := newTestServer(t)
+	ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	waitClients(t, s, 1)
+
+	post := func(ws *websocket.Conn, msg ChatMessage) {
+		t.Helper()
+		if err := ws.WriteJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	post(ann, ChatMessage{Username: "ann", Text: "root"})
+	root := readFrameOf(t, ann, messageTypeChat, nil)
+
+	other := ChatMessage{Username: "bob", Text: "in random", Timestamp: time.Now().UnixMilli()}
+	if err := s.store.Append(context.Background(), "random", &other); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		replyTo string
+		valid   bool
+	}{
+		{"valid", root.ID, true},
+		{"nonexistent parent", "no-such-id", false},
+		{"parent in another room", other.ID, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			post(ann, ChatMessage{Username: "ann", Text: tt.name, ReplyTo: tt.replyTo})
+			if !tt.valid {
+				var f errorFrame
+				readFrameInto(t, ann, messageTypeError, &f)
+				if f.Code != "invalid_reply" {
+					t.Errorf("error %q, want invalid_reply", f.Code)
+				}
+				return
+			}
+			reply := readFrameOf(t, ann, messageTypeChat, nil)
+			if reply.ReplyTo != tt.replyTo || reply.Text != tt.name {
+				t.Errorf("broadcast %+v, want a reply to %s", reply, tt.replyTo)
+			}
+		})
+	}
+
+	// the thread holds the valid reply alone, over the socket and REST
+	post(ann, ChatMessage{Type: messageTypeReplies, ID: root.ID})
+	var thread repliesFrame
+	readFrameInto(t, ann, messageTypeReplies, &thread)
+	if thread.ID != root.ID || len(thread.Replies) != 1 || thread.Replies[0].Text != "valid" {
+		t.Errorf("replies frame %+v, want the valid reply", thread)
+	}
+
+	rec := getReplies(s, root.ID)
+	var replies []ChatMessage
+	if err := json.NewDecoder(rec.Body).Decode(&replies); err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 1 || replies[0].Text != "valid" || replies[0].ReplyTo != root.ID {
+		t.Errorf("GET replies = %q, want the valid reply", texts(replies))
+	}
+
+	if rec := getReplies(s, "no-such-id"); rec.Code != http.StatusNotFound {
+		t.Errorf("replies to a missing message: status %d, want 404", rec.Code)
+	}
+
+	// a client joining later replays the thread
+	bob := dialTestServer(t, s, "room=general&username=bob", "chat.v2")
+	if got := readFrameOf(t, bob, messageTypeChat, nil); got.ID != root.ID || got.ReplyCount != 1 {
+		t.Errorf("replayed %+v, want the root with one reply", got)
+	}
+	if got := readFrameOf(t, bob, messageTypeChat, nil); got.ReplyTo != root.ID {
+		t.Errorf("replayed %+v, want the reply to the root", got)
+	}
+}
@@ -0,0 +1,34 @@
+package chat
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// serve runs srv on ln, over TLS when a certificate or autocert domains are
+// configured and in plaintext otherwise. cfg was validated, so at most one
+// of them is set.
+func serve(srv *http.Server, ln net.Listener, cfg Config) error {
+	switch {
+	case len(cfg.AutocertDomains) > 0:
+		return serveAutocert(srv, ln, cfg.AutocertDomains, cfg.AutocertCacheDir)
+
+	case cfg.TLSCertFile != "":
+		return srv.ServeTLS(ln, cfg.TLSCertFile, cfg.TLSKeyFile)
+
+	default:
+		return srv.Serve(ln)
+	}
+}
+
+// redirectHTTPS sends plaintext requests to the same URL over HTTPS.
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, found := strings.Cut(r.Host, ":")
+	if !found {
+		host = r.Host
+	}
+
+	target := "https://" + host + r.URL.RequestURI()
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
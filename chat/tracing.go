@@ -0,0 +1,53 @@
+package chat
+
+import "context"
+
+// tracer is the tracing backend of the message pipeline. The server holds a
+// nil tracer unless tracing is on, in which case every span is a no-op.
+type tracer interface {
+	start(ctx context.Context, name string) (context.Context, span)
+
+	// traceID returns the ID of the trace of ctx, if any.
+	traceID(ctx context.Context) string
+
+	// shutdown flushes the spans not exported yet.
+	shutdown(ctx context.Context) error
+}
+
+// span is a timed step of the message pipeline.
+type span interface {
+	setAttr(key string, value any)
+	recordError(err error)
+	end()
+}
+
+// noopSpan stands in for spans while tracing is off.
+type noopSpan struct{}
+
+func (noopSpan) setAttr(string, any) {}
+func (noopSpan) recordError(error)   {}
+func (noopSpan) end()                {}
+
+// startSpan starts a span named name as a child of the one in ctx.
+func (s *Server) startSpan(ctx context.Context, name string) (context.Context, span) {
+	if s.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return s.tracer.start(ctx, name)
+}
+
+// traceID returns the trace ID of ctx, empty when tracing is off.
+func (s *Server) traceID(ctx context.Context) string {
+	if s.tracer == nil {
+		return ""
+	}
+	return s.tracer.traceID(ctx)
+}
+
+// shutdownTracing flushes the pending spans before the process exits.
+func (s *Server) shutdownTracing(ctx context.Context) error {
+	if s.tracer == nil {
+		return nil
+	}
+	return s.tracer.shutdown(ctx)
+}
@@ -0,0 +1,95 @@
+//go:build otel
+
+package chat
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newTracer exports spans over OTLP when OTEL_EXPORTER_OTLP_ENDPOINT is set.
+// The exporter reads the rest of its configuration from the standard OTEL_*
+// variables.
+func newTracer() (tracer, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return nil, nil
+	}
+
+	exp, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_ENDPOINT: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName("chat_server"),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return &otelTracer{provider: tp, tracer: tp.Tracer("chat_server")}, nil
+}
+
+type otelTracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+func (t *otelTracer) start(ctx context.Context, name string) (context.Context, span) {
+	ctx, sp := t.tracer.Start(ctx, name)
+	return ctx, otelSpan{sp}
+}
+
+func (t *otelTracer) traceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+func (t *otelTracer) shutdown(ctx context.Context) error {
+	return t.provider.Shutdown(ctx)
+}
+
+type otelSpan struct {
+	trace.Span
+}
+
+func (sp otelSpan) setAttr(key string, value any) {
+	switch v := value.(type) {
+	case string:
+		sp.SetAttributes(attribute.String(key, v))
+	case int:
+		sp.SetAttributes(attribute.Int(key, v))
+	case int64:
+		sp.SetAttributes(attribute.Int64(key, v))
+	case bool:
+		sp.SetAttributes(attribute.Bool(key, v))
+	default:
+		sp.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+func (sp otelSpan) recordError(err error) {
+	sp.RecordError(err)
+	sp.SetStatus(codes.Error, err.Error())
+}
+
+func (sp otelSpan) end() {
+	sp.End()
+}
@@ -0,0 +1,17 @@
+//go:build !otel
+
+package chat
+
+import (
+	"errors"
+	"os"
+)
+
+// newTracer is only available in binaries built with the otel tag, which
+// pulls in the OpenTelemetry SDK.
+func newTracer() (tracer, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		return nil, errors.New("OTEL_EXPORTER_OTLP_ENDPOINT requires a binary built with -tags otel")
+	}
+	return nil, nil
+}
@@ -0,0 +1,84 @@
+package chat
+
+import "context"
+
+// messageTypeUnread is the frame telling v2 clients how many messages they
+// haven't read in the rooms they have a read marker in.
+const messageTypeUnread = "unread"
+
+// unreadFrame carries unread counts by room: all of them on connect, then
+// the ones that changed.
+type unreadFrame struct {
+	Type   string           `json:"type"`
+	Counts map[string]int64 `json:"counts"`
+}
+
+// loadUnread counts the unread messages of the user c connected as, in every
+// room they have a read marker in. It runs on the connection goroutine.
+func (s *Server) loadUnread(ctx context.Context, c *Client) (map[string]int64, error) {
+	// the read markers are kept in Redis
+	if c.version < protocolV2 || c.claimed == "" || !s.hasRedis() {
+		return nil, nil
+	}
+
+	rooms, err := s.rdb.SMembers(ctx, s.keys.readRooms(c.claimed)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(rooms))
+	for _, room := range rooms {
+		_, n, err := s.unreadCount(ctx, room, c.claimed)
+		if err != nil {
+			return nil, err
+		}
+		counts[room] = n
+	}
+	return counts, nil
+}
+
+// countUnread bumps the unread count of the room of msg for the clients
+// tracking it that may see msg, save from, which sent it, and tells them. It
+// runs on the hub.
+func countUnread(h *hub, from *Client, msg ChatMessage) {
+	room := msg.Room
+	for c := range h.clients {
+		if c == from || c.unread == nil || !msg.visibleTo(c.verified) {
+			continue
+		}
+		n, ok := c.unread[room]
+		if !ok {
+			continue
+		}
+		c.unread[room] = n + 1
+
+		f := unreadFrame{Type: messageTypeUnread, Counts: map[string]int64{room: n + 1}}
+		if err := c.deliver("", f); err != nil && unsafeError(err) {
+			c.logger.Warn("sending unread count", "err", err)
+		}
+	}
+}
+
+// refreshUnread recounts the unread messages of user in room after their
+// read marker moved, and tells every connection of theirs.
+func (s *Server) refreshUnread(ctx context.Context, room, user string) error {
+	_, n, err := s.unreadCount(ctx, room, user)
+	if err != nil {
+		return err
+	}
+
+	s.ops <- func(h *hub) {
+		for c := range h.clients {
+			if c.claimed != user || c.unread == nil {
+				continue
+			}
+			c.unread[room] = n
+
+			f := unreadFrame{Type: messageTypeUnread, Counts: map[string]int64{room: n}}
+			if err := c.deliver("", f); err != nil && unsafeError(err) {
+				c.logger.Warn("sending unread count", "err", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package chat
+
+import (
+	"context"
+	"testing"
+)
+
+func TestUnreadOnConnect(t *testing.T) {
+	tests := []struct {
+		name   string
+		marker int // index of the message bob read last, -1 for none
+		want   map[string]int64
+	}{
+		{"no marker", -1, map[string]int64{}},
+		{"behind", 0, map[string]int64{"general": 2}},
+		{"caught up", 2, map[string]int64{"general": 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			msgs := appendTexts(t, s.store, "general", "one", "two", "three")
+			if tt.marker >= 0 {
+				if err := s.markRead(context.Background(), "general", "bob", msgs[tt.marker].ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			bob := dialTestServer(t, s, "room=general&username=bob", "chat.v2")
+			var f unreadFrame
+			readFrameInto(t, bob, messageTypeUnread, &f)
+			if len(f.Counts) != len(tt.want) {
+				t.Fatalf("counts %v, want %v", f.Counts, tt.want)
+			}
+			for room, n := range tt.want {
+				if f.Counts[room] != n {
+					t.Errorf("%d unread in %s, want %d", f.Counts[room], room, n)
+				}
+			}
+		})
+	}
+}
+
+// TestUnreadCatchUp checks that a user falling behind is told each new
+// count, and that reading the last message brings it back to zero.
+func TestUnreadCatchUp(t *testing.T) {
+	s, _ := newTestServer(t)
+	msgs := appendTexts(t, s.store, "general", "one")
+	if err := s.markRead(context.Background(), "general", "bob", msgs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	bob := dialTestServer(t, s, "room=general&username=bob", "chat.v2")
+	var f unreadFrame
+	readFrameInto(t, bob, messageTypeUnread, &f)
+	if f.Counts["general"] != 0 {
+		t.Fatalf("%d unread on connect, want 0", f.Counts["general"])
+	}
+	ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	waitClients(t, s, 2)
+
+	var last ChatMessage
+	for i, text := range []string{"two", "three"} {
+		if err := ann.WriteJSON(ChatMessage{Text: text}); err != nil {
+			t.Fatal(err)
+		}
+		readFrameInto(t, bob, messageTypeUnread, &f)
+		if want := int64(i + 1); f.Counts["general"] != want {
+			t.Errorf("%d unread after %q, want %d", f.Counts["general"], text, want)
+		}
+		last = readFrameOf(t, ann, messageTypeChat, func(m ChatMessage) bool { return m.Text == text })
+	}
+
+	if err := bob.WriteJSON(ChatMessage{Type: messageTypeRead, MessageID: last.ID}); err != nil {
+		t.Fatal(err)
+	}
+	readFrameInto(t, bob, messageTypeUnread, &f)
+	if n := f.Counts["general"]; n != 0 {
+		t.Errorf("%d unread after reading %q, want 0", n, last.Text)
+	}
+
+	// bob's own messages don't count
+	if err := bob.WriteJSON(ChatMessage{Text: "back"}); err != nil {
+		t.Fatal(err)
+	}
+	readFrameOf(t, ann, messageTypeChat, func(m ChatMessage) bool { return m.Text == "back" })
+	if err := ann.WriteJSON(ChatMessage{Text: "welcome"}); err != nil {
+		t.Fatal(err)
+	}
+	readFrameInto(t, bob, messageTypeUnread, &f)
+	if n := f.Counts["general"]; n != 1 {
+		t.Errorf("%d unread after ann's reply, want 1", n)
+	}
+}
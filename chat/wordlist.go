@@ -0,0 +1,60 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// loadWordlist reads the banned words from the file at path, one per line,
+// skipping blank lines and those starting with #. Words are matched without
+// regard to case, so they are kept lowercase. There are none when path is
+// empty.
+func loadWordlist(path string) (map[string]bool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	words := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		word := strings.TrimSpace(sc.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		if strings.IndexFunc(word, splitsWords) >= 0 {
+			return nil, fmt.Errorf("%s:%d: %q is not a single word", path, n, word)
+		}
+		words[strings.ToLower(word)] = true
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return words, nil
+}
+
+// splitsWords reports whether r separates the words of a message.
+func splitsWords(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// hasBannedWord reports whether one of the words of text is banned. Only
+// whole words count, so that banning "ass" leaves "class" alone.
+func hasBannedWord(banned map[string]bool, text string) bool {
+	if len(banned) == 0 {
+		return false
+	}
+	for _, word := range strings.FieldsFunc(text, splitsWords) {
+		if banned[strings.ToLower(word)] {
+			return true
+		}
+	}
+	return false
+}
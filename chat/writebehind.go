@@ -0,0 +1,160 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// batchWriter is implemented by the stores whose IDs can be allocated ahead
+// of the writes, which write-behind needs to broadcast messages with their
+// ID before they are stored.
+type batchWriter interface {
+	// NextID allocates the ID of a message written later by WriteBatch.
+	NextID(ctx context.Context) (string, error)
+
+	// WriteBatch stores msgs, which have their ID and room, in one round
+	// trip.
+	WriteBatch(ctx context.Context, msgs []ChatMessage) error
+}
+
+// writeBehind stores messages in the background, so that they are broadcast
+// without waiting for the store. Messages are written in batches of up to
+// size, at least every interval, in the order they were added. A message is
+// acknowledged before it is written, so a crash loses those in the buffer.
+type writeBehind struct {
+	s        *Server
+	store    batchWriter
+	size     int
+	interval time.Duration
+
+	// mu guards closed, after which messages are written as they are
+	// added.
+	mu     sync.Mutex
+	closed bool
+	queue  chan ChatMessage
+	done   chan struct{}
+}
+
+// newWriteBehind returns the write-behind buffer of s, nil when disabled.
+func newWriteBehind(s *Server, cfg Config) (*writeBehind, error) {
+	if !cfg.WriteBehind {
+		return nil, nil
+	}
+	store, ok := unwrapStore(s.store).(batchWriter)
+	if !ok {
+		return nil, errors.New("WRITE_BEHIND=1 needs a message store that writes in batches")
+	}
+
+	return &writeBehind{
+		s:        s,
+		store:    store,
+		size:     cfg.WriteBehindBatch,
+		interval: cfg.WriteBehindInterval,
+		queue:    make(chan ChatMessage, 4*cfg.WriteBehindBatch),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// add assigns msg its ID and queues it to be written. It only blocks when the
+// store falls behind by several batches.
+func (wb *writeBehind) add(ctx context.Context, room string, msg *ChatMessage) error {
+	id, err := wb.store.NextID(ctx)
+	if err != nil {
+		return err
+	}
+	msg.ID = id
+	msg.Room = room
+
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	if wb.closed {
+		return wb.write([]ChatMessage{*msg})
+	}
+	wb.queue <- *msg
+	return nil
+}
+
+// run writes the queued messages until the buffer is closed, then writes
+// what is left.
+func (wb *writeBehind) run() {
+	defer close(wb.done)
+
+	ticker := time.NewTicker(wb.interval)
+	defer ticker.Stop()
+
+	batch := make([]ChatMessage, 0, wb.size)
+	flush := func() {
+		if len(batch) > 0 {
+			wb.write(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case msg, ok := <-wb.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if batch = append(batch, msg); len(batch) >= wb.size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// write stores msgs, retrying transient failures, and then trims the
+// histories they were added to.
+func (wb *writeBehind) write(msgs []ChatMessage) error {
+	// the server may be shutting down, this is what it waits for
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	var err error
+	backoff := storeRetryBackoff
+	for attempt := 1; attempt <= storeAttempts; attempt++ {
+		if err = wb.store.WriteBatch(ctx, msgs); !transient(err) {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	if err != nil {
+		wb.s.logger.Error("storing messages", "count", len(msgs), "first", msgs[0].ID, "err", err)
+		return err
+	}
+
+	trimmed := make(map[string]bool)
+	for _, msg := range msgs {
+		if trimmed[msg.Room] {
+			continue
+		}
+		trimmed[msg.Room] = true
+		if err := wb.s.trimHistory(ctx, msg.Room); err != nil {
+			wb.s.logger.Error("trimming history", "room", msg.Room, "err", err)
+		}
+	}
+	return nil
+}
+
+// close writes the queued messages and waits for them to be stored. The
+// messages added afterwards are written right away.
+func (wb *writeBehind) close() {
+	if wb == nil {
+		return
+	}
+
+	wb.mu.Lock()
+	if !wb.closed {
+		wb.closed = true
+		close(wb.queue)
+	}
+	wb.mu.Unlock()
+
+	<-wb.done
+}
@@ -0,0 +1,142 @@
+package chat
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingWriter is a batchWriter recording the batches written.
+type recordingWriter struct {
+	mu      sync.Mutex
+	nextID  int
+	batches [][]string
+}
+
+func (rw *recordingWriter) NextID(ctx context.Context) (string, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.nextID++
+	return strconv.Itoa(rw.nextID), nil
+}
+
+func (rw *recordingWriter) WriteBatch(ctx context.Context, msgs []ChatMessage) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	rw.batches = append(rw.batches, ids)
+	return nil
+}
+
+// sizes returns the size of each batch written so far.
+func (rw *recordingWriter) sizes() []int {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	sizes := make([]int, len(rw.batches))
+	for i, b := range rw.batches {
+		sizes[i] = len(b)
+	}
+	return sizes
+}
+
+func TestWriteBehindBatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		interval time.Duration
+		add      int
+		// batches written before closing, and once closed
+		wantBefore, wantAfter []int
+	}{
+		{"by size", 3, time.Hour, 7, []int{3, 3}, []int{3, 3, 1}},
+		{"by time", 100, 20 * time.Millisecond, 2, []int{2}, []int{2}},
+		{"flushed on close", 100, time.Hour, 5, nil, []int{5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			rw := new(recordingWriter)
+			wb := &writeBehind{
+				s:        s,
+				store:    rw,
+				size:     tt.size,
+				interval: tt.interval,
+				queue:    make(chan ChatMessage, 4*tt.size),
+				done:     make(chan struct{}),
+			}
+			go wb.run()
+
+			ctx := context.Background()
+			for i := 0; i < tt.add; i++ {
+				if err := wb.add(ctx, "general", &ChatMessage{Text: "hi"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deadline := time.Now().Add(time.Second)
+			for len(rw.sizes()) < len(tt.wantBefore) && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			// nothing more is written until closing
+			time.Sleep(50 * time.Millisecond)
+			if got := rw.sizes(); !slices.Equal(got, tt.wantBefore) {
+				t.Errorf("batches %v before closing, want %v", got, tt.wantBefore)
+			}
+
+			wb.close()
+			if got := rw.sizes(); !slices.Equal(got, tt.wantAfter) {
+				t.Errorf("batches %v once closed, want %v", got, tt.wantAfter)
+			}
+
+			// written right away once closed
+			if err := wb.add(ctx, "general", &ChatMessage{Text: "late"}); err != nil {
+				t.Fatal(err)
+			}
+			if got := rw.sizes(); len(got) != len(tt.wantAfter)+1 {
+				t.Errorf("batches %v, want the late message written alone", got)
+			}
+
+			var order []string
+			for _, b := range rw.batches {
+				order = append(order, b...)
+			}
+			for i, id := range order {
+				if id != strconv.Itoa(i+1) {
+					t.Fatalf("written in the order %v", order)
+				}
+			}
+		})
+	}
+}
+
+// TestWriteBehindShutdown checks that messages are broadcast before being
+// stored, and stored when the server shuts down.
+func TestWriteBehindShutdown(t *testing.T) {
+	t.Setenv("WRITE_BEHIND", "1")
+	t.Setenv("WRITE_BEHIND_INTERVAL", "1h")
+	s, mr := newTestServer(t)
+	ann := dialTestServer(t, s, "room=general&username=ann", "chat.v2")
+	waitClients(t, s, 1)
+
+	for _, text := range []string{"one", "two"} {
+		if err := ann.WriteJSON(ChatMessage{Text: text}); err != nil {
+			t.Fatal(err)
+		}
+		readFrameOf(t, ann, messageTypeChat, func(m ChatMessage) bool { return m.Text == text })
+	}
+	if mr.Exists(s.keys.roomIndex("general")) {
+		t.Fatal("stored before the buffer was flushed")
+	}
+
+	s.Shutdown()
+	ids, err := mr.ZMembers(s.keys.roomIndex("general"))
+	if err != nil || len(ids) != 2 {
+		t.Errorf("stored %v, %v on shutdown, want both messages", ids, err)
+	}
+}
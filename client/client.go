@@ -0,0 +1,110 @@
+//go:build grpc
+
+// Package client talks to the gRPC API of the chat server, described in
+// proto/chat.proto. Build with -tags grpc.
+package client
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	chatpb "heroku_chat_sample/proto"
+)
+
+// ChatMessage is a message sent to or received from a room.
+type ChatMessage struct {
+	ID       string `json:"id,omitempty"`
+	Room     string `json:"room,omitempty"`
+	Username string `json:"username"`
+	Text     string `json:"text"`
+	ReplyTo  string `json:"reply_to,omitempty"`
+
+	// Timestamp is when the server received the message, in Unix
+	// milliseconds.
+	Timestamp int64 `json:"ts,omitempty"`
+}
+
+// Ack confirms a message was stored, with the ID and time the server gave it.
+type Ack struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"ts"`
+}
+
+// Client is a connection to the gRPC API.
+type Client struct {
+	conn  *grpc.ClientConn
+	chat  chatpb.ChatClient
+	token string
+}
+
+// Dial connects to the server at target, authenticating with token, the
+// API_TOKEN of the server. Extra options, such as transport credentials,
+// override the plaintext default.
+func Dial(target, token string, opts ...grpc.DialOption) (*Client, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}, opts...)
+
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, chat: chatpb.NewChatClient(conn), token: token}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) withToken(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+c.token)
+}
+
+// Send posts msg, returning once the server stored it.
+func (c *Client) Send(ctx context.Context, msg ChatMessage) (Ack, error) {
+	ack, err := c.chat.Send(c.withToken(ctx), &chatpb.ChatMessage{
+		Room:     msg.Room,
+		Username: msg.Username,
+		Text:     msg.Text,
+		ReplyTo:  msg.ReplyTo,
+	})
+	if err != nil {
+		return Ack{}, err
+	}
+	return Ack{ID: ack.GetId(), Timestamp: ack.GetTs()}, nil
+}
+
+// Subscription is a stream of the messages of a room.
+type Subscription struct {
+	stream chatpb.Chat_SubscribeClient
+}
+
+// Subscribe streams the messages sent to room from now on, until ctx is
+// done.
+func (c *Client) Subscribe(ctx context.Context, room string) (*Subscription, error) {
+	stream, err := c.chat.Subscribe(c.withToken(ctx), &chatpb.SubscribeRequest{Room: room})
+	if err != nil {
+		return nil, err
+	}
+	return &Subscription{stream: stream}, nil
+}
+
+// Recv waits for the next message. It returns io.EOF once the server ended
+// the stream.
+func (sub *Subscription) Recv() (ChatMessage, error) {
+	msg, err := sub.stream.Recv()
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	return ChatMessage{
+		ID:        msg.GetId(),
+		Room:      msg.GetRoom(),
+		Username:  msg.GetUsername(),
+		Text:      msg.GetText(),
+		ReplyTo:   msg.GetReplyTo(),
+		Timestamp: msg.GetTs(),
+	}, nil
+}
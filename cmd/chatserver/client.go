@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"heroku_chat_sample/chat"
+)
+
+// subprotocol is the one spoken by the client and the load test: version 2
+// with the JSON codec.
+const subprotocol = "chat.v2"
+
+// clientFrame is any frame the server may send, as printed by the client.
+type clientFrame struct {
+	Type      string `json:"type"`
+	Username  string `json:"username"`
+	Text      string `json:"text"`
+	Timestamp int64  `json:"ts"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+}
+
+func (f clientFrame) String() string {
+	t := time.Now()
+	if f.Timestamp != 0 {
+		t = time.UnixMilli(f.Timestamp)
+	}
+	stamp := t.Format("15:04:05")
+
+	switch f.Type {
+	case "error":
+		return fmt.Sprintf("%s ! %s: %s", stamp, f.Code, f.Message)
+	case "system":
+		return fmt.Sprintf("%s * %s", stamp, f.Text)
+	}
+	return fmt.Sprintf("%s <%s> %s", stamp, f.Username, f.Text)
+}
+
+// runClient is the "client" subcommand: an interactive terminal chat for
+// smoke-testing a deployment. Lines read from stdin, or from a script, are
+// sent as messages and everything received is printed.
+func runClient(args []string) error {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	addr := fs.String("url", "ws://localhost:8080/websocket", "WebSocket URL of the server")
+	user := fs.String("user", "", "username to chat as")
+	room := fs.String("room", "", "room to join, the default room if empty")
+	script := fs.String("script", "", "send the lines of this file instead of reading stdin")
+	delay := fs.Duration("delay", time.Second, "pause between the lines of a script")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *user == "" {
+		return errors.New("client: --user is required")
+	}
+
+	u, err := url.Parse(*addr)
+	if err != nil {
+		return fmt.Errorf("client: %w", err)
+	}
+	q := u.Query()
+	q.Set("username", *user)
+	if *room != "" {
+		q.Set("room", *room)
+	}
+	u.RawQuery = q.Encode()
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{subprotocol}
+
+	ws, _, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("client: %w", err)
+	}
+	defer ws.Close()
+
+	// the reader prints until the server closes the connection
+	done := make(chan error, 1)
+	go func() {
+		for {
+			var f clientFrame
+			if err := ws.ReadJSON(&f); err != nil {
+				done <- err
+				return
+			}
+			fmt.Println(f)
+		}
+	}()
+
+	in := io.Reader(os.Stdin)
+	pause := time.Duration(0)
+	if *script != "" {
+		f, err := os.Open(*script)
+		if err != nil {
+			return fmt.Errorf("client: %w", err)
+		}
+		defer f.Close()
+		in, pause = f, *delay
+	}
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(in)
+		for sc.Scan() {
+			lines <- sc.Text()
+			time.Sleep(pause)
+		}
+	}()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	// this loop is the only writer of the connection
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return closeAndWait(ws, done)
+			}
+			if line == "" {
+				continue
+			}
+			if err := ws.WriteJSON(chat.ChatMessage{Username: *user, Text: line}); err != nil {
+				return fmt.Errorf("client: %w", err)
+			}
+
+		case <-interrupt:
+			return closeAndWait(ws, done)
+
+		case err := <-done:
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
+			}
+			return fmt.Errorf("client: %w", err)
+		}
+	}
+}
+
+// closeAndWait sends a close frame and waits briefly for the server to
+// answer it.
+func closeAndWait(ws *websocket.Conn, done <-chan error) error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err := ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+		return nil
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"heroku_chat_sample/chat"
+)
+
+// notifyDrain toggles the drain mode of s on every SIGUSR1.
+func notifyDrain(s *chat.Server) {
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGUSR1)
+		for range sig {
+			s.ToggleDrain()
+		}
+	}()
+}
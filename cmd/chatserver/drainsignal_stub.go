@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "heroku_chat_sample/chat"
+
+// notifyDrain does nothing where there is no SIGUSR1: drain mode is then
+// only toggled through the admin API.
+func notifyDrain(*chat.Server) {}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"heroku_chat_sample/chat"
+)
+
+// loadtestPrefix marks the messages sent by the load test, which carry the
+// send time so receivers can measure delivery latency.
+const loadtestPrefix = "loadtest:"
+
+// loadtestSummary is printed as JSON once a load test completes.
+type loadtestSummary struct {
+	Clients         int             `json:"clients"`
+	Connected       int64           `json:"connected"`
+	ConnectFailures int64           `json:"connect_failures"`
+	Sent            int64           `json:"sent"`
+	Received        int64           `json:"received"`
+	Dropped         int64           `json:"dropped"`
+	LatencyMillis   loadtestLatency `json:"latency_ms"`
+	DurationSeconds float64         `json:"duration_seconds"`
+}
+
+type loadtestLatency struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// loadtest holds the counters shared by every simulated client.
+type loadtest struct {
+	connected atomic.Int64
+	failures  atomic.Int64
+	sent      atomic.Int64
+	received  atomic.Int64
+	expected  atomic.Int64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+}
+
+// runLoadtest is the "loadtest" subcommand. It ramps up a number of
+// connections to one room, has some of them send at a fixed rate, and
+// prints delivery statistics as JSON.
+func runLoadtest(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	addr := fs.String("url", "ws://localhost:8080/websocket", "WebSocket URL of the server")
+	room := fs.String("room", "loadtest", "room the clients join")
+	clients := fs.Int("clients", 100, "number of connections")
+	senders := fs.Float64("senders", 0.1, "fraction of the connections that send")
+	rate := fs.Float64("rate", 1, "messages per second sent by each sender")
+	duration := fs.Duration("duration", 30*time.Second, "how long to send once every client connected")
+	ramp := fs.Duration("ramp", 10*time.Second, "time over which connections are opened")
+	grace := fs.Duration("grace", 2*time.Second, "time to wait for deliveries after sending stops")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *clients <= 0 || *rate <= 0 || *senders < 0 || *senders > 1 {
+		return fmt.Errorf("loadtest: invalid flags")
+	}
+
+	u, err := url.Parse(*addr)
+	if err != nil {
+		return fmt.Errorf("loadtest: %w", err)
+	}
+	q := u.Query()
+	q.Set("room", *room)
+	u.RawQuery = q.Encode()
+
+	lt := new(loadtest)
+	nsenders := int(float64(*clients) * *senders)
+
+	// stop ends the sending, finish the connections once deliveries had
+	// time to arrive
+	stop := make(chan struct{})
+	finish := make(chan struct{})
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < *clients; i++ {
+		// spread the handshakes evenly over the ramp
+		time.Sleep(*ramp / time.Duration(*clients))
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lt.client(u.String(), i, i < nsenders, *rate, stop, finish)
+		}(i)
+	}
+
+	time.Sleep(*duration)
+	close(stop)
+	time.Sleep(*grace)
+	close(finish)
+	wg.Wait()
+
+	summary := lt.summary(*clients, time.Since(start))
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(summary)
+}
+
+// client runs one simulated connection, sending until stop is closed if it
+// is a sender, and hangs up once finish is closed.
+func (lt *loadtest) client(addr string, i int, sender bool, rate float64, stop, finish <-chan struct{}) {
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{subprotocol}
+
+	ws, _, err := dialer.Dial(addr, nil)
+	if err != nil {
+		lt.failures.Add(1)
+		return
+	}
+	defer ws.Close()
+
+	lt.connected.Add(1)
+	defer lt.connected.Add(-1)
+	joined := time.Now()
+
+	go func() {
+		for {
+			var msg chat.ChatMessage
+			if err := ws.ReadJSON(&msg); err != nil {
+				return
+			}
+			lt.receive(msg, joined)
+		}
+	}()
+
+	if sender {
+		lt.send(ws, "loadtest-"+strconv.Itoa(i), rate, stop)
+	}
+
+	<-finish
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
+
+// send writes a timestamped message every 1/rate seconds until stop is
+// closed.
+func (lt *loadtest) send(ws *websocket.Conn, username string, rate float64, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		text := loadtestPrefix + strconv.FormatInt(time.Now().UnixNano(), 10)
+		// every connected client, this one included, should get it
+		lt.expected.Add(lt.connected.Load())
+		if err := ws.WriteJSON(chat.ChatMessage{Username: username, Text: text}); err != nil {
+			return
+		}
+		lt.sent.Add(1)
+	}
+}
+
+// receive records the latency of a load test message. Messages sent before
+// the receiver joined were replayed from history and are ignored.
+func (lt *loadtest) receive(msg chat.ChatMessage, joined time.Time) {
+	ns, ok := strings.CutPrefix(msg.Text, loadtestPrefix)
+	if !ok {
+		return
+	}
+	n, err := strconv.ParseInt(ns, 10, 64)
+	if err != nil {
+		return
+	}
+	sent := time.Unix(0, n)
+	if sent.Before(joined) {
+		return
+	}
+
+	lt.received.Add(1)
+	lt.mu.Lock()
+	lt.latencies = append(lt.latencies, time.Since(sent))
+	lt.mu.Unlock()
+}
+
+func (lt *loadtest) summary(clients int, elapsed time.Duration) loadtestSummary {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	sort.Slice(lt.latencies, func(i, j int) bool { return lt.latencies[i] < lt.latencies[j] })
+	percentile := func(p float64) float64 {
+		if len(lt.latencies) == 0 {
+			return 0
+		}
+		i := int(p * float64(len(lt.latencies)-1))
+		return float64(lt.latencies[i]) / float64(time.Millisecond)
+	}
+
+	return loadtestSummary{
+		Clients:         clients,
+		Connected:       int64(clients) - lt.failures.Load(),
+		ConnectFailures: lt.failures.Load(),
+		Sent:            lt.sent.Load(),
+		Received:        lt.received.Load(),
+		Dropped:         max(lt.expected.Load()-lt.received.Load(), 0),
+		LatencyMillis: loadtestLatency{
+			P50: percentile(0.50),
+			P95: percentile(0.95),
+			P99: percentile(0.99),
+			Max: percentile(1),
+		},
+		DurationSeconds: elapsed.Seconds(),
+	}
+}
@@ -0,0 +1,119 @@
+// Command chatserver runs the chat server configured by the environment and
+// the command line, along with its client, loadtest and vapid subcommands.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/joho/godotenv"
+
+	"heroku_chat_sample/chat"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		var run func([]string) error
+		switch os.Args[1] {
+		case "client":
+			run = runClient
+		case "loadtest":
+			run = runLoadtest
+		case "vapid":
+			run = runVAPID
+		}
+		if run != nil {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	slog.SetDefault(slog.New(chat.NewLogHandler(os.Stderr)))
+
+	// variables of the real environment win over .env, on reloads too
+	realEnv := make(map[string]bool)
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		realEnv[name] = true
+	}
+
+	// containers get their configuration from the real environment
+	if err := godotenv.Load(); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Fatal(err)
+		}
+		slog.Debug("no .env file", "err", err)
+	}
+
+	cfg, err := chat.LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := []chat.Option{chat.WithReloader(func() (chat.Config, error) {
+		env, err := godotenv.Read()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return chat.Config{}, err
+		}
+		for name, v := range env {
+			if !realEnv[name] {
+				os.Setenv(name, v)
+			}
+		}
+		return chat.LoadConfig(os.Args[1:])
+	})}
+	switch cfg.HistoryBackend {
+	case "memory":
+		opts = append(opts, chat.WithStore(chat.NewMemoryStore()))
+	case "sqlite":
+		store, err := chat.OpenSQLiteStore(cfg.SQLitePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, chat.WithStore(store))
+	case "postgres":
+		store, err := chat.OpenPostgresStore(cfg.DatabaseURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, chat.WithStore(store))
+	}
+
+	s, err := chat.NewServer(cfg, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// SIGTERM drains and then exits once every client is gone; SIGUSR1
+	// toggles drain mode, in which the process keeps running, where there
+	// is one; SIGHUP reloads the configuration
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM)
+		<-sig
+		s.Shutdown()
+	}()
+	notifyDrain(s)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGHUP)
+		for range sig {
+			// a failed reload was logged, and changed nothing
+			s.Reload()
+		}
+	}()
+
+	if err := s.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// runVAPID prints a new VAPID key pair, in the form of the environment
+// variables the server reads them from.
+func runVAPID(args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: vapid")
+	}
+
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("VAPID_PUBLIC_KEY=%s\n", base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()))
+	fmt.Printf("VAPID_PRIVATE_KEY=%s\n", base64.RawURLEncoding.EncodeToString(key.Bytes()))
+	return nil
+}
@@ -0,0 +1,5 @@
+// Package chatpb is the code generated from chat.proto, the gRPC API of the
+// chat server.
+package chatpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative chat.proto
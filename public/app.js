@@ -1,5 +1,18 @@
 window.addEventListener("DOMContentLoaded", (_) => {
-  let websocket = new WebSocket("ws://" + window.location.host + "/websocket");
+  let params = new URLSearchParams(window.location.search);
+  let scheme = window.location.protocol === "https:" ? "wss://" : "ws://";
+  let config = window.CHAT_CONFIG || {};
+  let url = scheme + window.location.host + (config.websocket_path || "/websocket");
+  let query = new URLSearchParams();
+  for (let key of ["room", "invite"]) {
+    if (params.has(key)) {
+      query.set(key, params.get(key));
+    }
+  }
+  if (query.toString()) {
+    url += "?" + query.toString();
+  }
+  let websocket = new WebSocket(url);
   let room = document.getElementById("chat-text");
 
   websocket.addEventListener("message", function (e) {